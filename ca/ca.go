@@ -1,90 +1,300 @@
 package ca
 
 import (
+	"errors"
+	"sort"
 	"sync"
 	"time"
 	"fmt"
 	"math"
 	"math/rand"
-	"bytes"
-	"net/http"
 
 	"github.com/golang/glog"
-	"github.com/Workiva/go-datastructures/bitarray"
 	"github.com/google/certificate-transparency-go/tls"
 
 	mtr "github.com/n-ct/ct-monitor"
 	"github.com/n-ct/ct-monitor/signature"
 	"github.com/n-ct/ct-monitor/entitylist"
-	"github.com/n-ct/ct-monitor/utils"
 	ctca "github.com/n-ct/ct-certificate-authority"
+	"github.com/n-ct/ct-certificate-authority/clock"
 )
 
+// Returned when revocations are added after StopRevocations
+var ErrRevocationsStopped = errors.New("CA is shutting down and no longer accepts revocations")
+
+// Exported methods of the CA are safe for concurrent use: they take the read lock to look at the revocation
+// state, the SRD maps and PreviousMMDTimestamp, and the write lock to change them. Unexported methods expect
+// the caller to hold the lock. The fields themselves may only be used directly before the CA is shared.
+// Registry, Responder and Storage do their own locking, and the remaining fields never change after setup
 type CA struct {
 	LogInfoMap map[string] *entitylist.LogInfo  // Maybe just have this be map[log]logURL
-	RevocationObjMap map[string] *bitarray.BitArray
+	RevocationTypes map[string] ctca.RevocationType	// Revocation types the CA produces an SRD for each MMD
+	DefaultRevocationType string	// Revocation type used by requests that do not name one
+	RevocationObjMap map[string] ctca.RevocationState
 	CASignedDigestMap map[string]map[uint64] *mtr.SRDWithRevData
+	latestCASRDTimestamps map[string] uint64	// Timestamp of the most recent SRD in CASignedDigestMap of each revType
 	LogSignedDigestMap map[string]map[uint64]map[string] *mtr.SRDWithRevData
-	DeltaRevocations map[uint64]bool // Stores the delta revocations per mmd. Reset at the end of mmd and acts like a set
+	DeltaRevocations map[string]map[uint64]ctca.ReasonCode // Stores the delta revocations of each revType and their reasons per mmd. Reset at the end of mmd
 	ListenAddress string 
-	MMD	uint64
+	MMD	uint64	// MMD of the CA list, in seconds
+	MMDs map[string] uint64	// MMD of the revocation types whose config sets one, see RevocationTypeMMD
 	CAID string
 	Signer *signature.Signer
 	PreviousMMDTimestamp uint64
-	sync.RWMutex // Mutex lock to prevent race conditions
+	Storage Storage	// Persists the state of the CA across restarts
+	Registry *CertificateRegistry	// Revocation numbers assigned to certificates
+	Issuer *Issuer	// Signs the certificates issued by the CA
+	Responder *OCSPResponder	// Answers OCSP requests from the CRVs
+	Clock clock.Clock	// Source of the time of MMDs, issued certificates and OCSP responses
+	Deliverer *Deliverer	// Delivers the SRDs of the CA to the logs in LogInfoMap
+	revocationsStopped bool	// Set by StopRevocations
+	sync.RWMutex // Guards RevocationObjMap, CASignedDigestMap, latestCASRDTimestamps, LogSignedDigestMap, DeltaRevocations, PreviousMMDTimestamp and revocationsStopped
 }
 
 // Create a new CA using the createCA function found in ca_setup.go
+// The storage is chosen by the storage_dir field of the CA config
 func NewCA(caConfigName string, caListName string, logListName string) (*CA, error){
-	ca, err := createCA(caConfigName, caListName, logListName)
+	return NewCAWithStorage(caConfigName, caListName, logListName, nil)
+}
+
+// Create a new CA that persists its state in the given storage and reload whatever state it already holds
+// If storage is nil, the storage described by the CA config is used
+func NewCAWithStorage(caConfigName string, caListName string, logListName string, storage Storage) (*CA, error){
+	return NewCAWithClock(caConfigName, caListName, logListName, storage, clock.New())
+}
+
+// Create a new CA like NewCAWithStorage that takes the time from clk, so MMDs can be simulated with a clock.Fake
+func NewCAWithClock(caConfigName string, caListName string, logListName string, storage Storage, clk clock.Clock) (*CA, error){
+	ca, err := createCA(caConfigName, caListName, logListName, storage, clk)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create CA: %v", err)
 	}
-	ca.UpdateMMD()
+	if err := ca.loadState(); err != nil {
+		return nil, fmt.Errorf("failed to create CA: %v", err)
+	}
+	if err := ca.replayJournal(); err != nil {
+		return nil, fmt.Errorf("failed to create CA: %v", err)
+	}
+	if err := ca.initMMD(ca.Clock.Now()); err != nil {
+		return nil, fmt.Errorf("failed to create CA: %v", err)
+	}
 	return ca, nil
 }
 
-// Add the numbers of revoked certificates to DeltaRevocations
-func (c *CA) AddRevocationNums(newRevocationNums *[]uint64) error {
-	//c.Lock()
-	for _, num := range *newRevocationNums {
-		c.DeltaRevocations[num] = true
+// Release the storage of the CA
+func (c *CA) Close() error {
+	return c.Storage.Close()
+}
+
+// Get the revocation type with the given name. An empty name resolves to the DefaultRevocationType
+func (c *CA) GetRevocationType(revType string) (ctca.RevocationType, error) {
+	if revType == "" {
+		revType = c.DefaultRevocationType
+	}
+	revocationType, ok := c.RevocationTypes[revType]
+	if !ok {
+		return nil, fmt.Errorf("unknown revocation type (%v)", revType)
+	}
+	return revocationType, nil
+}
+
+// Get the names of all revocation types of the CA in sorted order
+func (c *CA) RevocationTypeNames() []string {
+	revTypes := []string{}
+	for revType := range c.RevocationTypes {
+		revTypes = append(revTypes, revType)
+	}
+	sort.Strings(revTypes)
+	return revTypes
+}
+
+// Add the numbers of revoked certificates to the DeltaRevocations of revType with an unspecified reason
+func (c *CA) AddRevocationNums(revType string, newRevocationNums *[]uint64) error {
+	revocations, err := ctca.NewRevocations(*newRevocationNums, nil)
+	if err != nil {
+		return fmt.Errorf("failed to add revocation nums: %w", err)
+	}
+	return c.AddRevocations(revType, revocations)
+}
+
+// Add revoked certificates and their reasons to the DeltaRevocations of revType
+// The revocations are journaled first, so once this returns they survive a restart
+// Numbers outside the number space of revType are rejected with a *ctca.RevocationNumberError and numbers of expiration
+// buckets that are not live with a *ctca.ExpirationBucketError, and nothing is added
+func (c *CA) AddRevocations(revType string, revocations []ctca.Revocation) error {
+	c.Lock()
+	defer c.Unlock()
+	return c.addRevocations(revType, revocations)
+}
+
+// Reject every revocation added from now on with ErrRevocationsStopped, so the pending revocations can be sealed
+// in a final SRD while the CA shuts down
+func (c *CA) StopRevocations() {
+	c.Lock()
+	defer c.Unlock()
+	c.revocationsStopped = true
+}
+
+// Check, journal and add revocations to the DeltaRevocations of revType
+func (c *CA) addRevocations(revType string, revocations []ctca.Revocation) error {
+	if c.revocationsStopped {
+		return fmt.Errorf("failed to add revocation nums: %w", ErrRevocationsStopped)
+	}
+	revocationType, ok := c.RevocationTypes[revType]
+	if !ok {
+		return fmt.Errorf("failed to add revocation nums: unknown revocation type (%v)", revType)
+	}
+	revocationNums := []uint64{}
+	for _, revocation := range revocations {
+		if !revocation.Reason.IsValid() {
+			return fmt.Errorf("failed to add revocation nums: invalid reason code (%v) for revocation num (%v)", uint8(revocation.Reason), revocation.RevocationNum)
+		}
+		revocationNums = append(revocationNums, revocation.RevocationNum)
+	}
+	if err := revocationType.ValidateRevocationNums(revocationNums); err != nil {
+		return fmt.Errorf("failed to add revocation nums: %w", err)
+	}
+	// A bucket past the live window would get a CRV that is never retired
+	if err := ctca.ValidateExpirationBuckets(revocationType, revocationNums, uint64(c.Clock.Now().Unix())); err != nil {
+		return fmt.Errorf("failed to add revocation nums: %w", err)
+	}
+	// Check every revocation against the status left by the revocations before it, including the earlier ones of this request
+	batch := make(map[uint64]ctca.ReasonCode)
+	for _, revocation := range revocations {
+		currentReason, revoked := c.nextRevocationStatus(revType, batch, revocation.RevocationNum)
+		if err := ctca.CheckReasonTransition(revocation.RevocationNum, revoked, currentReason, revocation.Reason); err != nil {
+			return fmt.Errorf("failed to add revocation nums: %w", err)
+		}
+		pendingReason, pending := batch[revocation.RevocationNum]
+		if !pending {
+			pendingReason, pending = c.DeltaRevocations[revType][revocation.RevocationNum]
+		}
+		batch[revocation.RevocationNum] = mergePendingReason(pendingReason, pending, revocation.Reason)
+	}
+	if err := c.journalRevocations(revType, revocations); err != nil {
+		return fmt.Errorf("failed to add revocation nums: %w", err)
 	}
-	//c.Unlock()
+	c.addDeltaRevocations(revType, revocations)
 	return nil
 }
 
+// Convert revocations of registered certificates by fingerprint or serial into revocations of their revocation numbers
+func (c *CA) ResolveCertificateRevocations(revType string, certRevocations []ctca.CertificateRevocation) ([]ctca.Revocation, error) {
+	revocations := []ctca.Revocation{}
+	for _, certRevocation := range certRevocations {
+		var record *ctca.CertificateRecord
+		var err error
+		switch {
+		case certRevocation.Fingerprint != "" && certRevocation.Serial != "":
+			return nil, fmt.Errorf("certificate revocation names both fingerprint (%v) and serial (%v)", certRevocation.Fingerprint, certRevocation.Serial)
+		case certRevocation.Fingerprint != "":
+			record, err = c.Registry.ByFingerprint(revType, certRevocation.Fingerprint)
+		case certRevocation.Serial != "":
+			record, err = c.Registry.BySerial(revType, certRevocation.Serial)
+		default:
+			return nil, fmt.Errorf("certificate revocation names neither a fingerprint nor a serial")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve certificate revocation: %w", err)
+		}
+		revocations = append(revocations, ctca.Revocation{RevocationNum: record.RevocationNum, Reason: certRevocation.Reason})
+	}
+	return revocations, nil
+}
+
+// Add revocations to the DeltaRevocations of revType. A number revoked again in the same MMD keeps its latest reason
+func (c *CA) addDeltaRevocations(revType string, revocations []ctca.Revocation) {
+	if _, ok := c.DeltaRevocations[revType]; !ok {
+		c.DeltaRevocations[revType] = make(map[uint64]ctca.ReasonCode)
+	}
+	for _, revocation := range revocations {
+		pendingReason, pending := c.DeltaRevocations[revType][revocation.RevocationNum]
+		c.DeltaRevocations[revType][revocation.RevocationNum] = mergePendingReason(pendingReason, pending, revocation.Reason)
+	}
+}
+
+// Get the reason a pending revocation is replaced with when the same number is revoked again for reason.
+// Revoking as Unspecified leaves the reason of a pending revocation unchanged, like it does for a revoked certificate
+func mergePendingReason(pendingReason ctca.ReasonCode, pending bool, reason ctca.ReasonCode) ctca.ReasonCode {
+	if pending && reason == ctca.Unspecified && pendingReason != ctca.RemoveFromCRL {
+		return pendingReason
+	}
+	return reason
+}
+
+// Get the reason revocationNum will be revoked for at the next MMD of revType and whether it will be revoked at all.
+// Pending revocations in batch take precedence over those in the DeltaRevocations, which take precedence over the current state
+func (c *CA) nextRevocationStatus(revType string, batch map[uint64]ctca.ReasonCode, revocationNum uint64) (ctca.ReasonCode, bool) {
+	reason, revoked := ctca.Unspecified, false
+	if state, ok := c.RevocationObjMap[revType]; ok {
+		reason, revoked = state.RevocationReason(revocationNum)
+	}
+	pendingReason, pending := batch[revocationNum]
+	if !pending {
+		pendingReason, pending = c.DeltaRevocations[revType][revocationNum]
+	}
+	switch {
+	case !pending:
+		return reason, revoked
+	case pendingReason == ctca.RemoveFromCRL:
+		return ctca.Unspecified, false
+	case revoked && pendingReason == ctca.Unspecified:
+		return reason, revoked
+	}
+	return pendingReason, true
+}
+
 // Add the SRD produced by the CA to the CASignedDigestMap
 func (c *CA) AddCASRD(srdWithRevData *mtr.SRDWithRevData) (error) {
-	//c.Lock()
+	c.Lock()
+	defer c.Unlock()
+	return c.addCASRD(srdWithRevData)
+}
+
+// Add the SRD produced by the CA to the CASignedDigestMap and persist it
+func (c *CA) addCASRD(srdWithRevData *mtr.SRDWithRevData) (error) {
+	c.putCASRD(srdWithRevData)
+	if err := c.saveCASRD(srdWithRevData); err != nil {
+		return fmt.Errorf("failed to add caSRD: %w", err)
+	}
+	return nil
+}
+
+// Put the SRD produced by the CA in the CASignedDigestMap and keep track of the most recent SRD of its revType
+func (c *CA) putCASRD(srdWithRevData *mtr.SRDWithRevData) {
 	revType := srdWithRevData.RevData.RevocationType
 	timestamp := srdWithRevData.RevData.Timestamp
 	if _, ok := c.CASignedDigestMap[revType]; !ok {
 		c.CASignedDigestMap[revType] = make(map[uint64] *mtr.SRDWithRevData)
 	}
 	c.CASignedDigestMap[revType][timestamp] = srdWithRevData
-	//c.Unlock()
-	return nil
+	if latest, ok := c.latestCASRDTimestamps[revType]; !ok || timestamp > latest {
+		c.latestCASRDTimestamps[revType] = timestamp
+	}
 }
 
 // Get a given SRD produced by the CA from the CASignedDigestMap
 func (c *CA) GetCASRD(revType string, timestamp uint64) (*mtr.SRDWithRevData, error) {
-	var caSRD *mtr.SRDWithRevData
-	//c.Lock()
+	c.RLock()
+	defer c.RUnlock()
+	return c.getCASRD(revType, timestamp)
+}
+
+// Get a given SRD produced by the CA from the CASignedDigestMap
+func (c *CA) getCASRD(revType string, timestamp uint64) (*mtr.SRDWithRevData, error) {
 	if _, ok := c.CASignedDigestMap[revType]; !ok {
 		return nil, fmt.Errorf("failed to find revType (%v) in caSRD map", revType)
 	}
 	if _, ok := c.CASignedDigestMap[revType][timestamp]; !ok {
 		return nil, fmt.Errorf("failed to find timestamp (%v) in caSRD map", timestamp)
 	}
-	caSRD = c.CASignedDigestMap[revType][timestamp]
-	//c.Unlock()
-	return caSRD, nil
+	return c.CASignedDigestMap[revType][timestamp], nil
 }
 
 // Add the SRD produced by a Logger to the LogSignedDigestMap
 func (c *CA) AddLogSRD(srdWithRevData *mtr.SRDWithRevData) (error) {
-	//c.Lock()
+	c.Lock()
+	defer c.Unlock()
 	revType := srdWithRevData.RevData.RevocationType
 	timestamp := srdWithRevData.RevData.Timestamp
 	logID := srdWithRevData.SRD.EntityID
@@ -95,14 +305,16 @@ func (c *CA) AddLogSRD(srdWithRevData *mtr.SRDWithRevData) (error) {
 		c.LogSignedDigestMap[revType][timestamp] = make(map[string] *mtr.SRDWithRevData)
 	}
 	c.LogSignedDigestMap[revType][timestamp][logID] = srdWithRevData
-	//c.Unlock()
+	if err := c.saveLogSRD(srdWithRevData); err != nil {
+		return fmt.Errorf("failed to add logSRD: %w", err)
+	}
 	return nil
 }
 
 // Get a given SRD produced by a Logger from the LogSignedDigestMap
 func (c *CA) GetLogSRD(revType string, timestamp uint64, logID string) (*mtr.SRDWithRevData, error) {
-	var logSRD *mtr.SRDWithRevData
-	//c.RLock()
+	c.RLock()
+	defer c.RUnlock()
 	if _, ok := c.LogSignedDigestMap[revType]; !ok {
 		return nil, fmt.Errorf("failed to find revType (%v) in caSRD map", revType)
 	}
@@ -112,15 +324,19 @@ func (c *CA) GetLogSRD(revType string, timestamp uint64, logID string) (*mtr.SRD
 	if _, ok := c.LogSignedDigestMap[revType][timestamp][logID]; !ok {
 		return nil, fmt.Errorf("failed to find logID (%v) in caSRD map", logID)
 	}
-	logSRD = c.LogSignedDigestMap[revType][timestamp][logID]
-	//c.RUnlock()
-	return logSRD, nil
+	return c.LogSignedDigestMap[revType][timestamp][logID], nil
 }
 
 // Get a list of the Logger SRDs that were received in the most recent timestamp
 func (c *CA) GetRecentLogSRDCTObjecList(revType string, timestamp uint64) ([]mtr.CTObject, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.recentLogSRDCTObjectList(revType, timestamp)
+}
+
+// Get a list of the Logger SRDs that were received in the most recent timestamp
+func (c *CA) recentLogSRDCTObjectList(revType string, timestamp uint64) ([]mtr.CTObject, error) {
 	var logSRDs []mtr.CTObject
-	//c.RLock()
 	if _, ok := c.LogSignedDigestMap[revType]; !ok {
 		return nil, fmt.Errorf("failed to find revType (%v) in caSRD map", revType)
 	}
@@ -134,31 +350,75 @@ func (c *CA) GetRecentLogSRDCTObjecList(revType string, timestamp uint64) ([]mtr
 		}
 		logSRDs = append(logSRDs, *logSRDCTObj)
 	}
-	//c.RUnlock()
 	return logSRDs, nil
 }
 
-// Clear DeltaRevocations data structure
-func (c *CA) ClearDeltaRevocations() error {
-	//c.Lock()
-	c.DeltaRevocations = make(map[uint64]bool)
-	//c.Unlock()
+// Clear DeltaRevocations data structure of revType. DoRevocationTransparencyTasks already clears the revocations
+// it publishes, so this drops revocations that have not been published yet
+func (c *CA) ClearDeltaRevocations(revType string) error {
+	c.Lock()
+	defer c.Unlock()
+	c.clearDeltaRevocations(revType)
 	return nil
 }
 
-// Convert the DeltaRevocations Map to a list
-func (c *CA) DeltaRevocationsToList() []uint64 {
+func (c *CA) clearDeltaRevocations(revType string) {
+	c.DeltaRevocations[revType] = make(map[uint64]ctca.ReasonCode)
+}
+
+// Convert the DeltaRevocations Map of revType to a list
+func (c *CA) DeltaRevocationsToList(revType string) []uint64 {
+	c.RLock()
+	defer c.RUnlock()
 	revList := []uint64{}
-	for revNum := range c.DeltaRevocations {
+	for revNum := range c.DeltaRevocations[revType] {
 		revList = append(revList, revNum)
 	}
 	return revList
 }
 
+// Get the DeltaRevocations of revType and their reasons in ascending revocation number order
+func (c *CA) DeltaRevocationsWithReasons(revType string) []ctca.Revocation {
+	c.RLock()
+	defer c.RUnlock()
+	return c.deltaRevocationsWithReasons(revType)
+}
+
+func (c *CA) deltaRevocationsWithReasons(revType string) []ctca.Revocation {
+	revocations := []ctca.Revocation{}
+	for revNum, reason := range c.DeltaRevocations[revType] {
+		revocations = append(revocations, ctca.Revocation{RevocationNum: revNum, Reason: reason})
+	}
+	sort.Slice(revocations, func(i, j int) bool { return revocations[i].RevocationNum < revocations[j].RevocationNum })
+	return revocations
+}
+
 // THIS IS A STRICTLY A METHOD USED FOR COLLECTING DATA 
-func (c *CA) RevokeAndProduceSRD(totalCerts uint64, percentRevoked uint8) (*mtr.SRDWithRevData, error) {
+// Revoke percentRevoked percent of totalCerts at random and publish them in the SRD of the current MMD of revType.
+// Once revType has an SRD for its current MMD, that SRD (or a later one sealed ahead of it) is returned and nothing is
+// revoked, so every request of an MMD gets the same data
+func (c *CA) RevokeAndProduceSRD(revType string, totalCerts uint64, percentRevoked uint8) (*mtr.SRDWithRevData, error) {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.RevocationTypes[revType]; !ok {
+		return nil, fmt.Errorf("failed to revoke and produce SRD: unknown revocation type (%v)", revType)
+	}
+	now := c.Clock.Now()
+	first, count := c.missedMMDs(revType, now)
+	if count == 0 {
+		latest, _ := c.latestCASRDTimestamp(revType)
+		return c.getCASRD(revType, latest)
+	}
+	// Back-fill the missed MMDs first, so the SRDs of revType stay in order
+	mmd := c.RevocationTypeMMD(revType)
+	timestamp := first + (count - 1) * mmd
+	if count > 1 {
+		if _, err := c.catchUpRevocationType(revType, time.Unix(int64(timestamp - mmd), 0)); err != nil {
+			return nil, fmt.Errorf("failed to back-fill SRDs before new MMD: %v", err)
+		}
+	}
+
 	start := time.Now()
-	//c.UpdateMMD()
 	numToRevoke := uint64(math.Floor(float64(totalCerts) * float64(percentRevoked) / 100))
 	revokedMap := make(map[uint64]bool)
 	revNumList := []uint64{}
@@ -170,9 +430,14 @@ func (c *CA) RevokeAndProduceSRD(totalCerts uint64, percentRevoked uint8) (*mtr.
 			numToRevoke -= 1
 		}
 	}
-	c.AddRevocationNums(&revNumList)
-	revType := "Let's-Revoke"
-	srd, err := c.createNewMMDSRD(revType)
+	revocations, err := ctca.NewRevocations(revNumList, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add revocation nums: %v", err)
+	}
+	if err := c.addRevocations(revType, revocations); err != nil {
+		return nil, fmt.Errorf("failed to add revocation nums: %v", err)
+	}
+	srd, state, delta, err := c.createNewMMDSRD(revType, timestamp)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create SRD at new MMD: %v", err)
 	}
@@ -180,52 +445,105 @@ func (c *CA) RevokeAndProduceSRD(totalCerts uint64, percentRevoked uint8) (*mtr.
 	duration := time.Since(start)
 	glog.Infof("Entire process took: %v", duration)
 
-	c.AddCASRD(srd)
-
+	if err := c.publishMMDSRD(revType, srd, state, delta); err != nil {
+		return nil, fmt.Errorf("failed to publish SRD at new MMD: %v", err)
+	}
+	if err := c.advanceMMDTimestamp(now); err != nil {
+		return nil, fmt.Errorf("failed to advance MMD: %v", err)
+	}
 	return srd, nil
 }
 
-// During a new MMD, create a new SRD
-func (c *CA) createNewMMDSRD(revType string) (*mtr.SRDWithRevData, error) {
-	deltaRevList := c.DeltaRevocationsToList()
-	crvDelta := ctca.GetCRVDelta(deltaRevList)
-	currCRV, ok := c.RevocationObjMap[revType]
+// During a new MMD, create a new SRD of the pending DeltaRevocations along with the state and delta it publishes.
+// Neither the state nor the DeltaRevocations are changed until cutOverMMD
+func (c *CA) createNewMMDSRD(revType string, timestamp uint64) (*mtr.SRDWithRevData, ctca.RevocationState, ctca.RevocationDelta, error) {
+	revocationType, ok := c.RevocationTypes[revType]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("unknown revocation type (%v)", revType)
+	}
+	deltaRevocations := c.deltaRevocationsWithReasons(revType)
+	currState, ok := c.RevocationObjMap[revType]
 	if !ok {
-		currCRV = ctca.CreateCRV([]uint64{}, 0)
+		currState = revocationType.NewState()
+	}
+	newState, delta, err := revocationType.NextState(currState, deltaRevocations, timestamp)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create next state at new MMD: %v", err)
 	}
-	newCRV := ctca.ApplyCRVDeltaToCRV(currCRV, crvDelta)
-	c.RevocationObjMap[revType] = newCRV
 
 	// Create SRD
-	srd, err := CreateSRDWithRevData(newCRV, crvDelta, c.PreviousMMDTimestamp, c.CAID, tls.SHA256, c.Signer)
+	srd, err := CreateSRDWithRevData(revocationType, newState, delta, timestamp, c.CAID, tls.SHA256, c.Signer)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create SRD at new MMD: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to create SRD at new MMD: %v", err)
 	}
-	return srd, nil
+	return srd, newState, delta, nil
+}
+
+// Move revType to the next MMD once its SRD is stored: the state of the SRD becomes the current state and the
+// DeltaRevocations it published are swapped for an empty buffer. Both happen under the write lock that the SRD was
+// created under, so every accepted revocation is either in that SRD or pending for the next one, never in both or neither
+func (c *CA) cutOverMMD(revType string, state ctca.RevocationState) {
+	c.RevocationObjMap[revType] = state
+	c.clearDeltaRevocations(revType)
 }
 
 // Do all the tasks that are needed during a new MMD
 func (c *CA) DoRevocationTransparencyTasks(revType string) error {
-	srd, err := c.createNewMMDSRD(revType)
+	c.Lock()
+	defer c.Unlock()
+	return c.doRevocationTransparencyTasks(revType, c.PreviousMMDTimestamp)
+}
+
+// Produce, store and publish the SRD of revType for the MMD at timestamp.
+// The DeltaRevocations are cleared once they are part of the stored SRD, so callers no longer clear them.
+// If the SRD cannot be stored, they stay pending for the next MMD
+func (c *CA) doRevocationTransparencyTasks(revType string, timestamp uint64) error {
+	srd, state, delta, err := c.createNewMMDSRD(revType, timestamp)
 	if err != nil {
 		return fmt.Errorf("%v", err)
 	}
-	// Store the SRD
-	c.AddCASRD(srd)
+	return c.publishMMDSRD(revType, srd, state, delta)
+}
+
+// Store a new SRD of revType, cut over to its state and send it to the logs, then persist the CRV and CRLs it publishes.
+// The SRD is queued for the logs as soon as it is part of the chain, so a later failure cannot leave a gap in the SRDs
+// the logs receive
+func (c *CA) publishMMDSRD(revType string, srd *mtr.SRDWithRevData, state ctca.RevocationState, delta ctca.RevocationDelta) error {
+	// Store the SRD before the CRV so a crash in between can be repaired by replaying the SRD delta
+	if err := c.addCASRD(srd); err != nil {
+		return fmt.Errorf("failed to store SRD: %v", err)
+	}
+	c.cutOverMMD(revType, state)
+
+	// Send SRD to Loggers. It stays in the outbox until every log accepted it
+	if err := c.Deliverer.Enqueue(srd); err != nil {
+		return fmt.Errorf("failed to queue SRD for delivery: %v", err)
+	}
+
+	if err := c.saveCRV(revType, srd.RevData.Timestamp); err != nil {
+		return fmt.Errorf("failed to store CRV: %v", err)
+	}
+
+	// The delta revocations are now part of a stored SRD. If the CA stops before this, replayJournal skips them
+	if err := c.truncateJournal(revType); err != nil {
+		return fmt.Errorf("%v", err)
+	}
 
-	// Send SRD to Logger
-	// UNCOMMENT THE POSTCASRD when done with data collection
-	//PostCASRD(srd)	
+	// Relying parties that cannot consume CRVs yet get the same revocations as a CRL. CRLs are derived from the state,
+	// so a failure does not hold up the MMD and the full CRL of the next MMD includes the revocations of this one
+	if err := c.publishCRLs(revType, c.RevocationObjMap[revType], delta, srd.RevData.Timestamp); err != nil {
+		glog.Errorf("failed to publish CRLs of revType (%v) at (%v): %v", revType, srd.RevData.Timestamp, err)
+	}
 	return nil
 }
 
 // Create SRDWithRevData message
-func CreateSRDWithRevData(crv, deltaCRV *bitarray.BitArray, timestamp uint64, entityID string, hashAlgo tls.HashAlgorithm, signer *signature.Signer) (*mtr.SRDWithRevData, error) {
-	revData, err := createRevocationData(deltaCRV, timestamp, entityID)
+func CreateSRDWithRevData(revocationType ctca.RevocationType, state ctca.RevocationState, delta ctca.RevocationDelta, timestamp uint64, entityID string, hashAlgo tls.HashAlgorithm, signer *signature.Signer) (*mtr.SRDWithRevData, error) {
+	revData, err := createRevocationData(revocationType, delta, timestamp, entityID)
 	if err != nil {
 		return nil, fmt.Errorf("failed SRDWithRevData creation: %w", err)
 	}
-	srd, err := createSRD(crv, deltaCRV, timestamp, entityID, hashAlgo, signer)
+	srd, err := createSRD(revocationType, state, delta, timestamp, entityID, hashAlgo, signer)
 	if err != nil {
 		return nil, fmt.Errorf("failed SRDWithRevData creation: %w", err)
 	}
@@ -237,10 +555,10 @@ func CreateSRDWithRevData(crv, deltaCRV *bitarray.BitArray, timestamp uint64, en
 }
 
 // Create SRD message
-func createSRD(crv, deltaCRV *bitarray.BitArray, timestamp uint64, entityID string, hashAlgo tls.HashAlgorithm, signer *signature.Signer) (*mtr.SignedRevocationDigest, error) {
-	revDigest, err := createRevocationDigest(crv, deltaCRV, timestamp, hashAlgo)	
+func createSRD(revocationType ctca.RevocationType, state ctca.RevocationState, delta ctca.RevocationDelta, timestamp uint64, entityID string, hashAlgo tls.HashAlgorithm, signer *signature.Signer) (*mtr.SignedRevocationDigest, error) {
+	revDigest, err := revocationType.Digest(state, delta, timestamp, hashAlgo)
 	if err != nil {
-		return nil, fmt.Errorf("failed to compress crv when creating rev digest: %v", err)
+		return nil, fmt.Errorf("failed to create rev digest: %v", err)
 	}
 	sig, err := signer.CreateSignature(hashAlgo, revDigest)
 	if err != nil {
@@ -254,90 +572,48 @@ func createSRD(crv, deltaCRV *bitarray.BitArray, timestamp uint64, entityID stri
 	return srd, nil
 }
 
-// Create RevocationDigest message
-func createRevocationDigest(crv, deltaCRV *bitarray.BitArray, timestamp uint64, hashAlgo tls.HashAlgorithm) (*mtr.RevocationDigest, error) {
-	compCRV, err := ctca.CompressCRV(crv)
-	if err != nil {
-		return nil, fmt.Errorf("failed to compress crv when creating rev digest: %w", err)
-	}
-	crvHash, _, err := signature.GenerateHash(hashAlgo, compCRV)
-	if err != nil {
-		return nil, fmt.Errorf("failed to hash crv when creating rev digest: %w", err)
-	}
-
-	compDeltaCRV, err := ctca.CompressCRV(deltaCRV)
-	if err != nil {
-		return nil, fmt.Errorf("failed to compress deltaCRV when creating rev digest: %w", err)
-	}
-	crvDeltaHash, _, err := signature.GenerateHash(hashAlgo, compDeltaCRV)
-	if err != nil {
-		return nil, fmt.Errorf("failed to hash deltaCRV when creating rev digest: %w", err)
-	}
-
-	revDigest := &mtr.RevocationDigest{
-		Timestamp: timestamp, 
-		CRVHash: crvHash, 
-		CRVDeltaHash: crvDeltaHash,
-	}
-	return revDigest, nil
-}
-
 // Create RevocationData message
-func createRevocationData(deltaCRV *bitarray.BitArray, timestamp uint64, entityID string) (*mtr.RevocationData, error) {
-	revType := "Let's-Revoke"
-	compDeltaCRV, err := ctca.CompressCRV(deltaCRV)
+func createRevocationData(revocationType ctca.RevocationType, delta ctca.RevocationDelta, timestamp uint64, entityID string) (*mtr.RevocationData, error) {
+	compDeltaCRV, err := delta.Encode()
 	if err != nil {
 		return nil, fmt.Errorf("failed to compress deltaCRV when creating rev data: %w", err)
 	}
 
 	revData := &mtr.RevocationData{
 		EntityID: entityID,
-		RevocationType: revType,
+		RevocationType: revocationType.Name(),
 		Timestamp: timestamp,
 		CRVDelta: compDeltaCRV,
 	}
 	return revData, nil
 }
 
-// Update the PreviousMMDTimestamp instance variable at a new timestamp
+// Move PreviousMMDTimestamp on to the next MMD boundary
 func (c *CA) UpdateMMD() error {
-	var newMMDTimestamp uint64
+	c.Lock()
+	defer c.Unlock()
+	return c.updateMMD()
+}
+
+func (c *CA) updateMMD() error {
 	if c.PreviousMMDTimestamp == 0 {
-		newMMDTimestamp = uint64(time.Now().Unix())
+		c.PreviousMMDTimestamp = alignedMMDTimestamp(c.MMD, c.Clock.Now())
 	} else {
-		newMMDTimestamp = c.PreviousMMDTimestamp +  (2 * c.MMD)
+		c.PreviousMMDTimestamp = nextMMDTimestamp(c.MMD, c.PreviousMMDTimestamp)
 	}
-	c.PreviousMMDTimestamp = newMMDTimestamp - c.MMD
-	return nil
+	return c.saveMMDTimestamp()
 }
 
-// Make a post request to LogURLs with the given srd
-func (c *CA) PostCASRD(srd *mtr.SRDWithRevData) error {
-	jsonBytes, err := signature.SerializeData(*srd)	// Just use serialize method somewhere else
-	if err != nil {
-		return fmt.Errorf("failed to marshal SRDWithRevData (%v) when sending post to log: %v", srd, err)
-	}
-	for _, logInfo := range c.LogInfoMap {
-		logURL := logInfo.URL
-		logPostURL := utils.CreateRequestURL(logURL, "/ct/v1/post-ca-srd")
-		glog.Infof("\ngossip CTObject using Gossiper at address: %s", logPostURL)
-
-		// Create request
-		req, err := http.NewRequest("POST", logPostURL, bytes.NewBuffer(jsonBytes)) 
-		req.Header.Set("X-Custom-Header", "myvalue");
-		req.Header.Set("Content-Type", "application/json");
-
-		// Send request
-		client := &http.Client{};
-		resp, err := client.Do(req);
-		if err != nil {
-			panic(err);
-		}
-
-		defer resp.Body.Close();
-	}
+// Get the timestamp of the current MMD
+func (c *CA) MMDTimestamp() uint64 {
+	c.RLock()
+	defer c.RUnlock()
+	return c.PreviousMMDTimestamp
+}
 
-	return nil
+// Queue srd for delivery to every log in LogInfoMap. The Deliverer retries until each log accepted it
+func (c *CA) PostCASRD(srd *mtr.SRDWithRevData) error {
+	return c.Deliverer.Enqueue(srd)
 }
 
 // Verify the Signature of an SRD produced by a Logger
@@ -356,11 +632,52 @@ func VerifySRDSignature(srd *mtr.SignedRevocationDigest, key string) error {
 	return signature.VerifySignature(key, srd.RevDigest, srd.Signature)
 }
 
-// Create RevocationStatus message that contains the latests SRDs created by the CA and various Loggers
-func (c *CA) GetLatestRevocationStatus() (*ctca.RevocationStatus, error) {
-	latestTimestamp := c.PreviousMMDTimestamp - c.MMD
-	revType := "Let's-Revoke"
-	caSRD, err := c.GetCASRD(revType, latestTimestamp)
+// Report how much of the number space of revType the numbers assigned by the registry and the state of the latest
+// MMD consume
+func (c *CA) GetNumberSpaceUsage(revType string) (*ctca.NumberSpaceUsage, error) {
+	revocationType, err := c.GetRevocationType(revType)
+	if err != nil {
+		return nil, err
+	}
+	assigned := c.Registry.Assigned(revocationType.Name())
+	c.RLock()
+	defer c.RUnlock()
+	state, ok := c.RevocationObjMap[revocationType.Name()]
+	if !ok {
+		state = revocationType.NewState()
+	}
+	return revocationType.NumberSpaceUsage(state, assigned)
+}
+
+// Get the reason revocationNum of revType was revoked for as of the latest MMD
+func (c *CA) GetRevocationReason(revType string, revocationNum uint64) (*ctca.RevocationReasonResponse, error) {
+	revocationType, err := c.GetRevocationType(revType)
+	if err != nil {
+		return nil, err
+	}
+	reasonResp := &ctca.RevocationReasonResponse{
+		RevocationType: revocationType.Name(),
+		RevocationNum: revocationNum,
+	}
+	c.RLock()
+	defer c.RUnlock()
+	if state, ok := c.RevocationObjMap[revocationType.Name()]; ok {
+		reasonResp.Reason, reasonResp.Revoked = state.RevocationReason(revocationNum)
+	}
+	reasonResp.ReasonName = reasonResp.Reason.String()
+	return reasonResp, nil
+}
+
+// Create RevocationStatus message that contains the latests SRDs of revType created by the CA and various Loggers.
+// Revocation types run on their own MMDs, so the status names the MMD of the latest SRD of revType and when the next is due
+func (c *CA) GetLatestRevocationStatus(revType string) (*ctca.RevocationStatus, error) {
+	c.RLock()
+	defer c.RUnlock()
+	latestTimestamp, ok := c.latestCASRDTimestamp(revType)
+	if !ok {
+		return nil, fmt.Errorf("failed to get CASRD for revocationStatus: no SRD of revType (%v) yet", revType)
+	}
+	caSRD, err := c.getCASRD(revType, latestTimestamp)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get CASRD for revocationStatus: %w", err)
 	}
@@ -368,11 +685,20 @@ func (c *CA) GetLatestRevocationStatus() (*ctca.RevocationStatus, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to construct CASRDCTObject: %w", err)
 	}
-	logSRDs, err := c.GetRecentLogSRDCTObjecList(revType, latestTimestamp)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get logSRDs for revocationStatus: %w", err)
+	// Logs countersign an SRD after it is published, so the latest SRD may not have any log SRDs yet
+	logSRDs := []mtr.CTObject{}
+	if _, ok := c.LogSignedDigestMap[revType][latestTimestamp]; ok {
+		logSRDs, err = c.recentLogSRDCTObjectList(revType, latestTimestamp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get logSRDs for revocationStatus: %w", err)
+		}
 	}
+	mmd := c.RevocationTypeMMD(revType)
 	revocationStatus := &ctca.RevocationStatus{
+		RevocationType: revType,
+		Timestamp: latestTimestamp,
+		MMD: mmd,
+		NextTimestamp: nextMMDTimestamp(mmd, latestTimestamp),
 		CASRD: *caSRDCTObj, 
 		LogSRDs: logSRDs,
 	}
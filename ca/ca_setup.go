@@ -5,16 +5,16 @@ import (
 	"strings"
 	"encoding/json"
 
-	"github.com/Workiva/go-datastructures/bitarray"
-
 	mtr "github.com/n-ct/ct-monitor"
 	"github.com/n-ct/ct-monitor/entitylist"
 	"github.com/n-ct/ct-monitor/utils"
 	"github.com/n-ct/ct-monitor/signature"
+	ctca "github.com/n-ct/ct-certificate-authority"
+	"github.com/n-ct/ct-certificate-authority/clock"
 )
 
-// Create CA 
-func createCA(caConfigName string, caListName string, logListName string) (*CA, error){
+// Create CA. If storage is nil, the storage is created from the CA config
+func createCA(caConfigName string, caListName string, logListName string, storage Storage, clk clock.Clock) (*CA, error){
 	caConfig, err := parseCAConfig(caConfigName)
 	if nil != err {
 		return nil, fmt.Errorf("failed to setup new ca: %w", err)
@@ -31,21 +31,56 @@ func createCA(caConfigName string, caListName string, logListName string) (*CA,
 	if nil != err {
 		return nil, fmt.Errorf("failed to setup new ca: %w", err)
 	}
-	revObjMap := make(map[string] *bitarray.BitArray)
+	revocationTypes, defaultRevType, err := createRevocationTypes(caConfig)
+	if nil != err {
+		return nil, fmt.Errorf("failed to setup new ca: %w", err)
+	}
+	if storage == nil {
+		storage, err = createStorage(caConfig)
+		if nil != err {
+			return nil, fmt.Errorf("failed to setup new ca: %w", err)
+		}
+	}
+	registry, err := NewCertificateRegistry(storage, revocationTypes, clk)
+	if nil != err {
+		return nil, fmt.Errorf("failed to setup new ca: %w", err)
+	}
+	issuer, err := createIssuer(caConfig, storage)
+	if nil != err {
+		return nil, fmt.Errorf("failed to setup new ca: %w", err)
+	}
+	responder, err := createOCSPResponder(caConfig, storage, issuer)
+	if nil != err {
+		return nil, fmt.Errorf("failed to setup new ca: %w", err)
+	}
+	deliverer, err := createDeliverer(caConfig, storage, logInfoMap, clk)
+	if nil != err {
+		return nil, fmt.Errorf("failed to setup new ca: %w", err)
+	}
+	revObjMap := make(map[string] ctca.RevocationState)
 	caSignedDigestMap := make(map[string]map[uint64] *mtr.SRDWithRevData)
 	logSignedDigestMap := make(map[string]map[uint64]map[string] *mtr.SRDWithRevData)
-	deltaRevocations := make(map[uint64] bool)
+	deltaRevocations := make(map[string]map[uint64] ctca.ReasonCode)
 	ca := &CA{
 		LogInfoMap: logInfoMap, 
+		RevocationTypes: revocationTypes,
+		DefaultRevocationType: defaultRevType,
 		RevocationObjMap: revObjMap, 
 		CASignedDigestMap: caSignedDigestMap, 
+		latestCASRDTimestamps: make(map[string] uint64),
 		LogSignedDigestMap: logSignedDigestMap, 
 		DeltaRevocations: deltaRevocations, 
 		ListenAddress: *caURL, 
 		MMD: *mmd, 
+		MMDs: createRevocationTypeMMDs(caConfig),
 		CAID:*caID,
 		Signer: signer,
-
+		Storage: storage,
+		Registry: registry,
+		Issuer: issuer,
+		Responder: responder,
+		Deliverer: deliverer,
+		Clock: clk,
 	}
 	return ca, nil
 }
@@ -55,6 +90,11 @@ type CAConfig struct {
 	LogIDs []string `json:"log_ids"`
 	CAID string `json:"ca_id"`
 	StrPrivKey string `json:"priv_key"`
+	StorageDir string `json:"storage_dir"`	// Directory for persistent CA state. Empty keeps state in memory
+	RevocationTypes []ctca.RevocationTypeConfig `json:"revocation_types"`	// The first type is the default. Defaults to Let's-Revoke
+	Issuer IssuerConfig `json:"issuer"`	// Key and certificate the CA issues certificates with
+	OCSP OCSPConfig `json:"ocsp"`	// Delegated responder key of the OCSP endpoint
+	Delivery DeliveryConfig `json:"delivery"`	// Timeouts and retries of the delivery of SRDs to the logs
 }
 
 // Parse caConfig json file 
@@ -90,6 +130,37 @@ func createLogInfoMap(caConfig *CAConfig, logListName string) (map[string] *enti
 	return logInfoMap, nil 
 }
 
+// Create the revocation types of the CA along with the name of the default revocation type
+func createRevocationTypes(caConfig *CAConfig) (map[string] ctca.RevocationType, string, error) {
+	revTypeConfigs := caConfig.RevocationTypes
+	if len(revTypeConfigs) == 0 {
+		revTypeConfigs = []ctca.RevocationTypeConfig{{Name: ctca.LetsRevokeMechanism}}
+	}
+	revocationTypes := make(map[string] ctca.RevocationType)
+	for _, revTypeConfig := range revTypeConfigs {
+		revocationType, err := ctca.NewRevocationType(revTypeConfig)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create revocation types: %w", err)
+		}
+		if _, ok := revocationTypes[revocationType.Name()]; ok {
+			return nil, "", fmt.Errorf("duplicate revocation type (%v)", revocationType.Name())
+		}
+		revocationTypes[revocationType.Name()] = revocationType
+	}
+	return revocationTypes, revTypeConfigs[0].Name, nil
+}
+
+// Get the MMD of every revocation type whose config sets one
+func createRevocationTypeMMDs(caConfig *CAConfig) map[string] uint64 {
+	mmds := make(map[string] uint64)
+	for _, revTypeConfig := range caConfig.RevocationTypes {
+		if revTypeConfig.MMD > 0 {
+			mmds[revTypeConfig.Name] = revTypeConfig.MMD
+		}
+	}
+	return mmds
+}
+
 // Create signer for the CA
 func createSigner(caConfig *CAConfig) (*signature.Signer, error) {
 	strPrivKey := caConfig.StrPrivKey
@@ -2,13 +2,17 @@ package ca
 
 import (
 	"testing"
+	"errors"
 	"reflect"
 	"time"
 	"fmt"
+	"sync"
+	"strings"
 
 	mtr "github.com/n-ct/ct-monitor"
 	"github.com/google/certificate-transparency-go/tls"
 	ctca "github.com/n-ct/ct-certificate-authority"
+	"github.com/n-ct/ct-certificate-authority/clock"
 )
 
 var (
@@ -37,12 +41,12 @@ func TestAddRevocationNumsAndDeltaRevocationsToList(t *testing.T) {
 		t.Fatalf("failed to create new CA: %v", err)
 	}
 	revNumsList := []uint64{1}
-	err = newCA.AddRevocationNums(&revNumsList)
+	err = newCA.AddRevocationNums(revType, &revNumsList)
 	if err != nil {
 		t.Fatalf("failed to add new revNums: %v", err)
 	}
 
-	deltaRevNumsList := newCA.DeltaRevocationsToList()
+	deltaRevNumsList := newCA.DeltaRevocationsToList(revType)
 	if !reflect.DeepEqual(deltaRevNumsList, revNumsList) {
 		t.Fatalf("DeltaRevocations (%v) not equal to previous added revNumsList (%v)", deltaRevNumsList, revNumsList)
 	}
@@ -50,9 +54,16 @@ func TestAddRevocationNumsAndDeltaRevocationsToList(t *testing.T) {
 
 func mustGetSRDWithRevData(t *testing.T, newCA *CA, timestamp uint64) (*mtr.SRDWithRevData, error) {
 	t.Helper()
-	crv := ctca.CreateCRV([]uint64{1,2,3}, 0)
-	deltaCRV := ctca.GetCRVDelta([]uint64{3})
-	srd, err := CreateSRDWithRevData(crv, deltaCRV, timestamp, newCA.CAID, tls.SHA256, newCA.Signer)
+	revocationType := newCA.RevocationTypes[revType]
+	revocations, err := ctca.NewRevocations([]uint64{1,2,3}, nil)
+	if err != nil {
+		return nil, err
+	}
+	crv, deltaCRV, err := revocationType.NextState(revocationType.NewState(), revocations, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	srd, err := CreateSRDWithRevData(revocationType, crv, deltaCRV, timestamp, newCA.CAID, tls.SHA256, newCA.Signer)
 	return srd, err
 }
 
@@ -129,16 +140,16 @@ func TestClearDeltaRevocations(t *testing.T) {
 		t.Fatalf("failed to create new CA: %v", err)
 	}
 	revNumsList := []uint64{1,2,3}
-	err = newCA.AddRevocationNums(&revNumsList)
+	err = newCA.AddRevocationNums(revType, &revNumsList)
 	if err != nil {
 		t.Fatalf("failed to add new revNums: %v", err)
 	}
 
-	if err := newCA.ClearDeltaRevocations(); err != nil {
+	if err := newCA.ClearDeltaRevocations(revType); err != nil {
 		t.Errorf("failed to clear DeltaRevocation: %v", err)
 	}
 
-	deltaRevNumsList := newCA.DeltaRevocationsToList()
+	deltaRevNumsList := newCA.DeltaRevocationsToList(revType)
 	if len(deltaRevNumsList) != 0 {
 		t.Fatalf("failed to clear DeltaRevocation. (%v) remains: %v", deltaRevNumsList, err)
 	}
@@ -151,7 +162,7 @@ func TestDoRevocationTransparencyTasks(t *testing.T) {
 		t.Fatalf("failed to create new CA: %v", err)
 	}
 	revNumsList := []uint64{1, 2, 3}
-	err = newCA.AddRevocationNums(&revNumsList)
+	err = newCA.AddRevocationNums(revType, &revNumsList)
 	if err != nil {
 		t.Fatalf("failed to add new revNums: %v", err)
 	}
@@ -165,17 +176,167 @@ func TestDoRevocationTransparencyTasks(t *testing.T) {
 		t.Fatalf("failed to get SRD from CA: %v", err)
 	}
 
-	deltaCRV, err := ctca.DecompressCRV(srd.RevData.CRVDelta)
+	deltaCRV, err := newCA.RevocationTypes[revType].DecodeDelta(srd.RevData.CRVDelta)
 	if err != nil {
-		t.Fatalf("failed to decompress CRVDelta from RevData: %v", err)
+		t.Fatalf("failed to decode CRVDelta from RevData: %v", err)
 	}
 
-	deltaCRVRevNumsList := (*deltaCRV).ToNums()
+	deltaCRVRevNumsList := deltaCRV.RevocationNums()
 	if !reflect.DeepEqual(deltaCRVRevNumsList, revNumsList) {
 		t.Fatalf("DeltaRevocations (%v) not equal to previous added revNumsList (%v)", deltaCRVRevNumsList, revNumsList)
 	}
 }
 
+// Every SRD stored by an MMD is queued for every log, even when the CRV or CRLs of the MMD cannot be persisted
+func TestDoRevocationTransparencyTasksQueuesSRDForEveryLog(t *testing.T) {
+	storage := &failingStorage{NewMemoryStorage(), make(map[string] bool)}
+	newCA := mustGetCAWithStorage(t, storage)
+	logs := map[string] *srdLog{"a": newSRDLog(t, 100), "b": newSRDLog(t, 100)}
+	newCA.Deliverer = mustCreateDeliverer(t, newCA.Storage, newCA.Clock, logs)
+
+	for _, failing := range []string{"", crvBucket, crlBucket} {
+		storage.failing = map[string] bool{failing: true}
+		if err := newCA.UpdateMMD(); err != nil {
+			t.Fatalf("failed to update mmd: %v", err)
+		}
+		err := newCA.DoRevocationTransparencyTasks(revType)
+		if failing == crvBucket && err == nil {
+			t.Fatalf("expected failing to store the CRV to be reported")
+		}
+		if failing != crvBucket && err != nil {
+			t.Fatalf("failed to do revocation transparency tasks with (%v) failing: %v", failing, err)
+		}
+		if _, err := newCA.GetCASRD(revType, newCA.PreviousMMDTimestamp); err != nil {
+			t.Fatalf("no SRD stored with (%v) failing: %v", failing, err)
+		}
+	}
+	storage.failing = nil
+	if _, err := newCA.RevokeAndProduceSRD(revType, 100, 5); err != nil {
+		t.Fatalf("failed to revoke and produce SRD: %v", err)
+	}
+
+	// The outbox in storage holds every SRD of the chain for every log
+	srds := len(newCA.CASignedDigestMap[revType])
+	if keys, err := storage.Keys(srdOutboxBucket); err != nil || len(keys) != srds {
+		t.Fatalf("outbox holds (%v) instead of (%v) SRDs: %v", keys, srds, err)
+	}
+	restarted := mustCreateDeliverer(t, storage, newCA.Clock, logs)
+	for _, state := range restarted.State() {
+		if state.Pending != srds {
+			t.Fatalf("(%v) SRDs are not queued for every log (%+v)", srds, restarted.State())
+		}
+	}
+}
+
+// RevokeAndProduceSRD publishes one SRD per MMD of the revocation type and hands it to every request of that MMD
+func TestRevokeAndProduceSRDOncePerMMD(t *testing.T) {
+	newCA := mustGetCAWithStorage(t, NewMemoryStorage())
+	current := uint64(time.Now().Unix()) / 3600 * 3600
+	fake := clock.NewFake(time.Unix(int64(current + 10), 0))
+	newCA.Clock = fake
+	newCA.MMDs[revType] = 3600
+	srd, err := newCA.RevokeAndProduceSRD(revType, 100, 5)
+	if err != nil {
+		t.Fatalf("failed to revoke and produce SRD: %v", err)
+	}
+	if srd.RevData.Timestamp != current {
+		t.Fatalf("SRD at (%v) instead of the current boundary (%v)", srd.RevData.Timestamp, current)
+	}
+
+	// A second request in the same MMD gets the same SRD and revokes nothing
+	again, err := newCA.RevokeAndProduceSRD(revType, 100, 5)
+	if err != nil {
+		t.Fatalf("failed to revoke and produce SRD: %v", err)
+	}
+	if again != srd || len(newCA.CASignedDigestMap[revType]) != 1 || len(newCA.DeltaRevocationsToList(revType)) != 0 {
+		t.Fatalf("second request of the MMD produced SRD at (%v) with (%v) SRDs stored", again.RevData.Timestamp, len(newCA.CASignedDigestMap[revType]))
+	}
+
+	// The boundary missed in between is back-filled before the SRD of the current MMD
+	fake.Set(time.Unix(int64(current + 2 * 3600 + 10), 0))
+	next, err := newCA.RevokeAndProduceSRD(revType, 100, 5)
+	if err != nil {
+		t.Fatalf("failed to revoke and produce SRD: %v", err)
+	}
+	if next.RevData.Timestamp != current + 2 * 3600 {
+		t.Fatalf("SRD at (%v) instead of the current boundary (%v)", next.RevData.Timestamp, current + 2 * 3600)
+	}
+	if _, err := newCA.GetCASRD(revType, current + 3600); err != nil {
+		t.Fatalf("missed boundary was not back-filled: %v", err)
+	}
+}
+
+// Revocations accepted while MMDs are cut over must end up in exactly one SRD, neither dropped nor published twice
+func TestEveryAcknowledgedRevocationInExactlyOneSRD(t *testing.T) {
+	newCA, err := mustGetCA(t)
+	if err != nil {
+		t.Fatalf("failed to create new CA: %v", err)
+	}
+	const writers = 4
+	const revocationsPerWriter = 200
+	acknowledged := make(chan uint64, writers * revocationsPerWriter)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < revocationsPerWriter; i++ {
+				revocationNum := uint64(w * revocationsPerWriter + i)
+				if err := newCA.AddRevocations(revType, []ctca.Revocation{{RevocationNum: revocationNum}}); err != nil {
+					t.Errorf("failed to add revocation num (%v): %v", revocationNum, err)
+					continue
+				}
+				acknowledged <- revocationNum
+			}
+		}(w)
+	}
+	writersDone := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(writersDone)
+	}()
+
+	// Cut over MMDs while the writers run, then once more for whatever is still pending
+	for running := true; running; {
+		select {
+		case <-writersDone:
+			running = false
+		default:
+		}
+		if err := newCA.UpdateMMD(); err != nil {
+			t.Fatalf("failed to update mmd: %v", err)
+		}
+		if err := newCA.DoRevocationTransparencyTasks(revType); err != nil {
+			t.Fatalf("failed to DoRevocationTransparencyTasks: %v", err)
+		}
+	}
+	close(acknowledged)
+	if pending := newCA.DeltaRevocationsToList(revType); len(pending) != 0 {
+		t.Fatalf("revocations (%v) are still pending after the last MMD", pending)
+	}
+
+	published := make(map[uint64] int)
+	for timestamp, srd := range newCA.CASignedDigestMap[revType] {
+		delta, err := newCA.RevocationTypes[revType].DecodeDelta(srd.RevData.CRVDelta)
+		if err != nil {
+			t.Fatalf("failed to decode delta of SRD (%v): %v", timestamp, err)
+		}
+		for _, revocationNum := range delta.RevocationNums() {
+			published[revocationNum]++
+		}
+	}
+	count := 0
+	for revocationNum := range acknowledged {
+		count++
+		if published[revocationNum] != 1 {
+			t.Fatalf("acknowledged revocation num (%v) is in (%v) SRDs", revocationNum, published[revocationNum])
+		}
+	}
+	if count != len(published) {
+		t.Fatalf("SRDs publish (%v) revocation nums, but (%v) were acknowledged", len(published), count)
+	}
+}
+
 func TestCreateSRDWithRevData(t *testing.T) {
 	newCA, err := mustGetCA(t)
 	if err != nil {
@@ -212,10 +373,6 @@ func TestUpdateMMD(t *testing.T) {
 	}
 }
 
-func TestPostCASRD(t *testing.T) {
-
-}
-
 func TestVerifySRDSignature(t *testing.T) {
 	newCA, err := mustGetCA(t)
 	if err != nil {
@@ -268,7 +425,7 @@ func TestGetLatestRevocationStatus(t *testing.T) {
 		t.Fatalf("failed to update mmd of CA: %v", err)
 	}
 
-	revocationStatus, err := newCA.GetLatestRevocationStatus()
+	revocationStatus, err := newCA.GetLatestRevocationStatus(revType)
 	if err != nil {
 		t.Fatalf("failed to add GetLatestRevocationStatus: %v", err)
 	}
@@ -276,4 +433,149 @@ func TestGetLatestRevocationStatus(t *testing.T) {
 	if len(revocationStatus.LogSRDs) != 1 {
 		t.Fatalf("invalid RevocationStatus (%v) with length (%v) : %v", revocationStatus, len(revocationStatus.LogSRDs), err)
 	}
-}
\ No newline at end of file
+}
+
+func TestDoRevocationTransparencyTasksPerRevocationType(t *testing.T) {
+	newCA, err := NewCA("../testdata/ca_config_revocation_types.json", caListName, logListName)
+	if err != nil {
+		t.Fatalf("failed to create new CA: %v", err)
+	}
+	revTypes := newCA.RevocationTypeNames()
+	if !reflect.DeepEqual(revTypes, []string{"Let's-Revoke", "Let's-Revoke-Emergency"}) {
+		t.Fatalf("unexpected revocation types (%v)", revTypes)
+	}
+
+	emergencyRevNumsList := []uint64{7}
+	if err := newCA.AddRevocationNums("Let's-Revoke-Emergency", &emergencyRevNumsList); err != nil {
+		t.Fatalf("failed to add new revNums: %v", err)
+	}
+	for _, revType := range revTypes {
+		if err := newCA.DoRevocationTransparencyTasks(revType); err != nil {
+			t.Fatalf("failed to DoRevocationTransparencyTasks for (%v): %v", revType, err)
+		}
+		srd, err := newCA.GetCASRD(revType, newCA.PreviousMMDTimestamp)
+		if err != nil {
+			t.Fatalf("failed to get SRD of (%v) from CA: %v", revType, err)
+		}
+		if srd.RevData.RevocationType != revType {
+			t.Fatalf("SRD revocation type (%v) not equal to (%v)", srd.RevData.RevocationType, revType)
+		}
+	}
+
+	if nums := newCA.RevocationObjMap["Let's-Revoke"].RevocationNums(); len(nums) != 0 {
+		t.Fatalf("revocation of another type leaked into Let's-Revoke CRV: %v", nums)
+	}
+	if nums := newCA.RevocationObjMap["Let's-Revoke-Emergency"].RevocationNums(); !reflect.DeepEqual(nums, emergencyRevNumsList) {
+		t.Fatalf("emergency CRV nums (%v) not equal to added revNums (%v)", nums, emergencyRevNumsList)
+	}
+
+	if err := newCA.AddRevocationNums("Unknown", &emergencyRevNumsList); err == nil {
+		t.Fatalf("failed to reject revocation nums of unknown revocation type")
+	}
+}
+
+func TestAddRevocationNumsRejectsOutOfRange(t *testing.T) {
+	newCA, err := NewCA("../testdata/ca_config_revocation_types.json", caListName, logListName)
+	if err != nil {
+		t.Fatalf("failed to create new CA: %v", err)
+	}
+	emergencyRevType := "Let's-Revoke-Emergency"
+	revNumsList := []uint64{1, 1 << 16 - 1}
+	if err := newCA.AddRevocationNums(emergencyRevType, &revNumsList); err != nil {
+		t.Fatalf("failed to add revNums in range: %v", err)
+	}
+
+	outOfRangeRevNumsList := []uint64{7, 1 << 16}
+	err = newCA.AddRevocationNums(emergencyRevType, &outOfRangeRevNumsList)
+	var revNumErr *ctca.RevocationNumberError
+	if !errors.As(err, &revNumErr) {
+		t.Fatalf("expected RevocationNumberError for out of range revNums, got: %v", err)
+	}
+	if !reflect.DeepEqual(revNumErr.RevocationNums, []uint64{1 << 16}) {
+		t.Fatalf("RevocationNumberError revNums (%v) not equal to out of range revNums (%v)", revNumErr.RevocationNums, []uint64{1 << 16})
+	}
+	if len(newCA.DeltaRevocationsToList(emergencyRevType)) != len(revNumsList) {
+		t.Fatalf("revNums of rejected request were added to DeltaRevocations")
+	}
+
+	// A bucket far past the expiration of any certificate would never be retired
+	farBucketRevNumsList := []uint64{ctca.JoinRevocationNum(1 << 31, 1)}
+	var bucketErr *ctca.ExpirationBucketError
+	if err := newCA.AddRevocationNums(emergencyRevType, &farBucketRevNumsList); !errors.As(err, &bucketErr) {
+		t.Fatalf("expected ExpirationBucketError for revNums of a bucket outside the live window, got: %v", err)
+	}
+	if len(newCA.DeltaRevocationsToList(emergencyRevType)) != len(revNumsList) {
+		t.Fatalf("revNums of rejected request were added to DeltaRevocations")
+	}
+
+	if err := newCA.DoRevocationTransparencyTasks(emergencyRevType); err != nil {
+		t.Fatalf("failed to DoRevocationTransparencyTasks: %v", err)
+	}
+	usage, err := newCA.GetNumberSpaceUsage(emergencyRevType)
+	if err != nil {
+		t.Fatalf("failed to get number space usage: %v", err)
+	}
+	if usage.IndicesPerBucket != 1 << 16 || len(usage.Buckets) != 1 || usage.Buckets[0].Revoked != 2 || usage.Buckets[0].Consumed != 1 {
+		t.Fatalf("unexpected number space usage (%+v)", usage)
+	}
+
+	// Numbers assigned to certificates consume the number space before any of them is revoked
+	notAfter := uint64(certificateNotAfter.Unix())
+	for _, serial := range []string{"1", "2", "3"} {
+		if _, err := newCA.Registry.Assign(emergencyRevType, strings.Repeat(serial, 64), serial, notAfter); err != nil {
+			t.Fatalf("failed to assign revocation num: %v", err)
+		}
+	}
+	usage, err = newCA.GetNumberSpaceUsage(emergencyRevType)
+	if err != nil {
+		t.Fatalf("failed to get number space usage: %v", err)
+	}
+	bucket := newCA.RevocationTypes[emergencyRevType].ExpirationBucket(notAfter)
+	expected := ctca.BucketUsage{Bucket: bucket, Assigned: 3, Consumed: 3.0 / (1 << 16)}
+	if len(usage.Buckets) != 2 || usage.Buckets[1] != expected {
+		t.Fatalf("usage of bucket with assigned revocation nums (%+v) not equal to (%+v)", usage.Buckets, expected)
+	}
+}
+
+func TestAddRevocationsHoldAndRelease(t *testing.T) {
+	newCA, err := mustGetCA(t)
+	if err != nil {
+		t.Fatalf("failed to create new CA: %v", err)
+	}
+	revocations, _ := ctca.NewRevocations([]uint64{1, 2, 3}, []ctca.ReasonCode{ctca.CertificateHold, ctca.KeyCompromise, ctca.CertificateHold})
+	if err := newCA.AddRevocations(revType, revocations); err != nil {
+		t.Fatalf("failed to add revocations: %v", err)
+	}
+	// Held and released within the same MMD
+	release, _ := ctca.NewRevocations([]uint64{3}, []ctca.ReasonCode{ctca.RemoveFromCRL})
+	if err := newCA.AddRevocations(revType, release); err != nil {
+		t.Fatalf("failed to release pending hold: %v", err)
+	}
+	if err := newCA.DoRevocationTransparencyTasks(revType); err != nil {
+		t.Fatalf("failed to DoRevocationTransparencyTasks: %v", err)
+	}
+	if err := newCA.ClearDeltaRevocations(revType); err != nil {
+		t.Fatalf("failed to clear delta revocations: %v", err)
+	}
+
+	for _, revNum := range []uint64{2, 3} {
+		invalidRelease, _ := ctca.NewRevocations([]uint64{revNum}, []ctca.ReasonCode{ctca.RemoveFromCRL})
+		var transitionErr *ctca.ReasonTransitionError
+		if err := newCA.AddRevocations(revType, invalidRelease); !errors.As(err, &transitionErr) {
+			t.Fatalf("expected ReasonTransitionError for release of revNum (%v), got: %v", revNum, err)
+		}
+	}
+	release, _ = ctca.NewRevocations([]uint64{1}, []ctca.ReasonCode{ctca.RemoveFromCRL})
+	if err := newCA.AddRevocations(revType, release); err != nil {
+		t.Fatalf("failed to release held revNum: %v", err)
+	}
+	if len(newCA.DeltaRevocationsToList(revType)) != 1 {
+		t.Fatalf("rejected releases were added to DeltaRevocations")
+	}
+	if err := newCA.DoRevocationTransparencyTasks(revType); err != nil {
+		t.Fatalf("failed to DoRevocationTransparencyTasks: %v", err)
+	}
+	if revNums := newCA.RevocationObjMap[revType].RevocationNums(); !reflect.DeepEqual(revNums, []uint64{2}) {
+		t.Fatalf("revNums (%v) after release not equal to revNums revoked for keyCompromise (%v)", revNums, []uint64{2})
+	}
+}
@@ -0,0 +1,92 @@
+package ca
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/n-ct/ct-certificate-authority/extension"
+	ctca "github.com/n-ct/ct-certificate-authority"
+)
+
+// Returned for certificates whose signature was not made by the key of the CA
+var ErrNotIssuedByCA = errors.New("certificate was not issued by this CA")
+
+// Get the public key certificates issued by the CA are verified with
+func (c *CA) IssuerPublicKey() crypto.PublicKey {
+	return c.Issuer.Key.Public()
+}
+
+// Check that the signature of cert was made by the key of the CA
+func (c *CA) CheckIssuedCertificate(cert *x509.Certificate) error {
+	issuer := &x509.Certificate{PublicKey: c.IssuerPublicKey()}
+	if err := issuer.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		return fmt.Errorf("%w: %v", ErrNotIssuedByCA, err)
+	}
+	return nil
+}
+
+// Get the record of cert in the registry of revType. The revocation number is read from the revocation number
+// extension of cert if it carries one for revType. Otherwise the certificate is found by its fingerprint or,
+// since a precertificate and its final certificate share their serial but not their fingerprint, by its serial
+func (c *CA) LookupCertificate(revType string, cert *x509.Certificate) (*ctca.CertificateRecord, error) {
+	revocationNum, err := extension.ForRevocationType(cert, revType)
+	if err == nil {
+		return c.lookupCertificateByExtension(revType, cert, revocationNum)
+	}
+	if !errors.Is(err, extension.ErrNoRevocationNumber) {
+		return nil, fmt.Errorf("invalid revocation number extension: %w", err)
+	}
+	record, err := c.Registry.ByFingerprint(revType, ctca.CertificateFingerprint(cert.Raw))
+	if errors.Is(err, ErrUnknownCertificate) {
+		return c.Registry.BySerial(revType, ctca.SerialString(cert.SerialNumber))
+	}
+	return record, err
+}
+
+// Get the record of the revocation number carried by cert. A certificate without a record is described by its extension alone
+func (c *CA) lookupCertificateByExtension(revType string, cert *x509.Certificate, revocationNum extension.RevocationNumber) (*ctca.CertificateRecord, error) {
+	revocationType, err := c.GetRevocationType(revType)
+	if err != nil {
+		return nil, err
+	}
+	notAfter := uint64(cert.NotAfter.Unix())
+	if err := revocationNum.ValidateFor(revocationType, notAfter); err != nil {
+		return nil, fmt.Errorf("invalid revocation number extension: %w", err)
+	}
+	serial := ctca.SerialString(cert.SerialNumber)
+	record, err := c.Registry.ByRevocationNum(revType, revocationNum.RevocationNum())
+	if errors.Is(err, ErrUnknownCertificate) {
+		record = &ctca.CertificateRecord{
+			RevocationType: revType,
+			RevocationNum: revocationNum.RevocationNum(),
+			Fingerprint: ctca.CertificateFingerprint(cert.Raw),
+			Serial: serial,
+			NotAfter: notAfter,
+		}
+		return record, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if record.Serial != serial {
+		return nil, fmt.Errorf("revocation num (%v) is registered to serial (%v): %w", record.RevocationNum, record.Serial, ErrCertificateConflict)
+	}
+	return record, nil
+}
+
+// Revoke a certificate issued by the CA for reason by adding its revocation number to the DeltaRevocations of revType
+func (c *CA) RevokeCertificate(revType string, cert *x509.Certificate, reason ctca.ReasonCode) (*ctca.CertificateRecord, error) {
+	if err := c.CheckIssuedCertificate(cert); err != nil {
+		return nil, fmt.Errorf("failed to revoke certificate: %w", err)
+	}
+	record, err := c.LookupCertificate(revType, cert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke certificate: %w", err)
+	}
+	if err := c.AddRevocations(revType, []ctca.Revocation{{RevocationNum: record.RevocationNum, Reason: reason}}); err != nil {
+		return nil, fmt.Errorf("failed to revoke certificate: %w", err)
+	}
+	return record, nil
+}
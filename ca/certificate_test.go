@@ -0,0 +1,126 @@
+package ca
+
+import (
+	"testing"
+	"errors"
+	"time"
+	"math/big"
+	"crypto/rand"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/pem"
+
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/certificate-transparency-go/x509/pkix"
+	"github.com/n-ct/ct-certificate-authority/extension"
+	ctca "github.com/n-ct/ct-certificate-authority"
+)
+
+// Certificates created by mustCreateCertificate are still valid, so their expiration bucket accepts revocations
+var certificateNotAfter = time.Now().Add(24 * time.Hour).Truncate(time.Second)
+
+// Create a DER certificate with the given serial and extensions signed by signingKey
+func mustCreateCertificate(t *testing.T, serial int64, signingKey interface{}, extensions ...pkix.Extension) []byte {
+	t.Helper()
+	subjectKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate subject key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject: pkix.Name{CommonName: "example.com"},
+		NotBefore: time.Unix(1000, 0),
+		NotAfter: certificateNotAfter,
+		ExtraExtensions: extensions,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &subjectKey.PublicKey, signingKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	return der
+}
+
+func TestRevokeCertificate(t *testing.T) {
+	newCA, err := mustGetCA(t)
+	if err != nil {
+		t.Fatalf("failed to create new CA: %v", err)
+	}
+	der := mustCreateCertificate(t, 42, newCA.Signer.PrivKey)
+	cert, err := ctca.DecodeCertificate(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	if err != nil {
+		t.Fatalf("failed to decode PEM certificate: %v", err)
+	}
+	if _, err := newCA.RevokeCertificate(revType, cert, ctca.KeyCompromise); !errors.Is(err, ErrUnknownCertificate) {
+		t.Fatalf("expected ErrUnknownCertificate for unregistered certificate, got: %v", err)
+	}
+	record, err := newCA.Registry.Assign(revType, ctca.CertificateFingerprint(der), "2a", uint64(cert.NotAfter.Unix()))
+	if err != nil {
+		t.Fatalf("failed to assign revocation num: %v", err)
+	}
+	revokedRecord, err := newCA.RevokeCertificate(revType, cert, ctca.KeyCompromise)
+	if err != nil {
+		t.Fatalf("failed to revoke certificate: %v", err)
+	}
+	if *revokedRecord != *record || newCA.DeltaRevocations[revType][record.RevocationNum] != ctca.KeyCompromise {
+		t.Fatalf("revocation num (%v) of certificate was not added to DeltaRevocations", record.RevocationNum)
+	}
+
+	// A certificate with the same serial but a different fingerprint is found by its serial
+	otherCert, err := x509.ParseCertificate(mustCreateCertificate(t, 42, newCA.Signer.PrivKey))
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	if serialRecord, err := newCA.LookupCertificate(revType, otherCert); err != nil || *serialRecord != *record {
+		t.Fatalf("certificate record found by serial (%+v, %v) not equal to (%+v)", serialRecord, err, record)
+	}
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	foreignCert, err := x509.ParseCertificate(mustCreateCertificate(t, 42, otherKey))
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	if _, err := newCA.RevokeCertificate(revType, foreignCert, ctca.KeyCompromise); !errors.Is(err, ErrNotIssuedByCA) {
+		t.Fatalf("expected ErrNotIssuedByCA for certificate signed by another key, got: %v", err)
+	}
+}
+
+func TestRevokeCertificateWithRevocationNumberExtension(t *testing.T) {
+	newCA, err := mustGetCA(t)
+	if err != nil {
+		t.Fatalf("failed to create new CA: %v", err)
+	}
+	bucket := ctca.ExpirationBucket(uint64(certificateNotAfter.Unix()), ctca.DefaultBucketDuration)
+	revocationNum := extension.NewRevocationNumber(revType, ctca.JoinRevocationNum(bucket, 77))
+	ext, err := extension.NewExtension([]extension.RevocationNumber{revocationNum})
+	if err != nil {
+		t.Fatalf("failed to create extension: %v", err)
+	}
+	cert, err := x509.ParseCertificate(mustCreateCertificate(t, 7, newCA.Signer.PrivKey, ext))
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	// The certificate is not registered, so its revocation number comes from the extension alone
+	record, err := newCA.RevokeCertificate(revType, cert, ctca.Superseded)
+	if err != nil {
+		t.Fatalf("failed to revoke certificate: %v", err)
+	}
+	if record.RevocationNum != revocationNum.RevocationNum() || newCA.DeltaRevocations[revType][record.RevocationNum] != ctca.Superseded {
+		t.Fatalf("revocation num (%v) of extension was not added to DeltaRevocations", revocationNum.RevocationNum())
+	}
+
+	wrongBucketNum := extension.NewRevocationNumber(revType, ctca.JoinRevocationNum(bucket + 1, 77))
+	ext, err = extension.NewExtension([]extension.RevocationNumber{wrongBucketNum})
+	if err != nil {
+		t.Fatalf("failed to create extension: %v", err)
+	}
+	wrongBucketCert, err := x509.ParseCertificate(mustCreateCertificate(t, 8, newCA.Signer.PrivKey, ext))
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	if _, err := newCA.RevokeCertificate(revType, wrongBucketCert, ctca.Superseded); err == nil {
+		t.Fatalf("failed to reject revocation number outside the expiration bucket of the certificate")
+	}
+}
@@ -0,0 +1,241 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/certificate-transparency-go/asn1"
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/certificate-transparency-go/x509/pkix"
+	ctca "github.com/n-ct/ct-certificate-authority"
+)
+
+const (
+	crlBucket = "crls"
+	fullCRLSuffix = "/full"
+	deltaCRLSuffix = "/delta"
+)
+
+var (
+	oidSignatureECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidSignatureECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidSignatureECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+)
+
+// Identical to the authKeyId structure of the x509 package
+type authorityKeyID struct {
+	ID []byte `asn1:"optional,tag:0"`
+}
+
+// Get the URL of the CRL distribution point of revType
+func (c *CA) CRLDistributionPoint(revType string) string {
+	return "http://" + c.ListenAddress + ctca.GetCRLPath + "?" + ctca.RevocationTypeParam + "=" + url.QueryEscape(revType)
+}
+
+// Get the full CRL of revType, or its delta CRL, published at the most recent MMD
+func (c *CA) GetCRL(revType string, delta bool) ([]byte, error) {
+	key := revType + fullCRLSuffix
+	if delta {
+		key = revType + deltaCRLSuffix
+	}
+	crl, err := c.Storage.Get(crlBucket, key)
+	if errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("no CRL of revType (%v) was published yet: %w", revType, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get CRL of revType (%v): %w", revType, err)
+	}
+	return crl, nil
+}
+
+// Publish the full and delta CRLs of revType for the MMD at timestamp from the state the MMD produced and its delta.
+// Revocation numbers are mapped to serials through the registry, so revocations of numbers without a registered
+// certificate are left out. The CRL number is the timestamp of the MMD, so the full and delta CRL of an MMD share it
+// and the delta CRL names the full CRL of the previous MMD as its base
+func (c *CA) publishCRLs(revType string, state ctca.RevocationState, delta ctca.RevocationDelta, timestamp uint64) error {
+	thisUpdate := time.Unix(int64(timestamp), 0).UTC()
+	nextUpdate := thisUpdate.Add(time.Duration(c.RevocationTypeMMD(revType)) * time.Second)
+
+	// Entries keep the revocation time of the full CRL they first appeared in
+	revocationTimes := make(map[string] time.Time)
+	baseCRLNumber := int64(-1)
+	previous, err := c.GetCRL(revType, false)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to publish CRLs: %w", err)
+	}
+	if err == nil {
+		previousCRL, err := x509.ParseCertificateListDER(previous)
+		if x509.IsFatal(err) {
+			return fmt.Errorf("failed to parse previous CRL of revType (%v): %w", revType, err)
+		}
+		for _, revoked := range previousCRL.TBSCertList.RevokedCertificates {
+			revocationTimes[ctca.SerialString(revoked.SerialNumber)] = revoked.RevocationTime
+		}
+		baseCRLNumber = int64(previousCRL.TBSCertList.CRLNumber)
+	}
+
+	unregistered := 0
+	fullEntries := []pkix.RevokedCertificate{}
+	for _, revocationNum := range state.RevocationNums() {
+		reason, _ := state.RevocationReason(revocationNum)
+		entry, err := c.crlEntry(revType, revocationNum, reason, thisUpdate, revocationTimes)
+		if errors.Is(err, ErrUnknownCertificate) {
+			unregistered++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to publish CRLs: %w", err)
+		}
+		fullEntries = append(fullEntries, *entry)
+	}
+	if unregistered > 0 {
+		glog.Infof("left %v revocation nums of revType (%v) without a registered certificate out of the CRL", unregistered, revType)
+	}
+	fullCRL, err := c.createCRL(fullEntries, thisUpdate, nextUpdate, int64(timestamp), -1)
+	if err != nil {
+		return fmt.Errorf("failed to publish CRLs: %w", err)
+	}
+
+	var deltaCRL []byte
+	if baseCRLNumber >= 0 {
+		deltaEntries := []pkix.RevokedCertificate{}
+		for _, revocationNum := range delta.RevocationNums() {
+			reason, _ := state.RevocationReason(revocationNum)
+			entry, err := c.crlEntry(revType, revocationNum, reason, thisUpdate, revocationTimes)
+			if err == nil {
+				deltaEntries = append(deltaEntries, *entry)
+			} else if !errors.Is(err, ErrUnknownCertificate) {
+				return fmt.Errorf("failed to publish CRLs: %w", err)
+			}
+		}
+		// Released certificates are listed with removeFromCRL so relying parties drop them from their base CRL
+		for _, revocationNum := range delta.ReleasedNums() {
+			entry, err := c.crlEntry(revType, revocationNum, ctca.RemoveFromCRL, thisUpdate, nil)
+			if err == nil {
+				deltaEntries = append(deltaEntries, *entry)
+			} else if !errors.Is(err, ErrUnknownCertificate) {
+				return fmt.Errorf("failed to publish CRLs: %w", err)
+			}
+		}
+		deltaCRL, err = c.createCRL(deltaEntries, thisUpdate, nextUpdate, int64(timestamp), baseCRLNumber)
+		if err != nil {
+			return fmt.Errorf("failed to publish CRLs: %w", err)
+		}
+	}
+
+	if err := c.Storage.Put(crlBucket, revType + fullCRLSuffix, fullCRL); err != nil {
+		return fmt.Errorf("failed to store CRL of revType (%v): %w", revType, err)
+	}
+	if deltaCRL != nil {
+		if err := c.Storage.Put(crlBucket, revType + deltaCRLSuffix, deltaCRL); err != nil {
+			return fmt.Errorf("failed to store delta CRL of revType (%v): %w", revType, err)
+		}
+	}
+	return nil
+}
+
+// Create the CRL entry of the certificate registered with revocationNum
+func (c *CA) crlEntry(revType string, revocationNum uint64, reason ctca.ReasonCode, thisUpdate time.Time, revocationTimes map[string] time.Time) (*pkix.RevokedCertificate, error) {
+	record, err := c.Registry.ByRevocationNum(revType, revocationNum)
+	if err != nil {
+		return nil, err
+	}
+	serial, ok := new(big.Int).SetString(record.Serial, 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid serial (%v) of revocation num (%v)", record.Serial, revocationNum)
+	}
+	revocationTime, ok := revocationTimes[record.Serial]
+	if !ok {
+		revocationTime = thisUpdate
+	}
+	entry := &pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: revocationTime}
+	// RFC 5280 5.3.1 asks to leave out the reasonCode extension rather than use unspecified
+	if reason != ctca.Unspecified {
+		value, err := asn1.Marshal(asn1.Enumerated(reason))
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal reason code: %w", err)
+		}
+		entry.Extensions = []pkix.Extension{{Id: x509.OIDExtensionCRLReasons, Value: value}}
+	}
+	return entry, nil
+}
+
+// Create a v2 CRL signed by the issuer of the CA. A non-negative baseCRLNumber makes it a delta CRL of that base
+func (c *CA) createCRL(entries []pkix.RevokedCertificate, thisUpdate time.Time, nextUpdate time.Time, crlNumber int64, baseCRLNumber int64) ([]byte, error) {
+	hashFunc, signatureAlgorithm, err := crlSignatureAlgorithm(c.Issuer.Key.Public())
+	if err != nil {
+		return nil, err
+	}
+	var issuer pkix.RDNSequence
+	if _, err := asn1.Unmarshal(c.Issuer.Certificate.RawSubject, &issuer); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal issuer name: %w", err)
+	}
+	crlNumberValue, err := asn1.Marshal(big.NewInt(crlNumber))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal CRL number: %w", err)
+	}
+	extensions := []pkix.Extension{{Id: x509.OIDExtensionCRLNumber, Value: crlNumberValue}}
+	if len(c.Issuer.Certificate.SubjectKeyId) > 0 {
+		value, err := asn1.Marshal(authorityKeyID{ID: c.Issuer.Certificate.SubjectKeyId})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal authority key id: %w", err)
+		}
+		extensions = append(extensions, pkix.Extension{Id: x509.OIDExtensionAuthorityKeyId, Value: value})
+	}
+	if baseCRLNumber >= 0 {
+		value, err := asn1.Marshal(big.NewInt(baseCRLNumber))
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal base CRL number: %w", err)
+		}
+		extensions = append(extensions, pkix.Extension{Id: x509.OIDExtensionDeltaCRLIndicator, Critical: true, Value: value})
+	}
+	tbsCertList := pkix.TBSCertificateList{
+		Version: 1,
+		Signature: signatureAlgorithm,
+		Issuer: issuer,
+		ThisUpdate: thisUpdate,
+		NextUpdate: nextUpdate,
+		RevokedCertificates: entries,
+		Extensions: extensions,
+	}
+	tbsCertListBytes, err := asn1.Marshal(tbsCertList)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal CRL: %w", err)
+	}
+	hash := hashFunc.New()
+	hash.Write(tbsCertListBytes)
+	signature, err := c.Issuer.Key.Sign(rand.Reader, hash.Sum(nil), hashFunc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign CRL: %w", err)
+	}
+	return asn1.Marshal(pkix.CertificateList{
+		TBSCertList: tbsCertList,
+		SignatureAlgorithm: signatureAlgorithm,
+		SignatureValue: asn1.BitString{Bytes: signature, BitLength: len(signature) * 8},
+	})
+}
+
+// Choose the hash and signature algorithm for the ECDSA key of the issuer the same way the x509 package does
+func crlSignatureAlgorithm(publicKey crypto.PublicKey) (crypto.Hash, pkix.AlgorithmIdentifier, error) {
+	ecdsaKey, ok := publicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return 0, pkix.AlgorithmIdentifier{}, fmt.Errorf("unsupported issuer key of type %T", publicKey)
+	}
+	switch ecdsaKey.Curve {
+	case elliptic.P224(), elliptic.P256():
+		return crypto.SHA256, pkix.AlgorithmIdentifier{Algorithm: oidSignatureECDSAWithSHA256}, nil
+	case elliptic.P384():
+		return crypto.SHA384, pkix.AlgorithmIdentifier{Algorithm: oidSignatureECDSAWithSHA384}, nil
+	case elliptic.P521():
+		return crypto.SHA512, pkix.AlgorithmIdentifier{Algorithm: oidSignatureECDSAWithSHA512}, nil
+	}
+	return 0, pkix.AlgorithmIdentifier{}, fmt.Errorf("unsupported issuer key curve (%v)", ecdsaKey.Curve.Params().Name)
+}
@@ -0,0 +1,211 @@
+package ca
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/google/certificate-transparency-go/x509"
+	ctca "github.com/n-ct/ct-certificate-authority"
+)
+
+var ErrCRVNotEmpty = errors.New("CRV already has revocations")
+
+// Result of seeding the CRV of a revocation type from a CRL
+type CRLImport struct {
+	RevocationType string
+	Timestamp uint64	// Timestamp of the SRD of the migration epoch
+	Revocations []ctca.Revocation	// Revocations added to the CRV, ordered by revocation num
+	UnknownSerials []string	// Serials on the CRL without a registered certificate, which were left out
+	ExpiredSerials []string	// Serials on the CRL of certificates that have expired, which were left out
+}
+
+// A revoked certificate whose status differs between a CRL and the CRV
+type CRLDifference struct {
+	Serial string
+	RevocationNum uint64
+	CRLReason ctca.ReasonCode
+	CRVReason ctca.ReasonCode
+}
+
+// Differences between a CRL and the current CRV of a revocation type
+type CRLReconciliation struct {
+	RevocationType string
+	Timestamp uint64	// Timestamp of the SRD of the CRV the CRL was compared against
+	MissingFromCRV []CRLDifference	// Revoked on the CRL but not in the CRV
+	MissingFromCRL []CRLDifference	// Revoked in the CRV but not on the CRL
+	ReasonMismatches []CRLDifference	// Revoked on both for different reasons
+	UnknownSerials []string	// Serials on the CRL without a registered certificate
+}
+
+// Check whether the CRL and the CRV revoke the same registered certificates for the same reasons
+func (r *CRLReconciliation) InSync() bool {
+	return len(r.MissingFromCRV) == 0 && len(r.MissingFromCRL) == 0 && len(r.ReasonMismatches) == 0
+}
+
+// Parse a full CRL in DER or PEM. When issuer is given the CRL must carry a valid signature of it
+func ParseCRL(data []byte, issuer *x509.Certificate) (*x509.CertificateList, error) {
+	crl, err := x509.ParseCertificateList(data)
+	if x509.IsFatal(err) {
+		return nil, fmt.Errorf("failed to parse CRL: %w", err)
+	}
+	if crl.TBSCertList.BaseCRLNumber >= 0 {
+		return nil, fmt.Errorf("CRL with base CRL number (%v) is a delta CRL", crl.TBSCertList.BaseCRLNumber)
+	}
+	if issuer != nil {
+		if err := issuer.CheckCertificateListSignature(crl); err != nil {
+			return nil, fmt.Errorf("CRL is not signed by issuer (%v): %w", issuer.Subject, err)
+		}
+	}
+	return crl, nil
+}
+
+// Seed the empty CRV of revType with the revocations of a full CRL and publish them in an SRD of the MMD schedule of
+// revType: the SRD of its current boundary if that has none yet, otherwise the SRD of its next boundary (see SealMMDs).
+// Serials are mapped to revocation numbers through the registry, so the certificates of the CRL must be registered
+// before it is imported. The import runs the tasks of the MMD itself, so the sequencer should not be running
+func (c *CA) ImportCRL(revType string, crl *x509.CertificateList) (*CRLImport, error) {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.RevocationTypes[revType]; !ok {
+		return nil, fmt.Errorf("failed to import CRL: unknown revocation type (%v)", revType)
+	}
+	if state, ok := c.RevocationObjMap[revType]; ok && len(state.RevocationNums()) > 0 {
+		return nil, fmt.Errorf("failed to import CRL into revType (%v): %w", revType, ErrCRVNotEmpty)
+	}
+	if len(c.DeltaRevocations[revType]) > 0 {
+		return nil, fmt.Errorf("failed to import CRL into revType (%v) with pending revocations: %w", revType, ErrCRVNotEmpty)
+	}
+	reasons, unknownSerials, err := c.crlRevocationReasons(revType, crl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to import CRL: %w", err)
+	}
+	now := c.Clock.Now()
+	firstBucket, _ := c.RevocationTypes[revType].LiveBuckets(uint64(now.Unix()))
+	revocations := []ctca.Revocation{}
+	expiredSerials := []string{}
+	for _, record := range sortedRecords(reasons) {
+		// Expired certificates stay on a CRL until it is pruned, but their bucket no longer accepts revocations
+		if bucket, _ := ctca.SplitRevocationNum(record.RevocationNum); bucket != ctca.UnpartitionedBucket && bucket < firstBucket {
+			expiredSerials = append(expiredSerials, record.Serial)
+			continue
+		}
+		revocations = append(revocations, ctca.Revocation{RevocationNum: record.RevocationNum, Reason: reasons[record]})
+	}
+	if err := c.addRevocations(revType, revocations); err != nil {
+		return nil, fmt.Errorf("failed to import CRL: %w", err)
+	}
+	_, timestamp, err := c.sealRevocationType(revType, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to import CRL: %w", err)
+	}
+	if err := c.advanceMMDTimestamp(now); err != nil {
+		return nil, fmt.Errorf("failed to import CRL: %w", err)
+	}
+	return &CRLImport{
+		RevocationType: revType,
+		Timestamp: timestamp,
+		Revocations: revocations,
+		UnknownSerials: unknownSerials,
+		ExpiredSerials: expiredSerials,
+	}, nil
+}
+
+// Compare a full CRL with the CRV of revType published by the most recent SRD.
+// Revocations that are still pending for the next MMD are not part of the CRV yet
+func (c *CA) ReconcileCRL(revType string, crl *x509.CertificateList) (*CRLReconciliation, error) {
+	c.RLock()
+	defer c.RUnlock()
+	revocationType, ok := c.RevocationTypes[revType]
+	if !ok {
+		return nil, fmt.Errorf("failed to reconcile CRL: unknown revocation type (%v)", revType)
+	}
+	state, ok := c.RevocationObjMap[revType]
+	if !ok {
+		state = revocationType.NewState()
+	}
+	reasons, unknownSerials, err := c.crlRevocationReasons(revType, crl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reconcile CRL: %w", err)
+	}
+	timestamp, _ := c.latestCASRDTimestamp(revType)
+	reconciliation := &CRLReconciliation{
+		RevocationType: revType,
+		Timestamp: timestamp,
+		MissingFromCRV: []CRLDifference{},
+		MissingFromCRL: []CRLDifference{},
+		ReasonMismatches: []CRLDifference{},
+		UnknownSerials: unknownSerials,
+	}
+
+	onCRL := make(map[uint64] bool)
+	for _, record := range sortedRecords(reasons) {
+		onCRL[record.RevocationNum] = true
+		difference := CRLDifference{Serial: record.Serial, RevocationNum: record.RevocationNum, CRLReason: reasons[record]}
+		crvReason, revoked := state.RevocationReason(record.RevocationNum)
+		switch {
+		case !revoked:
+			reconciliation.MissingFromCRV = append(reconciliation.MissingFromCRV, difference)
+		case crvReason != difference.CRLReason:
+			difference.CRVReason = crvReason
+			reconciliation.ReasonMismatches = append(reconciliation.ReasonMismatches, difference)
+		}
+	}
+	// Revocation numbers without a registered certificate cannot be on a CRL, so they are not a difference
+	for _, revocationNum := range state.RevocationNums() {
+		if onCRL[revocationNum] {
+			continue
+		}
+		record, err := c.Registry.ByRevocationNum(revType, revocationNum)
+		if errors.Is(err, ErrUnknownCertificate) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to reconcile CRL: %w", err)
+		}
+		crvReason, _ := state.RevocationReason(revocationNum)
+		reconciliation.MissingFromCRL = append(reconciliation.MissingFromCRL, CRLDifference{Serial: record.Serial, RevocationNum: revocationNum, CRVReason: crvReason})
+	}
+	return reconciliation, nil
+}
+
+// Map the registered certificates on a CRL to the reasons they were revoked for, along with the serials that are not registered
+func (c *CA) crlRevocationReasons(revType string, crl *x509.CertificateList) (map[*ctca.CertificateRecord] ctca.ReasonCode, []string, error) {
+	reasons := make(map[*ctca.CertificateRecord] ctca.ReasonCode)
+	seen := make(map[string] bool)
+	unknownSerials := []string{}
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		serial := ctca.SerialString(revoked.SerialNumber)
+		if seen[serial] {
+			return nil, nil, fmt.Errorf("serial (%v) is listed twice on the CRL", serial)
+		}
+		seen[serial] = true
+		reason := ctca.ReasonCode(revoked.RevocationReason)
+		// A full CRL lists revoked certificates only, removeFromCRL belongs to delta CRLs
+		if !reason.IsValid() || reason == ctca.RemoveFromCRL {
+			return nil, nil, fmt.Errorf("serial (%v) has invalid reason (%v) on the CRL", serial, reason)
+		}
+		record, err := c.Registry.BySerial(revType, serial)
+		if errors.Is(err, ErrUnknownCertificate) {
+			unknownSerials = append(unknownSerials, serial)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		reasons[record] = reason
+	}
+	return reasons, unknownSerials, nil
+}
+
+// Order the records of the certificates on a CRL by revocation num
+func sortedRecords(reasons map[*ctca.CertificateRecord] ctca.ReasonCode) []*ctca.CertificateRecord {
+	records := []*ctca.CertificateRecord{}
+	for record := range reasons {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].RevocationNum < records[j].RevocationNum
+	})
+	return records
+}
@@ -0,0 +1,170 @@
+package ca
+
+import (
+	"testing"
+	"errors"
+	"math/big"
+	"time"
+	"encoding/pem"
+
+	"github.com/google/certificate-transparency-go/asn1"
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/certificate-transparency-go/x509/pkix"
+	ctca "github.com/n-ct/ct-certificate-authority"
+	"github.com/n-ct/ct-certificate-authority/clock"
+)
+
+// Create a full CRL signed by the issuer of c that revokes the serials for the given reasons
+func mustCreateImportCRL(t *testing.T, c *CA, reasons map[string] ctca.ReasonCode) []byte {
+	t.Helper()
+	now := time.Now().UTC().Truncate(time.Second)
+	entries := []pkix.RevokedCertificate{}
+	for serial, reason := range reasons {
+		serialNumber, ok := new(big.Int).SetString(serial, 16)
+		if !ok {
+			t.Fatalf("invalid serial (%v)", serial)
+		}
+		entry := pkix.RevokedCertificate{SerialNumber: serialNumber, RevocationTime: now}
+		if reason != ctca.Unspecified {
+			value, err := asn1.Marshal(asn1.Enumerated(reason))
+			if err != nil {
+				t.Fatalf("failed to marshal reason code: %v", err)
+			}
+			entry.Extensions = []pkix.Extension{{Id: x509.OIDExtensionCRLReasons, Value: value}}
+		}
+		entries = append(entries, entry)
+	}
+	der, err := c.createCRL(entries, now, now.Add(time.Hour), 1, -1)
+	if err != nil {
+		t.Fatalf("failed to create CRL: %v", err)
+	}
+	return der
+}
+
+func TestImportAndReconcileCRL(t *testing.T) {
+	newCA := mustGetCAWithStorage(t, NewMemoryStorage())
+	issued := []*ctca.IssuedCertificate{}
+	for i := 0; i < 3; i++ {
+		csr, err := ctca.DecodeCertificateRequest(mustCreateCertificateRequest(t))
+		if err != nil {
+			t.Fatalf("failed to decode certificate request: %v", err)
+		}
+		cert, err := newCA.IssueCertificate(revType, csr)
+		if err != nil {
+			t.Fatalf("failed to issue certificate: %v", err)
+		}
+		issued = append(issued, cert)
+	}
+
+	// The CRL is read as PEM and checked against its issuer
+	der := mustCreateImportCRL(t, newCA, map[string] ctca.ReasonCode{
+		issued[0].Record.Serial: ctca.KeyCompromise,
+		issued[1].Record.Serial: ctca.Unspecified,
+		"abcdef": ctca.Superseded,
+	})
+	crl, err := ParseCRL(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), newCA.Issuer.Certificate)
+	if err != nil {
+		t.Fatalf("failed to parse CRL: %v", err)
+	}
+	if _, err := ParseCRL(der, newCA.Responder.Certificate); err == nil {
+		t.Fatalf("expected CRL signed by another issuer to be rejected")
+	}
+
+	imported, err := newCA.ImportCRL(revType, crl)
+	if err != nil {
+		t.Fatalf("failed to import CRL: %v", err)
+	}
+	if len(imported.UnknownSerials) != 1 || imported.UnknownSerials[0] != "abcdef" || len(imported.Revocations) != 2 {
+		t.Fatalf("unexpected import (%+v)", imported)
+	}
+	if _, ok := newCA.CASignedDigestMap[revType][imported.Timestamp]; !ok || imported.Timestamp != newCA.PreviousMMDTimestamp {
+		t.Fatalf("no SRD was produced for the migration epoch at (%v)", imported.Timestamp)
+	}
+	state := newCA.RevocationObjMap[revType]
+	if reason, revoked := state.RevocationReason(issued[0].Record.RevocationNum); !revoked || reason != ctca.KeyCompromise {
+		t.Fatalf("imported revocation has status (%v, %v)", reason, revoked)
+	}
+	if _, revoked := state.RevocationReason(issued[2].Record.RevocationNum); revoked {
+		t.Fatalf("certificate that is not on the CRL was revoked")
+	}
+	if _, err := newCA.ImportCRL(revType, crl); !errors.Is(err, ErrCRVNotEmpty) {
+		t.Fatalf("expected ErrCRVNotEmpty on a second import, got: %v", err)
+	}
+
+	// The imported CRL matches the CRV it seeded
+	reconciliation, err := newCA.ReconcileCRL(revType, crl)
+	if err != nil {
+		t.Fatalf("failed to reconcile CRL: %v", err)
+	}
+	if !reconciliation.InSync() || reconciliation.Timestamp != imported.Timestamp || len(reconciliation.UnknownSerials) != 1 {
+		t.Fatalf("unexpected reconciliation of the imported CRL (%+v)", reconciliation)
+	}
+
+	// A CRL that drifted from the CRV reports every difference
+	drifted, err := ParseCRL(mustCreateImportCRL(t, newCA, map[string] ctca.ReasonCode{
+		issued[1].Record.Serial: ctca.Superseded,
+		issued[2].Record.Serial: ctca.CessationOfOperation,
+	}), nil)
+	if err != nil {
+		t.Fatalf("failed to parse CRL: %v", err)
+	}
+	reconciliation, err = newCA.ReconcileCRL(revType, drifted)
+	if err != nil {
+		t.Fatalf("failed to reconcile CRL: %v", err)
+	}
+	expected := &CRLReconciliation{
+		MissingFromCRV: []CRLDifference{{Serial: issued[2].Record.Serial, RevocationNum: issued[2].Record.RevocationNum, CRLReason: ctca.CessationOfOperation}},
+		MissingFromCRL: []CRLDifference{{Serial: issued[0].Record.Serial, RevocationNum: issued[0].Record.RevocationNum, CRVReason: ctca.KeyCompromise}},
+		ReasonMismatches: []CRLDifference{{Serial: issued[1].Record.Serial, RevocationNum: issued[1].Record.RevocationNum, CRLReason: ctca.Superseded, CRVReason: ctca.Unspecified}},
+	}
+	if reconciliation.InSync() ||
+		len(reconciliation.MissingFromCRV) != 1 || reconciliation.MissingFromCRV[0] != expected.MissingFromCRV[0] ||
+		len(reconciliation.MissingFromCRL) != 1 || reconciliation.MissingFromCRL[0] != expected.MissingFromCRL[0] ||
+		len(reconciliation.ReasonMismatches) != 1 || reconciliation.ReasonMismatches[0] != expected.ReasonMismatches[0] {
+		t.Fatalf("unexpected reconciliation (%+v)", reconciliation)
+	}
+}
+
+// The migration SRD follows the MMD schedule of the revocation type, so the MMDs after it neither collide with it nor are skipped
+func TestImportCRLFollowsRevocationTypeSchedule(t *testing.T) {
+	newCA := mustGetCAWithStorage(t, NewMemoryStorage())
+	current := uint64(time.Now().Unix()) / 3600 * 3600
+	fake := clock.NewFake(time.Unix(int64(current + 10), 0))
+	newCA.Clock = fake
+	newCA.MMDs[revType] = 3600
+	csr, err := ctca.DecodeCertificateRequest(mustCreateCertificateRequest(t))
+	if err != nil {
+		t.Fatalf("failed to decode certificate request: %v", err)
+	}
+	cert, err := newCA.IssueCertificate(revType, csr)
+	if err != nil {
+		t.Fatalf("failed to issue certificate: %v", err)
+	}
+	crl, err := ParseCRL(mustCreateImportCRL(t, newCA, map[string] ctca.ReasonCode{cert.Record.Serial: ctca.KeyCompromise}), newCA.Issuer.Certificate)
+	if err != nil {
+		t.Fatalf("failed to parse CRL: %v", err)
+	}
+
+	// The current boundary of the type already has an SRD, so the migration is published at its next one
+	if produced, err := newCA.CatchUpMMDs(fake.Now()); err != nil || produced != 1 {
+		t.Fatalf("produced (%v) SRDs at the current boundary: %v", produced, err)
+	}
+	imported, err := newCA.ImportCRL(revType, crl)
+	if err != nil {
+		t.Fatalf("failed to import CRL: %v", err)
+	}
+	if imported.Timestamp != current + 3600 {
+		t.Fatalf("migration SRD at (%v) instead of the next boundary (%v)", imported.Timestamp, current + 3600)
+	}
+	fake.Set(time.Unix(int64(current + 3600), 0))
+	if produced, err := newCA.CatchUpMMDs(fake.Now()); err != nil || produced != 0 {
+		t.Fatalf("produced (%v) SRDs at the boundary of the migration SRD: %v", produced, err)
+	}
+	fake.Set(time.Unix(int64(current + 7200), 0))
+	if produced, err := newCA.CatchUpMMDs(fake.Now()); err != nil || produced != 1 {
+		t.Fatalf("produced (%v) SRDs at the boundary after the migration SRD: %v", produced, err)
+	}
+	if _, err := newCA.GetCASRD(revType, current + 7200); err != nil {
+		t.Fatalf("no SRD at the boundary after the migration SRD: %v", err)
+	}
+}
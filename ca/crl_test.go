@@ -0,0 +1,161 @@
+package ca
+
+import (
+	"testing"
+	"errors"
+	"time"
+
+	"github.com/google/certificate-transparency-go/x509"
+	ctca "github.com/n-ct/ct-certificate-authority"
+)
+
+// Parse a CRL of the CA and check that the issuer of the CA signed it
+func mustParseCRL(t *testing.T, c *CA, der []byte) *x509.CertificateList {
+	t.Helper()
+	crl, err := x509.ParseCertificateListDER(der)
+	if err != nil {
+		t.Fatalf("failed to parse CRL: %v", err)
+	}
+	if err := c.Issuer.Certificate.CheckCertificateListSignature(crl); err != nil {
+		t.Fatalf("CRL is not signed by the issuer: %v", err)
+	}
+	return crl
+}
+
+// Map the serials of the entries of a CRL to their reasons
+func crlReasons(crl *x509.CertificateList) map[string] x509.RevocationReasonCode {
+	reasons := make(map[string] x509.RevocationReasonCode)
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		reasons[ctca.SerialString(revoked.SerialNumber)] = revoked.RevocationReason
+	}
+	return reasons
+}
+
+// Run the tasks of a new MMD for revType
+func mustDoMMD(t *testing.T, c *CA) {
+	t.Helper()
+	if err := c.UpdateMMD(); err != nil {
+		t.Fatalf("failed to update mmd: %v", err)
+	}
+	if err := c.DoRevocationTransparencyTasks(revType); err != nil {
+		t.Fatalf("failed to do revocation transparency tasks: %v", err)
+	}
+}
+
+func TestPublishCRLs(t *testing.T) {
+	newCA := mustGetCAWithStorage(t, NewMemoryStorage())
+	issued := []*ctca.IssuedCertificate{}
+	for i := 0; i < 3; i++ {
+		csr, err := ctca.DecodeCertificateRequest(mustCreateCertificateRequest(t))
+		if err != nil {
+			t.Fatalf("failed to decode certificate request: %v", err)
+		}
+		cert, err := newCA.IssueCertificate(revType, csr)
+		if err != nil {
+			t.Fatalf("failed to issue certificate: %v", err)
+		}
+		issued = append(issued, cert)
+	}
+	if _, err := newCA.GetCRL(revType, false); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound before the first MMD, got: %v", err)
+	}
+
+	// A revocation num without a registered certificate is left out of the CRL
+	if err := newCA.AddRevocations(revType, []ctca.Revocation{
+		{RevocationNum: issued[0].Record.RevocationNum, Reason: ctca.KeyCompromise},
+		{RevocationNum: issued[1].Record.RevocationNum, Reason: ctca.CertificateHold},
+		{RevocationNum: 7, Reason: ctca.Superseded},
+	}); err != nil {
+		t.Fatalf("failed to add revocations: %v", err)
+	}
+	if err := newCA.UpdateMMD(); err != nil {
+		t.Fatalf("failed to update mmd: %v", err)
+	}
+	if err := newCA.DoRevocationTransparencyTasks(revType); err != nil {
+		t.Fatalf("failed to do revocation transparency tasks: %v", err)
+	}
+	firstTimestamp := newCA.PreviousMMDTimestamp
+	der, err := newCA.GetCRL(revType, false)
+	if err != nil {
+		t.Fatalf("failed to get CRL: %v", err)
+	}
+	firstCRL := mustParseCRL(t, newCA, der)
+	thisUpdate := time.Unix(int64(firstTimestamp), 0)
+	if !firstCRL.TBSCertList.ThisUpdate.Equal(thisUpdate) || !firstCRL.TBSCertList.NextUpdate.Equal(thisUpdate.Add(time.Duration(newCA.MMD) * time.Second)) {
+		t.Fatalf("CRL covers (%v, %v), expected the MMD at (%v)", firstCRL.TBSCertList.ThisUpdate, firstCRL.TBSCertList.NextUpdate, thisUpdate)
+	}
+	if firstCRL.TBSCertList.CRLNumber != int(firstTimestamp) || firstCRL.TBSCertList.BaseCRLNumber != -1 {
+		t.Fatalf("CRL has number (%v) and base (%v), expected (%v) and no base", firstCRL.TBSCertList.CRLNumber, firstCRL.TBSCertList.BaseCRLNumber, firstTimestamp)
+	}
+	reasons := crlReasons(firstCRL)
+	if len(reasons) != 2 || reasons[issued[0].Record.Serial] != x509.KeyCompromise || reasons[issued[1].Record.Serial] != x509.CertificateHold {
+		t.Fatalf("unexpected CRL entries: %v", reasons)
+	}
+	if _, err := newCA.GetCRL(revType, true); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected no delta CRL without a base CRL, got: %v", err)
+	}
+
+	// Release the certificate on hold and revoke another one
+	if err := newCA.AddRevocations(revType, []ctca.Revocation{
+		{RevocationNum: issued[1].Record.RevocationNum, Reason: ctca.RemoveFromCRL},
+		{RevocationNum: issued[2].Record.RevocationNum, Reason: ctca.Unspecified},
+	}); err != nil {
+		t.Fatalf("failed to add revocations: %v", err)
+	}
+	if err := newCA.UpdateMMD(); err != nil {
+		t.Fatalf("failed to update mmd: %v", err)
+	}
+	if err := newCA.DoRevocationTransparencyTasks(revType); err != nil {
+		t.Fatalf("failed to do revocation transparency tasks: %v", err)
+	}
+	der, err = newCA.GetCRL(revType, false)
+	if err != nil {
+		t.Fatalf("failed to get CRL: %v", err)
+	}
+	secondCRL := mustParseCRL(t, newCA, der)
+	if secondCRL.TBSCertList.CRLNumber <= firstCRL.TBSCertList.CRLNumber {
+		t.Fatalf("CRL number (%v) did not increase past (%v)", secondCRL.TBSCertList.CRLNumber, firstCRL.TBSCertList.CRLNumber)
+	}
+	reasons = crlReasons(secondCRL)
+	if _, ok := reasons[issued[2].Record.Serial]; len(reasons) != 2 || reasons[issued[0].Record.Serial] != x509.KeyCompromise || !ok {
+		t.Fatalf("unexpected CRL entries: %v", reasons)
+	}
+	for _, revoked := range secondCRL.TBSCertList.RevokedCertificates {
+		if ctca.SerialString(revoked.SerialNumber) == issued[0].Record.Serial && !revoked.RevocationTime.Equal(thisUpdate) {
+			t.Fatalf("revocation time (%v) of an earlier revocation changed from (%v)", revoked.RevocationTime, thisUpdate)
+		}
+	}
+
+	der, err = newCA.GetCRL(revType, true)
+	if err != nil {
+		t.Fatalf("failed to get delta CRL: %v", err)
+	}
+	deltaCRL := mustParseCRL(t, newCA, der)
+	if deltaCRL.TBSCertList.BaseCRLNumber != firstCRL.TBSCertList.CRLNumber || deltaCRL.TBSCertList.CRLNumber != secondCRL.TBSCertList.CRLNumber {
+		t.Fatalf("delta CRL has number (%v) and base (%v)", deltaCRL.TBSCertList.CRLNumber, deltaCRL.TBSCertList.BaseCRLNumber)
+	}
+	reasons = crlReasons(deltaCRL)
+	if _, ok := reasons[issued[2].Record.Serial]; len(reasons) != 2 || reasons[issued[1].Record.Serial] != x509.RemoveFromCRL || !ok {
+		t.Fatalf("unexpected delta CRL entries: %v", reasons)
+	}
+}
+
+func TestCRLFailureDoesNotBlockMMD(t *testing.T) {
+	storage := NewMemoryStorage()
+	newCA := mustGetCAWithStorage(t, storage)
+	if err := storage.Put(crlBucket, revType + fullCRLSuffix, []byte("not a CRL")); err != nil {
+		t.Fatalf("failed to store CRL: %v", err)
+	}
+	if err := newCA.AddRevocations(revType, []ctca.Revocation{{RevocationNum: 1, Reason: ctca.KeyCompromise}}); err != nil {
+		t.Fatalf("failed to add revocations: %v", err)
+	}
+
+	// The SRD of the MMD is produced even though its CRLs cannot be published
+	mustDoMMD(t, newCA)
+	if _, err := newCA.GetCASRD(revType, newCA.PreviousMMDTimestamp); err != nil {
+		t.Fatalf("failed to get SRD: %v", err)
+	}
+	if len(newCA.DeltaRevocations[revType]) != 0 {
+		t.Fatalf("revocations are still pending after the MMD")
+	}
+}
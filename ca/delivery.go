@@ -0,0 +1,402 @@
+package ca
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"encoding/json"
+	"errors"
+
+	"github.com/golang/glog"
+
+	mtr "github.com/n-ct/ct-monitor"
+	"github.com/n-ct/ct-monitor/entitylist"
+	"github.com/n-ct/ct-monitor/signature"
+	"github.com/n-ct/ct-monitor/utils"
+	ctca "github.com/n-ct/ct-certificate-authority"
+	"github.com/n-ct/ct-certificate-authority/clock"
+)
+
+// SRDs of the CA stay in this bucket until their log accepted them
+const srdOutboxBucket = "srd_outbox"
+
+// Defaults of DeliveryConfig
+const (
+	defaultDeliveryTimeout = 10 * time.Second
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff = 10 * time.Minute
+)
+
+// Configures how the SRDs of the CA are delivered to its logs
+type DeliveryConfig struct {
+	Timeout uint64 `json:"timeout"`	// Seconds a log has to accept an SRD. Defaults to 10
+	InitialBackoff uint64 `json:"initial_backoff"`	// Seconds before the first retry of a failed delivery, doubled after every failure. Defaults to 1
+	MaxBackoff uint64 `json:"max_backoff"`	// Longest wait between retries in seconds. Defaults to 600
+}
+
+// Deliverer posts every SRD of the CA to every log in LogInfoMap. Each log has its own worker, so a slow or failing
+// log does not hold up the others. An SRD is written to the outbox in storage together with the logs it is pending
+// for before it is sent, and a log is removed from it once it accepted the SRD, so deliveries resume after a restart.
+// A failed delivery is retried after a backoff that doubles with every failure, and the SRDs of a log are delivered
+// in the order they were produced
+type Deliverer struct {
+	Logs map[string] *entitylist.LogInfo
+	Timeout time.Duration
+	InitialBackoff time.Duration
+	MaxBackoff time.Duration
+	storage Storage
+	clock clock.Clock
+	client *http.Client
+	queues map[string] *logDeliveries	// Deliveries of each log of Logs
+	outbox map[string] *srdOutboxEntry	// Entries of the outbox by their key
+	cancel context.CancelFunc	// Cancels the context of the workers while they run
+	workers sync.WaitGroup
+	sync.Mutex	// Guards queues, outbox and cancel
+}
+
+// An SRD in the outbox and the logs it is still pending for. It is stored as a single record, so an SRD is either
+// queued for all of its logs or for none of them
+type srdOutboxEntry struct {
+	SRD *mtr.SRDWithRevData
+	Deliveries map[string] *srdDelivery	// By log ID
+}
+
+// An SRD waiting in the outbox of a log
+type srdDelivery struct {
+	LogID string
+	SRD *mtr.SRDWithRevData `json:"-"`	// Stored once in the outbox entry
+	Attempts int	// Failed attempts so far
+	NextAttempt time.Time	// Zero until the first failure
+	LastError string
+	entry *srdOutboxEntry
+}
+
+// The outbox of a log and what it delivered since the CA started
+type logDeliveries struct {
+	pending []*srdDelivery	// In the order the SRDs were produced
+	delivered uint64
+	lastDelivered *srdDelivery
+	wake chan struct{}	// Signalled when an SRD is added to an empty outbox
+}
+
+// Create the Deliverer of the CA and load the outbox it left in storage
+func createDeliverer(caConfig *CAConfig, storage Storage, logs map[string] *entitylist.LogInfo, clk clock.Clock) (*Deliverer, error) {
+	d := &Deliverer{
+		Logs: logs,
+		Timeout: durationOrDefault(caConfig.Delivery.Timeout, defaultDeliveryTimeout),
+		InitialBackoff: durationOrDefault(caConfig.Delivery.InitialBackoff, defaultInitialBackoff),
+		MaxBackoff: durationOrDefault(caConfig.Delivery.MaxBackoff, defaultMaxBackoff),
+		storage: storage,
+		clock: clk,
+		queues: make(map[string] *logDeliveries),
+		outbox: make(map[string] *srdOutboxEntry),
+	}
+	d.client = &http.Client{Timeout: d.Timeout}
+	for logID := range logs {
+		d.queues[logID] = &logDeliveries{wake: make(chan struct{}, 1)}
+	}
+	if err := d.loadOutbox(); err != nil {
+		return nil, fmt.Errorf("failed to create deliverer: %w", err)
+	}
+	return d, nil
+}
+
+// Get seconds as a duration, or def when seconds is zero
+func durationOrDefault(seconds uint64, def time.Duration) time.Duration {
+	if seconds == 0 {
+		return def
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func srdOutboxKey(revType string, timestamp uint64) string {
+	return fmt.Sprintf("%s/%020d", revType, timestamp)
+}
+
+// Load the deliveries left in the outbox
+func (d *Deliverer) loadOutbox() error {
+	keys, err := d.storage.Keys(srdOutboxBucket)
+	if err != nil {
+		return fmt.Errorf("failed to list srd outbox: %w", err)
+	}
+	for _, key := range keys {
+		value, err := d.storage.Get(srdOutboxBucket, key)
+		if err != nil {
+			return fmt.Errorf("failed to load srd delivery (%v): %w", key, err)
+		}
+		var entry srdOutboxEntry
+		if err := json.Unmarshal(value, &entry); err != nil {
+			return fmt.Errorf("failed to unmarshal srd delivery (%v): %w", key, err)
+		}
+		d.outbox[key] = &entry
+		for logID, delivery := range entry.Deliveries {
+			queue, ok := d.queues[logID]
+			if !ok {
+				glog.Warningf("keeping srd delivery (%v) of log (%v) that is no longer configured", key, logID)
+				continue
+			}
+			delivery.LogID = logID
+			delivery.SRD = entry.SRD
+			delivery.entry = &entry
+			queue.pending = append(queue.pending, delivery)
+		}
+	}
+	for _, queue := range d.queues {
+		sort.SliceStable(queue.pending, func(i, j int) bool {
+			return queue.pending[i].SRD.RevData.Timestamp < queue.pending[j].SRD.RevData.Timestamp
+		})
+	}
+	return nil
+}
+
+// Persist an entry of the outbox, or remove it once it is no longer pending for any log
+func (d *Deliverer) saveEntry(entry *srdOutboxEntry) error {
+	key := srdOutboxKey(entry.SRD.RevData.RevocationType, entry.SRD.RevData.Timestamp)
+	if len(entry.Deliveries) == 0 {
+		if err := d.storage.Delete(srdOutboxBucket, key); err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("failed to remove srd delivery (%v): %w", key, err)
+		}
+		delete(d.outbox, key)
+		return nil
+	}
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal srd delivery: %w", err)
+	}
+	if err := d.storage.Put(srdOutboxBucket, key, value); err != nil {
+		return fmt.Errorf("failed to store srd delivery (%v): %w", key, err)
+	}
+	d.outbox[key] = entry
+	return nil
+}
+
+// Add srd to the outbox of every log. Once this returns the SRD is delivered even if the CA restarts first.
+// The SRD is written for all logs at once, so an error leaves it queued for none of them.
+// An SRD that is still in the outbox is not queued again
+func (d *Deliverer) Enqueue(srd *mtr.SRDWithRevData) error {
+	d.Lock()
+	defer d.Unlock()
+	if _, ok := d.outbox[srdOutboxKey(srd.RevData.RevocationType, srd.RevData.Timestamp)]; ok || len(d.queues) == 0 {
+		return nil
+	}
+	entry := &srdOutboxEntry{SRD: srd, Deliveries: make(map[string] *srdDelivery)}
+	for logID := range d.queues {
+		entry.Deliveries[logID] = &srdDelivery{LogID: logID, SRD: srd, entry: entry}
+	}
+	if err := d.saveEntry(entry); err != nil {
+		return fmt.Errorf("failed to queue SRD: %w", err)
+	}
+	for logID, delivery := range entry.Deliveries {
+		queue := d.queues[logID]
+		queue.pending = append(queue.pending, delivery)
+		select {
+		case queue.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Start a worker for every log that delivers its outbox until Stop is called
+func (d *Deliverer) Start() {
+	d.Lock()
+	defer d.Unlock()
+	if d.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	for logID := range d.queues {
+		d.workers.Add(1)
+		go d.run(ctx, logID)
+	}
+}
+
+// Stop the workers and make a last attempt to deliver the outbox of every log, ignoring backoffs, until ctx is done.
+// Posts still in flight when ctx is done are cancelled. Deliveries that still fail stay in the outbox for the next
+// start. Returns an error if any remain
+func (d *Deliverer) Stop(ctx context.Context) error {
+	d.Lock()
+	if d.cancel != nil {
+		d.cancel()
+		d.cancel = nil
+	}
+	d.Unlock()
+	d.workers.Wait()
+
+	var wg sync.WaitGroup
+	for logID := range d.queues {
+		wg.Add(1)
+		go func(logID string) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				delivery := d.head(logID)
+				if delivery == nil || d.attempt(ctx, delivery) != nil {
+					return
+				}
+			}
+		}(logID)
+	}
+	wg.Wait()
+	remaining := 0
+	for _, state := range d.State() {
+		remaining += state.Pending
+	}
+	if remaining > 0 {
+		return fmt.Errorf("%v SRD deliveries remain in the outbox", remaining)
+	}
+	return nil
+}
+
+// Deliver the outbox of a log until ctx is cancelled
+func (d *Deliverer) run(ctx context.Context, logID string) {
+	defer d.workers.Done()
+	wake := d.queues[logID].wake
+	for ctx.Err() == nil {
+		delivery := d.head(logID)
+		if delivery == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-wake:
+			}
+			continue
+		}
+		if wait := delivery.NextAttempt.Sub(d.clock.Now()); !delivery.NextAttempt.IsZero() && wait > 0 {
+			timer := d.clock.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C():
+			}
+		}
+		if err := d.attempt(ctx, delivery); err != nil {
+			glog.Warningf("failed to deliver SRD of revType (%v) at (%v) to log (%v), attempt %v: %v", delivery.SRD.RevData.RevocationType, delivery.SRD.RevData.Timestamp, logID, delivery.Attempts, err)
+		}
+	}
+}
+
+// Get the oldest delivery in the outbox of a log, or nil if it is empty
+func (d *Deliverer) head(logID string) *srdDelivery {
+	d.Lock()
+	defer d.Unlock()
+	queue := d.queues[logID]
+	if len(queue.pending) == 0 {
+		return nil
+	}
+	return queue.pending[0]
+}
+
+// Post a delivery to its log once. It leaves the outbox when the log accepted it, and is otherwise scheduled for a retry.
+// A post cancelled with ctx is not counted as a failed attempt
+func (d *Deliverer) attempt(ctx context.Context, delivery *srdDelivery) error {
+	postErr := d.post(ctx, d.Logs[delivery.LogID], delivery.SRD)
+	d.Lock()
+	defer d.Unlock()
+	queue := d.queues[delivery.LogID]
+	if postErr != nil && ctx.Err() != nil {
+		return postErr
+	}
+	if postErr != nil {
+		delivery.Attempts++
+		delivery.NextAttempt = d.clock.Now().Add(d.backoff(delivery.Attempts))
+		delivery.LastError = postErr.Error()
+		if err := d.saveEntry(delivery.entry); err != nil {
+			glog.Errorf("failed to save failed delivery: %v", err)
+		}
+		return postErr
+	}
+	delete(delivery.entry.Deliveries, delivery.LogID)
+	if err := d.saveEntry(delivery.entry); err != nil {
+		// The log gets the SRD again after a restart, which it has to accept anyway after a lost response
+		glog.Errorf("failed to remove delivered SRD from the outbox of log (%v): %v", delivery.LogID, err)
+	}
+	queue.pending = queue.pending[1:]
+	queue.delivered++
+	queue.lastDelivered = delivery
+	return nil
+}
+
+// Get the wait before the retry that follows the given number of failed attempts
+func (d *Deliverer) backoff(attempts int) time.Duration {
+	backoff := d.InitialBackoff
+	for i := 1; i < attempts && backoff < d.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > d.MaxBackoff {
+		backoff = d.MaxBackoff
+	}
+	return backoff
+}
+
+// Post srd to the post-ca-srd endpoint of a log within ctx. Any status but 200 OK is a failure
+func (d *Deliverer) post(ctx context.Context, logInfo *entitylist.LogInfo, srd *mtr.SRDWithRevData) error {
+	if logInfo == nil {
+		return fmt.Errorf("log is not configured")
+	}
+	jsonBytes, err := signature.SerializeData(*srd)
+	if err != nil {
+		return fmt.Errorf("failed to marshal SRDWithRevData: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, utils.CreateRequestURL(logInfo.URL, ctca.PostCASRDPath), bytes.NewBuffer(jsonBytes))
+	if err != nil {
+		return fmt.Errorf("failed to create post-ca-srd request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post SRD: %w", err)
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused, keeping the start of it for the error
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("post-ca-srd returned status (%v): %s", resp.StatusCode, body)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read post-ca-srd response: %w", err)
+	}
+	return nil
+}
+
+// Report the delivery state of every log, in the order of the log IDs
+func (d *Deliverer) State() []ctca.LogDeliveryState {
+	d.Lock()
+	defer d.Unlock()
+	states := []ctca.LogDeliveryState{}
+	for logID, queue := range d.queues {
+		state := ctca.LogDeliveryState{
+			LogID: logID,
+			Pending: len(queue.pending),
+			Delivered: queue.delivered,
+		}
+		if logInfo, ok := d.Logs[logID]; ok {
+			state.URL = logInfo.URL
+		}
+		if queue.lastDelivered != nil {
+			state.LastDeliveredRevocationType = queue.lastDelivered.SRD.RevData.RevocationType
+			state.LastDeliveredTimestamp = queue.lastDelivered.SRD.RevData.Timestamp
+		}
+		if len(queue.pending) > 0 {
+			oldest := queue.pending[0]
+			state.Attempts = oldest.Attempts
+			state.LastError = oldest.LastError
+			if !oldest.NextAttempt.IsZero() {
+				state.NextAttempt = uint64(oldest.NextAttempt.Unix())
+			}
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].LogID < states[j].LogID })
+	return states
+}
@@ -0,0 +1,277 @@
+package ca
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	mtr "github.com/n-ct/ct-monitor"
+	"github.com/n-ct/ct-monitor/entitylist"
+	ctca "github.com/n-ct/ct-certificate-authority"
+	"github.com/n-ct/ct-certificate-authority/clock"
+)
+
+// A log that rejects the first failures SRDs posted to it and sends every SRD it accepts to received
+type srdLog struct {
+	failures int
+	received chan *mtr.SRDWithRevData
+	server *httptest.Server
+	sync.Mutex
+}
+
+func newSRDLog(t *testing.T, failures int) *srdLog {
+	t.Helper()
+	log := &srdLog{failures: failures, received: make(chan *mtr.SRDWithRevData, 100)}
+	mux := http.NewServeMux()
+	mux.HandleFunc(ctca.PostCASRDPath, log.postCASRD)
+	log.server = httptest.NewServer(mux)
+	t.Cleanup(log.server.Close)
+	return log
+}
+
+func (l *srdLog) postCASRD(rw http.ResponseWriter, req *http.Request) {
+	l.Lock()
+	defer l.Unlock()
+	if l.failures > 0 {
+		l.failures--
+		http.Error(rw, "log is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	var srd mtr.SRDWithRevData
+	if err := json.NewDecoder(req.Body).Decode(&srd); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l.received <- &srd
+}
+
+// A MemoryStorage that fails to write to the buckets in failing
+type failingStorage struct {
+	*MemoryStorage
+	failing map[string] bool
+}
+
+func (f *failingStorage) Put(bucket string, key string, value []byte) error {
+	if f.failing[bucket] {
+		return fmt.Errorf("bucket (%v) is not writable", bucket)
+	}
+	return f.MemoryStorage.Put(bucket, key, value)
+}
+
+// Create a Deliverer for the logs over storage
+func mustCreateDeliverer(t *testing.T, storage Storage, clk clock.Clock, logs map[string] *srdLog) *Deliverer {
+	t.Helper()
+	logInfoMap := make(map[string] *entitylist.LogInfo)
+	for logID, log := range logs {
+		logInfoMap[logID] = &entitylist.LogInfo{LogID: logID, URL: log.server.URL + "/"}
+	}
+	d, err := createDeliverer(&CAConfig{}, storage, logInfoMap, clk)
+	if err != nil {
+		t.Fatalf("failed to create deliverer: %v", err)
+	}
+	return d
+}
+
+// Wait until the state of logID satisfies done
+func mustWaitForDeliveryState(t *testing.T, d *Deliverer, logID string, done func(ctca.LogDeliveryState) bool) ctca.LogDeliveryState {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, state := range d.State() {
+			if state.LogID == logID && done(state) {
+				return state
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("delivery state of (%v) did not settle: %+v", logID, d.State())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDelivererRetriesWithBackoff(t *testing.T) {
+	newCA := mustGetCAWithStorage(t, NewMemoryStorage())
+	srd, err := mustGetSRDWithRevData(t, newCA, 1600000000)
+	if err != nil {
+		t.Fatalf("failed to create SRD: %v", err)
+	}
+	fake := clock.NewFake(time.Unix(1600000000, 0))
+	storage := NewMemoryStorage()
+	flaky, healthy := newSRDLog(t, 2), newSRDLog(t, 0)
+	d := mustCreateDeliverer(t, storage, fake, map[string] *srdLog{"flaky": flaky, "healthy": healthy})
+	d.Start()
+	if err := d.Enqueue(srd); err != nil {
+		t.Fatalf("failed to enqueue SRD: %v", err)
+	}
+
+	// The healthy log is not held up by the failing one
+	if received := <-healthy.received; received.RevData.Timestamp != srd.RevData.Timestamp {
+		t.Fatalf("healthy log received SRD at (%v)", received.RevData.Timestamp)
+	}
+	mustWaitForDeliveryState(t, d, "healthy", func(state ctca.LogDeliveryState) bool { return state.Delivered == 1 })
+
+	// The backoff doubles after every failure
+	for attempts, backoff := range []time.Duration{time.Second, 2 * time.Second} {
+		state := mustWaitForDeliveryState(t, d, "flaky", func(state ctca.LogDeliveryState) bool { return state.Attempts == attempts + 1 })
+		if state.Pending != 1 || state.LastError == "" || state.NextAttempt != uint64(fake.Now().Add(backoff).Unix()) {
+			t.Fatalf("unexpected delivery state after %v failures (%+v)", attempts + 1, state)
+		}
+		if keys, err := storage.Keys(srdOutboxBucket); err != nil || len(keys) != 1 {
+			t.Fatalf("outbox holds (%v): %v", keys, err)
+		}
+		fake.BlockUntil(1)
+		fake.Advance(backoff)
+	}
+	<-flaky.received
+	state := mustWaitForDeliveryState(t, d, "flaky", func(state ctca.LogDeliveryState) bool { return state.Delivered == 1 })
+	if state.Pending != 0 || state.LastDeliveredRevocationType != srd.RevData.RevocationType || state.LastDeliveredTimestamp != srd.RevData.Timestamp {
+		t.Fatalf("unexpected delivery state after delivery (%+v)", state)
+	}
+	if keys, err := storage.Keys(srdOutboxBucket); err != nil || len(keys) != 0 {
+		t.Fatalf("outbox still holds (%v): %v", keys, err)
+	}
+	if err := d.Stop(context.Background()); err != nil {
+		t.Fatalf("failed to stop deliverer: %v", err)
+	}
+	if backoff := d.backoff(20); backoff != d.MaxBackoff {
+		t.Fatalf("backoff (%v) is not capped at (%v)", backoff, d.MaxBackoff)
+	}
+}
+
+func TestDelivererResumesOutboxAfterRestart(t *testing.T) {
+	newCA := mustGetCAWithStorage(t, NewMemoryStorage())
+	storage := NewMemoryStorage()
+	down := newSRDLog(t, 100)
+	d := mustCreateDeliverer(t, storage, clock.New(), map[string] *srdLog{"log": down})
+	for _, timestamp := range []uint64{1600000001, 1600000002} {
+		srd, err := mustGetSRDWithRevData(t, newCA, timestamp)
+		if err != nil {
+			t.Fatalf("failed to create SRD: %v", err)
+		}
+		if err := d.Enqueue(srd); err != nil {
+			t.Fatalf("failed to enqueue SRD: %v", err)
+		}
+	}
+	if err := d.Stop(context.Background()); err == nil {
+		t.Fatalf("expected undelivered SRDs to be reported")
+	}
+
+	// The outbox and its failed attempts are loaded, and delivered in order once the log is back
+	up := newSRDLog(t, 0)
+	restarted := mustCreateDeliverer(t, storage, clock.New(), map[string] *srdLog{"log": up})
+	if state := restarted.State(); len(state) != 1 || state[0].Pending != 2 || state[0].Attempts != 1 {
+		t.Fatalf("unexpected state of the loaded outbox (%+v)", state)
+	}
+	if err := restarted.Stop(context.Background()); err != nil {
+		t.Fatalf("failed to flush outbox: %v", err)
+	}
+	for _, timestamp := range []uint64{1600000001, 1600000002} {
+		if received := <-up.received; received.RevData.Timestamp != timestamp {
+			t.Fatalf("log received SRD at (%v) instead of (%v)", received.RevData.Timestamp, timestamp)
+		}
+	}
+}
+
+func TestDelivererEnqueuesForAllLogsOrNone(t *testing.T) {
+	newCA := mustGetCAWithStorage(t, NewMemoryStorage())
+	srd, err := mustGetSRDWithRevData(t, newCA, 1600000000)
+	if err != nil {
+		t.Fatalf("failed to create SRD: %v", err)
+	}
+	storage := &failingStorage{NewMemoryStorage(), map[string] bool{srdOutboxBucket: true}}
+	logs := map[string] *srdLog{"a": newSRDLog(t, 0), "b": newSRDLog(t, 0), "c": newSRDLog(t, 0)}
+	d := mustCreateDeliverer(t, storage, clock.New(), logs)
+	if err := d.Enqueue(srd); err == nil {
+		t.Fatalf("expected enqueue to fail")
+	}
+	for _, state := range d.State() {
+		if state.Pending != 0 {
+			t.Fatalf("failed enqueue left SRD queued (%+v)", d.State())
+		}
+	}
+
+	// Once the outbox is writable the SRD is stored once for all logs
+	storage.failing[srdOutboxBucket] = false
+	if err := d.Enqueue(srd); err != nil {
+		t.Fatalf("failed to enqueue SRD: %v", err)
+	}
+	if keys, err := storage.Keys(srdOutboxBucket); err != nil || len(keys) != 1 {
+		t.Fatalf("outbox holds (%v): %v", keys, err)
+	}
+	restarted := mustCreateDeliverer(t, storage, clock.New(), logs)
+	for _, state := range restarted.State() {
+		if state.Pending != 1 {
+			t.Fatalf("SRD is not queued for every log after a restart (%+v)", restarted.State())
+		}
+	}
+}
+
+func TestDelivererStopKeepsToDeadline(t *testing.T) {
+	newCA := mustGetCAWithStorage(t, NewMemoryStorage())
+	srd, err := mustGetSRDWithRevData(t, newCA, 1600000000)
+	if err != nil {
+		t.Fatalf("failed to create SRD: %v", err)
+	}
+	// A log that never answers
+	posted, release := make(chan struct{}, 10), make(chan struct{})
+	hanging := &srdLog{server: httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		posted <- struct{}{}
+		<-release
+	}))}
+	defer hanging.server.Close()
+	defer close(release)
+	d := mustCreateDeliverer(t, NewMemoryStorage(), clock.New(), map[string] *srdLog{"hanging": hanging})
+	d.Start()
+	if err := d.Enqueue(srd); err != nil {
+		t.Fatalf("failed to enqueue SRD: %v", err)
+	}
+	<-posted
+
+	// Both the post of the worker and the last attempt of Stop are cancelled at the deadline, well before the timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := d.Stop(ctx); err == nil {
+		t.Fatalf("expected undelivered SRD to be reported")
+	}
+	if elapsed := time.Since(start); elapsed > d.Timeout / 2 {
+		t.Fatalf("stop took (%v) with a deadline of 100ms", elapsed)
+	}
+	if state := d.State(); len(state) != 1 || state[0].Pending != 1 || state[0].Attempts != 0 {
+		t.Fatalf("cancelled posts changed the delivery state (%+v)", state)
+	}
+}
+
+func TestPostCASRD(t *testing.T) {
+	newCA := mustGetCAWithStorage(t, NewMemoryStorage())
+	log := newSRDLog(t, 0)
+	newCA.Deliverer = mustCreateDeliverer(t, newCA.Storage, newCA.Clock, map[string] *srdLog{"log": log})
+
+	// Every SRD produced at an MMD is queued for the logs
+	mustDoMMD(t, newCA)
+	if state := newCA.Deliverer.State(); state[0].Pending != 1 {
+		t.Fatalf("SRD of the MMD was not queued (%+v)", state)
+	}
+	srd, err := newCA.GetCASRD(revType, newCA.PreviousMMDTimestamp)
+	if err != nil {
+		t.Fatalf("failed to get SRD: %v", err)
+	}
+	// Posting an SRD that is still queued does not deliver it twice
+	if err := newCA.PostCASRD(srd); err != nil {
+		t.Fatalf("failed to post SRD: %v", err)
+	}
+	if state := newCA.Deliverer.State(); state[0].Pending != 1 {
+		t.Fatalf("SRD was queued twice (%+v)", state)
+	}
+	if err := newCA.Deliverer.Stop(context.Background()); err != nil {
+		t.Fatalf("failed to deliver SRDs: %v", err)
+	}
+	if received := <-log.received; received.RevData.Timestamp != srd.RevData.Timestamp {
+		t.Fatalf("log received SRD at (%v)", received.RevData.Timestamp)
+	}
+}
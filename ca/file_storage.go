@@ -0,0 +1,237 @@
+package ca
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"strings"
+	"net/url"
+	"io/ioutil"
+	"path/filepath"
+	"hash/crc32"
+	"encoding/binary"
+
+	"github.com/golang/glog"
+)
+
+const (
+	tmpFilePrefix = ".tmp-"
+	journalDir = "journals"
+	journalHeaderSize = 8	// 4 byte record length followed by 4 byte crc32 of the record
+)
+
+// FileStorage persists the state of the CA on the local filesystem.
+// Every bucket is a directory and every key is a file within that directory.
+// Values are written to a temporary file first and then renamed so a crash never leaves a partial value behind.
+// Journals are files of length and checksum prefixed records that are synced after every append
+type FileStorage struct {
+	dir string
+	journalLock sync.Mutex	// Serializes journal appends and truncations
+}
+
+// Create a FileStorage rooted at dir. The directory is created if it does not exist
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create storage dir (%v): %w", dir, err)
+	}
+	return &FileStorage{dir: dir}, nil
+}
+
+// Store value under the given bucket and key
+func (f *FileStorage) Put(bucket string, key string, value []byte) error {
+	bucketDir := f.bucketDir(bucket)
+	if err := os.MkdirAll(bucketDir, 0700); err != nil {
+		return fmt.Errorf("failed to create bucket dir (%v): %w", bucketDir, err)
+	}
+	tmpFile, err := ioutil.TempFile(bucketDir, tmpFilePrefix)
+	if err != nil {
+		return fmt.Errorf("failed to create temp file in (%v): %w", bucketDir, err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(value); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write temp file (%v): %w", tmpFile.Name(), err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to sync temp file (%v): %w", tmpFile.Name(), err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file (%v): %w", tmpFile.Name(), err)
+	}
+	if err := os.Rename(tmpFile.Name(), f.keyPath(bucket, key)); err != nil {
+		return fmt.Errorf("failed to rename temp file to key (%v): %w", key, err)
+	}
+	return syncDir(bucketDir)
+}
+
+// Get the value stored under the given bucket and key
+func (f *FileStorage) Get(bucket string, key string) ([]byte, error) {
+	value, err := ioutil.ReadFile(f.keyPath(bucket, key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key (%v) of bucket (%v): %w", key, bucket, err)
+	}
+	return value, nil
+}
+
+// Delete the value stored under the given bucket and key
+func (f *FileStorage) Delete(bucket string, key string) error {
+	err := os.Remove(f.keyPath(bucket, key))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete key (%v) of bucket (%v): %w", key, bucket, err)
+	}
+	return nil
+}
+
+// Get the sorted keys of a bucket
+func (f *FileStorage) Keys(bucket string) ([]string, error) {
+	keys := []string{}
+	files, err := ioutil.ReadDir(f.bucketDir(bucket))
+	if os.IsNotExist(err) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bucket (%v): %w", bucket, err)
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), tmpFilePrefix) {
+			continue
+		}
+		key, err := url.PathUnescape(file.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to unescape key file (%v): %w", file.Name(), err)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Append record to the end of journal and sync it to disk
+func (f *FileStorage) AppendJournal(journal string, record []byte) error {
+	f.journalLock.Lock()
+	defer f.journalLock.Unlock()
+	dir := filepath.Join(f.dir, journalDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create journal dir: %w", err)
+	}
+	_, err := os.Stat(f.journalPath(journal))
+	created := os.IsNotExist(err)
+	file, err := os.OpenFile(f.journalPath(journal), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open journal (%v): %w", journal, err)
+	}
+	defer file.Close()
+
+	entry := make([]byte, journalHeaderSize + len(record))
+	binary.BigEndian.PutUint32(entry[0:4], uint32(len(record)))
+	binary.BigEndian.PutUint32(entry[4:8], crc32.ChecksumIEEE(record))
+	copy(entry[journalHeaderSize:], record)
+	if _, err := file.Write(entry); err != nil {
+		return fmt.Errorf("failed to append to journal (%v): %w", journal, err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal (%v): %w", journal, err)
+	}
+	// A new journal file is only durable once its directory entry is
+	if created {
+		return syncDir(dir)
+	}
+	return nil
+}
+
+// Get every record of journal. A partially written record at the end of the journal,
+// left behind by a crash during an append, is discarded and cut from the file
+func (f *FileStorage) ReadJournal(journal string) ([][]byte, error) {
+	f.journalLock.Lock()
+	defer f.journalLock.Unlock()
+	records := [][]byte{}
+	data, err := ioutil.ReadFile(f.journalPath(journal))
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal (%v): %w", journal, err)
+	}
+
+	offset := 0
+	for offset < len(data) {
+		record, err := readJournalRecord(data[offset:])
+		if err != nil {
+			glog.Warningf("discarding torn tail of journal (%v) at offset (%v): %v", journal, offset, err)
+			if err := os.Truncate(f.journalPath(journal), int64(offset)); err != nil {
+				return nil, fmt.Errorf("failed to cut torn tail of journal (%v): %w", journal, err)
+			}
+			break
+		}
+		records = append(records, record)
+		offset += journalHeaderSize + len(record)
+	}
+	return records, nil
+}
+
+// Remove every record of journal
+func (f *FileStorage) TruncateJournal(journal string) error {
+	f.journalLock.Lock()
+	defer f.journalLock.Unlock()
+	err := os.Remove(f.journalPath(journal))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to truncate journal (%v): %w", journal, err)
+	}
+	return syncDir(filepath.Join(f.dir, journalDir))
+}
+
+// Every write is already synced, so there is nothing to flush
+func (f *FileStorage) Close() error {
+	return nil
+}
+
+func (f *FileStorage) journalPath(journal string) string {
+	return filepath.Join(f.dir, journalDir, url.PathEscape(journal))
+}
+
+// Parse the record at the start of data
+func readJournalRecord(data []byte) ([]byte, error) {
+	if len(data) < journalHeaderSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	length := int(binary.BigEndian.Uint32(data[0:4]))
+	checksum := binary.BigEndian.Uint32(data[4:8])
+	if len(data) < journalHeaderSize + length {
+		return nil, io.ErrUnexpectedEOF
+	}
+	record := data[journalHeaderSize:journalHeaderSize + length]
+	if crc32.ChecksumIEEE(record) != checksum {
+		return nil, fmt.Errorf("journal record checksum mismatch")
+	}
+	return append([]byte{}, record...), nil
+}
+
+func (f *FileStorage) bucketDir(bucket string) string {
+	return filepath.Join(f.dir, url.PathEscape(bucket))
+}
+
+func (f *FileStorage) keyPath(bucket string, key string) string {
+	return filepath.Join(f.bucketDir(bucket), url.PathEscape(key))
+}
+
+// Sync a directory so that renames and new files within it are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open dir (%v) for sync: %w", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync dir (%v): %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package ca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/certificate-transparency-go/x509/pkix"
+	"github.com/n-ct/ct-certificate-authority/extension"
+	ctca "github.com/n-ct/ct-certificate-authority"
+)
+
+const (
+	issuedCertificateBucket = "issued_certificates"
+	issuerCertificateKey = "issuer_certificate"
+	defaultIssuerValidity = 90 * 24 * time.Hour
+	selfSignedIssuerValidity = 10 * 365 * 24 * time.Hour
+)
+
+// Returned for CSRs whose signature does not verify with the public key they carry
+var ErrInvalidCertificateRequest = errors.New("invalid certificate request")
+
+// Value of the critical CT poison extension that marks a precertificate, an ASN.1 NULL
+var poisonExtensionValue = []byte{0x05, 0x00}
+
+// Configures the key and certificate the CA issues certificates with
+type IssuerConfig struct {
+	PrivKey string `json:"priv_key"`	// Base64 DER EC private key. Defaults to the priv_key of the CA
+	Certificate string `json:"certificate"`	// PEM or base64 DER certificate of PrivKey. A self-signed certificate is created when empty
+	Validity uint64 `json:"validity"`	// Lifetime of issued certificates in seconds. Defaults to 90 days
+	MinSCTs int `json:"min_scts"`	// SCTs a precertificate needs before its certificate is signed. Defaults to one from every log of the CA
+}
+
+// Issuer signs the precertificates and certificates of the CA
+type Issuer struct {
+	Certificate *x509.Certificate
+	Key crypto.Signer
+	Validity time.Duration
+	MinSCTs int	// Zero requires an SCT from every log in the LogInfoMap of the CA
+}
+
+// Create the Issuer described by the CA config. A self-signed issuer certificate is created once and kept in storage
+func createIssuer(caConfig *CAConfig, storage Storage) (*Issuer, error) {
+	issuerConfig := caConfig.Issuer
+	strPrivKey := issuerConfig.PrivKey
+	if strPrivKey == "" {
+		strPrivKey = caConfig.StrPrivKey
+	}
+	derPrivKey, err := base64.StdEncoding.DecodeString(strPrivKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode issuer private key: %w", err)
+	}
+	key, err := x509.ParseECPrivateKey(derPrivKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse issuer private key: %w", err)
+	}
+	validity := defaultIssuerValidity
+	if issuerConfig.Validity != 0 {
+		validity = time.Duration(issuerConfig.Validity) * time.Second
+	}
+	if issuerConfig.MinSCTs < 0 {
+		return nil, fmt.Errorf("invalid min_scts (%v)", issuerConfig.MinSCTs)
+	}
+	issuer := &Issuer{Key: key, Validity: validity, MinSCTs: issuerConfig.MinSCTs}
+
+	if issuerConfig.Certificate != "" {
+		issuer.Certificate, err = ctca.DecodeCertificate(issuerConfig.Certificate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode issuer certificate: %w", err)
+		}
+		if !issuer.matchesKey(issuer.Certificate) {
+			return nil, errors.New("issuer certificate does not belong to the issuer private key")
+		}
+		return issuer, nil
+	}
+	stored, err := storage.Get(metaBucket, issuerCertificateKey)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("failed to load issuer certificate: %w", err)
+	}
+	if err == nil {
+		cert, err := x509.ParseCertificate(stored)
+		if x509.IsFatal(err) {
+			return nil, fmt.Errorf("failed to parse stored issuer certificate: %w", err)
+		}
+		// A stored certificate of a replaced key is replaced along with it
+		if issuer.matchesKey(cert) {
+			issuer.Certificate = cert
+			return issuer, nil
+		}
+	}
+	issuer.Certificate, err = issuer.createSelfSignedCertificate(caConfig.CAID)
+	if err != nil {
+		return nil, err
+	}
+	if err := storage.Put(metaBucket, issuerCertificateKey, issuer.Certificate.Raw); err != nil {
+		return nil, fmt.Errorf("failed to store issuer certificate: %w", err)
+	}
+	return issuer, nil
+}
+
+// Check whether cert holds the public key of the issuer
+func (i *Issuer) matchesKey(cert *x509.Certificate) bool {
+	certKey, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return false
+	}
+	issuerKey, err := x509.MarshalPKIXPublicKey(i.Key.Public())
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(certKey, issuerKey)
+}
+
+// Create a self-signed CA certificate for the issuer key named after the CAID
+func (i *Issuer) createSelfSignedCertificate(caID string) (*x509.Certificate, error) {
+	publicKey, err := x509.MarshalPKIXPublicKey(i.Key.Public())
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal issuer public key: %w", err)
+	}
+	subjectKeyID := sha1.Sum(publicKey)
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	notBefore := time.Now().Truncate(time.Second)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{CommonName: "CT Certificate Authority " + caID},
+		NotBefore: notBefore,
+		NotAfter: notBefore.Add(selfSignedIssuerValidity),
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA: true,
+		SubjectKeyId: subjectKeyID[:],
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, i.Key.Public(), i.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create issuer certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if x509.IsFatal(err) {
+		return nil, fmt.Errorf("failed to parse issuer certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// Get a random positive 128 bit serial
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial: %w", err)
+	}
+	return serial.Add(serial, big.NewInt(1)), nil
+}
+
+// Issue a certificate for csr that carries the next revocation number of revType in its revocation number extension.
+// A precertificate is signed first and submitted to the logs of the CA, then the final certificate is signed from the
+// same template with the SCTs of the logs in place of the poison.
+// The record of the revocation number and both certificates are persisted before they are returned
+func (c *CA) IssueCertificate(revType string, csr *x509.CertificateRequest) (*ctca.IssuedCertificate, error) {
+	revocationType, err := c.GetRevocationType(revType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue certificate: %w", err)
+	}
+	revType = revocationType.Name()
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("failed to issue certificate: %w: %v", ErrInvalidCertificateRequest, err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue certificate: %w", err)
+	}
+	notBefore := c.Clock.Now().Truncate(time.Second)
+	notAfter := notBefore.Add(c.Issuer.Validity)
+	if notAfter.After(c.Issuer.Certificate.NotAfter) {
+		notAfter = c.Issuer.Certificate.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: csr.Subject,
+		NotBefore: notBefore,
+		NotAfter: notAfter,
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		DNSNames: csr.DNSNames,
+		EmailAddresses: csr.EmailAddresses,
+		IPAddresses: csr.IPAddresses,
+		URIs: csr.URIs,
+		CRLDistributionPoints: []string{c.CRLDistributionPoint(revType)},
+		OCSPServer: []string{c.OCSPServer()},
+	}
+	// The precertificate is registered before it is submitted, so its revocation number is never reused once a log may hold it
+	record, precertificate, err := c.Registry.AssignAndIssue(revType, ctca.SerialString(serial), uint64(notAfter.Unix()), func(revocationNum uint64) ([]byte, error) {
+		revNumExtension, err := extension.NewExtension([]extension.RevocationNumber{extension.NewRevocationNumber(revType, revocationNum)})
+		if err != nil {
+			return nil, err
+		}
+		template.ExtraExtensions = []pkix.Extension{revNumExtension}
+		precertTemplate := *template
+		precertTemplate.ExtraExtensions = append([]pkix.Extension{revNumExtension}, pkix.Extension{Id: x509.OIDExtensionCTPoison, Critical: true, Value: poisonExtensionValue})
+		precertificate, err := x509.CreateCertificate(rand.Reader, &precertTemplate, c.Issuer.Certificate, csr.PublicKey, c.Issuer.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign precertificate: %w", err)
+		}
+		return precertificate, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue certificate: %w", err)
+	}
+	precert, err := x509.ParseCertificate(precertificate)
+	if x509.IsFatal(err) {
+		return nil, fmt.Errorf("failed to issue certificate: failed to parse precertificate: %w", err)
+	}
+	scts, err := c.SubmitPrecertificate(precert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue certificate with serial (%v): %w", record.Serial, err)
+	}
+	if len(scts) > 0 {
+		sctExtension, err := sctListExtension(scts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to issue certificate: %w", err)
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, sctExtension)
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, c.Issuer.Certificate, csr.PublicKey, c.Issuer.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue certificate: failed to sign certificate: %w", err)
+	}
+	record, err = c.Registry.AddFinalCertificate(revType, record.RevocationNum, ctca.CertificateFingerprint(certificate))
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue certificate: %w", err)
+	}
+	issued := &ctca.IssuedCertificate{
+		Record: *record,
+		Precertificate: precertificate,
+		Certificate: certificate,
+	}
+	if err := c.saveIssuedCertificate(issued); err != nil {
+		return nil, fmt.Errorf("failed to issue certificate: %w", err)
+	}
+	return issued, nil
+}
+
+// Persist an issued certificate under its serial
+func (c *CA) saveIssuedCertificate(issued *ctca.IssuedCertificate) error {
+	value, err := json.Marshal(issued)
+	if err != nil {
+		return fmt.Errorf("failed to marshal issued certificate: %w", err)
+	}
+	if err := c.Storage.Put(issuedCertificateBucket, issued.Record.Serial, value); err != nil {
+		return fmt.Errorf("failed to store issued certificate (%v): %w", issued.Record.Serial, err)
+	}
+	return nil
+}
+
+// Get the certificate issued by the CA with the given serial
+func (c *CA) GetIssuedCertificate(serial string) (*ctca.IssuedCertificate, error) {
+	serial, err := ctca.NormalizeSerial(serial)
+	if err != nil {
+		return nil, err
+	}
+	value, err := c.Storage.Get(issuedCertificateBucket, serial)
+	if errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("issued certificate with serial (%v): %w", serial, ErrUnknownCertificate)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get issued certificate (%v): %w", serial, err)
+	}
+	var issued ctca.IssuedCertificate
+	if err := json.Unmarshal(value, &issued); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal issued certificate (%v): %w", serial, err)
+	}
+	return &issued, nil
+}
+
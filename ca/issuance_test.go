@@ -0,0 +1,132 @@
+package ca
+
+import (
+	"testing"
+	"bytes"
+	"errors"
+	"crypto/rand"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/pem"
+
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/certificate-transparency-go/x509/pkix"
+	"github.com/n-ct/ct-certificate-authority/extension"
+	ctca "github.com/n-ct/ct-certificate-authority"
+)
+
+// Create a PEM CSR for example.com signed by a new key
+func mustCreateCertificateRequest(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate subject key: %v", err)
+	}
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "example.com"},
+		DNSNames: []string{"example.com", "www.example.com"},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate request: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+}
+
+func TestIssueCertificate(t *testing.T) {
+	storage := NewMemoryStorage()
+	newCA := mustGetCAWithStorage(t, storage)
+	csr, err := ctca.DecodeCertificateRequest(mustCreateCertificateRequest(t))
+	if err != nil {
+		t.Fatalf("failed to decode certificate request: %v", err)
+	}
+	issued, err := newCA.IssueCertificate(revType, csr)
+	if err != nil {
+		t.Fatalf("failed to issue certificate: %v", err)
+	}
+
+	precert, err := x509.ParseCertificate(issued.Precertificate)
+	if x509.IsFatal(err) {
+		t.Fatalf("failed to parse precertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(issued.Certificate)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	hasPoison := func(cert *x509.Certificate) bool {
+		for _, ext := range cert.Extensions {
+			if ext.Id.Equal(x509.OIDExtensionCTPoison) {
+				return ext.Critical && bytes.Equal(ext.Value, poisonExtensionValue)
+			}
+		}
+		return false
+	}
+	if !hasPoison(precert) || hasPoison(cert) {
+		t.Fatalf("only the precertificate should carry the critical poison extension")
+	}
+	if err := cert.CheckSignatureFrom(newCA.Issuer.Certificate); err != nil {
+		t.Fatalf("certificate is not signed by the issuer certificate: %v", err)
+	}
+	if cert.SerialNumber.Cmp(precert.SerialNumber) != 0 || ctca.SerialString(cert.SerialNumber) != issued.Record.Serial {
+		t.Fatalf("serials of precertificate (%v) and certificate (%v) do not match record (%v)", precert.SerialNumber, cert.SerialNumber, issued.Record.Serial)
+	}
+	if cert.Subject.CommonName != "example.com" || len(cert.DNSNames) != 2 {
+		t.Fatalf("certificate does not carry the subject and names of the CSR: %v %v", cert.Subject, cert.DNSNames)
+	}
+	for _, c := range []*x509.Certificate{precert, cert} {
+		revocationNum, err := extension.ForRevocationType(c, revType)
+		if err != nil || revocationNum.RevocationNum() != issued.Record.RevocationNum {
+			t.Fatalf("revocation number extension (%+v, %v) does not match record (%v)", revocationNum, err, issued.Record.RevocationNum)
+		}
+	}
+
+	// The registry knows the final certificate by its fingerprint
+	record, err := newCA.Registry.ByFingerprint(revType, ctca.CertificateFingerprint(issued.Certificate))
+	if err != nil || *record != issued.Record {
+		t.Fatalf("registry record (%+v, %v) not equal to issued record (%+v)", record, err, issued.Record)
+	}
+	revokedRecord, err := newCA.RevokeCertificate(revType, cert, ctca.KeyCompromise)
+	if err != nil || *revokedRecord != issued.Record {
+		t.Fatalf("failed to revoke issued certificate (%+v): %v", revokedRecord, err)
+	}
+
+	// A second certificate gets the next revocation number
+	second, err := newCA.IssueCertificate(revType, csr)
+	if err != nil {
+		t.Fatalf("failed to issue second certificate: %v", err)
+	}
+	if second.Record.RevocationNum == issued.Record.RevocationNum {
+		t.Fatalf("revocation num (%v) was assigned twice", second.Record.RevocationNum)
+	}
+
+	// The issuer certificate and the issued certificates survive a restart
+	reloadedCA := mustGetCAWithStorage(t, storage)
+	if !bytes.Equal(reloadedCA.Issuer.Certificate.Raw, newCA.Issuer.Certificate.Raw) {
+		t.Fatalf("issuer certificate changed across restart")
+	}
+	stored, err := reloadedCA.GetIssuedCertificate(issued.Record.Serial)
+	if err != nil {
+		t.Fatalf("failed to get issued certificate: %v", err)
+	}
+	if stored.Record != issued.Record || !bytes.Equal(stored.Certificate, issued.Certificate) || !bytes.Equal(stored.Precertificate, issued.Precertificate) {
+		t.Fatalf("stored issued certificate (%+v) not equal to (%+v)", stored.Record, issued.Record)
+	}
+	if _, err := reloadedCA.GetIssuedCertificate("abcdef"); !errors.Is(err, ErrUnknownCertificate) {
+		t.Fatalf("expected ErrUnknownCertificate for unknown serial, got: %v", err)
+	}
+}
+
+func TestIssueCertificateRejectsInvalidCSR(t *testing.T) {
+	newCA := mustGetCAWithStorage(t, NewMemoryStorage())
+	csr, err := ctca.DecodeCertificateRequest(mustCreateCertificateRequest(t))
+	if err != nil {
+		t.Fatalf("failed to decode certificate request: %v", err)
+	}
+	csr.Signature[len(csr.Signature)-1] ^= 0xff
+	if _, err := newCA.IssueCertificate(revType, csr); !errors.Is(err, ErrInvalidCertificateRequest) {
+		t.Fatalf("expected ErrInvalidCertificateRequest, got: %v", err)
+	}
+	if len(newCA.Registry.records[revType]) != 0 {
+		t.Fatalf("a revocation number was registered for a rejected CSR")
+	}
+}
@@ -0,0 +1,86 @@
+package ca
+
+import (
+	"fmt"
+	"encoding/json"
+
+	"github.com/golang/glog"
+	ctca "github.com/n-ct/ct-certificate-authority"
+)
+
+const (
+	deltaRevocationsJournalPrefix = "delta_revocations_"
+)
+
+// A batch of revocations accepted by the CA that has not yet been folded into a CRV
+type journalEntry struct {
+	RevocationNums []uint64
+	Reasons []ctca.ReasonCode `json:",omitempty"`	// Reason of the revocation number at the same position
+	SRDTimestamp uint64	// Timestamp of the latest stored SRD of the type when the entry was journaled. Any later SRD publishes the entry
+}
+
+// Every revocation type journals its delta revocations separately, so each can be truncated after its own SRD
+func deltaRevocationsJournal(revType string) string {
+	return deltaRevocationsJournalPrefix + revType
+}
+
+// Durably record newly accepted revocations of revType before they are added to DeltaRevocations
+func (c *CA) journalRevocations(revType string, revocations []ctca.Revocation) error {
+	srdTimestamp, _ := c.latestCASRDTimestamp(revType)
+	entry := journalEntry{RevocationNums: []uint64{}, Reasons: []ctca.ReasonCode{}, SRDTimestamp: srdTimestamp}
+	for _, revocation := range revocations {
+		entry.RevocationNums = append(entry.RevocationNums, revocation.RevocationNum)
+		entry.Reasons = append(entry.Reasons, revocation.Reason)
+	}
+	record, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal entry: %w", err)
+	}
+	if err := c.Storage.AppendJournal(deltaRevocationsJournal(revType), record); err != nil {
+		return fmt.Errorf("failed to journal revocation nums: %w", err)
+	}
+	return nil
+}
+
+// Add the revocations that were accepted but not yet part of an SRD when the CA last stopped back into DeltaRevocations.
+// Entries journaled before the latest stored SRD were published by it, even if the CA stopped before truncating the journal
+func (c *CA) replayJournal() error {
+	for revType := range c.RevocationTypes {
+		records, err := c.Storage.ReadJournal(deltaRevocationsJournal(revType))
+		if err != nil {
+			return fmt.Errorf("failed to read journal of revType (%v): %w", revType, err)
+		}
+		latestTimestamp, _ := c.latestCASRDTimestamp(revType)
+		published := 0
+		for _, record := range records {
+			var entry journalEntry
+			if err := json.Unmarshal(record, &entry); err != nil {
+				return fmt.Errorf("failed to unmarshal journal entry of revType (%v): %w", revType, err)
+			}
+			if entry.SRDTimestamp < latestTimestamp {
+				published++
+				continue
+			}
+			revocations, err := ctca.NewRevocations(entry.RevocationNums, entry.Reasons)
+			if err != nil {
+				return fmt.Errorf("invalid journal entry of revType (%v): %w", revType, err)
+			}
+			c.addDeltaRevocations(revType, revocations)
+		}
+		if published > 0 {
+			glog.Infof("Skipped %v journal entries of revType (%v) published by the SRD at (%v)", published, revType, latestTimestamp)
+		}
+		if len(records) > published {
+			glog.Infof("Replayed %v journal entries into DeltaRevocations of revType (%v)", len(records) - published, revType)
+		}
+	}
+	return nil
+}
+
+// Drop the journaled revocations of revType once an SRD containing them has been stored
+func (c *CA) truncateJournal(revType string) error {
+	if err := c.Storage.TruncateJournal(deltaRevocationsJournal(revType)); err != nil {
+		return fmt.Errorf("failed to truncate journal: %w", err)
+	}
+	return nil
+}
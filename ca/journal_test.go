@@ -0,0 +1,145 @@
+package ca
+
+import (
+	"testing"
+	"os"
+	"sort"
+	"reflect"
+
+	ctca "github.com/n-ct/ct-certificate-authority"
+)
+
+func TestFileStorageJournalDiscardsTornTail(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create file storage: %v", err)
+	}
+	records := [][]byte{[]byte("first"), []byte("second")}
+	for _, record := range records {
+		if err := storage.AppendJournal(deltaRevocationsJournal(revType), record); err != nil {
+			t.Fatalf("failed to append record: %v", err)
+		}
+	}
+
+	// Simulate a crash in the middle of an append
+	journalFile, err := os.OpenFile(storage.journalPath(deltaRevocationsJournal(revType)), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("failed to open journal: %v", err)
+	}
+	journalFile.Write([]byte{0, 0, 0, 9, 1})
+	journalFile.Close()
+
+	readRecords, err := storage.ReadJournal(deltaRevocationsJournal(revType))
+	if err != nil {
+		t.Fatalf("failed to read journal: %v", err)
+	}
+	if !reflect.DeepEqual(readRecords, records) {
+		t.Fatalf("journal records (%v) not equal to appended records (%v)", readRecords, records)
+	}
+
+	// Records appended after the torn tail was cut must be readable
+	if err := storage.AppendJournal(deltaRevocationsJournal(revType), []byte("third")); err != nil {
+		t.Fatalf("failed to append record: %v", err)
+	}
+	readRecords, err = storage.ReadJournal(deltaRevocationsJournal(revType))
+	if err != nil {
+		t.Fatalf("failed to read journal: %v", err)
+	}
+	if len(readRecords) != 3 {
+		t.Fatalf("expected 3 journal records, got (%v)", len(readRecords))
+	}
+}
+
+func TestNewCAReplaysJournal(t *testing.T) {
+	storage := NewMemoryStorage()
+	firstCA := mustGetCAWithStorage(t, storage)
+	revNumsList := []uint64{1, 2, 3}
+	if err := firstCA.AddRevocationNums(revType, &revNumsList); err != nil {
+		t.Fatalf("failed to add new revNums: %v", err)
+	}
+
+	secondCA := mustGetCAWithStorage(t, storage)
+	deltaRevNumsList := secondCA.DeltaRevocationsToList(revType)
+	sort.Slice(deltaRevNumsList, func(i, j int) bool { return deltaRevNumsList[i] < deltaRevNumsList[j] })
+	if !reflect.DeepEqual(deltaRevNumsList, revNumsList) {
+		t.Fatalf("replayed DeltaRevocations (%v) not equal to added revNumsList (%v)", deltaRevNumsList, revNumsList)
+	}
+
+	if err := secondCA.DoRevocationTransparencyTasks(revType); err != nil {
+		t.Fatalf("failed to DoRevocationTransparencyTasks: %v", err)
+	}
+	thirdCA := mustGetCAWithStorage(t, storage)
+	if len(thirdCA.DeltaRevocationsToList(revType)) != 0 {
+		t.Fatalf("journal not truncated after SRD was produced. (%v) replayed", thirdCA.DeltaRevocationsToList(revType))
+	}
+}
+
+func TestNewCAReplaysJournaledReasons(t *testing.T) {
+	storage := NewMemoryStorage()
+	firstCA := mustGetCAWithStorage(t, storage)
+	revocations, err := ctca.NewRevocations([]uint64{1, 2}, []ctca.ReasonCode{ctca.KeyCompromise})
+	if err != nil {
+		t.Fatalf("failed to create revocations: %v", err)
+	}
+	if err := firstCA.AddRevocations(revType, revocations); err != nil {
+		t.Fatalf("failed to add revocations: %v", err)
+	}
+
+	secondCA := mustGetCAWithStorage(t, storage)
+	if !reflect.DeepEqual(secondCA.DeltaRevocationsWithReasons(revType), revocations) {
+		t.Fatalf("replayed revocations (%v) not equal to added revocations (%v)", secondCA.DeltaRevocationsWithReasons(revType), revocations)
+	}
+	if err := secondCA.DoRevocationTransparencyTasks(revType); err != nil {
+		t.Fatalf("failed to DoRevocationTransparencyTasks: %v", err)
+	}
+	reasonResp, err := secondCA.GetRevocationReason(revType, 1)
+	if err != nil {
+		t.Fatalf("failed to get revocation reason: %v", err)
+	}
+	if !reasonResp.Revoked || reasonResp.Reason != ctca.KeyCompromise || reasonResp.ReasonName != "keyCompromise" {
+		t.Fatalf("unexpected revocation reason response (%+v)", reasonResp)
+	}
+}
+
+// A MemoryStorage that never truncates its journals, as if the CA stopped right after storing every SRD
+type untruncatedJournalStorage struct {
+	*MemoryStorage
+}
+
+func (s *untruncatedJournalStorage) TruncateJournal(journal string) error {
+	return nil
+}
+
+func TestNewCADoesNotReplayPublishedJournalEntries(t *testing.T) {
+	storage := &untruncatedJournalStorage{NewMemoryStorage()}
+	firstCA := mustGetCAWithStorage(t, storage)
+	if err := firstCA.AddRevocations(revType, []ctca.Revocation{{RevocationNum: 7, Reason: ctca.KeyCompromise}}); err != nil {
+		t.Fatalf("failed to add revocations: %v", err)
+	}
+	mustDoMMD(t, firstCA)
+	publishedTimestamp := firstCA.MMDTimestamp()
+	if err := firstCA.AddRevocations(revType, []ctca.Revocation{{RevocationNum: 9, Reason: ctca.Superseded}}); err != nil {
+		t.Fatalf("failed to add revocations: %v", err)
+	}
+
+	// The journal still holds revocation 7, but the stored SRD already published it
+	secondCA := mustGetCAWithStorage(t, storage)
+	pending := secondCA.DeltaRevocationsToList(revType)
+	if !reflect.DeepEqual(pending, []uint64{9}) {
+		t.Fatalf("replayed DeltaRevocations (%v) not equal to the revocations after the SRD ([9])", pending)
+	}
+	mustDoMMD(t, secondCA)
+	for _, timestamp := range []uint64{publishedTimestamp, secondCA.MMDTimestamp()} {
+		srd, err := secondCA.GetCASRD(revType, timestamp)
+		if err != nil {
+			t.Fatalf("failed to get SRD: %v", err)
+		}
+		delta, err := secondCA.RevocationTypes[revType].DecodeDelta(srd.RevData.CRVDelta)
+		if err != nil {
+			t.Fatalf("failed to decode delta: %v", err)
+		}
+		if nums := delta.RevocationNums(); len(nums) != 1 || (timestamp == publishedTimestamp) != (nums[0] == 7) {
+			t.Fatalf("SRD at (%v) publishes revocation nums (%v)", timestamp, nums)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package ca
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// MMD boundaries are the multiples of an MMD in unix seconds, so the epochs of a CA line up with the wall clock
+// and do not drift with the time the CA was started or how long the tasks of an MMD took.
+// Every revocation type has its own MMD (see RevocationTypeMMD) and so its own schedule of boundaries, while
+// PreviousMMDTimestamp follows the boundaries of the MMD of the CA list
+
+// Get the MMD boundary of mmd at or before now
+func alignedMMDTimestamp(mmd uint64, now time.Time) uint64 {
+	timestamp := uint64(now.Unix())
+	return timestamp - timestamp % mmd
+}
+
+// Get the first MMD boundary of mmd after timestamp. A timestamp that is not on a boundary moves to the next one
+func nextMMDTimestamp(mmd uint64, timestamp uint64) uint64 {
+	return (timestamp / mmd + 1) * mmd
+}
+
+// Get the MMD of revType in seconds. A revocation type without an mmd in the CA config uses the MMD of the CA list
+func (c *CA) RevocationTypeMMD(revType string) uint64 {
+	if mmd, ok := c.MMDs[revType]; ok && mmd > 0 {
+		return mmd
+	}
+	return c.MMD
+}
+
+// Get the time of the first MMD boundary of revType after now, when the sequencer next has to produce its SRDs
+func (c *CA) NextMMDBoundary(revType string, now time.Time) time.Time {
+	return time.Unix(int64(nextMMDTimestamp(c.RevocationTypeMMD(revType), uint64(now.Unix()))), 0)
+}
+
+// Set up PreviousMMDTimestamp when the CA is created. A new CA starts one MMD before the current boundary, so its
+// first SRD is the one of the current MMD. A restarted CA keeps the MMD it stopped in and reports the MMDs it missed
+func (c *CA) initMMD(now time.Time) error {
+	if c.PreviousMMDTimestamp == 0 {
+		c.PreviousMMDTimestamp = alignedMMDTimestamp(c.MMD, now) - c.MMD
+		return c.saveMMDTimestamp()
+	}
+	for _, revType := range c.RevocationTypeNames() {
+		// The SRD of the current MMD is still on time, only the ones before it were missed
+		if first, count := c.missedMMDs(revType, now); count > 1 {
+			glog.Warningf("revType (%v) missed %v MMDs from (%v) while the CA was down, they are back-filled by the sequencer", revType, count - 1, first)
+		}
+	}
+	return nil
+}
+
+// Get the first MMD boundary of revType up to now that it has not produced an SRD for yet and the number of such
+// boundaries. A revType without any SRD only owes the SRD of its current MMD, and a revType whose latest SRD is
+// ahead of now, because SealMMDs produced it before a shutdown, owes nothing until the boundary after it
+func (c *CA) missedMMDs(revType string, now time.Time) (uint64, uint64) {
+	mmd := c.RevocationTypeMMD(revType)
+	current := alignedMMDTimestamp(mmd, now)
+	first := current
+	if latest, ok := c.latestCASRDTimestamp(revType); ok {
+		first = nextMMDTimestamp(mmd, latest)
+	}
+	if first > current {
+		return first, 0
+	}
+	return first, (current - first) / mmd + 1
+}
+
+// Produce the SRD of every MMD boundary up to now that has none yet, for every revocation type.
+// Returns the number of SRDs produced and the first error, see CatchUpRevocationType
+func (c *CA) CatchUpMMDs(now time.Time) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	produced := 0
+	var firstErr error
+	for _, revType := range c.RevocationTypeNames() {
+		revTypeProduced, err := c.catchUpRevocationType(revType, now)
+		produced += revTypeProduced
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := c.advanceMMDTimestamp(now); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return produced, firstErr
+}
+
+// Produce the SRD of every MMD boundary of revType up to now that has none yet.
+// Boundaries that were missed, because the CA was down or an MMD took too long, are back-filled with SRDs in order,
+// so the SRDs of a revType always form an unbroken chain of MMDs; the first of them publishes the pending revocations
+// and the others are empty. If an SRD cannot be produced, the later boundaries are left for the next call.
+// Returns the number of SRDs produced
+func (c *CA) CatchUpRevocationType(revType string, now time.Time) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	produced, err := c.catchUpRevocationType(revType, now)
+	if advanceErr := c.advanceMMDTimestamp(now); err == nil {
+		err = advanceErr
+	}
+	return produced, err
+}
+
+func (c *CA) catchUpRevocationType(revType string, now time.Time) (int, error) {
+	mmd := c.RevocationTypeMMD(revType)
+	first, count := c.missedMMDs(revType, now)
+	if count > 1 {
+		glog.Warningf("back-filling %v missed MMDs of revType (%v) from (%v)", count - 1, revType, first)
+	}
+	for i := uint64(0); i < count; i++ {
+		timestamp := first + i * mmd
+		if err := c.doRevocationTransparencyTasks(revType, timestamp); err != nil {
+			return int(i), fmt.Errorf("failed to produce SRD of revType (%v) at (%v): %w", revType, timestamp, err)
+		}
+	}
+	return int(count), nil
+}
+
+// Move PreviousMMDTimestamp on to the boundary of the MMD of the CA list at or before now
+func (c *CA) advanceMMDTimestamp(now time.Time) error {
+	if current := alignedMMDTimestamp(c.MMD, now); current > c.PreviousMMDTimestamp {
+		c.PreviousMMDTimestamp = current
+		return c.saveMMDTimestamp()
+	}
+	return nil
+}
+
+// Seal the current MMD of every revocation type before the CA shuts down. The boundaries that are due are caught up,
+// and a revocation type with pending revocations publishes them early in the SRD of the boundary that ends its current
+// MMD, so they are not left waiting for the next start. Once restarted, the sequencer carries on after that boundary,
+// even before it has passed, and PreviousMMDTimestamp moves up to it so the MMD of the CA list does not produce it again.
+// Call StopRevocations first, or revocations added later end up in the MMD after the sealed one.
+// Returns the number of SRDs produced and the first error
+func (c *CA) SealMMDs(now time.Time) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	produced := 0
+	var firstErr error
+	for _, revType := range c.RevocationTypeNames() {
+		revTypeProduced, _, err := c.sealRevocationType(revType, now)
+		produced += revTypeProduced
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := c.advanceMMDTimestamp(now); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return produced, firstErr
+}
+
+// Catch up the MMD boundaries of revType up to now and publish the revocations still pending after them in the SRD of
+// its next boundary. Returns the number of SRDs produced and the timestamp of the SRD that published the pending
+// revocations, which is zero when nothing was pending
+func (c *CA) sealRevocationType(revType string, now time.Time) (int, uint64, error) {
+	var timestamp uint64
+	if len(c.DeltaRevocations[revType]) > 0 {
+		// The first of the missed boundaries publishes the pending revocations
+		if first, count := c.missedMMDs(revType, now); count > 0 {
+			timestamp = first
+		}
+	}
+	produced, err := c.catchUpRevocationType(revType, now)
+	if err != nil || len(c.DeltaRevocations[revType]) == 0 {
+		return produced, timestamp, err
+	}
+	timestamp = nextMMDTimestamp(c.RevocationTypeMMD(revType), uint64(now.Unix()))
+	if err := c.doRevocationTransparencyTasks(revType, timestamp); err != nil {
+		return produced, 0, fmt.Errorf("failed to produce final SRD of revType (%v) at (%v): %w", revType, timestamp, err)
+	}
+	return produced + 1, timestamp, c.recordSealedMMD(timestamp)
+}
+
+// Move PreviousMMDTimestamp up to the boundary of the MMD of the CA list at or before a sealed SRD at timestamp, so the
+// next MMD of the CA list comes after it
+func (c *CA) recordSealedMMD(timestamp uint64) error {
+	if sealed := timestamp - timestamp % c.MMD; sealed > c.PreviousMMDTimestamp {
+		c.PreviousMMDTimestamp = sealed
+		return c.saveMMDTimestamp()
+	}
+	return nil
+}
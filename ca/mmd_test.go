@@ -0,0 +1,187 @@
+package ca
+
+import (
+	"testing"
+	"time"
+
+	ctca "github.com/n-ct/ct-certificate-authority"
+)
+
+func TestCatchUpMMDsBackfillsMissedMMDs(t *testing.T) {
+	newCA := mustGetCAWithStorage(t, NewMemoryStorage())
+	now := time.Now()
+	current := uint64(now.Unix()) / 60 * 60
+	newCA.MMD = 60
+	newCA.PreviousMMDTimestamp = current - 60
+
+	// A CA without SRDs owes the SRD of the current boundary only
+	produced, err := newCA.CatchUpMMDs(now)
+	if err != nil || produced != 1 {
+		t.Fatalf("produced (%v) SRDs at the first MMD: %v", produced, err)
+	}
+	if _, err := newCA.GetCASRD(revType, current); err != nil || newCA.PreviousMMDTimestamp != current {
+		t.Fatalf("first SRD is not at the current boundary (%v): %v", current, err)
+	}
+	if produced, err := newCA.CatchUpMMDs(time.Unix(int64(current + 59), 0)); err != nil || produced != 0 {
+		t.Fatalf("produced (%v) SRDs before the next boundary: %v", produced, err)
+	}
+	if next := newCA.NextMMDBoundary(revType, now); uint64(next.Unix()) != current + 60 {
+		t.Fatalf("next boundary (%v) is not one MMD after (%v)", next.Unix(), current)
+	}
+
+	// Three boundaries pass without the sequencer, the first back-filled SRD publishes the pending revocation
+	if err := newCA.AddRevocations(revType, []ctca.Revocation{{RevocationNum: 3, Reason: ctca.KeyCompromise}}); err != nil {
+		t.Fatalf("failed to add revocations: %v", err)
+	}
+	later := now.Add(3 * time.Minute)
+	if first, count := newCA.missedMMDs(revType, later); first != current + 60 || count != 3 {
+		t.Fatalf("expected 3 missed MMDs from (%v), got (%v) from (%v)", current + 60, count, first)
+	}
+	produced, err = newCA.CatchUpMMDs(later)
+	if err != nil || produced != 3 {
+		t.Fatalf("produced (%v) SRDs for 3 missed MMDs: %v", produced, err)
+	}
+	for i, timestamp := range []uint64{current + 60, current + 120, current + 180} {
+		srd, err := newCA.GetCASRD(revType, timestamp)
+		if err != nil {
+			t.Fatalf("missed MMD (%v) was not back-filled: %v", timestamp, err)
+		}
+		delta, err := newCA.RevocationTypes[revType].DecodeDelta(srd.RevData.CRVDelta)
+		if err != nil {
+			t.Fatalf("failed to decode delta of SRD (%v): %v", timestamp, err)
+		}
+		if revNums := delta.RevocationNums(); (i == 0) != (len(revNums) == 1) {
+			t.Fatalf("SRD (%v) publishes revocation nums (%v)", timestamp, revNums)
+		}
+	}
+	if newCA.PreviousMMDTimestamp != current + 180 || len(newCA.DeltaRevocationsToList(revType)) != 0 {
+		t.Fatalf("CA did not catch up to (%v): at (%v) with pending (%v)", current + 180, newCA.PreviousMMDTimestamp, newCA.DeltaRevocationsToList(revType))
+	}
+}
+
+func TestRevocationTypeMMDs(t *testing.T) {
+	newCA, err := NewCAWithStorage("../testdata/ca_config_mmd_schedules.json", caListName, logListName, NewMemoryStorage())
+	if err != nil {
+		t.Fatalf("failed to create new CA: %v", err)
+	}
+	emergency := "Let's-Revoke-Emergency"
+	if newCA.RevocationTypeMMD(revType) != 3600 || newCA.RevocationTypeMMD(emergency) != 60 {
+		t.Fatalf("unexpected MMDs (%v, %v)", newCA.RevocationTypeMMD(revType), newCA.RevocationTypeMMD(emergency))
+	}
+	hour := uint64(time.Now().Unix()) / 3600 * 3600
+	if next := newCA.NextMMDBoundary(emergency, time.Unix(int64(hour + 30), 0)); uint64(next.Unix()) != hour + 60 {
+		t.Fatalf("next boundary of (%v) is at (%v)", emergency, next.Unix())
+	}
+
+	// Each revocation type catches up on its own boundaries
+	if produced, err := newCA.CatchUpMMDs(time.Unix(int64(hour), 0)); err != nil || produced != 2 {
+		t.Fatalf("produced (%v) SRDs at the first MMD: %v", produced, err)
+	}
+	if produced, err := newCA.CatchUpRevocationType(emergency, time.Unix(int64(hour + 3599), 0)); err != nil || produced != 59 {
+		t.Fatalf("produced (%v) SRDs of (%v) within an hour: %v", produced, emergency, err)
+	}
+	if produced, err := newCA.CatchUpMMDs(time.Unix(int64(hour + 3600), 0)); err != nil || produced != 2 {
+		t.Fatalf("produced (%v) SRDs at the next hour: %v", produced, err)
+	}
+	if len(newCA.CASignedDigestMap[revType]) != 2 || len(newCA.CASignedDigestMap[emergency]) != 61 {
+		t.Fatalf("unexpected SRD counts (%v, %v)", len(newCA.CASignedDigestMap[revType]), len(newCA.CASignedDigestMap[emergency]))
+	}
+
+	// The status reports the latest MMD of the revocation type
+	if err := newCA.AddRevocations(emergency, []ctca.Revocation{{RevocationNum: 3, Reason: ctca.KeyCompromise}}); err != nil {
+		t.Fatalf("failed to add revocations: %v", err)
+	}
+	if _, err := newCA.CatchUpMMDs(time.Unix(int64(hour + 3660), 0)); err != nil {
+		t.Fatalf("failed to catch up: %v", err)
+	}
+	for _, expected := range []ctca.RevocationStatus{
+		{RevocationType: revType, Timestamp: hour + 3600, MMD: 3600, NextTimestamp: hour + 7200},
+		{RevocationType: emergency, Timestamp: hour + 3660, MMD: 60, NextTimestamp: hour + 3720},
+	} {
+		status, err := newCA.GetLatestRevocationStatus(expected.RevocationType)
+		if err != nil {
+			t.Fatalf("failed to get revocation status of (%v): %v", expected.RevocationType, err)
+		}
+		if status.RevocationType != expected.RevocationType || status.Timestamp != expected.Timestamp || status.MMD != expected.MMD || status.NextTimestamp != expected.NextTimestamp {
+			t.Fatalf("unexpected revocation status (%+v)", status)
+		}
+	}
+	if _, revoked := newCA.RevocationObjMap[emergency].RevocationReason(3); !revoked {
+		t.Fatalf("revocation of (%v) was not published at its next MMD", emergency)
+	}
+}
+
+func TestSealMMDs(t *testing.T) {
+	newCA := mustGetCAWithStorage(t, NewMemoryStorage())
+	now := time.Now()
+	current := uint64(now.Unix()) / 60 * 60
+	newCA.MMD = 60
+	newCA.PreviousMMDTimestamp = current - 60
+
+	// Only the due SRD is produced when nothing is pending
+	if produced, err := newCA.SealMMDs(now); err != nil || produced != 1 {
+		t.Fatalf("produced (%v) SRDs without pending revocations: %v", produced, err)
+	}
+	if err := newCA.AddRevocationNums(revType, &[]uint64{9}); err != nil {
+		t.Fatalf("failed to add revocation nums: %v", err)
+	}
+	if produced, err := newCA.SealMMDs(now); err != nil || produced != 1 {
+		t.Fatalf("produced (%v) SRDs to seal a pending revocation: %v", produced, err)
+	}
+	if _, err := newCA.GetCASRD(revType, current + 60); err != nil {
+		t.Fatalf("pending revocation was not sealed at the end of the MMD: %v", err)
+	}
+	if _, revoked := newCA.RevocationObjMap[revType].RevocationReason(9); !revoked || len(newCA.DeltaRevocationsToList(revType)) != 0 {
+		t.Fatalf("pending revocation was not published")
+	}
+
+	// The sequencer carries on after the sealed boundary
+	if first, count := newCA.missedMMDs(revType, time.Unix(int64(current + 60), 0)); first != current + 120 || count != 0 {
+		t.Fatalf("(%v) MMDs are due from (%v) after sealing", count, first)
+	}
+}
+
+// A CA that restarts before the boundary of its final SRD has passed neither produces that boundary again nor skips the next
+func TestSealMMDsRestartBeforeBoundary(t *testing.T) {
+	storage := NewMemoryStorage()
+	newCA := mustGetCAWithStorage(t, storage)
+	now := time.Now()
+	current := uint64(now.Unix()) / 60 * 60
+	newCA.MMD = 60
+	newCA.PreviousMMDTimestamp = current - 60
+	if _, err := newCA.CatchUpMMDs(now); err != nil {
+		t.Fatalf("failed to catch up MMDs: %v", err)
+	}
+	if err := newCA.AddRevocationNums(revType, &[]uint64{9}); err != nil {
+		t.Fatalf("failed to add revocation nums: %v", err)
+	}
+	if produced, err := newCA.SealMMDs(now); err != nil || produced != 1 {
+		t.Fatalf("produced (%v) SRDs to seal a pending revocation: %v", produced, err)
+	}
+	sealed, err := newCA.GetCASRD(revType, current + 60)
+	if err != nil {
+		t.Fatalf("pending revocation was not sealed at the end of the MMD: %v", err)
+	}
+
+	restarted := mustGetCAWithStorage(t, storage)
+	restarted.MMD = 60
+	if timestamp := restarted.MMDTimestamp(); timestamp != current + 60 {
+		t.Fatalf("restarted CA is at MMD (%v) instead of the sealed one (%v)", timestamp, current + 60)
+	}
+	for _, at := range []uint64{uint64(now.Unix()), current + 60} {
+		if produced, err := restarted.CatchUpMMDs(time.Unix(int64(at), 0)); err != nil || produced != 0 {
+			t.Fatalf("produced (%v) SRDs at (%v) before the sealed boundary passed: %v", produced, at, err)
+		}
+	}
+	if srd, err := restarted.GetCASRD(revType, current + 60); err != nil || string(srd.SRD.Signature.Signature) != string(sealed.SRD.Signature.Signature) {
+		t.Fatalf("sealed SRD was replaced: %v", err)
+	}
+	if produced, err := restarted.CatchUpMMDs(time.Unix(int64(current + 120), 0)); err != nil || produced != 1 {
+		t.Fatalf("produced (%v) SRDs at the boundary after the sealed one: %v", produced, err)
+	}
+
+	// The MMD of the CA list moves on after the sealed boundary as well
+	if err := restarted.UpdateMMD(); err != nil || restarted.MMDTimestamp() != current + 180 {
+		t.Fatalf("CA list MMD moved to (%v): %v", restarted.MMDTimestamp(), err)
+	}
+}
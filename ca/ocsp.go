@@ -0,0 +1,389 @@
+package ca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	stdx509 "crypto/x509"
+	"encoding/base64"
+
+	"github.com/golang/glog"
+	"github.com/google/certificate-transparency-go/asn1"
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/certificate-transparency-go/x509/pkix"
+	"golang.org/x/crypto/ocsp"
+	ctca "github.com/n-ct/ct-certificate-authority"
+)
+
+const (
+	ocspResponderKeyKey = "ocsp_responder_key"
+	ocspResponderCertificateKey = "ocsp_responder_certificate"
+	// A responder certificate closer than this to its expiration is replaced on startup
+	ocspResponderRenewal = 7 * 24 * time.Hour
+)
+
+// id-pkix-ocsp-nocheck, which tells clients not to check the revocation status of the responder certificate
+var oidExtensionOCSPNoCheck = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}
+
+// Configures the delegated OCSP responder of the CA
+type OCSPConfig struct {
+	PrivKey string `json:"priv_key"`	// Base64 DER EC private key of the responder. A key is generated and kept in storage when empty
+}
+
+// OCSPResponder signs the OCSP responses of the CA with a delegated key certified by the issuer.
+// Signed responses are cached until the next MMD of their revocation type, so every client gets the answer of the
+// current CRV. Only the responses of the current MMD of each revocation type are kept
+type OCSPResponder struct {
+	Certificate *x509.Certificate	// Responder certificate issued by the issuer with the OCSPSigning extended key usage
+	Key crypto.Signer
+	issuer *stdx509.Certificate
+	responder *stdx509.Certificate
+	responses map[string] cachedOCSPResponses	// Signed responses of the current MMD of each revType
+	revocationTimes map[string] cachedRevocationTimes	// Revocation times of the full CRL of each revType
+	sync.Mutex
+}
+
+// The responses signed for the MMD at timestamp by serial and issuer hash
+type cachedOCSPResponses struct {
+	timestamp uint64
+	responses map[string] []byte
+}
+
+// The revocation time of every serial of the full CRL of the MMD at timestamp
+type cachedRevocationTimes struct {
+	timestamp uint64
+	times map[string] time.Time
+}
+
+// Create the OCSPResponder of the CA. Its key and certificate are created once and kept in storage
+func createOCSPResponder(caConfig *CAConfig, storage Storage, issuer *Issuer) (*OCSPResponder, error) {
+	key, err := loadOCSPResponderKey(caConfig.OCSP, storage)
+	if err != nil {
+		return nil, err
+	}
+	responder := &OCSPResponder{
+		Key: key,
+		responses: make(map[string] cachedOCSPResponses),
+		revocationTimes: make(map[string] cachedRevocationTimes),
+	}
+	stored, err := storage.Get(metaBucket, ocspResponderCertificateKey)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("failed to load OCSP responder certificate: %w", err)
+	}
+	if err == nil {
+		cert, err := x509.ParseCertificate(stored)
+		if x509.IsFatal(err) {
+			return nil, fmt.Errorf("failed to parse stored OCSP responder certificate: %w", err)
+		}
+		if responder.usableCertificate(cert, issuer) {
+			responder.Certificate = cert
+		}
+	}
+	if responder.Certificate == nil {
+		responder.Certificate, err = responder.createCertificate(issuer)
+		if err != nil {
+			return nil, err
+		}
+		if err := storage.Put(metaBucket, ocspResponderCertificateKey, responder.Certificate.Raw); err != nil {
+			return nil, fmt.Errorf("failed to store OCSP responder certificate: %w", err)
+		}
+	}
+
+	// The ocsp package works with the certificates of the standard library
+	responder.issuer, err = stdx509.ParseCertificate(issuer.Certificate.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse issuer certificate for OCSP: %w", err)
+	}
+	responder.responder, err = stdx509.ParseCertificate(responder.Certificate.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse OCSP responder certificate: %w", err)
+	}
+	return responder, nil
+}
+
+// Get the responder key of the config, or the one kept in storage, generating it on first use
+func loadOCSPResponderKey(ocspConfig OCSPConfig, storage Storage) (*ecdsa.PrivateKey, error) {
+	if ocspConfig.PrivKey != "" {
+		derPrivKey, err := base64.StdEncoding.DecodeString(ocspConfig.PrivKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode OCSP responder private key: %w", err)
+		}
+		key, err := x509.ParseECPrivateKey(derPrivKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse OCSP responder private key: %w", err)
+		}
+		return key, nil
+	}
+	derPrivKey, err := storage.Get(metaBucket, ocspResponderKeyKey)
+	if err == nil {
+		key, err := x509.ParseECPrivateKey(derPrivKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse stored OCSP responder private key: %w", err)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("failed to load OCSP responder private key: %w", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate OCSP responder private key: %w", err)
+	}
+	derPrivKey, err = x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal OCSP responder private key: %w", err)
+	}
+	if err := storage.Put(metaBucket, ocspResponderKeyKey, derPrivKey); err != nil {
+		return nil, fmt.Errorf("failed to store OCSP responder private key: %w", err)
+	}
+	return key, nil
+}
+
+// Check whether cert certifies the responder key, was issued by issuer and is not about to expire
+func (r *OCSPResponder) usableCertificate(cert *x509.Certificate, issuer *Issuer) bool {
+	certKey, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return false
+	}
+	responderKey, err := x509.MarshalPKIXPublicKey(r.Key.Public())
+	if err != nil {
+		return false
+	}
+	if !bytes.Equal(certKey, responderKey) || cert.CheckSignatureFrom(issuer.Certificate) != nil {
+		return false
+	}
+	return time.Now().Add(ocspResponderRenewal).Before(cert.NotAfter)
+}
+
+// Issue the delegated responder certificate with the issuer
+func (r *OCSPResponder) createCertificate(issuer *Issuer) (*x509.Certificate, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	noCheck, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagNull})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal ocsp-nocheck extension: %w", err)
+	}
+	notBefore := time.Now().Truncate(time.Second)
+	notAfter := notBefore.Add(issuer.Validity)
+	if notAfter.After(issuer.Certificate.NotAfter) {
+		notAfter = issuer.Certificate.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{CommonName: issuer.Certificate.Subject.CommonName + " OCSP Responder"},
+		NotBefore: notBefore,
+		NotAfter: notAfter,
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+		BasicConstraintsValid: true,
+		ExtraExtensions: []pkix.Extension{{Id: oidExtensionOCSPNoCheck, Value: noCheck}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer.Certificate, r.Key.Public(), issuer.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OCSP responder certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if x509.IsFatal(err) {
+		return nil, fmt.Errorf("failed to parse OCSP responder certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// Get the URL of the OCSP endpoint of the CA
+func (c *CA) OCSPServer() string {
+	return "http://" + c.ListenAddress + ctca.OCSPPath
+}
+
+// Answer a DER OCSP request. The status of a registered certificate is taken from the CRV of its revocation type
+// at the most recent MMD. Requests that cannot be answered get an OCSP error response, so a response is always returned
+func (c *CA) RespondOCSP(requestDER []byte) []byte {
+	req, err := ocsp.ParseRequest(requestDER)
+	if err != nil {
+		return ocsp.MalformedRequestErrorResponse
+	}
+	issued, err := c.Responder.issuedBy(req)
+	if err != nil {
+		glog.Warningf("failed to check issuer of OCSP request: %v", err)
+		return ocsp.MalformedRequestErrorResponse
+	}
+	if !issued {
+		return ocsp.UnauthorizedErrorResponse
+	}
+	c.RLock()
+	response, err := c.ocspResponse(req)
+	c.RUnlock()
+	if err != nil {
+		glog.Errorf("failed to create OCSP response for serial (%x): %v", req.SerialNumber, err)
+		return ocsp.InternalErrorErrorResponse
+	}
+	if response == nil {
+		return ocsp.TryLaterErrorResponse
+	}
+	return response
+}
+
+// Check whether req asks about a certificate of the issuer of the CA
+func (r *OCSPResponder) issuedBy(req *ocsp.Request) (bool, error) {
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(r.issuer.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
+		return false, fmt.Errorf("failed to unmarshal issuer public key: %w", err)
+	}
+	if !req.HashAlgorithm.Available() {
+		return false, fmt.Errorf("unsupported issuer hash (%v)", req.HashAlgorithm)
+	}
+	hash := req.HashAlgorithm.New()
+	hash.Write(r.issuer.RawSubject)
+	nameHash := hash.Sum(nil)
+	hash.Reset()
+	hash.Write(publicKeyInfo.PublicKey.RightAlign())
+	keyHash := hash.Sum(nil)
+	return bytes.Equal(nameHash, req.IssuerNameHash) && bytes.Equal(keyHash, req.IssuerKeyHash), nil
+}
+
+// Get the signed response to req, from the cache if it was signed at the most recent MMD.
+// Returns nil if the revocation type of the certificate has not published a CRV yet
+func (c *CA) ocspResponse(req *ocsp.Request) ([]byte, error) {
+	serial := ctca.SerialString(req.SerialNumber)
+	for _, revType := range c.RevocationTypeNames() {
+		record, err := c.Registry.BySerial(revType, serial)
+		if errors.Is(err, ErrUnknownCertificate) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return c.registeredOCSPResponse(req, record)
+	}
+	// RFC 6960 allows answering unknown for serials the CA never issued
+	now := c.Clock.Now().Truncate(time.Second)
+	return c.Responder.sign(ocsp.Response{
+		Status: ocsp.Unknown,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate: now,
+		IssuerHash: req.HashAlgorithm,
+	})
+}
+
+// Get the signed response for a registered certificate
+func (c *CA) registeredOCSPResponse(req *ocsp.Request, record *ctca.CertificateRecord) ([]byte, error) {
+	timestamp, ok := c.latestCASRDTimestamp(record.RevocationType)
+	if !ok {
+		return nil, nil
+	}
+	cacheKey := fmt.Sprintf("%s/%v", record.Serial, req.HashAlgorithm)
+	if response, ok := c.Responder.cachedResponse(record.RevocationType, timestamp, cacheKey); ok {
+		return response, nil
+	}
+
+	thisUpdate := time.Unix(int64(timestamp), 0).UTC()
+	template := ocsp.Response{
+		Status: ocsp.Good,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate: thisUpdate,
+		NextUpdate: thisUpdate.Add(time.Duration(c.RevocationTypeMMD(record.RevocationType)) * time.Second),
+		IssuerHash: req.HashAlgorithm,
+	}
+	if state, ok := c.RevocationObjMap[record.RevocationType]; ok {
+		if reason, revoked := state.RevocationReason(record.RevocationNum); revoked {
+			revocationTimes, err := c.crlRevocationTimes(record.RevocationType, timestamp)
+			if err != nil {
+				return nil, err
+			}
+			template.Status = ocsp.Revoked
+			template.RevocationReason = int(reason)
+			template.RevokedAt = thisUpdate
+			if revokedAt, ok := revocationTimes[record.Serial]; ok {
+				template.RevokedAt = revokedAt
+			}
+		}
+	}
+	response, err := c.Responder.sign(template)
+	if err != nil {
+		return nil, err
+	}
+	c.Responder.cacheResponse(record.RevocationType, timestamp, cacheKey, response)
+	return response, nil
+}
+
+// Get the cached response of revType signed for the MMD at timestamp
+func (r *OCSPResponder) cachedResponse(revType string, timestamp uint64, cacheKey string) ([]byte, bool) {
+	r.Lock()
+	defer r.Unlock()
+	cached, ok := r.responses[revType]
+	if !ok || cached.timestamp != timestamp {
+		return nil, false
+	}
+	response, ok := cached.responses[cacheKey]
+	return response, ok
+}
+
+// Cache a response of revType signed for the MMD at timestamp. The responses of an earlier MMD are dropped, and a
+// response of an earlier MMD, signed while a newer one was cut over, is not cached
+func (r *OCSPResponder) cacheResponse(revType string, timestamp uint64, cacheKey string, response []byte) {
+	r.Lock()
+	defer r.Unlock()
+	cached, ok := r.responses[revType]
+	if ok && cached.timestamp > timestamp {
+		return
+	}
+	if !ok || cached.timestamp < timestamp {
+		cached = cachedOCSPResponses{timestamp: timestamp, responses: make(map[string] []byte)}
+		r.responses[revType] = cached
+	}
+	cached.responses[cacheKey] = response
+}
+
+// Get the revocation time of every serial in the full CRL of revType, so OCSP and the CRL agree on them
+func (c *CA) crlRevocationTimes(revType string, timestamp uint64) (map[string] time.Time, error) {
+	c.Responder.Lock()
+	cached, ok := c.Responder.revocationTimes[revType]
+	c.Responder.Unlock()
+	if ok && cached.timestamp == timestamp {
+		return cached.times, nil
+	}
+	times := make(map[string] time.Time)
+	der, err := c.GetCRL(revType, false)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		crl, err := x509.ParseCertificateListDER(der)
+		if x509.IsFatal(err) {
+			return nil, fmt.Errorf("failed to parse CRL of revType (%v): %w", revType, err)
+		}
+		for _, revoked := range crl.TBSCertList.RevokedCertificates {
+			times[ctca.SerialString(revoked.SerialNumber)] = revoked.RevocationTime
+		}
+	}
+	c.Responder.Lock()
+	c.Responder.revocationTimes[revType] = cachedRevocationTimes{timestamp: timestamp, times: times}
+	c.Responder.Unlock()
+	return times, nil
+}
+
+// Sign an OCSP response with the responder key and include the responder certificate
+func (r *OCSPResponder) sign(template ocsp.Response) ([]byte, error) {
+	template.Certificate = r.responder
+	response, err := ocsp.CreateResponse(r.issuer, r.responder, template, r.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign OCSP response: %w", err)
+	}
+	return response, nil
+}
+
+// Get the timestamp of the most recent SRD of revType
+func (c *CA) latestCASRDTimestamp(revType string) (uint64, bool) {
+	latest, ok := c.latestCASRDTimestamps[revType]
+	return latest, ok
+}
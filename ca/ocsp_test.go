@@ -0,0 +1,152 @@
+package ca
+
+import (
+	"testing"
+	"bytes"
+	"errors"
+	"math/big"
+	stdx509 "crypto/x509"
+
+	"github.com/google/certificate-transparency-go/x509"
+	"golang.org/x/crypto/ocsp"
+	ctca "github.com/n-ct/ct-certificate-authority"
+)
+
+// Ask the OCSP responder of c about cert and parse the answer
+func mustRespondOCSP(t *testing.T, c *CA, cert *stdx509.Certificate, issuer *stdx509.Certificate) ([]byte, *ocsp.Response, error) {
+	t.Helper()
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		t.Fatalf("failed to create OCSP request: %v", err)
+	}
+	der := c.RespondOCSP(req)
+	resp, err := ocsp.ParseResponseForCert(der, cert, issuer)
+	return der, resp, err
+}
+
+func TestRespondOCSP(t *testing.T) {
+	storage := NewMemoryStorage()
+	newCA := mustGetCAWithStorage(t, storage)
+	csr, err := ctca.DecodeCertificateRequest(mustCreateCertificateRequest(t))
+	if err != nil {
+		t.Fatalf("failed to decode certificate request: %v", err)
+	}
+	issued, err := newCA.IssueCertificate(revType, csr)
+	if err != nil {
+		t.Fatalf("failed to issue certificate: %v", err)
+	}
+	cert, err := stdx509.ParseCertificate(issued.Certificate)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	issuer, err := stdx509.ParseCertificate(newCA.Issuer.Certificate.Raw)
+	if err != nil {
+		t.Fatalf("failed to parse issuer certificate: %v", err)
+	}
+	if len(cert.OCSPServer) != 1 || cert.OCSPServer[0] != newCA.OCSPServer() {
+		t.Fatalf("certificate points to OCSP servers (%v)", cert.OCSPServer)
+	}
+
+	// Nothing is answered before the first CRV is published
+	var respErr ocsp.ResponseError
+	if _, _, err := mustRespondOCSP(t, newCA, cert, issuer); !errors.As(err, &respErr) || respErr.Status != ocsp.TryLater {
+		t.Fatalf("expected tryLater before the first MMD, got: %v", err)
+	}
+
+	mustDoMMD(t, newCA)
+	goodDER, resp, err := mustRespondOCSP(t, newCA, cert, issuer)
+	if err != nil {
+		t.Fatalf("failed to parse OCSP response: %v", err)
+	}
+	if resp.Status != ocsp.Good || resp.SerialNumber.Cmp(cert.SerialNumber) != 0 || uint64(resp.ThisUpdate.Unix()) != newCA.PreviousMMDTimestamp {
+		t.Fatalf("unexpected OCSP response (status %v, serial %v, thisUpdate %v)", resp.Status, resp.SerialNumber, resp.ThisUpdate)
+	}
+	if resp.Certificate == nil || !bytes.Equal(resp.Certificate.Raw, newCA.Responder.Certificate.Raw) {
+		t.Fatalf("OCSP response is not signed by the delegated responder")
+	}
+
+	// A revocation only shows once it is part of the CRV, and until then the cached response is served
+	ctCert, err := x509.ParseCertificate(issued.Certificate)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	if _, err := newCA.RevokeCertificate(revType, ctCert, ctca.KeyCompromise); err != nil {
+		t.Fatalf("failed to revoke certificate: %v", err)
+	}
+	cachedDER, _, err := mustRespondOCSP(t, newCA, cert, issuer)
+	if err != nil || !bytes.Equal(cachedDER, goodDER) {
+		t.Fatalf("expected the cached good response before the next MMD (%v)", err)
+	}
+	mustDoMMD(t, newCA)
+	_, resp, err = mustRespondOCSP(t, newCA, cert, issuer)
+	if err != nil {
+		t.Fatalf("failed to parse OCSP response: %v", err)
+	}
+	if resp.Status != ocsp.Revoked || resp.RevocationReason != ocsp.KeyCompromise || uint64(resp.RevokedAt.Unix()) != newCA.PreviousMMDTimestamp {
+		t.Fatalf("unexpected OCSP response (status %v, reason %v, revokedAt %v)", resp.Status, resp.RevocationReason, resp.RevokedAt)
+	}
+
+	// Serials the CA never registered are unknown
+	unknownCert := *cert
+	unknownCert.SerialNumber = big.NewInt(12345)
+	if _, resp, err := mustRespondOCSP(t, newCA, &unknownCert, issuer); err != nil || resp.Status != ocsp.Unknown {
+		t.Fatalf("expected unknown status for unregistered serial, got (%v, %v)", resp, err)
+	}
+
+	// Requests for certificates of another issuer are unauthorized
+	otherIssuer := *issuer
+	otherIssuer.RawSubject = append([]byte{}, issuer.RawSubject...)
+	otherIssuer.RawSubject[len(otherIssuer.RawSubject)-1] ^= 0xff
+	req, err := ocsp.CreateRequest(cert, &otherIssuer, nil)
+	if err != nil {
+		t.Fatalf("failed to create OCSP request: %v", err)
+	}
+	if _, err := ocsp.ParseResponse(newCA.RespondOCSP(req), nil); !errors.As(err, &respErr) || respErr.Status != ocsp.Unauthorized {
+		t.Fatalf("expected unauthorized for another issuer, got: %v", err)
+	}
+	if _, err := ocsp.ParseResponse(newCA.RespondOCSP([]byte("not a request")), nil); !errors.As(err, &respErr) || respErr.Status != ocsp.Malformed {
+		t.Fatalf("expected malformed for an invalid request, got: %v", err)
+	}
+
+	// The responder key and certificate survive a restart
+	reloadedCA := mustGetCAWithStorage(t, storage)
+	if !bytes.Equal(reloadedCA.Responder.Certificate.Raw, newCA.Responder.Certificate.Raw) {
+		t.Fatalf("OCSP responder certificate changed across restart")
+	}
+}
+
+func TestOCSPResponseCacheKeepsCurrentMMD(t *testing.T) {
+	newCA := mustGetCAWithStorage(t, NewMemoryStorage())
+	issuer, err := stdx509.ParseCertificate(newCA.Issuer.Certificate.Raw)
+	if err != nil {
+		t.Fatalf("failed to parse issuer certificate: %v", err)
+	}
+	certs := []*stdx509.Certificate{}
+	for i := 0; i < 3; i++ {
+		csr, err := ctca.DecodeCertificateRequest(mustCreateCertificateRequest(t))
+		if err != nil {
+			t.Fatalf("failed to decode certificate request: %v", err)
+		}
+		issued, err := newCA.IssueCertificate(revType, csr)
+		if err != nil {
+			t.Fatalf("failed to issue certificate: %v", err)
+		}
+		cert, err := stdx509.ParseCertificate(issued.Certificate)
+		if err != nil {
+			t.Fatalf("failed to parse certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	// Every MMD asks about another serial, and only the responses of the latest MMD stay cached
+	for _, cert := range certs {
+		mustDoMMD(t, newCA)
+		if _, _, err := mustRespondOCSP(t, newCA, cert, issuer); err != nil {
+			t.Fatalf("failed to parse OCSP response: %v", err)
+		}
+		cached := newCA.Responder.responses[revType]
+		if cached.timestamp != newCA.PreviousMMDTimestamp || len(cached.responses) != 1 {
+			t.Fatalf("cache holds (%v) responses of (%v) at MMD (%v)", len(cached.responses), cached.timestamp, newCA.PreviousMMDTimestamp)
+		}
+	}
+}
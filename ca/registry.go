@@ -0,0 +1,297 @@
+package ca
+
+import (
+	"errors"
+	"fmt"
+	"encoding/json"
+	"sync"
+
+	ctca "github.com/n-ct/ct-certificate-authority"
+	"github.com/n-ct/ct-certificate-authority/clock"
+)
+
+const (
+	certificateBucket = "certificates"
+)
+
+var (
+	// Returned when a lookup names a certificate that has no revocation number
+	ErrUnknownCertificate = errors.New("certificate is not registered")
+	// Returned when a certificate would share its fingerprint or serial with a different registered certificate
+	ErrCertificateConflict = errors.New("certificate conflicts with a registered certificate")
+)
+
+// CertificateRegistry assigns every certificate a unique revocation number of each revocation type and
+// remembers it by the SHA-256 fingerprint and the serial of the certificate.
+// Numbers are handed out in order within the expiration bucket of the certificate and are never reused, and only in the
+// buckets that are live at the time of the assignment.
+// Every record is persisted before it is returned, so a number is never assigned twice across restarts
+type CertificateRegistry struct {
+	storage Storage
+	revocationTypes map[string] ctca.RevocationType
+	clock clock.Clock	// Source of the time the live buckets are taken at
+	records map[string]map[uint64] *ctca.CertificateRecord	// Records of each revType by revocation number
+	fingerprints map[string]map[string] uint64	// Revocation numbers of each revType by fingerprint
+	serials map[string]map[string] uint64	// Revocation numbers of each revType by serial
+	nextIndex map[string]map[uint64] uint64	// Next unassigned index of each bucket of each revType
+	sync.RWMutex
+}
+
+// Create a CertificateRegistry for revocationTypes and load the records already persisted in storage
+func NewCertificateRegistry(storage Storage, revocationTypes map[string] ctca.RevocationType, clk clock.Clock) (*CertificateRegistry, error) {
+	r := &CertificateRegistry{
+		storage: storage,
+		revocationTypes: revocationTypes,
+		clock: clk,
+		records: make(map[string]map[uint64] *ctca.CertificateRecord),
+		fingerprints: make(map[string]map[string] uint64),
+		serials: make(map[string]map[string] uint64),
+		nextIndex: make(map[string]map[uint64] uint64),
+	}
+	keys, err := storage.Keys(certificateBucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list certificate records: %w", err)
+	}
+	for _, key := range keys {
+		value, err := storage.Get(certificateBucket, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get certificate record (%v): %w", key, err)
+		}
+		var record ctca.CertificateRecord
+		if err := json.Unmarshal(value, &record); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal certificate record (%v): %w", key, err)
+		}
+		r.add(&record)
+	}
+	return r, nil
+}
+
+// Keys are built so that the sorted order of the bucket is also the revocation number order of each revType
+func certificateRecordKey(revType string, revocationNum uint64) string {
+	return fmt.Sprintf("%s/%020d", revType, revocationNum)
+}
+
+// Add a record to the lookup maps and move the next index of its bucket past it
+func (r *CertificateRegistry) add(record *ctca.CertificateRecord) {
+	revType := record.RevocationType
+	if _, ok := r.records[revType]; !ok {
+		r.records[revType] = make(map[uint64] *ctca.CertificateRecord)
+		r.fingerprints[revType] = make(map[string] uint64)
+		r.serials[revType] = make(map[string] uint64)
+		r.nextIndex[revType] = make(map[uint64] uint64)
+	}
+	r.records[revType][record.RevocationNum] = record
+	r.fingerprints[revType][record.Fingerprint] = record.RevocationNum
+	if record.PrecertificateFingerprint != "" {
+		r.fingerprints[revType][record.PrecertificateFingerprint] = record.RevocationNum
+	}
+	r.serials[revType][record.Serial] = record.RevocationNum
+	bucket, index := ctca.SplitRevocationNum(record.RevocationNum)
+	if index >= r.nextIndex[revType][bucket] {
+		r.nextIndex[revType][bucket] = index + 1
+	}
+}
+
+// Assign the next revocation number of the expiration bucket of the certificate.
+// A certificate that already has a revocation number of revType keeps it. A certificate whose expiration bucket is not
+// live is rejected with a *ctca.ExpirationBucketError
+func (r *CertificateRegistry) Assign(revType string, fingerprint string, serial string, notAfter uint64) (*ctca.CertificateRecord, error) {
+	revocationType, ok := r.revocationTypes[revType]
+	if !ok {
+		return nil, fmt.Errorf("unknown revocation type (%v)", revType)
+	}
+	fingerprint, err := ctca.NormalizeFingerprint(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	serial, err = ctca.NormalizeSerial(serial)
+	if err != nil {
+		return nil, err
+	}
+	if notAfter == 0 {
+		return nil, fmt.Errorf("certificate (%v) is missing its expiration", fingerprint)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if revocationNum, ok := r.fingerprints[revType][fingerprint]; ok {
+		record := r.records[revType][revocationNum]
+		if record.Serial != serial || record.NotAfter != notAfter {
+			return nil, fmt.Errorf("fingerprint (%v) is registered with serial (%v): %w", fingerprint, record.Serial, ErrCertificateConflict)
+		}
+		copied := *record
+		return &copied, nil
+	}
+	if revocationNum, ok := r.serials[revType][serial]; ok {
+		return nil, fmt.Errorf("serial (%v) is registered to fingerprint (%v): %w", serial, r.records[revType][revocationNum].Fingerprint, ErrCertificateConflict)
+	}
+
+	revocationNum, err := r.nextRevocationNum(revocationType, notAfter)
+	if err != nil {
+		return nil, err
+	}
+	record := &ctca.CertificateRecord{
+		RevocationType: revType,
+		RevocationNum: revocationNum,
+		Fingerprint: fingerprint,
+		Serial: serial,
+		NotAfter: notAfter,
+	}
+	if err := r.store(record); err != nil {
+		return nil, err
+	}
+	copied := *record
+	return &copied, nil
+}
+
+// Assign the next revocation number of the expiration bucket of a certificate that does not exist yet.
+// issue creates the DER certificate carrying the revocation number, which is then registered under its fingerprint.
+// Nothing is registered if issue fails or, with a *ctca.ExpirationBucketError, if the expiration bucket is not live
+func (r *CertificateRegistry) AssignAndIssue(revType string, serial string, notAfter uint64, issue func(revocationNum uint64) ([]byte, error)) (*ctca.CertificateRecord, []byte, error) {
+	revocationType, ok := r.revocationTypes[revType]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown revocation type (%v)", revType)
+	}
+	serial, err := ctca.NormalizeSerial(serial)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.serials[revType][serial]; ok {
+		return nil, nil, fmt.Errorf("serial (%v) is already registered: %w", serial, ErrCertificateConflict)
+	}
+	revocationNum, err := r.nextRevocationNum(revocationType, notAfter)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := issue(revocationNum)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to issue certificate with revocation num (%v): %w", revocationNum, err)
+	}
+	record := &ctca.CertificateRecord{
+		RevocationType: revType,
+		RevocationNum: revocationNum,
+		Fingerprint: ctca.CertificateFingerprint(der),
+		Serial: serial,
+		NotAfter: notAfter,
+	}
+	if err := r.store(record); err != nil {
+		return nil, nil, err
+	}
+	copied := *record
+	return &copied, der, nil
+}
+
+// Register the final certificate of a precertificate registered by AssignAndIssue under fingerprint.
+// The precertificate stays registered under its own fingerprint
+func (r *CertificateRegistry) AddFinalCertificate(revType string, revocationNum uint64, fingerprint string) (*ctca.CertificateRecord, error) {
+	fingerprint, err := ctca.NormalizeFingerprint(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	r.Lock()
+	defer r.Unlock()
+	record, ok := r.records[revType][revocationNum]
+	if !ok {
+		return nil, fmt.Errorf("revocation num (%v) of revType (%v): %w", revocationNum, revType, ErrUnknownCertificate)
+	}
+	if record.PrecertificateFingerprint != "" {
+		return nil, fmt.Errorf("revocation num (%v) already has a final certificate: %w", revocationNum, ErrCertificateConflict)
+	}
+	if other, ok := r.fingerprints[revType][fingerprint]; ok && other != revocationNum {
+		return nil, fmt.Errorf("fingerprint (%v) is registered to revocation num (%v): %w", fingerprint, other, ErrCertificateConflict)
+	}
+	updated := *record
+	updated.PrecertificateFingerprint = record.Fingerprint
+	updated.Fingerprint = fingerprint
+	if err := r.store(&updated); err != nil {
+		return nil, err
+	}
+	copied := updated
+	return &copied, nil
+}
+
+// Get the next unassigned revocation number of the expiration bucket of notAfter. The caller must hold the lock
+func (r *CertificateRegistry) nextRevocationNum(revocationType ctca.RevocationType, notAfter uint64) (uint64, error) {
+	bucket := revocationType.ExpirationBucket(notAfter)
+	revocationNum := ctca.JoinRevocationNum(bucket, r.nextIndex[revocationType.Name()][bucket])
+	if err := revocationType.ValidateRevocationNums([]uint64{revocationNum}); err != nil {
+		return 0, fmt.Errorf("failed to assign revocation num in bucket (%v): %w", bucket, err)
+	}
+	// The CA would reject every revocation of a number in a bucket that is not live
+	if err := ctca.ValidateExpirationBuckets(revocationType, []uint64{revocationNum}, uint64(r.clock.Now().Unix())); err != nil {
+		return 0, fmt.Errorf("failed to assign revocation num in bucket (%v): %w", bucket, err)
+	}
+	return revocationNum, nil
+}
+
+// Get the number of revocation numbers of revType assigned in each bucket. Numbers are assigned in index order, so
+// this is also the next index each bucket assigns
+func (r *CertificateRegistry) Assigned(revType string) map[uint64] uint64 {
+	r.RLock()
+	defer r.RUnlock()
+	assigned := make(map[uint64] uint64)
+	for bucket, nextIndex := range r.nextIndex[revType] {
+		assigned[bucket] = nextIndex
+	}
+	return assigned
+}
+
+// Persist a record and add it to the lookup maps. The caller must hold the lock
+func (r *CertificateRegistry) store(record *ctca.CertificateRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal certificate record: %w", err)
+	}
+	if err := r.storage.Put(certificateBucket, certificateRecordKey(record.RevocationType, record.RevocationNum), value); err != nil {
+		return fmt.Errorf("failed to store certificate record: %w", err)
+	}
+	r.add(record)
+	return nil
+}
+
+// Get the record of the certificate of revType with the given fingerprint
+func (r *CertificateRegistry) ByFingerprint(revType string, fingerprint string) (*ctca.CertificateRecord, error) {
+	fingerprint, err := ctca.NormalizeFingerprint(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	r.RLock()
+	defer r.RUnlock()
+	revocationNum, ok := r.fingerprints[revType][fingerprint]
+	if !ok {
+		return nil, fmt.Errorf("fingerprint (%v) of revType (%v): %w", fingerprint, revType, ErrUnknownCertificate)
+	}
+	copied := *r.records[revType][revocationNum]
+	return &copied, nil
+}
+
+// Get the record of the certificate of revType with the given serial
+func (r *CertificateRegistry) BySerial(revType string, serial string) (*ctca.CertificateRecord, error) {
+	serial, err := ctca.NormalizeSerial(serial)
+	if err != nil {
+		return nil, err
+	}
+	r.RLock()
+	defer r.RUnlock()
+	revocationNum, ok := r.serials[revType][serial]
+	if !ok {
+		return nil, fmt.Errorf("serial (%v) of revType (%v): %w", serial, revType, ErrUnknownCertificate)
+	}
+	copied := *r.records[revType][revocationNum]
+	return &copied, nil
+}
+
+// Get the record of the certificate of revType with the given revocation number
+func (r *CertificateRegistry) ByRevocationNum(revType string, revocationNum uint64) (*ctca.CertificateRecord, error) {
+	r.RLock()
+	defer r.RUnlock()
+	record, ok := r.records[revType][revocationNum]
+	if !ok {
+		return nil, fmt.Errorf("revocation num (%v) of revType (%v): %w", revocationNum, revType, ErrUnknownCertificate)
+	}
+	copied := *record
+	return &copied, nil
+}
@@ -0,0 +1,81 @@
+package ca
+
+import (
+	"testing"
+	"errors"
+	"strings"
+
+	ctca "github.com/n-ct/ct-certificate-authority"
+)
+
+func TestCertificateRegistryAssignsAndPersistsRevocationNums(t *testing.T) {
+	storage := NewMemoryStorage()
+	firstCA := mustGetCAWithStorage(t, storage)
+	notAfter := uint64(certificateNotAfter.Unix())
+	bucket := ctca.ExpirationBucket(notAfter, ctca.DefaultBucketDuration)
+	firstFingerprint := strings.Repeat("ab", 32)
+	secondFingerprint := strings.Repeat("cd", 32)
+
+	firstRecord, err := firstCA.Registry.Assign(revType, firstFingerprint, "0a", notAfter)
+	if err != nil {
+		t.Fatalf("failed to assign revocation num: %v", err)
+	}
+	secondRecord, err := firstCA.Registry.Assign(revType, strings.ToUpper(secondFingerprint), "0B", notAfter)
+	if err != nil {
+		t.Fatalf("failed to assign revocation num: %v", err)
+	}
+	if firstRecord.RevocationNum != ctca.JoinRevocationNum(bucket, 0) || secondRecord.RevocationNum != ctca.JoinRevocationNum(bucket, 1) {
+		t.Fatalf("revocation nums (%v, %v) not assigned in order within bucket (%v)", firstRecord.RevocationNum, secondRecord.RevocationNum, bucket)
+	}
+	sameRecord, err := firstCA.Registry.Assign(revType, firstFingerprint, "a", notAfter)
+	if err != nil || *sameRecord != *firstRecord {
+		t.Fatalf("assigning the same certificate again returned (%+v, %v) instead of (%+v)", sameRecord, err, firstRecord)
+	}
+	if _, err := firstCA.Registry.Assign(revType, strings.Repeat("ef", 32), "a", notAfter); !errors.Is(err, ErrCertificateConflict) {
+		t.Fatalf("expected ErrCertificateConflict for reused serial, got: %v", err)
+	}
+
+	// The revocations of a certificate that has already expired would be rejected, so it gets no revocation number
+	expiredNotAfter := uint64(3 * ctca.DefaultBucketDuration + 5)
+	var bucketErr *ctca.ExpirationBucketError
+	if _, err := firstCA.Registry.Assign(revType, strings.Repeat("ef", 32), "e", expiredNotAfter); !errors.As(err, &bucketErr) {
+		t.Fatalf("expected ExpirationBucketError for expired certificate, got: %v", err)
+	}
+	issue := func(revocationNum uint64) ([]byte, error) {
+		t.Fatalf("issued certificate with revocation num (%v) in a bucket that is not live", revocationNum)
+		return nil, nil
+	}
+	if _, _, err := firstCA.Registry.AssignAndIssue(revType, "f", expiredNotAfter, issue); !errors.As(err, &bucketErr) {
+		t.Fatalf("expected ExpirationBucketError for expired certificate, got: %v", err)
+	}
+
+	// A restarted CA finds the records and continues after the last assigned index
+	secondCA := mustGetCAWithStorage(t, storage)
+	record, err := secondCA.Registry.BySerial(revType, "0b")
+	if err != nil || *record != *secondRecord {
+		t.Fatalf("reloaded record (%+v, %v) not equal to assigned record (%+v)", record, err, secondRecord)
+	}
+	if _, err := secondCA.Registry.ByFingerprint(revType, strings.Repeat("00", 32)); !errors.Is(err, ErrUnknownCertificate) {
+		t.Fatalf("expected ErrUnknownCertificate for unregistered fingerprint, got: %v", err)
+	}
+	thirdRecord, err := secondCA.Registry.Assign(revType, strings.Repeat("12", 32), "c", notAfter)
+	if err != nil {
+		t.Fatalf("failed to assign revocation num: %v", err)
+	}
+	if thirdRecord.RevocationNum != ctca.JoinRevocationNum(bucket, 2) {
+		t.Fatalf("revocation num (%v) reassigned an index of bucket (%v)", thirdRecord.RevocationNum, bucket)
+	}
+
+	certRevocations := []ctca.CertificateRevocation{{Fingerprint: firstFingerprint, Reason: ctca.KeyCompromise}, {Serial: "0c"}}
+	revocations, err := secondCA.ResolveCertificateRevocations(revType, certRevocations)
+	if err != nil {
+		t.Fatalf("failed to resolve certificate revocations: %v", err)
+	}
+	expectedRevocations := []ctca.Revocation{{RevocationNum: firstRecord.RevocationNum, Reason: ctca.KeyCompromise}, {RevocationNum: thirdRecord.RevocationNum}}
+	if len(revocations) != 2 || revocations[0] != expectedRevocations[0] || revocations[1] != expectedRevocations[1] {
+		t.Fatalf("resolved revocations (%v) not equal to (%v)", revocations, expectedRevocations)
+	}
+	if _, err := secondCA.ResolveCertificateRevocations(revType, []ctca.CertificateRevocation{{Serial: "ff"}}); !errors.Is(err, ErrUnknownCertificate) {
+		t.Fatalf("expected ErrUnknownCertificate for unregistered serial, got: %v", err)
+	}
+}
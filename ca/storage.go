@@ -0,0 +1,376 @@
+package ca
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"encoding/json"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/google/certificate-transparency-go/tls"
+
+	mtr "github.com/n-ct/ct-monitor"
+	ctca "github.com/n-ct/ct-certificate-authority"
+)
+
+// Bucket and key names used to persist the state of the CA
+const (
+	crvBucket 		= "crvs"
+	caSRDBucket 	= "ca_srds"
+	logSRDBucket 	= "log_srds"
+	metaBucket 		= "meta"
+	previousMMDTimestampKey = "previous_mmd_timestamp"
+)
+
+// Returned by Storage.Get when the key does not exist
+var ErrNotFound = errors.New("key not found in storage")
+
+// Storage persists the state of the CA so that it survives restarts.
+// Values are grouped into buckets and addressed by a key within their bucket.
+// Journals are append only logs of records. A record is durable once AppendJournal returns
+type Storage interface {
+	Put(bucket string, key string, value []byte) error
+	Get(bucket string, key string) ([]byte, error)
+	Delete(bucket string, key string) error
+	Keys(bucket string) ([]string, error)	// Keys of a bucket in sorted order
+	AppendJournal(journal string, record []byte) error
+	ReadJournal(journal string) ([][]byte, error)	// Records in the order they were appended
+	TruncateJournal(journal string) error
+	Close() error
+}
+
+// Stores the most recent CRV of a revocation type along with the timestamp of the SRD it belongs to
+type storedCRV struct {
+	Timestamp 	uint64
+	CRV 		[]byte	// Encoded RevocationState
+}
+
+// MemoryStorage keeps the state of the CA in memory. Nothing survives a restart
+type MemoryStorage struct {
+	buckets map[string]map[string][]byte
+	journals map[string][][]byte
+	sync.RWMutex
+}
+
+// Create a new empty MemoryStorage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		buckets: make(map[string]map[string][]byte),
+		journals: make(map[string][][]byte),
+	}
+}
+
+// Store value under the given bucket and key
+func (m *MemoryStorage) Put(bucket string, key string, value []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.buckets[bucket]; !ok {
+		m.buckets[bucket] = make(map[string][]byte)
+	}
+	m.buckets[bucket][key] = append([]byte{}, value...)
+	return nil
+}
+
+// Get the value stored under the given bucket and key
+func (m *MemoryStorage) Get(bucket string, key string) ([]byte, error) {
+	m.RLock()
+	defer m.RUnlock()
+	value, ok := m.buckets[bucket][key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, value...), nil
+}
+
+// Delete the value stored under the given bucket and key
+func (m *MemoryStorage) Delete(bucket string, key string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.buckets[bucket], key)
+	return nil
+}
+
+// Get the sorted keys of a bucket
+func (m *MemoryStorage) Keys(bucket string) ([]string, error) {
+	m.RLock()
+	defer m.RUnlock()
+	keys := []string{}
+	for key := range m.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Append record to the end of journal
+func (m *MemoryStorage) AppendJournal(journal string, record []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	m.journals[journal] = append(m.journals[journal], append([]byte{}, record...))
+	return nil
+}
+
+// Get every record of journal
+func (m *MemoryStorage) ReadJournal(journal string) ([][]byte, error) {
+	m.RLock()
+	defer m.RUnlock()
+	records := [][]byte{}
+	for _, record := range m.journals[journal] {
+		records = append(records, append([]byte{}, record...))
+	}
+	return records, nil
+}
+
+// Remove every record of journal
+func (m *MemoryStorage) TruncateJournal(journal string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.journals, journal)
+	return nil
+}
+
+// Nothing to release for MemoryStorage
+func (m *MemoryStorage) Close() error {
+	return nil
+}
+
+// Create the storage described by caConfig. An empty storage dir keeps everything in memory
+func createStorage(caConfig *CAConfig) (Storage, error) {
+	if caConfig.StorageDir == "" {
+		glog.Warningln("No storage_dir configured. CA state will not survive a restart")
+		return NewMemoryStorage(), nil
+	}
+	storage, err := NewFileStorage(caConfig.StorageDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage: %w", err)
+	}
+	return storage, nil
+}
+
+// Keys are built so that the sorted order of a bucket is also the timestamp order of each revType
+func caSRDKey(revType string, timestamp uint64) string {
+	return fmt.Sprintf("%s/%020d", revType, timestamp)
+}
+
+func logSRDKey(revType string, timestamp uint64, logID string) string {
+	return fmt.Sprintf("%s/%020d/%s", revType, timestamp, logID)
+}
+
+// Persist an SRD produced by the CA
+func (c *CA) saveCASRD(srd *mtr.SRDWithRevData) error {
+	srdBytes, err := json.Marshal(srd)
+	if err != nil {
+		return fmt.Errorf("failed to marshal caSRD for storage: %w", err)
+	}
+	key := caSRDKey(srd.RevData.RevocationType, srd.RevData.Timestamp)
+	if err := c.Storage.Put(caSRDBucket, key, srdBytes); err != nil {
+		return fmt.Errorf("failed to store caSRD (%v): %w", key, err)
+	}
+	return nil
+}
+
+// Persist an SRD produced by a Logger
+func (c *CA) saveLogSRD(srd *mtr.SRDWithRevData) error {
+	srdBytes, err := json.Marshal(srd)
+	if err != nil {
+		return fmt.Errorf("failed to marshal logSRD for storage: %w", err)
+	}
+	key := logSRDKey(srd.RevData.RevocationType, srd.RevData.Timestamp, srd.SRD.EntityID)
+	if err := c.Storage.Put(logSRDBucket, key, srdBytes); err != nil {
+		return fmt.Errorf("failed to store logSRD (%v): %w", key, err)
+	}
+	return nil
+}
+
+// Persist the current CRV of revType. timestamp is the timestamp of the SRD that commits to the CRV
+func (c *CA) saveCRV(revType string, timestamp uint64) error {
+	state, ok := c.RevocationObjMap[revType]
+	if !ok {
+		return fmt.Errorf("failed to find revType (%v) in revocationObj map", revType)
+	}
+	compCRV, err := state.Encode()
+	if err != nil {
+		return fmt.Errorf("failed to encode crv for storage: %w", err)
+	}
+	crvBytes, err := json.Marshal(storedCRV{Timestamp: timestamp, CRV: compCRV})
+	if err != nil {
+		return fmt.Errorf("failed to marshal crv for storage: %w", err)
+	}
+	if err := c.Storage.Put(crvBucket, revType, crvBytes); err != nil {
+		return fmt.Errorf("failed to store crv of revType (%v): %w", revType, err)
+	}
+	return nil
+}
+
+// Persist PreviousMMDTimestamp
+func (c *CA) saveMMDTimestamp() error {
+	timestamp := strconv.FormatUint(c.PreviousMMDTimestamp, 10)
+	if err := c.Storage.Put(metaBucket, previousMMDTimestampKey, []byte(timestamp)); err != nil {
+		return fmt.Errorf("failed to store previous mmd timestamp: %w", err)
+	}
+	return nil
+}
+
+// Load the state persisted in Storage into the CA
+func (c *CA) loadState() error {
+	if err := c.loadCASRDs(); err != nil {
+		return fmt.Errorf("failed to load state: %w", err)
+	}
+	if err := c.loadLogSRDs(); err != nil {
+		return fmt.Errorf("failed to load state: %w", err)
+	}
+	if err := c.loadCRVs(); err != nil {
+		return fmt.Errorf("failed to load state: %w", err)
+	}
+	timestamp, err := c.Storage.Get(metaBucket, previousMMDTimestampKey)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to load previous mmd timestamp: %w", err)
+	}
+	if err == nil {
+		c.PreviousMMDTimestamp, err = strconv.ParseUint(string(timestamp), 10, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse previous mmd timestamp: %w", err)
+		}
+	}
+	return nil
+}
+
+// Load every stored SRD produced by the CA into the CASignedDigestMap
+func (c *CA) loadCASRDs() error {
+	keys, err := c.Storage.Keys(caSRDBucket)
+	if err != nil {
+		return fmt.Errorf("failed to list caSRDs: %w", err)
+	}
+	for _, key := range keys {
+		var srd mtr.SRDWithRevData
+		if err := c.loadJSON(caSRDBucket, key, &srd); err != nil {
+			return err
+		}
+		c.putCASRD(&srd)
+	}
+	return nil
+}
+
+// Load every stored SRD produced by a Logger into the LogSignedDigestMap
+func (c *CA) loadLogSRDs() error {
+	keys, err := c.Storage.Keys(logSRDBucket)
+	if err != nil {
+		return fmt.Errorf("failed to list logSRDs: %w", err)
+	}
+	for _, key := range keys {
+		var srd mtr.SRDWithRevData
+		if err := c.loadJSON(logSRDBucket, key, &srd); err != nil {
+			return err
+		}
+		revType := srd.RevData.RevocationType
+		timestamp := srd.RevData.Timestamp
+		if _, ok := c.LogSignedDigestMap[revType]; !ok {
+			c.LogSignedDigestMap[revType] = make(map[uint64]map[string] *mtr.SRDWithRevData)
+		}
+		if _, ok := c.LogSignedDigestMap[revType][timestamp]; !ok {
+			c.LogSignedDigestMap[revType][timestamp] = make(map[string] *mtr.SRDWithRevData)
+		}
+		c.LogSignedDigestMap[revType][timestamp][srd.SRD.EntityID] = &srd
+	}
+	return nil
+}
+
+// Load the latest CRV of every revType. SRDs are always stored before their CRV, so if the process
+// died in between, the deltas of the newer SRDs are applied to bring the CRV up to date
+func (c *CA) loadCRVs() error {
+	crvKeys, err := c.Storage.Keys(crvBucket)
+	if err != nil {
+		return fmt.Errorf("failed to list crvs: %w", err)
+	}
+	for _, revType := range crvKeys {
+		if _, ok := c.RevocationTypes[revType]; !ok {
+			glog.Warningf("ignoring stored crv of unconfigured revocation type (%v)", revType)
+		}
+	}
+
+	for revType, revocationType := range c.RevocationTypes {
+		state := revocationType.NewState()
+		crvTimestamp := uint64(0)
+		var stored storedCRV
+		err := c.loadJSON(crvBucket, revType, &stored)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err == nil {
+			state, err = revocationType.DecodeState(stored.CRV)
+			if err != nil {
+				return fmt.Errorf("failed to decode stored crv of revType (%v): %w", revType, err)
+			}
+			crvTimestamp = stored.Timestamp
+		}
+
+		state, latestTimestamp, err := c.replaySRDDeltas(revocationType, state, crvTimestamp)
+		if err != nil {
+			return err
+		}
+		c.RevocationObjMap[revType] = state
+		if latestTimestamp != crvTimestamp {
+			if err := c.saveCRV(revType, latestTimestamp); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Apply the deltas of every SRD newer than crvTimestamp to state and check the result against the latest SRD.
+// Returns the replayed state and the timestamp of the SRD it belongs to
+func (c *CA) replaySRDDeltas(revocationType ctca.RevocationType, state ctca.RevocationState, crvTimestamp uint64) (ctca.RevocationState, uint64, error) {
+	revType := revocationType.Name()
+	timestamps := []uint64{}
+	for timestamp := range c.CASignedDigestMap[revType] {
+		if timestamp > crvTimestamp {
+			timestamps = append(timestamps, timestamp)
+		}
+	}
+	if len(timestamps) == 0 {
+		return state, crvTimestamp, nil
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	glog.Warningf("stored crv of revType (%v) is behind its SRDs. Replaying %v deltas", revType, len(timestamps))
+
+	var srd *mtr.SRDWithRevData
+	var delta ctca.RevocationDelta
+	for _, timestamp := range timestamps {
+		srd = c.CASignedDigestMap[revType][timestamp]
+		var err error
+		delta, err = revocationType.DecodeDelta(srd.RevData.CRVDelta)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to decode delta of caSRD (%v) of revType (%v): %w", timestamp, revType, err)
+		}
+		state, err = state.Apply(delta)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to apply delta of caSRD (%v) of revType (%v): %w", timestamp, revType, err)
+		}
+	}
+
+	// The replayed CRV must be the one the latest SRD committed to
+	revDigest, err := revocationType.Digest(state, delta, srd.RevData.Timestamp, tls.SHA256)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create digest of replayed crv of revType (%v): %w", revType, err)
+	}
+	if !bytes.Equal(revDigest.CRVHash, srd.SRD.RevDigest.CRVHash) {
+		return nil, 0, fmt.Errorf("replayed crv of revType (%v) does not match latest caSRD (%v)", revType, srd.RevData.Timestamp)
+	}
+	return state, srd.RevData.Timestamp, nil
+}
+
+// Get the value at bucket and key and unmarshal it into v
+func (c *CA) loadJSON(bucket string, key string, v interface{}) error {
+	value, err := c.Storage.Get(bucket, key)
+	if err != nil {
+		return fmt.Errorf("failed to get (%v) from bucket (%v): %w", key, bucket, err)
+	}
+	if err := json.Unmarshal(value, v); err != nil {
+		return fmt.Errorf("failed to unmarshal (%v) from bucket (%v): %w", key, bucket, err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package ca
+
+import (
+	"testing"
+	"errors"
+	"reflect"
+)
+
+func mustGetCAWithStorage(t *testing.T, storage Storage) *CA {
+	t.Helper()
+	newCA, err := NewCAWithStorage(caConfigName, caListName, logListName, storage)
+	if err != nil {
+		t.Fatalf("failed to create new CA: %v", err)
+	}
+	return newCA
+}
+
+func TestFileStorageRoundTrip(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create file storage: %v", err)
+	}
+	key := "Let's-Revoke/00000000000000000001"
+	value := []byte("value")
+	if err := storage.Put(caSRDBucket, key, value); err != nil {
+		t.Fatalf("failed to put value: %v", err)
+	}
+
+	storedValue, err := storage.Get(caSRDBucket, key)
+	if err != nil {
+		t.Fatalf("failed to get value: %v", err)
+	}
+	if !reflect.DeepEqual(storedValue, value) {
+		t.Fatalf("stored value (%v) not equal to value (%v)", storedValue, value)
+	}
+
+	keys, err := storage.Keys(caSRDBucket)
+	if err != nil {
+		t.Fatalf("failed to list keys: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{key}) {
+		t.Fatalf("keys (%v) not equal to stored keys (%v)", keys, []string{key})
+	}
+
+	if err := storage.Delete(caSRDBucket, key); err != nil {
+		t.Fatalf("failed to delete key: %v", err)
+	}
+	if _, err := storage.Get(caSRDBucket, key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for deleted key, got: %v", err)
+	}
+}
+
+func TestNewCAReloadsState(t *testing.T) {
+	storageDir := t.TempDir()
+	storage, err := NewFileStorage(storageDir)
+	if err != nil {
+		t.Fatalf("failed to create file storage: %v", err)
+	}
+	firstCA := mustGetCAWithStorage(t, storage)
+	revNumsList := []uint64{1, 2, 3}
+	if err := firstCA.AddRevocationNums(revType, &revNumsList); err != nil {
+		t.Fatalf("failed to add new revNums: %v", err)
+	}
+	if err := firstCA.DoRevocationTransparencyTasks(revType); err != nil {
+		t.Fatalf("failed to DoRevocationTransparencyTasks: %v", err)
+	}
+	if err := firstCA.Close(); err != nil {
+		t.Fatalf("failed to close CA: %v", err)
+	}
+
+	storage, err = NewFileStorage(storageDir)
+	if err != nil {
+		t.Fatalf("failed to reopen file storage: %v", err)
+	}
+	secondCA := mustGetCAWithStorage(t, storage)
+	if !secondCA.RevocationObjMap[revType].Equals(firstCA.RevocationObjMap[revType]) {
+		t.Fatalf("reloaded CRV (%v) not equal to previous CRV (%v)", secondCA.RevocationObjMap[revType], firstCA.RevocationObjMap[revType])
+	}
+	if _, err := secondCA.GetCASRD(revType, firstCA.PreviousMMDTimestamp); err != nil {
+		t.Fatalf("failed to get reloaded SRD: %v", err)
+	}
+	// A restart does not move on to the next MMD, the sequencer does once it is due
+	if secondCA.PreviousMMDTimestamp != firstCA.PreviousMMDTimestamp {
+		t.Fatalf("reloaded PreviousMMDTimestamp (%v) does not continue from previous (%v)", secondCA.PreviousMMDTimestamp, firstCA.PreviousMMDTimestamp)
+	}
+}
+
+func TestNewCAReplaysSRDsNewerThanStoredCRV(t *testing.T) {
+	storage := NewMemoryStorage()
+	firstCA := mustGetCAWithStorage(t, storage)
+	firstRevNumsList := []uint64{1, 2}
+	firstCA.AddRevocationNums(revType, &firstRevNumsList)
+	if err := firstCA.DoRevocationTransparencyTasks(revType); err != nil {
+		t.Fatalf("failed to DoRevocationTransparencyTasks: %v", err)
+	}
+	firstCA.ClearDeltaRevocations(revType)
+	staleCRV, err := storage.Get(crvBucket, revType)
+	if err != nil {
+		t.Fatalf("failed to get stored CRV: %v", err)
+	}
+
+	firstCA.UpdateMMD()
+	secondRevNumsList := []uint64{5}
+	firstCA.AddRevocationNums(revType, &secondRevNumsList)
+	if err := firstCA.DoRevocationTransparencyTasks(revType); err != nil {
+		t.Fatalf("failed to DoRevocationTransparencyTasks: %v", err)
+	}
+
+	// Simulate a crash after the SRD was stored but before the CRV was
+	if err := storage.Put(crvBucket, revType, staleCRV); err != nil {
+		t.Fatalf("failed to put stale CRV: %v", err)
+	}
+
+	secondCA := mustGetCAWithStorage(t, storage)
+	if !secondCA.RevocationObjMap[revType].Equals(firstCA.RevocationObjMap[revType]) {
+		t.Fatalf("replayed CRV (%v) not equal to previous CRV (%v)", secondCA.RevocationObjMap[revType], firstCA.RevocationObjMap[revType])
+	}
+}
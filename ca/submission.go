@@ -0,0 +1,160 @@
+package ca
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/golang/glog"
+	ct "github.com/google/certificate-transparency-go"
+	"github.com/google/certificate-transparency-go/tls"
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/certificate-transparency-go/x509/pkix"
+	"github.com/n-ct/ct-monitor/entitylist"
+	"github.com/n-ct/ct-monitor/utils"
+)
+
+// Time a log has to answer an add-pre-chain request
+const logSubmissionTimeout = 30 * time.Second
+
+// Returned when fewer logs than required returned a valid SCT for a precertificate
+var ErrInsufficientSCTs = errors.New("not enough logs returned a valid SCT")
+
+// Submit a precertificate signed by the issuer of the CA to every log in LogInfoMap with the RFC 6962 add-pre-chain API.
+// Returns the SCTs whose signature verifies with the key of their log, in the order of the log IDs.
+// Fails with ErrInsufficientSCTs when fewer than MinSCTs of the issuer are collected
+func (c *CA) SubmitPrecertificate(precert *x509.Certificate) ([]ct.SignedCertificateTimestamp, error) {
+	required := c.Issuer.MinSCTs
+	if required == 0 {
+		required = len(c.LogInfoMap)
+	}
+	if required > len(c.LogInfoMap) {
+		return nil, fmt.Errorf("%w: %v required but only %v logs are configured", ErrInsufficientSCTs, required, len(c.LogInfoMap))
+	}
+	logIDs := []string{}
+	for logID := range c.LogInfoMap {
+		logIDs = append(logIDs, logID)
+	}
+	sort.Strings(logIDs)
+
+	chain := []*x509.Certificate{precert, c.Issuer.Certificate}
+	client := &http.Client{Timeout: logSubmissionTimeout}
+	scts := make([]*ct.SignedCertificateTimestamp, len(logIDs))
+	var wg sync.WaitGroup
+	for i, logID := range logIDs {
+		wg.Add(1)
+		go func(i int, logInfo *entitylist.LogInfo) {
+			defer wg.Done()
+			sct, err := submitPrecertificateToLog(client, logInfo, chain)
+			if err != nil {
+				glog.Warningf("failed to submit precertificate to log (%v): %v", logInfo.LogID, err)
+				return
+			}
+			scts[i] = sct
+		}(i, c.LogInfoMap[logID])
+	}
+	wg.Wait()
+
+	collected := []ct.SignedCertificateTimestamp{}
+	for _, sct := range scts {
+		if sct != nil {
+			collected = append(collected, *sct)
+		}
+	}
+	if len(collected) < required {
+		return nil, fmt.Errorf("%w: got %v of %v", ErrInsufficientSCTs, len(collected), required)
+	}
+	return collected, nil
+}
+
+// Post chain to the add-pre-chain endpoint of a log and verify the returned SCT
+func submitPrecertificateToLog(client *http.Client, logInfo *entitylist.LogInfo, chain []*x509.Certificate) (*ct.SignedCertificateTimestamp, error) {
+	addChainReq := ct.AddChainRequest{}
+	for _, cert := range chain {
+		addChainReq.Chain = append(addChainReq.Chain, cert.Raw)
+	}
+	jsonBytes, err := json.Marshal(addChainReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal add-pre-chain request: %w", err)
+	}
+	resp, err := client.Post(utils.CreateRequestURL(logInfo.URL, ct.AddPreChainPath), "application/json", bytes.NewBuffer(jsonBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to post add-pre-chain request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read add-pre-chain response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("add-pre-chain returned status (%v): %s", resp.StatusCode, body)
+	}
+	var addChainResp ct.AddChainResponse
+	if err := json.Unmarshal(body, &addChainResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal add-pre-chain response: %w", err)
+	}
+	sct, err := addChainResp.ToSignedCertificateTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("invalid SCT: %w", err)
+	}
+	if err := verifyPrecertificateSCT(logInfo, chain, sct); err != nil {
+		return nil, err
+	}
+	return sct, nil
+}
+
+// Check that sct was issued by the log for the precertificate at the start of chain
+func verifyPrecertificateSCT(logInfo *entitylist.LogInfo, chain []*x509.Certificate, sct *ct.SignedCertificateTimestamp) error {
+	logID, err := base64.StdEncoding.DecodeString(logInfo.LogID)
+	if err != nil {
+		return fmt.Errorf("failed to decode log id (%v): %w", logInfo.LogID, err)
+	}
+	if !bytes.Equal(sct.LogID.KeyID[:], logID) {
+		return fmt.Errorf("SCT of log (%v) carries log id (%v)", logInfo.LogID, base64.StdEncoding.EncodeToString(sct.LogID.KeyID[:]))
+	}
+	publicKey, err := ct.PublicKeyFromB64(logInfo.Key)
+	if err != nil {
+		return fmt.Errorf("failed to parse key of log (%v): %w", logInfo.LogID, err)
+	}
+	verifier, err := ct.NewSignatureVerifier(publicKey)
+	if err != nil {
+		return fmt.Errorf("failed to create verifier for log (%v): %w", logInfo.LogID, err)
+	}
+	leaf, err := ct.MerkleTreeLeafFromChain(chain, ct.PrecertLogEntryType, sct.Timestamp)
+	if err != nil {
+		return fmt.Errorf("failed to build precertificate leaf: %w", err)
+	}
+	if err := verifier.VerifySCTSignature(*sct, ct.LogEntry{Leaf: *leaf}); err != nil {
+		return fmt.Errorf("invalid SCT signature of log (%v): %w", logInfo.LogID, err)
+	}
+	return nil
+}
+
+// Create the RFC 6962 extension that embeds scts in a certificate
+func sctListExtension(scts []ct.SignedCertificateTimestamp) (pkix.Extension, error) {
+	sctList := x509.SignedCertificateTimestampList{}
+	for _, sct := range scts {
+		serialized, err := tls.Marshal(sct)
+		if err != nil {
+			return pkix.Extension{}, fmt.Errorf("failed to serialize SCT: %w", err)
+		}
+		sctList.SCTList = append(sctList.SCTList, x509.SerializedSCT{Val: serialized})
+	}
+	listBytes, err := tls.Marshal(sctList)
+	if err != nil {
+		return pkix.Extension{}, fmt.Errorf("failed to serialize SCT list: %w", err)
+	}
+	value, err := asn1.Marshal(listBytes)
+	if err != nil {
+		return pkix.Extension{}, fmt.Errorf("failed to marshal SCT list extension: %w", err)
+	}
+	return pkix.Extension{Id: x509.OIDExtensionCTSCT, Value: value}, nil
+}
@@ -0,0 +1,209 @@
+package ca
+
+import (
+	"testing"
+	"errors"
+	"crypto/rand"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	ct "github.com/google/certificate-transparency-go"
+	"github.com/google/certificate-transparency-go/tls"
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/n-ct/ct-monitor/entitylist"
+	ctca "github.com/n-ct/ct-certificate-authority"
+)
+
+// An in-process log that answers add-pre-chain requests with an SCT signed by its key
+type fakeLog struct {
+	key *ecdsa.PrivateKey
+	logID [sha256.Size]byte
+	corrupt bool	// Sign SCTs over the wrong timestamp
+	server *httptest.Server
+}
+
+func newFakeLog(t *testing.T) *fakeLog {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate log key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal log key: %v", err)
+	}
+	log := &fakeLog{key: key, logID: sha256.Sum256(der)}
+	mux := http.NewServeMux()
+	mux.HandleFunc(ct.AddPreChainPath, log.addPreChain)
+	log.server = httptest.NewServer(mux)
+	t.Cleanup(log.server.Close)
+	return log
+}
+
+// Describe the fake log the way the log list does
+func (l *fakeLog) logInfo(t *testing.T) *entitylist.LogInfo {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(&l.key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal log key: %v", err)
+	}
+	return &entitylist.LogInfo{
+		LogID: base64.StdEncoding.EncodeToString(l.logID[:]),
+		Key: base64.StdEncoding.EncodeToString(der),
+		URL: l.server.URL + "/",
+	}
+}
+
+func (l *fakeLog) addPreChain(rw http.ResponseWriter, req *http.Request) {
+	var addChainReq ct.AddChainRequest
+	if err := json.NewDecoder(req.Body).Decode(&addChainReq); err != nil || len(addChainReq.Chain) < 2 {
+		http.Error(rw, "invalid add-pre-chain request", http.StatusBadRequest)
+		return
+	}
+	chain := []*x509.Certificate{}
+	for _, der := range addChainReq.Chain {
+		cert, err := x509.ParseCertificate(der)
+		if x509.IsFatal(err) {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		chain = append(chain, cert)
+	}
+	sct := ct.SignedCertificateTimestamp{SCTVersion: ct.V1, LogID: ct.LogID{KeyID: l.logID}, Timestamp: 1600000000000}
+	leaf, err := ct.MerkleTreeLeafFromChain(chain, ct.PrecertLogEntryType, sct.Timestamp)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	signed := sct
+	if l.corrupt {
+		signed.Timestamp++
+	}
+	input, err := ct.SerializeSCTSignatureInput(signed, ct.LogEntry{Leaf: *leaf})
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sig, err := tls.CreateSignature(*l.key, tls.SHA256, input)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sigBytes, err := tls.Marshal(sig)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(rw).Encode(ct.AddChainResponse{
+		SCTVersion: sct.SCTVersion,
+		ID: l.logID[:],
+		Timestamp: sct.Timestamp,
+		Signature: sigBytes,
+	})
+}
+
+func TestIssueCertificateEmbedsSCTs(t *testing.T) {
+	newCA := mustGetCAWithStorage(t, NewMemoryStorage())
+	logs := []*fakeLog{newFakeLog(t), newFakeLog(t)}
+	newCA.LogInfoMap = make(map[string] *entitylist.LogInfo)
+	for _, log := range logs {
+		logInfo := log.logInfo(t)
+		newCA.LogInfoMap[logInfo.LogID] = logInfo
+	}
+	csr, err := ctca.DecodeCertificateRequest(mustCreateCertificateRequest(t))
+	if err != nil {
+		t.Fatalf("failed to decode certificate request: %v", err)
+	}
+	issued, err := newCA.IssueCertificate(revType, csr)
+	if err != nil {
+		t.Fatalf("failed to issue certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(issued.Certificate)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	if len(cert.SCTList.SCTList) != len(logs) {
+		t.Fatalf("certificate embeds %v SCTs, expected %v", len(cert.SCTList.SCTList), len(logs))
+	}
+
+	// Every embedded SCT verifies against the final certificate as an embedded SCT
+	chain := []*x509.Certificate{cert, newCA.Issuer.Certificate}
+	for _, serialized := range cert.SCTList.SCTList {
+		var sct ct.SignedCertificateTimestamp
+		if _, err := tls.Unmarshal(serialized.Val, &sct); err != nil {
+			t.Fatalf("failed to unmarshal embedded SCT: %v", err)
+		}
+		logInfo, ok := newCA.LogInfoMap[base64.StdEncoding.EncodeToString(sct.LogID.KeyID[:])]
+		if !ok {
+			t.Fatalf("embedded SCT of unknown log (%x)", sct.LogID.KeyID)
+		}
+		publicKey, err := ct.PublicKeyFromB64(logInfo.Key)
+		if err != nil {
+			t.Fatalf("failed to parse log key: %v", err)
+		}
+		verifier, err := ct.NewSignatureVerifier(publicKey)
+		if err != nil {
+			t.Fatalf("failed to create verifier: %v", err)
+		}
+		leaf, err := ct.MerkleTreeLeafForEmbeddedSCT(chain, sct.Timestamp)
+		if err != nil {
+			t.Fatalf("failed to build embedded SCT leaf: %v", err)
+		}
+		if err := verifier.VerifySCTSignature(sct, ct.LogEntry{Leaf: *leaf}); err != nil {
+			t.Fatalf("embedded SCT does not verify: %v", err)
+		}
+	}
+
+	// Both the precertificate and the final certificate are registered
+	for _, der := range [][]byte{issued.Precertificate, issued.Certificate} {
+		record, err := newCA.Registry.ByFingerprint(revType, ctca.CertificateFingerprint(der))
+		if err != nil || *record != issued.Record {
+			t.Fatalf("registry record (%+v, %v) not equal to issued record (%+v)", record, err, issued.Record)
+		}
+	}
+}
+
+func TestIssueCertificateRequiresValidSCTs(t *testing.T) {
+	newCA := mustGetCAWithStorage(t, NewMemoryStorage())
+	goodLog, badLog := newFakeLog(t), newFakeLog(t)
+	badLog.corrupt = true
+	newCA.LogInfoMap = make(map[string] *entitylist.LogInfo)
+	for _, log := range []*fakeLog{goodLog, badLog} {
+		logInfo := log.logInfo(t)
+		newCA.LogInfoMap[logInfo.LogID] = logInfo
+	}
+	csr, err := ctca.DecodeCertificateRequest(mustCreateCertificateRequest(t))
+	if err != nil {
+		t.Fatalf("failed to decode certificate request: %v", err)
+	}
+
+	// By default every log has to return a valid SCT
+	if _, err := newCA.IssueCertificate(revType, csr); !errors.Is(err, ErrInsufficientSCTs) {
+		t.Fatalf("expected ErrInsufficientSCTs, got: %v", err)
+	}
+	// The revocation number of the submitted precertificate is not handed out again
+	if len(newCA.Registry.records[revType]) != 1 {
+		t.Fatalf("expected the precertificate to stay registered, got %v records", len(newCA.Registry.records[revType]))
+	}
+
+	newCA.Issuer.MinSCTs = 1
+	issued, err := newCA.IssueCertificate(revType, csr)
+	if err != nil {
+		t.Fatalf("failed to issue certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(issued.Certificate)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	if len(cert.SCTList.SCTList) != 1 {
+		t.Fatalf("certificate embeds %v SCTs, expected only the valid one", len(cert.SCTList.SCTList))
+	}
+	if len(newCA.Registry.records[revType]) != 2 {
+		t.Fatalf("expected 2 registered certificates, got %v", len(newCA.Registry.records[revType]))
+	}
+}
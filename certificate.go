@@ -0,0 +1,90 @@
+package ctca
+
+import (
+	"fmt"
+	"strings"
+	"math/big"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/base64"
+
+	"github.com/google/certificate-transparency-go/x509"
+)
+
+// Parse a PEM encoded certificate, or the base64 of a DER encoded one
+func DecodeCertificate(encoded string) (*x509.Certificate, error) {
+	var der []byte
+	if block, _ := pem.Decode([]byte(encoded)); block != nil {
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("pem block of type (%v) is not a certificate", block.Type)
+		}
+		der = block.Bytes
+	} else {
+		var err error
+		der, err = base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("certificate is neither PEM nor base64 DER: %w", err)
+		}
+	}
+	cert, err := x509.ParseCertificate(der)
+	if x509.IsFatal(err) {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// Parse a PEM encoded CSR, or the base64 of a DER encoded one
+func DecodeCertificateRequest(encoded string) (*x509.CertificateRequest, error) {
+	var der []byte
+	if block, _ := pem.Decode([]byte(encoded)); block != nil {
+		if block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST" {
+			return nil, fmt.Errorf("pem block of type (%v) is not a certificate request", block.Type)
+		}
+		der = block.Bytes
+	} else {
+		var err error
+		der, err = base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("certificate request is neither PEM nor base64 DER: %w", err)
+		}
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate request: %w", err)
+	}
+	return csr, nil
+}
+
+// Get the SHA-256 fingerprint of a DER encoded certificate as lowercase hex
+func CertificateFingerprint(der []byte) string {
+	fingerprint := sha256.Sum256(der)
+	return hex.EncodeToString(fingerprint[:])
+}
+
+// Convert a SHA-256 fingerprint in hex, optionally separated by colons, to the form returned by CertificateFingerprint
+func NormalizeFingerprint(fingerprint string) (string, error) {
+	fingerprint = strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+	decoded, err := hex.DecodeString(fingerprint)
+	if err != nil {
+		return "", fmt.Errorf("invalid fingerprint (%v): %w", fingerprint, err)
+	}
+	if len(decoded) != sha256.Size {
+		return "", fmt.Errorf("fingerprint (%v) is not a SHA-256 hash", fingerprint)
+	}
+	return fingerprint, nil
+}
+
+// Convert a serial number in hex, optionally separated by colons, to lowercase hex without leading zeros
+func NormalizeSerial(serial string) (string, error) {
+	serialNum, ok := new(big.Int).SetString(strings.ReplaceAll(serial, ":", ""), 16)
+	if !ok || serialNum.Sign() < 0 {
+		return "", fmt.Errorf("invalid serial (%v)", serial)
+	}
+	return SerialString(serialNum), nil
+}
+
+// Format a certificate serial number the way NormalizeSerial does
+func SerialString(serial *big.Int) string {
+	return serial.Text(16)
+}
@@ -0,0 +1,27 @@
+package ctca
+
+import (
+	"testing"
+	"strings"
+)
+
+func TestNormalizeCertificateIdentity(t *testing.T) {
+	fingerprint := strings.Repeat("ab", 32)
+	colonFingerprint := strings.TrimSuffix(strings.Repeat("AB:", 32), ":")
+	if normalized, err := NormalizeFingerprint(colonFingerprint); err != nil || normalized != fingerprint {
+		t.Fatalf("normalized fingerprint (%v, %v) not equal to (%v)", normalized, err, fingerprint)
+	}
+	if _, err := NormalizeFingerprint("abcd"); err == nil {
+		t.Fatalf("failed to reject fingerprint that is not a SHA-256 hash")
+	}
+	if CertificateFingerprint([]byte{}) != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Fatalf("CertificateFingerprint is not the SHA-256 hash of the certificate")
+	}
+
+	if normalized, err := NormalizeSerial("00:0A:FF"); err != nil || normalized != "aff" {
+		t.Fatalf("normalized serial (%v, %v) not equal to (%v)", normalized, err, "aff")
+	}
+	if _, err := NormalizeSerial("xyz"); err == nil {
+		t.Fatalf("failed to reject serial that is not hex")
+	}
+}
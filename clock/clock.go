@@ -0,0 +1,44 @@
+// Package clock abstracts the time source of the CA and the sequencer, so that MMDs can be driven by the wall
+// clock in production and by a Fake clock in simulations that run through thousands of MMDs in seconds
+package clock
+
+import (
+	"time"
+)
+
+// Source of the current time and of timers
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer	// Create a timer that fires once after d
+}
+
+// A single-use timer, like time.Timer
+type Timer interface {
+	C() <-chan time.Time	// Receives the time the timer fired at
+	Stop() bool	// Stop the timer, returns false if it already fired or was stopped
+}
+
+// Clock backed by the time package
+type realClock struct{}
+
+// Timer backed by a time.Timer
+type realTimer struct {
+	*time.Timer
+}
+
+// Get the Clock of the wall clock
+func New() Clock {
+	return realClock{}
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
@@ -0,0 +1,102 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock that only moves when it is told to. Timers fire when Advance or Set moves the time past their deadline,
+// and BlockUntil lets a test wait until the code under test is waiting on a timer before it moves the time
+type Fake struct {
+	now time.Time
+	timers []*fakeTimer	// Pending timers in the order they were created
+	changed *sync.Cond	// Signalled when a timer is created
+	sync.Mutex	// Guards now and timers
+}
+
+// Timer of a Fake clock
+type fakeTimer struct {
+	clock *Fake
+	deadline time.Time
+	c chan time.Time
+}
+
+// Create a Fake clock that starts at now
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.changed = sync.NewCond(&f.Mutex)
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.Lock()
+	defer f.Unlock()
+	return f.now
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	f.Lock()
+	defer f.Unlock()
+	t := &fakeTimer{clock: f, deadline: f.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- f.now
+		return t
+	}
+	f.timers = append(f.timers, t)
+	f.changed.Broadcast()
+	return t
+}
+
+// Move the time forward by d and fire the timers that are due
+func (f *Fake) Advance(d time.Duration) {
+	f.Lock()
+	defer f.Unlock()
+	f.setTime(f.now.Add(d))
+}
+
+// Move the time to now and fire the timers that are due. The time never moves backwards
+func (f *Fake) Set(now time.Time) {
+	f.Lock()
+	defer f.Unlock()
+	if now.After(f.now) {
+		f.setTime(now)
+	}
+}
+
+// Wait until at least n timers are pending
+func (f *Fake) BlockUntil(n int) {
+	f.Lock()
+	defer f.Unlock()
+	for len(f.timers) < n {
+		f.changed.Wait()
+	}
+}
+
+func (f *Fake) setTime(now time.Time) {
+	f.now = now
+	pending := f.timers[:0]
+	for _, t := range f.timers {
+		if t.deadline.After(now) {
+			pending = append(pending, t)
+		} else {
+			t.c <- now
+		}
+	}
+	f.timers = pending
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	for i, pending := range t.clock.timers {
+		if pending == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i + 1:]...)
+			return true
+		}
+	}
+	return false
+}
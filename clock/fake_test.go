@@ -0,0 +1,60 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeTimers(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	f := NewFake(start)
+	first := f.NewTimer(time.Minute)
+	second := f.NewTimer(time.Hour)
+	stopped := f.NewTimer(time.Minute)
+	if !stopped.Stop() || stopped.Stop() {
+		t.Fatalf("pending timer did not stop exactly once")
+	}
+
+	f.Advance(59 * time.Second)
+	select {
+	case <-first.C():
+		t.Fatalf("timer fired before its deadline")
+	default:
+	}
+	f.Advance(time.Second)
+	if fired := <-first.C(); !fired.Equal(start.Add(time.Minute)) {
+		t.Fatalf("timer fired at (%v) instead of its deadline", fired)
+	}
+	if first.Stop() {
+		t.Fatalf("fired timer stopped")
+	}
+	select {
+	case <-stopped.C():
+		t.Fatalf("stopped timer fired")
+	default:
+	}
+
+	// Set never moves the time backwards
+	f.Set(start)
+	if !f.Now().Equal(start.Add(time.Minute)) {
+		t.Fatalf("time moved back to (%v)", f.Now())
+	}
+	f.Set(start.Add(2 * time.Hour))
+	<-second.C()
+	if timer := f.NewTimer(0); len(timer.C()) != 1 {
+		t.Fatalf("timer without a duration did not fire at once")
+	}
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+	f := NewFake(time.Unix(0, 0))
+	fired := make(chan time.Time)
+	go func() {
+		fired <- <-f.NewTimer(time.Second).C()
+	}()
+	f.BlockUntil(1)
+	f.Advance(time.Second)
+	if at := <-fired; at.Unix() != 1 {
+		t.Fatalf("timer fired at (%v)", at.Unix())
+	}
+}
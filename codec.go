@@ -0,0 +1,451 @@
+package ctca
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"bytes"
+	"io/ioutil"
+	"compress/gzip"
+	"compress/flate"
+	"encoding/binary"
+	"math/bits"
+
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	RawCodecID uint8 = 0
+	XZCodecID uint8 = 1
+	GzipCodecID uint8 = 2
+	DeflateCodecID uint8 = 3
+	GolombRiceCodecID uint8 = 4
+
+	RawCodecName = "raw"
+	XZCodecName = "xz"
+	GzipCodecName = "gzip"
+	DeflateCodecName = "deflate"
+	GolombRiceCodecName = "golomb-rice"
+	DefaultCodecName = XZCodecName
+
+	maxGolombRiceDataLen = 1 << 30	// Largest decompressed size accepted, enough for a bitmap of 2^33 bits
+)
+
+// Codec compresses the serialized CRVs and deltas of a revocation type.
+// Encoded data starts with the ID of its codec so it can be decoded without knowing the configuration that produced it
+type Codec interface {
+	ID() uint8	// Prefix byte identifying the codec in encoded data
+	Name() string	// Name used to select the codec in configuration
+	Compress(data []byte) ([]byte, error)
+	Decompress(compressedData []byte) ([]byte, error)
+}
+
+// IndexCodec is a Codec that also codes lists of revoked indices directly, without building a bitmap of them.
+// A revocation type whose codec is an IndexCodec codes the index list of every CRV with it and leaves the rest of its
+// encoded states and deltas uncompressed behind the codec ID
+type IndexCodec interface {
+	Codec
+	EncodeIndices(indices []uint64) []byte	// indices must be strictly ascending
+	DecodeIndices(encodedIndices []byte) ([]uint64, error)
+}
+
+var (
+	codecsByID = make(map[uint8]Codec)
+	codecsByName = make(map[string]Codec)
+	codecsLock sync.RWMutex
+)
+
+func init() {
+	for _, codec := range []Codec{RawCodec{}, XZCodec{}, GzipCodec{}, DeflateCodec{}, GolombRiceCodec{}} {
+		if err := RegisterCodec(codec); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Make a codec available to GetCodec and DecodeWithCodec
+func RegisterCodec(codec Codec) error {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	if existing, ok := codecsByID[codec.ID()]; ok && existing.Name() != codec.Name() {
+		return fmt.Errorf("codec id (%v) of codec (%v) already used by codec (%v)", codec.ID(), codec.Name(), existing.Name())
+	}
+	codecsByID[codec.ID()] = codec
+	codecsByName[codec.Name()] = codec
+	return nil
+}
+
+// Get the names of every registered codec
+func CodecNames() []string {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	names := []string{}
+	for name := range codecsByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get a registered codec by name. An empty name selects the DefaultCodecName
+func GetCodec(name string) (Codec, error) {
+	if name == "" {
+		name = DefaultCodecName
+	}
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	codec, ok := codecsByName[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec (%v)", name)
+	}
+	return codec, nil
+}
+
+// Compress data with codec and prefix it with the codec ID
+func EncodeWithCodec(codec Codec, data []byte) ([]byte, error) {
+	compressedData, err := codec.Compress(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress with codec (%v): %w", codec.Name(), err)
+	}
+	return append([]byte{codec.ID()}, compressedData...), nil
+}
+
+// Decompress data produced by EncodeWithCodec using the codec named by its prefix
+func DecodeWithCodec(encodedData []byte) ([]byte, error) {
+	codec, err := EncodedCodec(encodedData)
+	if err != nil {
+		return nil, err
+	}
+	data, err := codec.Decompress(encodedData[1:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress with codec (%v): %w", codec.Name(), err)
+	}
+	return data, nil
+}
+
+// Get the codec that produced encodedData
+func EncodedCodec(encodedData []byte) (Codec, error) {
+	if len(encodedData) == 0 {
+		return nil, fmt.Errorf("encoded data is missing codec id")
+	}
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	codec, ok := codecsByID[encodedData[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec id (%v)", encodedData[0])
+	}
+	return codec, nil
+}
+
+// RawCodec leaves data uncompressed
+type RawCodec struct{}
+
+func (RawCodec) ID() uint8 { return RawCodecID }
+func (RawCodec) Name() string { return RawCodecName }
+
+func (RawCodec) Compress(data []byte) ([]byte, error) {
+	return append([]byte{}, data...), nil
+}
+
+func (RawCodec) Decompress(compressedData []byte) ([]byte, error) {
+	return append([]byte{}, compressedData...), nil
+}
+
+// XZCodec compresses data using xz. Slowest, but produces the smallest output for dense CRVs
+type XZCodec struct{}
+
+func (XZCodec) ID() uint8 { return XZCodecID }
+func (XZCodec) Name() string { return XZCodecName }
+
+func (XZCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := xz.NewWriter(&buf)
+	if err != nil {
+		return nil, fmt.Errorf("xz.NewWriter error %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("WriteString error %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("w.Close error %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (XZCodec) Decompress(compressedData []byte) ([]byte, error) {
+	r, err := xz.NewReader(bytes.NewBuffer(compressedData))
+	if err != nil {
+		return nil, fmt.Errorf("NewReader error %s", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %v", err)
+	}
+	return data, nil
+}
+
+// GzipCodec compresses data using gzip
+type GzipCodec struct{}
+
+func (GzipCodec) ID() uint8 { return GzipCodecID }
+func (GzipCodec) Name() string { return GzipCodecName }
+
+func (GzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to write gzip data: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close gzip writer: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (GzipCodec) Decompress(compressedData []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewBuffer(compressedData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %v", err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %v", err)
+	}
+	return data, nil
+}
+
+// DeflateCodec compresses data using raw deflate, without the gzip header
+type DeflateCodec struct{}
+
+func (DeflateCodec) ID() uint8 { return DeflateCodecID }
+func (DeflateCodec) Name() string { return DeflateCodecName }
+
+func (DeflateCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create deflate writer: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to write deflate data: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close deflate writer: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (DeflateCodec) Decompress(compressedData []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewBuffer(compressedData))
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %v", err)
+	}
+	return data, nil
+}
+
+// GolombRiceCodec run-length encodes the gaps between set bits with Golomb-Rice codes.
+// It is fast and close to optimal for sparse bitmaps, where most bits are zero and set bits are spread evenly.
+// Compress reads data as such a bitmap. Revocation types use it as an IndexCodec, which codes the same gaps from a
+// list of indices.
+// Encoded form: uvarint data length, then the set bits as Rice coded gaps (see encodeRiceGaps)
+type GolombRiceCodec struct{}
+
+func (GolombRiceCodec) ID() uint8 { return GolombRiceCodecID }
+func (GolombRiceCodec) Name() string { return GolombRiceCodecName }
+
+func (GolombRiceCodec) Compress(data []byte) ([]byte, error) {
+	positions := []uint64{}
+	for i, b := range data {
+		for b != 0 {
+			positions = append(positions, uint64(i) * 8 + uint64(bits.TrailingZeros8(b)))
+			b &= b - 1
+		}
+	}
+	header := make([]byte, binary.MaxVarintLen64)
+	header = header[:binary.PutUvarint(header, uint64(len(data)))]
+	return encodeRiceGaps(header, positions, uint64(len(data)) * 8), nil
+}
+
+func (GolombRiceCodec) Decompress(compressedData []byte) ([]byte, error) {
+	dataLen, n := binary.Uvarint(compressedData)
+	if n <= 0 {
+		return nil, fmt.Errorf("failed to read data length")
+	}
+	if dataLen > maxGolombRiceDataLen {
+		return nil, fmt.Errorf("data length (%v) exceeds limit (%v)", dataLen, maxGolombRiceDataLen)
+	}
+	positions, err := decodeRiceGaps(compressedData[n:], dataLen * 8)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, dataLen)
+	for _, pos := range positions {
+		data[pos / 8] |= 1 << (pos % 8)
+	}
+	return data, nil
+}
+
+// Code indices as the Rice coded gaps between them (see encodeRiceGaps)
+func (GolombRiceCodec) EncodeIndices(indices []uint64) []byte {
+	span := uint64(0)
+	if len(indices) > 0 {
+		span = indices[len(indices) - 1] + 1
+	}
+	return encodeRiceGaps(nil, indices, span)
+}
+
+// Decode indices coded by EncodeIndices, rejecting any outside of the number space of a CRV
+func (GolombRiceCodec) DecodeIndices(encodedIndices []byte) ([]uint64, error) {
+	return decodeRiceGaps(encodedIndices, 1 << MaxBitsInRevocationNumber)
+}
+
+// Append the strictly ascending indices below span to buf as Rice codes of the gaps between them:
+// uvarint number of indices, Rice parameter byte, then the Rice code of every index minus the one before it plus one
+func encodeRiceGaps(buf []byte, indices []uint64, span uint64) []byte {
+	riceParam := golombRiceParameter(span, uint64(len(indices)))
+	header := make([]byte, binary.MaxVarintLen64 + 1)
+	n := binary.PutUvarint(header, uint64(len(indices)))
+	header[n] = riceParam
+	w := &bitWriter{buf: append(buf, header[:n+1]...)}
+	prev := uint64(0)
+	for _, index := range indices {
+		gap := index - prev
+		w.writeUnary(gap >> riceParam)
+		w.writeBits(gap, riceParam)
+		prev = index + 1
+	}
+	return w.bytes()
+}
+
+// Decode the indices written by encodeRiceGaps, rejecting any index at or above span
+func decodeRiceGaps(data []byte, span uint64) ([]uint64, error) {
+	count, n := binary.Uvarint(data)
+	if n <= 0 || len(data) <= n {
+		return nil, fmt.Errorf("failed to read number of set bits")
+	}
+	riceParam := data[n]
+	if riceParam > 63 {
+		return nil, fmt.Errorf("invalid rice parameter (%v)", riceParam)
+	}
+	r := &bitReader{buf: data[n+1:]}
+	// Every index takes at least one bit to encode, which bounds the allocation by the size of the input
+	if count > uint64(len(r.buf)) * 8 || count > span {
+		return nil, fmt.Errorf("number of set bits (%v) exceeds encoded data", count)
+	}
+
+	indices := make([]uint64, 0, count)
+	pos := uint64(0)
+	for i := uint64(0); i < count; i++ {
+		quotient, err := r.readUnary()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gap of set bit (%v): %v", i, err)
+		}
+		remainder, err := r.readBits(riceParam)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gap of set bit (%v): %v", i, err)
+		}
+		if quotient > (span - pos) >> riceParam {
+			return nil, fmt.Errorf("gap of set bit (%v) is out of range", i)
+		}
+		pos += quotient << riceParam | remainder
+		if pos >= span {
+			return nil, fmt.Errorf("set bit (%v) is out of range", pos)
+		}
+		indices = append(indices, pos)
+		pos++
+	}
+	return indices, nil
+}
+
+// Pick the Rice parameter closest to log2 of the mean gap between set bits
+func golombRiceParameter(totalBits uint64, setBits uint64) uint8 {
+	if setBits == 0 || totalBits <= setBits {
+		return 0
+	}
+	meanGap := (totalBits - setBits) / setBits
+	if meanGap == 0 {
+		return 0
+	}
+	return uint8(bits.Len64(meanGap) - 1)
+}
+
+// Appends bits to a byte slice, least significant bit first
+type bitWriter struct {
+	buf []byte
+	bitPos uint8
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.bitPos == 0 {
+		w.buf = append(w.buf, 0)
+	}
+	if bit {
+		w.buf[len(w.buf) - 1] |= 1 << w.bitPos
+	}
+	w.bitPos = (w.bitPos + 1) % 8
+}
+
+// Write n ones followed by a zero
+func (w *bitWriter) writeUnary(n uint64) {
+	for ; n > 0; n-- {
+		w.writeBit(true)
+	}
+	w.writeBit(false)
+}
+
+// Write the lower count bits of value, least significant first
+func (w *bitWriter) writeBits(value uint64, count uint8) {
+	for i := uint8(0); i < count; i++ {
+		w.writeBit(value >> i & 1 == 1)
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	return w.buf
+}
+
+// Reads bits written by a bitWriter
+type bitReader struct {
+	buf []byte
+	pos uint64
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= uint64(len(r.buf)) * 8 {
+		return false, fmt.Errorf("unexpected end of data")
+	}
+	bit := r.buf[r.pos / 8] >> (r.pos % 8) & 1 == 1
+	r.pos++
+	return bit, nil
+}
+
+func (r *bitReader) readUnary() (uint64, error) {
+	n := uint64(0)
+	for {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			return n, nil
+		}
+		n++
+	}
+}
+
+func (r *bitReader) readBits(count uint8) (uint64, error) {
+	value := uint64(0)
+	for i := uint8(0); i < count; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if bit {
+			value |= 1 << i
+		}
+	}
+	return value, nil
+}
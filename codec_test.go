@@ -0,0 +1,140 @@
+package ctca
+
+import (
+	"testing"
+	"reflect"
+	"math/rand"
+)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	sparseCRV := CreateCRV([]uint64{3, 700, 701, 50000}, 0)
+	sparseData, err := CompressCRV(sparseCRV)
+	if err != nil {
+		t.Fatalf("failed to compress CRV: %v", err)
+	}
+	randomData := make([]byte, 1000)
+	rand.Read(randomData)
+	inputs := [][]byte{{}, {0xff}, sparseData, randomData, make([]byte, 4096)}
+
+	for _, name := range CodecNames() {
+		codec, err := GetCodec(name)
+		if err != nil {
+			t.Fatalf("failed to get codec (%v): %v", name, err)
+		}
+		for _, input := range inputs {
+			encoded, err := EncodeWithCodec(codec, input)
+			if err != nil {
+				t.Fatalf("failed to encode with codec (%v): %v", name, err)
+			}
+			if encoded[0] != codec.ID() {
+				t.Fatalf("encoded data prefix (%v) not equal to id (%v) of codec (%v)", encoded[0], codec.ID(), name)
+			}
+			decoded, err := DecodeWithCodec(encoded)
+			if err != nil {
+				t.Fatalf("failed to decode with codec (%v): %v", name, err)
+			}
+			if !reflect.DeepEqual(decoded, append([]byte{}, input...)) {
+				t.Fatalf("decoded data (%v) not equal to input (%v) with codec (%v)", len(decoded), len(input), name)
+			}
+		}
+	}
+}
+
+func TestGolombRiceCodecRejectsTruncatedData(t *testing.T) {
+	data := make([]byte, 512)
+	data[10], data[300] = 0x81, 0x10
+	compressed, err := GolombRiceCodec{}.Compress(data)
+	if err != nil {
+		t.Fatalf("failed to compress: %v", err)
+	}
+	if _, err := (GolombRiceCodec{}).Decompress(compressed[:len(compressed) - 1]); err == nil {
+		t.Fatalf("failed to reject truncated data")
+	}
+	if _, err := DecodeWithCodec([]byte{0xee}); err == nil {
+		t.Fatalf("failed to reject unknown codec id")
+	}
+}
+
+func TestLetsRevokeUsesConfiguredCodec(t *testing.T) {
+	revType, err := NewRevocationType(RevocationTypeConfig{Name: LetsRevokeMechanism, Codec: GzipCodecName})
+	if err != nil {
+		t.Fatalf("failed to create revocation type: %v", err)
+	}
+	_, delta, err := revType.NextState(revType.NewState(), unspecifiedRevocations([]uint64{1, 2, 3}), 0)
+	if err != nil {
+		t.Fatalf("failed to create next state: %v", err)
+	}
+	encodedDelta, err := delta.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode delta: %v", err)
+	}
+	codec, err := EncodedCodec(encodedDelta)
+	if err != nil {
+		t.Fatalf("failed to get codec of encoded delta: %v", err)
+	}
+	if codec.Name() != GzipCodecName {
+		t.Fatalf("delta encoded with codec (%v) instead of configured codec (%v)", codec.Name(), GzipCodecName)
+	}
+
+	if _, err := NewRevocationType(RevocationTypeConfig{Name: LetsRevokeMechanism, Codec: "unknown"}); err == nil {
+		t.Fatalf("failed to reject unknown codec")
+	}
+}
+
+func TestLetsRevokeGolombRiceCodesIndexLists(t *testing.T) {
+	riceType, err := NewRevocationType(RevocationTypeConfig{Name: LetsRevokeMechanism, Codec: GolombRiceCodecName})
+	if err != nil {
+		t.Fatalf("failed to create revocation type: %v", err)
+	}
+	rawType, err := NewRevocationType(RevocationTypeConfig{Name: LetsRevokeMechanism, Codec: RawCodecName})
+	if err != nil {
+		t.Fatalf("failed to create revocation type: %v", err)
+	}
+	revocationNums := []uint64{}
+	for i := uint64(0); i < 200; i++ {
+		revocationNums = append(revocationNums, JoinRevocationNum(2, i * 300))
+	}
+	state, delta, err := riceType.NextState(riceType.NewState(), unspecifiedRevocations(revocationNums), 0)
+	if err != nil {
+		t.Fatalf("failed to create next state: %v", err)
+	}
+	_, rawDelta, err := rawType.NextState(rawType.NewState(), unspecifiedRevocations(revocationNums), 0)
+	if err != nil {
+		t.Fatalf("failed to create next state: %v", err)
+	}
+
+	// The delta carries the golomb-rice codec ID and Rice codes the index list of the bucket
+	encodedDelta, err := delta.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode delta: %v", err)
+	}
+	encodedRawDelta, err := rawDelta.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode delta: %v", err)
+	}
+	if encodedDelta[0] != GolombRiceCodecID {
+		t.Fatalf("delta codec id (%v) not equal to golomb-rice codec id (%v)", encodedDelta[0], GolombRiceCodecID)
+	}
+	if len(encodedDelta) >= len(encodedRawDelta) {
+		t.Fatalf("rice coded delta (%v bytes) not smaller than raw delta (%v bytes)", len(encodedDelta), len(encodedRawDelta))
+	}
+	decodedDelta, err := riceType.DecodeDelta(encodedDelta)
+	if err != nil {
+		t.Fatalf("failed to decode delta: %v", err)
+	}
+	if !reflect.DeepEqual(decodedDelta.RevocationNums(), revocationNums) {
+		t.Fatalf("decoded delta (%v) not equal to revoked nums (%v)", decodedDelta.RevocationNums(), revocationNums)
+	}
+
+	encodedState, err := state.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode state: %v", err)
+	}
+	decodedState, err := riceType.DecodeState(encodedState)
+	if err != nil {
+		t.Fatalf("failed to decode state: %v", err)
+	}
+	if !decodedState.Equals(state) {
+		t.Fatalf("decoded state (%v) not equal to state (%v)", decodedState.RevocationNums(), state.RevocationNums())
+	}
+}
@@ -2,47 +2,325 @@ package ctca
 
 import (
 	"fmt"
-	"bytes"
-	"io/ioutil"
+	"math/bits"
 
 	"github.com/Workiva/go-datastructures/bitarray"
-	"github.com/ulikunitz/xz"
 )
 
 const (
-	MaxBitsInRevocationNumber = 32
+	MaxBitsInRevocationNumber = 32	// Bits of a revocation number that index into the CRV of its expiration bucket
+	UnpartitionedBucket = 0	// Expiration bucket of revocation numbers that never expire. Never retired
 )
 
+// Returned when revocation numbers fall outside the number space of a revocation type
+type RevocationNumberError struct {
+	RevocationType string
+	RevocationNums []uint64	// The out of range revocation numbers
+	MaxBits uint64	// Bits available to the index of a revocation number within its bucket
+}
+
+func (e *RevocationNumberError) Error() string {
+	return fmt.Sprintf("revocation nums (%v) of revocation type (%v) have an index that does not fit in (%v) bits", e.RevocationNums, e.RevocationType, e.MaxBits)
+}
+
+// Returned when revocation numbers belong to expiration buckets that do not accept revocations, because every
+// certificate of the bucket has expired or it is further in the future than any certificate can expire
+type ExpirationBucketError struct {
+	RevocationType string
+	RevocationNums []uint64	// The revocation numbers of buckets outside the live window
+	FirstBucket uint64	// First and last partitioned bucket that accept revocations
+	LastBucket uint64
+}
+
+func (e *ExpirationBucketError) Error() string {
+	return fmt.Sprintf("revocation nums (%v) of revocation type (%v) are not in the UnpartitionedBucket or the live expiration buckets (%v) to (%v)", e.RevocationNums, e.RevocationType, e.FirstBucket, e.LastBucket)
+}
+
+// Check that every revocation number belongs to the UnpartitionedBucket or to a bucket of revocationType that is live
+// at timestamp (unix seconds), so a revocation cannot create a CRV for a bucket that never expires
+func ValidateExpirationBuckets(revocationType RevocationType, revocationNums []uint64, timestamp uint64) error {
+	first, last := revocationType.LiveBuckets(timestamp)
+	outside := []uint64{}
+	for _, revocationNum := range revocationNums {
+		if bucket, _ := SplitRevocationNum(revocationNum); bucket != UnpartitionedBucket && (bucket < first || bucket > last) {
+			outside = append(outside, revocationNum)
+		}
+	}
+	if len(outside) > 0 {
+		return &ExpirationBucketError{RevocationType: revocationType.Name(), RevocationNums: outside, FirstBucket: first, LastBucket: last}
+	}
+	return nil
+}
+
+// Build the revocation number of the certificate at index within the CRV of an expiration bucket.
+// The bucket is kept in the bits above MaxBitsInRevocationNumber, so numbers below 2^MaxBitsInRevocationNumber
+// belong to the UnpartitionedBucket
+func JoinRevocationNum(bucket uint64, index uint64) uint64 {
+	return bucket << MaxBitsInRevocationNumber | index
+}
+
+// Split a revocation number into its expiration bucket and its index within the CRV of that bucket
+func SplitRevocationNum(revocationNum uint64) (uint64, uint64) {
+	return revocationNum >> MaxBitsInRevocationNumber, revocationNum & (1 << MaxBitsInRevocationNumber - 1)
+}
+
+// Get the expiration bucket of a certificate that expires at notAfter (unix seconds).
+// Bucket b holds the certificates expiring in [(b-1)*bucketDuration, b*bucketDuration)
+func ExpirationBucket(notAfter uint64, bucketDuration uint64) uint64 {
+	return notAfter / bucketDuration + 1
+}
+
+// Check whether every certificate of bucket has expired at timestamp (unix seconds)
+func IsBucketExpired(bucket uint64, bucketDuration uint64, timestamp uint64) bool {
+	return bucket != UnpartitionedBucket && bucket * bucketDuration <= timestamp
+}
+
+const (
+	BitArrayCRVKind = "bitarray"
+	RoaringCRVKind = "roaring"
+	SparseCRVKind = "sparse"
+	DefaultCRVKind = RoaringCRVKind
+
+	bitArrayCRVKindID uint8 = 0
+	roaringCRVKindID uint8 = 1
+	sparseCRVKindID uint8 = 2
+)
+
+// CRV is a certificate revocation vector where bit n is set if the certificate at index n is revoked
+type CRV interface {
+	Kind() string	// Name used to select the representation in configuration
+	SetBit(index uint64) error
+	ClearBit(index uint64) error
+	GetBit(index uint64) bool
+	Or(other CRV) (CRV, error)	// Returns a new CRV of the receiver's kind. Neither CRV is changed
+	Equals(other CRV) bool
+	ToNums() []uint64	// Indices of the set bits in ascending order
+	Cardinality() uint64	// Number of set bits
+	Marshal() ([]byte, error)
+}
+
+// Create an empty CRV of kind. An empty kind selects the DefaultCRVKind
+func NewCRV(kind string) (CRV, error) {
+	switch kind {
+	case BitArrayCRVKind:
+		return NewBitArrayCRV(), nil
+	case RoaringCRVKind, "":
+		return NewRoaringCRV(), nil
+	case SparseCRVKind:
+		return NewSparseCRV(), nil
+	}
+	return nil, fmt.Errorf("unknown crv kind (%v)", kind)
+}
+
+// Create a copy of crv that can be changed without affecting crv
+func CopyCRV(crv CRV) (CRV, error) {
+	emptyCRV, err := NewCRV(crv.Kind())
+	if err != nil {
+		return nil, err
+	}
+	return emptyCRV.Or(crv)
+}
+
+// Serialize a CRV prefixed with the ID of its kind
+func MarshalCRV(crv CRV) ([]byte, error) {
+	var kindID uint8
+	switch crv.Kind() {
+	case BitArrayCRVKind:
+		kindID = bitArrayCRVKindID
+	case RoaringCRVKind:
+		kindID = roaringCRVKindID
+	case SparseCRVKind:
+		kindID = sparseCRVKindID
+	default:
+		return nil, fmt.Errorf("unknown crv kind (%v)", crv.Kind())
+	}
+	serializedCRV, err := crv.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize %v crv: %w", crv.Kind(), err)
+	}
+	return append([]byte{kindID}, serializedCRV...), nil
+}
+
+// Deserialize a CRV serialized by MarshalCRV
+func UnmarshalCRV(data []byte) (CRV, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("serialized crv is missing its kind")
+	}
+	switch data[0] {
+	case bitArrayCRVKindID:
+		// Or of sparse and dense bitarrays allocates far past the highest bit, so BitArrayCRVs are always dense
+		if len(data) < 2 || data[1] != 'B' {
+			return nil, fmt.Errorf("bitarray crv is not a dense bitarray")
+		}
+		crv, err := bitarray.Unmarshal(data[1:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to deserialize bitarray crv: %w", err)
+		}
+		return &BitArrayCRV{crv}, nil
+	case roaringCRVKindID:
+		crv, err := UnmarshalRoaringCRV(data[1:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to deserialize roaring crv: %w", err)
+		}
+		return crv, nil
+	case sparseCRVKindID:
+		crv, err := UnmarshalSparseCRV(data[1:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to deserialize sparse crv: %w", err)
+		}
+		return crv, nil
+	}
+	return nil, fmt.Errorf("unknown crv kind id (%v)", data[0])
+}
+
+// Serialize a CRV in the form that is independent of its kind, the serialized SparseCRV of its set bits.
+// Hashes are computed over this form so CRVs holding the same bits hash equally whatever their representation
+func CanonicalCRV(crv CRV) ([]byte, error) {
+	sparseCRV, ok := crv.(*SparseCRV)
+	if !ok {
+		sparseCRV = &SparseCRV{indices: crv.ToNums()}
+	}
+	return sparseCRV.Marshal()
+}
+
+// Serialize a delta CRV with MarshalCRV as a SparseCRV or as bitmapKind, whichever is smaller.
+// A dense bitarray is only built if its estimated size beats the sparse form, so a delta with a
+// single index near 2^32 never allocates a bitmap of that size
+func MarshalCompactCRV(crv CRV, bitmapKind string) ([]byte, error) {
+	indices := crv.ToNums()
+	sparseCRV, err := MarshalCRV(&SparseCRV{indices: indices})
+	if err != nil {
+		return nil, err
+	}
+	if bitmapKind == SparseCRVKind || len(indices) == 0 {
+		return sparseCRV, nil
+	}
+	if bitmapKind == BitArrayCRVKind {
+		if (indices[len(indices) - 1] / 64 + 1) * 8 >= uint64(len(sparseCRV)) {
+			return sparseCRV, nil
+		}
+	}
+
+	bitmapCRV, err := NewCRV(bitmapKind)
+	if err != nil {
+		return nil, err
+	}
+	if bitmapCRV, err = bitmapCRV.Or(crv); err != nil {
+		return nil, fmt.Errorf("failed to convert crv to %v: %w", bitmapKind, err)
+	}
+	serializedBitmap, err := MarshalCRV(bitmapCRV)
+	if err != nil {
+		return nil, err
+	}
+	if len(serializedBitmap) < len(sparseCRV) {
+		return serializedBitmap, nil
+	}
+	return sparseCRV, nil
+}
+
+// BitArrayCRV is a CRV backed by a dense go-datastructures bitarray sized to the highest set index
+type BitArrayCRV struct {
+	BitArray bitarray.BitArray
+}
+
+// Create an empty dense BitArrayCRV
+func NewBitArrayCRV() *BitArrayCRV {
+	return &BitArrayCRV{bitarray.NewBitArray(1)}
+}
+
+func (b *BitArrayCRV) Kind() string {
+	return BitArrayCRVKind
+}
+
+// Set the bit at index, growing the bitarray if index is past its capacity
+func (b *BitArrayCRV) SetBit(index uint64) error {
+	if err := b.BitArray.SetBit(index); err == nil {
+		return nil
+	}
+	// Or copies an empty operand's counterpart as is, so the bit has to be set before growing
+	grown := bitarray.NewBitArray(index + 1)
+	if err := grown.SetBit(index); err != nil {
+		return fmt.Errorf("failed to set bit (%v): %w", index, err)
+	}
+	b.BitArray = grown.Or(b.BitArray)
+	return nil
+}
+
+// Clear the bit at index. Indices past the capacity of the bitarray are already clear
+func (b *BitArrayCRV) ClearBit(index uint64) error {
+	if index >= b.BitArray.Capacity() {
+		return nil
+	}
+	return b.BitArray.ClearBit(index)
+}
+
+func (b *BitArrayCRV) GetBit(index uint64) bool {
+	set, err := b.BitArray.GetBit(index)
+	return err == nil && set
+}
+
+func (b *BitArrayCRV) Or(other CRV) (CRV, error) {
+	if otherBitArray, ok := other.(*BitArrayCRV); ok {
+		return &BitArrayCRV{b.BitArray.Or(otherBitArray.BitArray)}, nil
+	}
+	result := &BitArrayCRV{bitarray.NewBitArray(1).Or(b.BitArray)}
+	for _, index := range other.ToNums() {
+		if err := result.SetBit(index); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Compare the set bits, since bitarrays of different capacities can hold the same indices
+func (b *BitArrayCRV) Equals(other CRV) bool {
+	return equalNums(b.ToNums(), other.ToNums())
+}
+
+func (b *BitArrayCRV) ToNums() []uint64 {
+	return b.BitArray.ToNums()
+}
+
+func (b *BitArrayCRV) Cardinality() uint64 {
+	cardinality := uint64(0)
+	for iter := b.BitArray.Blocks(); iter.Next(); {
+		_, block := iter.Value()
+		cardinality += uint64(bits.OnesCount64(uint64(block)))
+	}
+	return cardinality
+}
+
+func (b *BitArrayCRV) Marshal() ([]byte, error) {
+	return bitarray.Marshal(b.BitArray)
+}
+
+// Check whether two ascending lists of indices are equal
+func equalNums(nums1, nums2 []uint64) bool {
+	if len(nums1) != len(nums2) {
+		return false
+	}
+	for i := range nums1 {
+		if nums1[i] != nums2[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // Compress a given crv using xz compression
 func CompressCRV(crv *bitarray.BitArray) ([]byte, error) {
 	serializedCRV, err := bitarray.Marshal(*crv)
 	if err != nil {
         return nil, fmt.Errorf("failed to serialize crv: %v", err)
 	}
-	var buf bytes.Buffer
-    w, err := xz.NewWriter(&buf)
-    if err != nil {
-        return nil, fmt.Errorf("xz.NewWriter error %v", err)
-    }
-    if _, err := w.Write(serializedCRV); err != nil {
-        return nil, fmt.Errorf("WriteString error %v", err)
-    }
-    if err := w.Close(); err != nil {
-        return nil, fmt.Errorf("w.Close error %v", err)
-	}
-	return buf.Bytes(), nil
+	return XZCodec{}.Compress(serializedCRV)
 }
 
 // Decompress a given xz compressed crv
 func DecompressCRV(compressedCRV []byte) (*bitarray.BitArray, error) {
-	buf := bytes.NewBuffer(compressedCRV)
-    r, err := xz.NewReader(buf)
-    if err != nil {
-        return nil, fmt.Errorf("NewReader error %s", err)
-	}
-    decompCRV, err := ioutil.ReadAll(r)
+	decompCRV, err := XZCodec{}.Decompress(compressedCRV)
 	if err != nil {
-        return nil, fmt.Errorf("failed to decompress: %v", err)
+        return nil, err
 	}
 	crv, err := bitarray.Unmarshal(decompCRV)
 	if err != nil {
@@ -51,10 +329,9 @@ func DecompressCRV(compressedCRV []byte) (*bitarray.BitArray, error) {
 	return &crv, nil
 }
 
-// Convert a list of revocationNumbers to a crv bitarray of delta certificates
+// Convert a list of revocationNumbers to a sparse crv bitarray of delta certificates, which only allocates blocks holding set bits
 func GetCRVDelta(revocationNumbers []uint64) (*bitarray.BitArray) {
-	maxNum := max(revocationNumbers)
-	crvDelta := bitarray.NewBitArray(maxNum + 1)	
+	crvDelta := bitarray.NewSparseBitArray()
 	for _, revocationNum := range revocationNumbers {
 		crvDelta.SetBit(revocationNum)
 	}
@@ -73,9 +350,11 @@ func CreateCRV(revocationNumbers []uint64, length uint64) (*bitarray.BitArray) {
 	return &crvDelta
 }
 
-// OR the crv and delta crv to get the most recent version of the crv
+// OR the crv and delta crv to get the most recent version of the crv.
+// The delta is copied into a dense bitarray first since Or of a sparse and a dense bitarray allocates far past the highest bit
 func ApplyCRVDeltaToCRV(crv, crvDelta *bitarray.BitArray) *bitarray.BitArray {
-	newCRV := (*crv).Or(*crvDelta)
+	denseDelta := CreateCRV((*crvDelta).ToNums(), 0)
+	newCRV := (*crv).Or(*denseDelta)
 	return &newCRV
 }
 
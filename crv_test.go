@@ -78,3 +78,34 @@ func TestEquals(t *testing.T) {
 		t.Errorf("firstSameCRV (%v) equal to firstDiffCRV (%v) when it should not be", *firstSameCRV, *firstDiffCRV)
 	}
 }
+
+func TestBitArrayCRVGrowsOnSetBit(t *testing.T) {
+	crv := NewBitArrayCRV()
+	revNumsList := []uint64{1, 100, 5000}
+	for _, revNum := range revNumsList {
+		if err := crv.SetBit(revNum); err != nil {
+			t.Errorf("failed to set bit (%v): %v", revNum, err)
+		}
+	}
+	if !reflect.DeepEqual(crv.ToNums(), revNumsList) {
+		t.Errorf("CRV nums (%v) not equal to set revNums (%v)", crv.ToNums(), revNumsList)
+	}
+	if crv.Cardinality() != uint64(len(revNumsList)) {
+		t.Errorf("CRV cardinality (%v) not equal to number of set bits (%v)", crv.Cardinality(), len(revNumsList))
+	}
+}
+
+func TestGetCRVDeltaIsSparse(t *testing.T) {
+	deltaCRV := GetCRVDelta([]uint64{1 << 32 - 1})
+	if !reflect.DeepEqual((*deltaCRV).ToNums(), []uint64{1 << 32 - 1}) {
+		t.Errorf("delta CRV nums (%v) not equal to revNums", (*deltaCRV).ToNums())
+	}
+
+	deltaCRV = GetCRVDelta([]uint64{1 << 20})
+	crv := CreateCRV([]uint64{1, 2, 3}, 0)
+	newCRV := ApplyCRVDeltaToCRV(crv, deltaCRV)
+	newCRVRevNumsList := (*newCRV).ToNums()
+	if !reflect.DeepEqual(newCRVRevNumsList, []uint64{1, 2, 3, 1 << 20}) {
+		t.Errorf("combined new CRV nums (%v) not equal to CRV and delta revNums", newCRVRevNumsList)
+	}
+}
@@ -21,6 +21,8 @@ var (
 	caConfigName = flag.String("config", "ca/ca_config.json", "File containing CA configuration")
 	caListName = flag.String("calist", "ca/ca_list.json", "File containing CAList")
 	logListName = flag.String("loglist", "ca/log_list.json", "File containing LogList")
+	finalSRD = flag.Bool("final-srd", true, "Publish the pending revocations in a final SRD when the CA shuts down")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 5 * time.Second, "Time in-flight requests get to finish when the CA shuts down")
 )
 
 func main(){
@@ -48,13 +50,18 @@ func main(){
 	server := serverSetup(caInstance)
 	glog.Infoln("Created ca http.Server")
 
+	// Start delivering SRDs to the logs, including the ones left in the outbox
+	caInstance.Deliverer.Start()
+
 	// Start the Sequencer that will keep track of MMDs
-	startSequencer(caInstance)
+	stopSequencer := startSequencer(caInstance)
 
 	// Handling the stop signal and closing things 
-	<-stop
-	glog.Infoln("Received stop signal")
-	shutdownServer(server, 0)
+	sig := <-stop
+	glog.Infof("Received stop signal (%v)", sig)
+	status := shutdownServer(server, caInstance, stopSequencer, *finalSRD)
+	glog.Flush()
+	os.Exit(status)
 }
 
 // Sets up the basic ca http server
@@ -68,7 +75,7 @@ func serverSetup(c *ca.CA) *http.Server{
 
 	// start up handles
 	go func() {
-		if err := server.ListenAndServe(); err != nil {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			glog.Flush()
 			glog.Exitf("Problem serving: %v\n",err)
 		}
@@ -84,6 +91,16 @@ func handlerSetup(c *ca.CA) (*http.ServeMux) {
 	serveMux.HandleFunc(ctca.PostLogSRDWithRevDataPath, handler.PostLogSRDWithRevData)
 	serveMux.HandleFunc(ctca.PostNewRevocationNumsPath, handler.PostNewRevocationNums)
 	serveMux.HandleFunc(ctca.RevokeAndProduceSRDPath, handler.RevokeAndProduceSRD)
+	serveMux.HandleFunc(ctca.GetNumberSpaceUsagePath, handler.GetNumberSpaceUsage)
+	serveMux.HandleFunc(ctca.GetRevocationReasonPath, handler.GetRevocationReason)
+	serveMux.HandleFunc(ctca.AssignRevocationNumPath, handler.AssignRevocationNum)
+	serveMux.HandleFunc(ctca.GetCertificateRecordPath, handler.GetCertificateRecord)
+	serveMux.HandleFunc(ctca.RevokeCertificatePath, handler.RevokeCertificate)
+	serveMux.HandleFunc(ctca.IssueCertificatePath, handler.IssueCertificate)
+	serveMux.HandleFunc(ctca.GetCRLPath, handler.GetCRL)
+	serveMux.HandleFunc(ctca.OCSPPath, handler.OCSP)
+	serveMux.HandleFunc(ctca.OCSPPath + "/", handler.OCSP)
+	serveMux.HandleFunc(ctca.GetSRDDeliveriesPath, handler.GetSRDDeliveries)
 
 	// Return a 200 on the root so clients can easily check if server is up
 	serveMux.HandleFunc("/", func(resp http.ResponseWriter, req *http.Request) {
@@ -97,22 +114,57 @@ func handlerSetup(c *ca.CA) (*http.ServeMux) {
 }
 
 // Start the sequencer that keeps track of time for the MMD
-func startSequencer(caInstance *ca.CA) {
+// The returned function stops the sequencer through its done channel and waits until it has returned
+func startSequencer(caInstance *ca.CA) func() error {
 	glog.Infoln("Starting sequencer")
 	seqdone := make(chan bool)
+	seqErr := make(chan error, 1)
 	go func() {
-		if err := sequencer.Run(seqdone, caInstance); err != nil {
-			glog.Exitf("failed to start sequencer: %v",err)
-		}
+		seqErr <- sequencer.Run(seqdone, caInstance)
 	}()
 	glog.Infoln("Sequencer started")
+	return func() error {
+		close(seqdone)
+		return <-seqErr
+	}
 }
 
-// Shut down the CA Server instance
-func shutdownServer(server *http.Server, returnCode int){
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	server.Shutdown(ctx)
+// Shut down the CA Server instance in order and get the exit status of the CA: 0 when every step succeeded and 1 otherwise.
+// New revocations are rejected first and in-flight requests are drained, so no revocation is acknowledged after the
+// sequencer stops. With finalSRD the pending revocations are then published in a final SRD (see ca.SealMMDs); without
+// it they stay in the journal and are published at the first MMD after the next start. The outbox of SRDs is then
+// flushed to the logs, and the storage is closed last
+func shutdownServer(server *http.Server, caInstance *ca.CA, stopSequencer func() error, finalSRD bool) int {
+	status := 0
+	caInstance.StopRevocations()
 	glog.Infoln("Shutting down Server")
-	glog.Flush()
-	os.Exit(returnCode)
-}
\ No newline at end of file
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		glog.Errorf("failed to drain in-flight requests: %v", err)
+		status = 1
+	}
+	if err := stopSequencer(); err != nil {
+		glog.Errorf("sequencer failed: %v", err)
+		status = 1
+	}
+	if finalSRD {
+		produced, err := caInstance.SealMMDs(caInstance.Clock.Now())
+		if err != nil {
+			glog.Errorf("failed to seal the current MMD, the pending revocations are published after the next start: %v", err)
+			status = 1
+		}
+		glog.Infof("Produced %v final SRDs", produced)
+	}
+	// Undelivered SRDs stay in the outbox and are delivered after the next start, so they do not fail the shutdown
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancelFlush()
+	if err := caInstance.Deliverer.Stop(flushCtx); err != nil {
+		glog.Warningf("failed to flush SRD deliveries: %v", err)
+	}
+	if err := caInstance.Close(); err != nil {
+		glog.Errorf("failed to close ca storage: %v", err)
+		status = 1
+	}
+	return status
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"testing"
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/base64"
+	stdx509 "crypto/x509"
+	cryptorand "crypto/rand"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/certificate-transparency-go/x509/pkix"
+	"golang.org/x/crypto/ocsp"
+	ctca "github.com/n-ct/ct-certificate-authority"
+	"github.com/n-ct/ct-certificate-authority/ca"
+	"github.com/n-ct/ct-certificate-authority/clock"
+	"github.com/n-ct/ct-certificate-authority/sequencer"
+)
+
+var (
+	testCAConfigName = "../testdata/ca_config.json"
+	testCAListName = "../testdata/ca_list.json"
+	testLogListName = "../testdata/log_list.json"
+)
+
+// Send a request with a JSON body, a raw body if body is a []byte, or no body if body is nil, and drain the response
+func mustDo(t *testing.T, method string, url string, body interface{}) (int, []byte) {
+	t.Helper()
+	reqBody, raw := body.([]byte)
+	if body != nil && !raw {
+		var err error
+		if reqBody, err = json.Marshal(body); err != nil {
+			t.Errorf("failed to marshal request body: %v", err)
+			return 0, nil
+		}
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(reqBody))
+	if err != nil {
+		t.Errorf("failed to create request: %v", err)
+		return 0, nil
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("failed to send %v %v: %v", method, url, err)
+		return 0, nil
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("failed to read response of %v %v: %v", method, url, err)
+	}
+	return resp.StatusCode, respBody
+}
+
+// Create a PEM CSR for example.com signed by a new key
+func mustCreateCSR(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate subject key: %v", err)
+	}
+	der, err := x509.CreateCertificateRequest(cryptorand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "example.com"}}, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate request: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+}
+
+// Issue, look up, query and revoke a certificate through the endpoints
+func issueAndRevoke(t *testing.T, url string, csr string, issuer *stdx509.Certificate) {
+	status, body := mustDo(t, "POST", url + ctca.IssueCertificatePath, ctca.IssueCertificateRequest{CSR: csr})
+	if status != http.StatusOK {
+		t.Errorf("issue-certificate returned (%v): %s", status, body)
+		return
+	}
+	var issued ctca.IssuedCertificate
+	if err := json.Unmarshal(body, &issued); err != nil {
+		t.Errorf("failed to unmarshal issued certificate: %v", err)
+		return
+	}
+	if status, body := mustDo(t, "GET", url + ctca.GetCertificateRecordPath + "?" + ctca.SerialParam + "=" + issued.Record.Serial, nil); status != http.StatusOK {
+		t.Errorf("get-certificate-record returned (%v): %s", status, body)
+	}
+	cert, err := stdx509.ParseCertificate(issued.Certificate)
+	if err != nil {
+		t.Errorf("failed to parse issued certificate: %v", err)
+		return
+	}
+	ocspReq, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		t.Errorf("failed to create OCSP request: %v", err)
+		return
+	}
+	if status, _ := mustDo(t, "POST", url + ctca.OCSPPath, ocspReq); status != http.StatusOK {
+		t.Errorf("ocsp returned (%v)", status)
+	}
+	revokeReq := ctca.RevokeCertificateRequest{
+		Certificate: base64.StdEncoding.EncodeToString(issued.Certificate),
+		Reason: ctca.KeyCompromise,
+	}
+	if status, body := mustDo(t, "POST", url + ctca.RevokeCertificatePath, revokeReq); status != http.StatusOK {
+		t.Errorf("revoke-certificate returned (%v): %s", status, body)
+	}
+}
+
+// Hammer every endpoint while the sequencer runs MMDs. Run with go test -race to check the locking of the CA
+func TestConcurrentEndpointsAndSequencer(t *testing.T) {
+	caInstance, err := ca.NewCA(testCAConfigName, testCAListName, testLogListName)
+	if err != nil {
+		t.Fatalf("failed to create ca: %v", err)
+	}
+	defer caInstance.Close()
+	server := httptest.NewServer(handlerSetup(caInstance))
+	defer server.Close()
+	issuer, err := stdx509.ParseCertificate(caInstance.Issuer.Certificate.Raw)
+	if err != nil {
+		t.Fatalf("failed to parse issuer certificate: %v", err)
+	}
+	csr := mustCreateCSR(t)
+
+	done := make(chan bool)
+	seqErr := make(chan error, 1)
+	go func() {
+		seqErr <- sequencer.Run(done, caInstance)
+	}()
+
+	// Every worker runs a different mix of requests until the sequencer has had a few MMDs
+	workers := []func(i int){
+		func(i int) {
+			revocationNums := []uint64{uint64(rand.Intn(1000)), uint64(rand.Intn(1000))}
+			if status, body := mustDo(t, "POST", server.URL + ctca.PostNewRevocationNumsPath, ctca.PostNewRevocationNumsRequest{RevocationNums: revocationNums}); status != http.StatusOK {
+				t.Errorf("post-new-revocation-nums returned (%v): %s", status, body)
+			}
+		},
+		func(i int) {
+			issueAndRevoke(t, server.URL, csr, issuer)
+		},
+		func(i int) {
+			assignReq := ctca.AssignRevocationNumRequest{
+				Fingerprint: fmt.Sprintf("%064x", rand.Int63()),
+				Serial: fmt.Sprintf("%x", rand.Int63()),
+				NotAfter: uint64(time.Now().Add(time.Hour).Unix()),
+			}
+			if status, body := mustDo(t, "POST", server.URL + ctca.AssignRevocationNumPath, assignReq); status != http.StatusOK {
+				t.Errorf("assign-revocation-num returned (%v): %s", status, body)
+			}
+		},
+		func(i int) {
+			mustDo(t, "GET", server.URL + ctca.GetRevocationStatusPath, nil)
+			mustDo(t, "GET", server.URL + ctca.GetNumberSpaceUsagePath, nil)
+			mustDo(t, "GET", fmt.Sprintf("%v%v?%v=%v", server.URL, ctca.GetRevocationReasonPath, ctca.RevocationNumParam, rand.Intn(1000)), nil)
+			mustDo(t, "GET", server.URL + ctca.GetCRLPath, nil)
+			mustDo(t, "GET", server.URL + ctca.GetCRLPath + "?" + ctca.DeltaParam + "=true", nil)
+			if status, body := mustDo(t, "GET", server.URL + ctca.GetSRDDeliveriesPath, nil); status != http.StatusOK {
+				t.Errorf("get-srd-deliveries returned (%v): %s", status, body)
+			}
+		},
+		func(i int) {
+			// Neither request is valid, but both reach the CA
+			mustDo(t, "POST", server.URL + ctca.PostLogSRDWithRevDataPath, struct{}{})
+			if i % 10 == 0 {
+				mustDo(t, "GET", server.URL + ctca.RevokeAndProduceSRDPath, ctca.RevokeAndProduceSRDRequest{TotalCerts: 1000, PercentRevoked: 1})
+			}
+		},
+	}
+	deadline := time.Now().Add(time.Duration(3 * caInstance.MMD) * time.Second + 500 * time.Millisecond)
+	var wg sync.WaitGroup
+	for _, worker := range workers {
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func(worker func(int)) {
+				defer wg.Done()
+				for i := 0; time.Now().Before(deadline); i++ {
+					worker(i)
+				}
+			}(worker)
+		}
+	}
+	wg.Wait()
+	close(done)
+	if err := <-seqErr; err != nil {
+		t.Fatalf("sequencer failed: %v", err)
+	}
+
+	// The sequencer produced SRDs while the endpoints were in use
+	if status, body := mustDo(t, "GET", server.URL + ctca.GetCRLPath, nil); status != http.StatusOK {
+		t.Fatalf("get-crl returned (%v) after the sequencer ran: %s", status, body)
+	}
+}
+
+// Shut down while a revocation is pending and check that it is sealed in a final SRD and later revocations are rejected
+func TestShutdownSealsPendingRevocations(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1600000000, 0))
+	caInstance, err := ca.NewCAWithClock(testCAConfigName, testCAListName, testLogListName, ca.NewMemoryStorage(), fake)
+	if err != nil {
+		t.Fatalf("failed to create ca: %v", err)
+	}
+	server := httptest.NewServer(handlerSetup(caInstance))
+	defer server.Close()
+	revType := caInstance.DefaultRevocationType
+	stopSequencer := startSequencer(caInstance)
+
+	// The sequencer has produced the SRD of the current MMD and waits for the next boundary
+	fake.BlockUntil(len(caInstance.RevocationTypeNames()))
+	current := caInstance.MMDTimestamp()
+	revocationReq := ctca.PostNewRevocationNumsRequest{RevocationNums: []uint64{5}, Reasons: []ctca.ReasonCode{ctca.KeyCompromise}}
+	if status, body := mustDo(t, "POST", server.URL + ctca.PostNewRevocationNumsPath, revocationReq); status != http.StatusOK {
+		t.Fatalf("post-new-revocation-nums returned (%v): %s", status, body)
+	}
+
+	if status := shutdownServer(server.Config, caInstance, stopSequencer, true); status != 0 {
+		t.Fatalf("shutdown exited with status (%v)", status)
+	}
+	final, err := caInstance.GetCASRD(revType, current + caInstance.RevocationTypeMMD(revType))
+	if err != nil {
+		t.Fatalf("no final SRD at the end of the current MMD: %v", err)
+	}
+	delta, err := caInstance.RevocationTypes[revType].DecodeDelta(final.RevData.CRVDelta)
+	if err != nil {
+		t.Fatalf("failed to decode delta of the final SRD: %v", err)
+	}
+	if revNums := delta.RevocationNums(); len(revNums) != 1 || revNums[0] != 5 || len(caInstance.DeltaRevocationsToList(revType)) != 0 {
+		t.Fatalf("final SRD publishes (%v) with (%v) still pending", revNums, caInstance.DeltaRevocationsToList(revType))
+	}
+
+	// Revocations are rejected once the CA shuts down
+	if err := caInstance.AddRevocationNums(revType, &[]uint64{6}); !errors.Is(err, ca.ErrRevocationsStopped) {
+		t.Fatalf("expected ErrRevocationsStopped, got: %v", err)
+	}
+	body, err := json.Marshal(ctca.PostNewRevocationNumsRequest{RevocationNums: []uint64{6}})
+	if err != nil {
+		t.Fatalf("failed to marshal request body: %v", err)
+	}
+	recorder := httptest.NewRecorder()
+	handlerSetup(caInstance).ServeHTTP(recorder, httptest.NewRequest("POST", ctca.PostNewRevocationNumsPath, bytes.NewReader(body)))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("post-new-revocation-nums returned (%v) during shutdown", recorder.Code)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/google/certificate-transparency-go/x509"
+	ctca "github.com/n-ct/ct-certificate-authority"
+	"github.com/n-ct/ct-certificate-authority/ca"
+)
+
+var (
+	caConfigName = flag.String("config", "ca/ca_config.json", "File containing CA configuration")
+	caListName = flag.String("calist", "ca/ca_list.json", "File containing CAList")
+	logListName = flag.String("loglist", "ca/log_list.json", "File containing LogList")
+	crlName = flag.String("crl", "", "File containing the DER or PEM CRL")
+	crlIssuerName = flag.String("crl-issuer", "", "File containing the PEM certificate that signed the CRL, checked when given")
+	revType = flag.String("revocation-type", "", "Revocation type of the CRV, the default revocation type of the CA when empty")
+	reconcile = flag.Bool("reconcile", false, "Report the differences between the CRL and the CRV instead of importing the CRL")
+)
+
+// Seed the CRV of a revocation type from a CRL, or report how the CRL and the CRV differ.
+// Run it while the CA is stopped. Exits with 1 when it fails and with 2 when a reconciled CRL differs from the CRV
+func main() {
+	flag.Parse()
+	defer glog.Flush()
+	os.Exit(run())
+}
+
+func run() int {
+	if *crlName == "" {
+		fmt.Fprintln(os.Stderr, "-crl is required")
+		return 1
+	}
+	crl, err := readCRL(*crlName, *crlIssuerName)
+	if err != nil {
+		glog.Errorf("Couldn't read CRL: %v", err)
+		return 1
+	}
+
+	caInstance, err := ca.NewCA(*caConfigName, *caListName, *logListName)
+	if err != nil {
+		glog.Errorf("Couldn't create ca: %v", err)
+		return 1
+	}
+	defer caInstance.Close()
+	if *revType == "" {
+		*revType = caInstance.DefaultRevocationType
+	}
+
+	var report interface{}
+	status := 0
+	if *reconcile {
+		reconciliation, err := caInstance.ReconcileCRL(*revType, crl)
+		if err != nil {
+			glog.Errorf("Couldn't reconcile CRL: %v", err)
+			return 1
+		}
+		if !reconciliation.InSync() {
+			status = 2
+		}
+		report = reconciliation
+	} else {
+		imported, err := caInstance.ImportCRL(*revType, crl)
+		if err != nil {
+			glog.Errorf("Couldn't import CRL: %v", err)
+			return 1
+		}
+		glog.Infof("Imported %v revocations of revType (%v) in SRD at (%v)", len(imported.Revocations), *revType, imported.Timestamp)
+		report = imported
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		glog.Errorf("Couldn't write report: %v", err)
+		return 1
+	}
+	return status
+}
+
+// Read the CRL and, when issuerName is given, the issuer certificate its signature is checked against
+func readCRL(crlName string, issuerName string) (*x509.CertificateList, error) {
+	data, err := ioutil.ReadFile(crlName)
+	if err != nil {
+		return nil, err
+	}
+	var issuer *x509.Certificate
+	if issuerName != "" {
+		issuerPEM, err := ioutil.ReadFile(issuerName)
+		if err != nil {
+			return nil, err
+		}
+		issuer, err = ctca.DecodeCertificate(string(issuerPEM))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read issuer certificate (%v): %w", issuerName, err)
+		}
+	}
+	return ca.ParseCRL(data, issuer)
+}
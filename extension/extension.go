@@ -0,0 +1,184 @@
+// Package extension defines the X.509 extension that carries the revocation number of a certificate,
+// so that relying parties can find the bit of the certificate in the CRV of its revocation type.
+//
+// A certificate has at most one instance of the extension (RFC 5280 section 4.2), so its value is the DER encoding of
+//
+//	RevocationNumbers ::= SEQUENCE SIZE (1..MAX) OF RevocationNumber
+//
+//	RevocationNumber ::= SEQUENCE {
+//	    revocationType    UTF8String,
+//	    expirationBucket  INTEGER,
+//	    index             INTEGER }
+//
+// with one RevocationNumber per revocation type. expirationBucket and index are the two halves of the revocation number (see ctca.SplitRevocationNum)
+package extension
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/certificate-transparency-go/asn1"
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/certificate-transparency-go/x509/pkix"
+	ctca "github.com/n-ct/ct-certificate-authority"
+)
+
+// OID of the revocation number extension. It lives in the IANA experimental arc (1.3.6.1.3) until it is registered
+var OIDRevocationNumber = asn1.ObjectIdentifier{1, 3, 6, 1, 3, 6962, 1}
+
+// Returned by FromCertificate for certificates without the revocation number extension
+var ErrNoRevocationNumber = errors.New("certificate has no revocation number extension")
+
+// The revocation number of a certificate within a revocation type
+type RevocationNumber struct {
+	RevocationType 	string
+	Bucket 			uint64	// Expiration bucket of the certificate
+	Index 			uint64	// Index of the certificate within the CRV of its bucket
+}
+
+// ASN.1 form of a RevocationNumber
+type revocationNumberASN1 struct {
+	RevocationType 	string `asn1:"utf8"`
+	Bucket 			int64
+	Index 			int64
+}
+
+// Split revocationNum of revType into its bucket and index
+func NewRevocationNumber(revType string, revocationNum uint64) RevocationNumber {
+	bucket, index := ctca.SplitRevocationNum(revocationNum)
+	return RevocationNumber{RevocationType: revType, Bucket: bucket, Index: index}
+}
+
+// Join the bucket and index back into a revocation number
+func (r RevocationNumber) RevocationNum() uint64 {
+	return ctca.JoinRevocationNum(r.Bucket, r.Index)
+}
+
+// Check that the revocation number names a revocation type and that its bucket and index fit in a revocation number
+func (r RevocationNumber) Validate() error {
+	if r.RevocationType == "" {
+		return fmt.Errorf("revocation number is missing its revocation type")
+	}
+	if r.Index >> ctca.MaxBitsInRevocationNumber != 0 {
+		return fmt.Errorf("index (%v) exceeds the (%v) index bits of a revocation number", r.Index, ctca.MaxBitsInRevocationNumber)
+	}
+	if r.Bucket >> (64 - ctca.MaxBitsInRevocationNumber) != 0 {
+		return fmt.Errorf("bucket (%v) exceeds the (%v) bucket bits of a revocation number", r.Bucket, 64 - ctca.MaxBitsInRevocationNumber)
+	}
+	return nil
+}
+
+// Check that the revocation number is one revocationType would assign to a certificate expiring at notAfter (unix seconds)
+func (r RevocationNumber) ValidateFor(revocationType ctca.RevocationType, notAfter uint64) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	if r.RevocationType != revocationType.Name() {
+		return fmt.Errorf("revocation number of revocation type (%v) used with (%v)", r.RevocationType, revocationType.Name())
+	}
+	if bucket := revocationType.ExpirationBucket(notAfter); r.Bucket != bucket {
+		return fmt.Errorf("bucket (%v) of revocation number is not the expiration bucket (%v) of the certificate", r.Bucket, bucket)
+	}
+	return revocationType.ValidateRevocationNums([]uint64{r.RevocationNum()})
+}
+
+// Check that there is at least one revocation number, that each is valid and that no revocation type appears twice
+func validateAll(revocationNums []RevocationNumber) error {
+	if len(revocationNums) == 0 {
+		return fmt.Errorf("no revocation numbers")
+	}
+	revTypes := make(map[string]bool)
+	for _, r := range revocationNums {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+		if revTypes[r.RevocationType] {
+			return fmt.Errorf("more than one revocation number of revocation type (%v)", r.RevocationType)
+		}
+		revTypes[r.RevocationType] = true
+	}
+	return nil
+}
+
+// DER encode the revocation numbers as an extension value
+func Marshal(revocationNums []RevocationNumber) ([]byte, error) {
+	if err := validateAll(revocationNums); err != nil {
+		return nil, err
+	}
+	encoded := []revocationNumberASN1{}
+	for _, r := range revocationNums {
+		encoded = append(encoded, revocationNumberASN1{RevocationType: r.RevocationType, Bucket: int64(r.Bucket), Index: int64(r.Index)})
+	}
+	value, err := asn1.Marshal(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal revocation numbers: %w", err)
+	}
+	return value, nil
+}
+
+// Decode a DER encoded extension value
+func Unmarshal(value []byte) ([]RevocationNumber, error) {
+	var decoded []revocationNumberASN1
+	rest, err := asn1.Unmarshal(value, &decoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal revocation numbers: %w", err)
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("trailing data after revocation numbers")
+	}
+	revocationNums := []RevocationNumber{}
+	for _, d := range decoded {
+		if d.Bucket < 0 || d.Index < 0 {
+			return nil, fmt.Errorf("revocation number has a negative bucket (%v) or index (%v)", d.Bucket, d.Index)
+		}
+		revocationNums = append(revocationNums, RevocationNumber{RevocationType: d.RevocationType, Bucket: uint64(d.Bucket), Index: uint64(d.Index)})
+	}
+	if err := validateAll(revocationNums); err != nil {
+		return nil, err
+	}
+	return revocationNums, nil
+}
+
+// Create the non-critical extension carrying the revocation numbers, for use in a certificate template
+func NewExtension(revocationNums []RevocationNumber) (pkix.Extension, error) {
+	value, err := Marshal(revocationNums)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: OIDRevocationNumber, Critical: false, Value: value}, nil
+}
+
+// Get the revocation numbers carried by the extension of cert
+func FromCertificate(cert *x509.Certificate) ([]RevocationNumber, error) {
+	var revocationNums []RevocationNumber
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(OIDRevocationNumber) {
+			continue
+		}
+		if revocationNums != nil {
+			return nil, fmt.Errorf("certificate has more than one revocation number extension")
+		}
+		var err error
+		if revocationNums, err = Unmarshal(ext.Value); err != nil {
+			return nil, err
+		}
+	}
+	if revocationNums == nil {
+		return nil, ErrNoRevocationNumber
+	}
+	return revocationNums, nil
+}
+
+// Get the revocation number cert carries for revType
+func ForRevocationType(cert *x509.Certificate, revType string) (RevocationNumber, error) {
+	revocationNums, err := FromCertificate(cert)
+	if err != nil {
+		return RevocationNumber{}, err
+	}
+	for _, r := range revocationNums {
+		if r.RevocationType == revType {
+			return r, nil
+		}
+	}
+	return RevocationNumber{}, fmt.Errorf("no revocation number of revocation type (%v): %w", revType, ErrNoRevocationNumber)
+}
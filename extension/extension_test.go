@@ -0,0 +1,97 @@
+package extension
+
+import (
+	"testing"
+	"errors"
+	"reflect"
+	"time"
+	"math/big"
+	"crypto/rand"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+
+	"github.com/google/certificate-transparency-go/asn1"
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/certificate-transparency-go/x509/pkix"
+	ctca "github.com/n-ct/ct-certificate-authority"
+)
+
+func TestRevocationNumberExtensionRoundTrip(t *testing.T) {
+	revType, err := ctca.NewRevocationType(ctca.RevocationTypeConfig{Name: ctca.LetsRevokeMechanism})
+	if err != nil {
+		t.Fatalf("failed to create revocation type: %v", err)
+	}
+	notAfter := time.Unix(5 * ctca.DefaultBucketDuration + 7, 0)
+	bucket := revType.ExpirationBucket(uint64(notAfter.Unix()))
+	revocationNums := []RevocationNumber{
+		NewRevocationNumber(revType.Name(), ctca.JoinRevocationNum(bucket, 1 << 31 + 9)),
+		{RevocationType: "Emergency", Bucket: bucket, Index: 3},
+	}
+	ext, err := NewExtension(revocationNums)
+	if err != nil {
+		t.Fatalf("failed to create extension: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "example.com"},
+		NotBefore: time.Unix(0, 0),
+		NotAfter: notAfter,
+		ExtraExtensions: []pkix.Extension{ext},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	decoded, err := FromCertificate(cert)
+	if err != nil {
+		t.Fatalf("failed to get revocation numbers from certificate: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, revocationNums) {
+		t.Fatalf("decoded revocation numbers (%v) not equal to (%v)", decoded, revocationNums)
+	}
+	letsRevokeNum, err := ForRevocationType(cert, revType.Name())
+	if err != nil || letsRevokeNum.RevocationNum() != revocationNums[0].RevocationNum() {
+		t.Fatalf("revocation number of (%v) (%v, %v) not equal to (%v)", revType.Name(), letsRevokeNum, err, revocationNums[0])
+	}
+	if err := letsRevokeNum.ValidateFor(revType, uint64(notAfter.Unix())); err != nil {
+		t.Fatalf("failed to validate revocation number: %v", err)
+	}
+	if err := letsRevokeNum.ValidateFor(revType, uint64(notAfter.Unix()) + ctca.DefaultBucketDuration); err == nil {
+		t.Fatalf("failed to reject revocation number outside the expiration bucket of the certificate")
+	}
+	if _, err := ForRevocationType(cert, "unknown"); !errors.Is(err, ErrNoRevocationNumber) {
+		t.Fatalf("expected ErrNoRevocationNumber for unknown revocation type, got: %v", err)
+	}
+}
+
+func TestUnmarshalRejectsInvalidRevocationNumbers(t *testing.T) {
+	if _, err := Marshal([]RevocationNumber{{RevocationType: "a", Index: 1}, {RevocationType: "a", Index: 2}}); err == nil {
+		t.Fatalf("failed to reject two revocation numbers of the same revocation type")
+	}
+	if _, err := Marshal([]RevocationNumber{{RevocationType: "a", Index: 1 << 32}}); err == nil {
+		t.Fatalf("failed to reject index that does not fit in a revocation number")
+	}
+	negative, err := asn1.Marshal([]revocationNumberASN1{{RevocationType: "a", Bucket: 1, Index: -1}})
+	if err != nil {
+		t.Fatalf("failed to marshal revocation numbers: %v", err)
+	}
+	if _, err := Unmarshal(negative); err == nil {
+		t.Fatalf("failed to reject negative index")
+	}
+	empty, err := asn1.Marshal([]revocationNumberASN1{})
+	if err != nil {
+		t.Fatalf("failed to marshal revocation numbers: %v", err)
+	}
+	if _, err := Unmarshal(empty); err == nil {
+		t.Fatalf("failed to reject empty revocation numbers")
+	}
+}
@@ -8,4 +8,5 @@ require (
 	github.com/google/certificate-transparency-go v1.1.1
 	github.com/n-ct/ct-monitor v0.0.0-20210522153318-69a089d8ea07
 	github.com/ulikunitz/xz v0.5.10
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 )
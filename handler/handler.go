@@ -5,6 +5,12 @@ import (
 	"encoding/json"
 	"net/http"
 	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"io/ioutil"
+	"net/url"
+	"encoding/base64"
 
 	"github.com/golang/glog"
 	"github.com/n-ct/ct-certificate-authority/ca"
@@ -13,6 +19,9 @@ import (
 	ctca "github.com/n-ct/ct-certificate-authority"
 )
 
+// Largest OCSP request body accepted by the OCSP endpoint
+const maxOCSPRequestSize = 10000
+
 type Handler struct {
 	c *ca.CA
 }
@@ -32,6 +41,29 @@ func writeErrorResponse(rw *http.ResponseWriter, status int, body string) {
 	(*rw).Write([]byte(body))
 }
 
+// Write an error that clients can act on as JSON, with its message in an Error field
+func writeJSONErrorResponse(rw *http.ResponseWriter, status int, err error) {
+	body, marshalErr := json.Marshal(struct {
+		Error string
+		Details error
+	}{err.Error(), err})
+	if marshalErr != nil {
+		writeErrorResponse(rw, status, err.Error())
+		return
+	}
+	(*rw).Header().Set("Content-Type", "application/json")
+	writeErrorResponse(rw, status, string(body))
+}
+
+// Resolve the revocation type named by a request to one of the revocation types of the CA
+func (h *Handler) getRevocationType(revType string) (string, error) {
+	revocationType, err := h.c.GetRevocationType(revType)
+	if err != nil {
+		return "", err
+	}
+	return revocationType.Name(), nil
+}
+
 // Handle a post request for an SRDWithRevData from a Logger
 func (h *Handler) PostLogSRDWithRevData(rw http.ResponseWriter, req *http.Request){
 	glog.Infoln("Received PostLogRevocationDigest Request")
@@ -46,6 +78,11 @@ func (h *Handler) PostLogSRDWithRevData(rw http.ResponseWriter, req *http.Reques
 		return
 	}
 
+	if _, err := h.c.GetRevocationType(srd.RevData.RevocationType); err != nil {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid PostLogSRDWithRevData Request: %v", err))
+		return
+	}
+
 	// Verify Signature
 	if err := h.c.VerifyLogSRDSignature(&srd.SRD); err != nil {
 		writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("invalid logSRD signature: %v", err))
@@ -73,9 +110,15 @@ func (h *Handler) GetRevocationStatus(rw http.ResponseWriter, req *http.Request)
 		writeWrongMethodResponse(&rw, "GET")
 		return
 	}
-	revocationStatus, err := h.c.GetLatestRevocationStatus()
+	revType, err := h.getRevocationType(req.URL.Query().Get(ctca.RevocationTypeParam))
+	if err != nil {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid GetRevocationStatus Request: %v", err))
+		return
+	}
+	revocationStatus, err := h.c.GetLatestRevocationStatus(revType)
 	if err != nil {
 		writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't produce revocationStatus: %v", err))
+		return
 	}
 	encoder := json.NewEncoder(rw)
 	if err := encoder.Encode(*revocationStatus); err != nil {
@@ -98,10 +141,371 @@ func (h *Handler) PostNewRevocationNums(rw http.ResponseWriter, req *http.Reques
 		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid PostNewRevocationNums Request: %v", err))
 		return
 	}
-	h.c.AddRevocationNums(&newRevList.RevocationNums)
+	revType, err := h.getRevocationType(newRevList.RevocationType)
+	if err != nil {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid PostNewRevocationNums Request: %v", err))
+		return
+	}
+	revocations, err := ctca.NewRevocations(newRevList.RevocationNums, newRevList.Reasons)
+	if err != nil {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid PostNewRevocationNums Request: %v", err))
+		return
+	}
+	certRevocations, err := h.c.ResolveCertificateRevocations(revType, newRevList.Certificates)
+	if errors.Is(err, ca.ErrUnknownCertificate) {
+		writeErrorResponse(&rw, http.StatusNotFound, fmt.Sprintf("Invalid PostNewRevocationNums Request: %v", err))
+		return
+	}
+	if err != nil {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid PostNewRevocationNums Request: %v", err))
+		return
+	}
+	revocations = append(revocations, certRevocations...)
+	if err := h.c.AddRevocations(revType, revocations); err != nil {
+		writeAddRevocationsErrorResponse(&rw, err)
+		return
+	}
 	rw.WriteHeader(http.StatusOK)
 }
 
+// Write the response for an error returned when adding revocations to the CA
+func writeAddRevocationsErrorResponse(rw *http.ResponseWriter, err error) {
+	if errors.Is(err, ca.ErrRevocationsStopped) {
+		writeErrorResponse(rw, http.StatusServiceUnavailable, fmt.Sprintf("failed to add revocation nums: %v", err))
+		return
+	}
+	var revNumErr *ctca.RevocationNumberError
+	if errors.As(err, &revNumErr) {
+		writeJSONErrorResponse(rw, http.StatusBadRequest, revNumErr)
+		return
+	}
+	var bucketErr *ctca.ExpirationBucketError
+	if errors.As(err, &bucketErr) {
+		writeJSONErrorResponse(rw, http.StatusBadRequest, bucketErr)
+		return
+	}
+	// The revocation conflicts with the current status of the certificate, e.g. releasing one that is not on hold
+	var transitionErr *ctca.ReasonTransitionError
+	if errors.As(err, &transitionErr) {
+		writeJSONErrorResponse(rw, http.StatusConflict, transitionErr)
+		return
+	}
+	writeErrorResponse(rw, http.StatusInternalServerError, fmt.Sprintf("failed to add revocation nums: %v", err))
+}
+
+// Handle a request to revoke a certificate issued by the CA by submitting the certificate
+func (h *Handler) RevokeCertificate(rw http.ResponseWriter, req *http.Request) {
+	glog.Infoln("Received RevokeCertificate request")
+	if req.Method != "POST" {
+		writeWrongMethodResponse(&rw, "POST")
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	var revokeReq ctca.RevokeCertificateRequest
+	if err := decoder.Decode(&revokeReq); err != nil {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid RevokeCertificate Request: %v", err))
+		return
+	}
+	revType, err := h.getRevocationType(revokeReq.RevocationType)
+	if err != nil {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid RevokeCertificate Request: %v", err))
+		return
+	}
+	if !revokeReq.Reason.IsValid() {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid RevokeCertificate Request: invalid reason code (%v)", uint8(revokeReq.Reason)))
+		return
+	}
+	cert, err := ctca.DecodeCertificate(revokeReq.Certificate)
+	if err != nil {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid RevokeCertificate Request: %v", err))
+		return
+	}
+	record, err := h.c.RevokeCertificate(revType, cert, revokeReq.Reason)
+	switch {
+	case errors.Is(err, ca.ErrNotIssuedByCA):
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid RevokeCertificate Request: %v", err))
+		return
+	case errors.Is(err, ca.ErrUnknownCertificate):
+		writeErrorResponse(&rw, http.StatusNotFound, fmt.Sprintf("Invalid RevokeCertificate Request: %v", err))
+		return
+	case err != nil:
+		writeAddRevocationsErrorResponse(&rw, err)
+		return
+	}
+	encoder := json.NewEncoder(rw)
+	if err := encoder.Encode(*record); err != nil {
+		writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't encode CertificateRecord response: %v", err))
+		return
+	}
+}
+
+// Handle a request to issue a certificate for a CSR with the next revocation number of a revocation type
+func (h *Handler) IssueCertificate(rw http.ResponseWriter, req *http.Request) {
+	glog.Infoln("Received IssueCertificate request")
+	if req.Method != "POST" {
+		writeWrongMethodResponse(&rw, "POST")
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	var issueReq ctca.IssueCertificateRequest
+	if err := decoder.Decode(&issueReq); err != nil {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid IssueCertificate Request: %v", err))
+		return
+	}
+	revType, err := h.getRevocationType(issueReq.RevocationType)
+	if err != nil {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid IssueCertificate Request: %v", err))
+		return
+	}
+	csr, err := ctca.DecodeCertificateRequest(issueReq.CSR)
+	if err != nil {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid IssueCertificate Request: %v", err))
+		return
+	}
+	issued, err := h.c.IssueCertificate(revType, csr)
+	if err != nil {
+		var revNumErr *ctca.RevocationNumberError
+		switch {
+		case errors.Is(err, ca.ErrInvalidCertificateRequest):
+			writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid IssueCertificate Request: %v", err))
+		// The logs of the CA did not return enough valid SCTs for the precertificate
+		case errors.Is(err, ca.ErrInsufficientSCTs):
+			writeErrorResponse(&rw, http.StatusBadGateway, fmt.Sprintf("Couldn't issue certificate: %v", err))
+		// The expiration bucket of the certificate has no revocation numbers left
+		case errors.As(err, &revNumErr):
+			writeJSONErrorResponse(&rw, http.StatusServiceUnavailable, revNumErr)
+		default:
+			writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't issue certificate: %v", err))
+		}
+		return
+	}
+	encoder := json.NewEncoder(rw)
+	if err := encoder.Encode(*issued); err != nil {
+		writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't encode IssuedCertificate response: %v", err))
+		return
+	}
+}
+
+// Handle an admin request to get the delivery state of the SRDs of the CA to each of its logs
+func (h *Handler) GetSRDDeliveries(rw http.ResponseWriter, req *http.Request) {
+	glog.Infoln("Received GetSRDDeliveries request")
+	if req.Method != "GET" {
+		writeWrongMethodResponse(&rw, "GET")
+		return
+	}
+	encoder := json.NewEncoder(rw)
+	if err := encoder.Encode(h.c.Deliverer.State()); err != nil {
+		writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't encode LogDeliveryState response: %v", err))
+		return
+	}
+}
+
+// Handle a request to get how much of the revocation number space of a revocation type is consumed
+func (h *Handler) GetNumberSpaceUsage(rw http.ResponseWriter, req *http.Request) {
+	glog.Infoln("Received GetNumberSpaceUsage request")
+	if req.Method != "GET" {
+		writeWrongMethodResponse(&rw, "GET")
+		return
+	}
+	revType, err := h.getRevocationType(req.URL.Query().Get(ctca.RevocationTypeParam))
+	if err != nil {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid GetNumberSpaceUsage Request: %v", err))
+		return
+	}
+	usage, err := h.c.GetNumberSpaceUsage(revType)
+	if err != nil {
+		writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't produce number space usage: %v", err))
+		return
+	}
+	encoder := json.NewEncoder(rw)
+	if err := encoder.Encode(*usage); err != nil {
+		writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't encode NumberSpaceUsage response: %v", err))
+		return
+	}
+}
+
+// Handle a request to get the reason a revocation number was revoked for
+func (h *Handler) GetRevocationReason(rw http.ResponseWriter, req *http.Request) {
+	glog.Infoln("Received GetRevocationReason request")
+	if req.Method != "GET" {
+		writeWrongMethodResponse(&rw, "GET")
+		return
+	}
+	revType, err := h.getRevocationType(req.URL.Query().Get(ctca.RevocationTypeParam))
+	if err != nil {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid GetRevocationReason Request: %v", err))
+		return
+	}
+	revocationNum, err := strconv.ParseUint(req.URL.Query().Get(ctca.RevocationNumParam), 10, 64)
+	if err != nil {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid GetRevocationReason Request: invalid %v: %v", ctca.RevocationNumParam, err))
+		return
+	}
+	reasonResp, err := h.c.GetRevocationReason(revType, revocationNum)
+	if err != nil {
+		writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't get revocation reason: %v", err))
+		return
+	}
+	encoder := json.NewEncoder(rw)
+	if err := encoder.Encode(*reasonResp); err != nil {
+		writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't encode RevocationReasonResponse: %v", err))
+		return
+	}
+}
+
+// Handle a request to the CRL distribution point for the full or delta CRL of a revocation type
+func (h *Handler) GetCRL(rw http.ResponseWriter, req *http.Request) {
+	glog.Infoln("Received GetCRL request")
+	if req.Method != "GET" {
+		writeWrongMethodResponse(&rw, "GET")
+		return
+	}
+	query := req.URL.Query()
+	revType, err := h.getRevocationType(query.Get(ctca.RevocationTypeParam))
+	if err != nil {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid GetCRL Request: %v", err))
+		return
+	}
+	delta := false
+	if deltaStr := query.Get(ctca.DeltaParam); deltaStr != "" {
+		delta, err = strconv.ParseBool(deltaStr)
+		if err != nil {
+			writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid GetCRL Request: invalid %v: %v", ctca.DeltaParam, err))
+			return
+		}
+	}
+	crl, err := h.c.GetCRL(revType, delta)
+	if errors.Is(err, ca.ErrNotFound) {
+		writeErrorResponse(&rw, http.StatusNotFound, fmt.Sprintf("Couldn't get CRL: %v", err))
+		return
+	}
+	if err != nil {
+		writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't get CRL: %v", err))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/pkix-crl")
+	rw.Write(crl)
+}
+
+// Handle an RFC 6960 OCSP request, either as the body of a POST or as the base64 path segment of a GET
+func (h *Handler) OCSP(rw http.ResponseWriter, req *http.Request) {
+	glog.Infoln("Received OCSP request")
+	var ocspReq []byte
+	switch req.Method {
+	case "GET":
+		encoded, err := url.PathUnescape(strings.TrimPrefix(strings.TrimPrefix(req.URL.EscapedPath(), ctca.OCSPPath), "/"))
+		if err != nil {
+			writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid OCSP Request: %v", err))
+			return
+		}
+		ocspReq, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid OCSP Request: %v", err))
+			return
+		}
+	case "POST":
+		var err error
+		ocspReq, err = ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, maxOCSPRequestSize))
+		if err != nil {
+			writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid OCSP Request: %v", err))
+			return
+		}
+	default:
+		writeWrongMethodResponse(&rw, "GET, POST")
+		return
+	}
+	rw.Header().Set("Content-Type", "application/ocsp-response")
+	rw.Write(h.c.RespondOCSP(ocspReq))
+}
+
+// Handle a request to assign a revocation number to a certificate
+func (h *Handler) AssignRevocationNum(rw http.ResponseWriter, req *http.Request) {
+	glog.Infoln("Received AssignRevocationNum request")
+	if req.Method != "POST" {
+		writeWrongMethodResponse(&rw, "POST")
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	var assignReq ctca.AssignRevocationNumRequest
+	if err := decoder.Decode(&assignReq); err != nil {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid AssignRevocationNum Request: %v", err))
+		return
+	}
+	revType, err := h.getRevocationType(assignReq.RevocationType)
+	if err != nil {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid AssignRevocationNum Request: %v", err))
+		return
+	}
+	record, err := h.c.Registry.Assign(revType, assignReq.Fingerprint, assignReq.Serial, assignReq.NotAfter)
+	if err != nil {
+		var revNumErr *ctca.RevocationNumberError
+		var bucketErr *ctca.ExpirationBucketError
+		switch {
+		case errors.Is(err, ca.ErrCertificateConflict):
+			writeErrorResponse(&rw, http.StatusConflict, fmt.Sprintf("Couldn't assign revocation num: %v", err))
+		// The expiration bucket of the certificate has no revocation numbers left
+		case errors.As(err, &revNumErr):
+			writeJSONErrorResponse(&rw, http.StatusServiceUnavailable, revNumErr)
+		// The certificate has already expired or expires after the longest certificate lifetime
+		case errors.As(err, &bucketErr):
+			writeJSONErrorResponse(&rw, http.StatusBadRequest, bucketErr)
+		default:
+			writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Couldn't assign revocation num: %v", err))
+		}
+		return
+	}
+	encoder := json.NewEncoder(rw)
+	if err := encoder.Encode(*record); err != nil {
+		writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't encode CertificateRecord response: %v", err))
+		return
+	}
+}
+
+// Handle a request to look up the revocation number of a certificate by its fingerprint, serial or revocation number
+func (h *Handler) GetCertificateRecord(rw http.ResponseWriter, req *http.Request) {
+	glog.Infoln("Received GetCertificateRecord request")
+	if req.Method != "GET" {
+		writeWrongMethodResponse(&rw, "GET")
+		return
+	}
+	query := req.URL.Query()
+	revType, err := h.getRevocationType(query.Get(ctca.RevocationTypeParam))
+	if err != nil {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid GetCertificateRecord Request: %v", err))
+		return
+	}
+	var record *ctca.CertificateRecord
+	switch {
+	case query.Get(ctca.FingerprintParam) != "":
+		record, err = h.c.Registry.ByFingerprint(revType, query.Get(ctca.FingerprintParam))
+	case query.Get(ctca.SerialParam) != "":
+		record, err = h.c.Registry.BySerial(revType, query.Get(ctca.SerialParam))
+	case query.Get(ctca.RevocationNumParam) != "":
+		revocationNum, parseErr := strconv.ParseUint(query.Get(ctca.RevocationNumParam), 10, 64)
+		if parseErr != nil {
+			writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid GetCertificateRecord Request: invalid %v: %v", ctca.RevocationNumParam, parseErr))
+			return
+		}
+		record, err = h.c.Registry.ByRevocationNum(revType, revocationNum)
+	default:
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid GetCertificateRecord Request: missing %v, %v or %v", ctca.FingerprintParam, ctca.SerialParam, ctca.RevocationNumParam))
+		return
+	}
+	if errors.Is(err, ca.ErrUnknownCertificate) {
+		writeErrorResponse(&rw, http.StatusNotFound, fmt.Sprintf("Couldn't get certificate record: %v", err))
+		return
+	}
+	if err != nil {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid GetCertificateRecord Request: %v", err))
+		return
+	}
+	encoder := json.NewEncoder(rw)
+	if err := encoder.Encode(*record); err != nil {
+		writeErrorResponse(&rw, http.StatusInternalServerError, fmt.Sprintf("Couldn't encode CertificateRecord response: %v", err))
+		return
+	}
+}
+
 // Handle request to revoke a certain number of certificates and to produce an SRD with the newly revoked certificates
 func (h *Handler) RevokeAndProduceSRD(rw http.ResponseWriter, req *http.Request) {
 	if req.Method != "GET" {
@@ -116,14 +520,17 @@ func (h *Handler) RevokeAndProduceSRD(rw http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	// TEMP FIX to access same data from same timestamp
-	srd, err := h.c.GetCASRD("Let's-Revoke", h.c.PreviousMMDTimestamp)
+	revType, err := h.getRevocationType(revAndProdSRDReq.RevocationType)
 	if err != nil {
-		srd, err = h.c.RevokeAndProduceSRD(revAndProdSRDReq.TotalCerts, revAndProdSRDReq.PercentRevoked)
-		if err != nil {
-			writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("failed to produce SRDWithRevData for request: %v", err))
-			return
-		}
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("Invalid RevokeAndProduceSRDRequest: %v", err))
+		return
+	}
+
+	// Requests of an MMD that already has its SRD get that SRD
+	srd, err := h.c.RevokeAndProduceSRD(revType, revAndProdSRDReq.TotalCerts, revAndProdSRDReq.PercentRevoked)
+	if err != nil {
+		writeErrorResponse(&rw, http.StatusBadRequest, fmt.Sprintf("failed to produce SRDWithRevData for request: %v", err))
+		return
 	}
 
 	encoder := json.NewEncoder(rw)
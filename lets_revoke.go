@@ -0,0 +1,745 @@
+package ctca
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+	"github.com/google/certificate-transparency-go/tls"
+
+	mtr "github.com/n-ct/ct-monitor"
+	"github.com/n-ct/ct-monitor/signature"
+)
+
+const (
+	LetsRevokeMechanism = "Let's-Revoke"
+	DefaultBucketDuration = 86400	// One day of certificate expirations per CRV partition
+	DefaultMaxLifetime = 398 * 86400	// Longest validity of publicly trusted TLS certificates
+)
+
+func init() {
+	RegisterRevocationMechanism(LetsRevokeMechanism, newLetsRevoke)
+}
+
+// LetsRevoke partitions the revocation state by certificate expiration as described by Let's-Revoke.
+// Every expiration bucket has its own CRV where bit n is set if the certificate at index n of the bucket is revoked.
+// Once every certificate of a bucket has expired, the bucket is retired and its CRV is dropped
+type LetsRevoke struct {
+	name string
+	bucketDuration uint64
+	codec Codec
+	crvKind string
+	maxBits uint64
+	maxLifetime uint64
+}
+
+// The CRVs of a LetsRevoke revocation type keyed by expiration bucket
+type LetsRevokeState struct {
+	CRVs map[uint64] CRV
+	Reasons map[uint64] BucketReasons	// Reasons of the revoked indices of each bucket
+	codec Codec	// Codec used by Encode. Defaults to the DefaultCodecName
+	crvKind string	// Kind of the CRVs of new buckets. Defaults to the DefaultCRVKind
+}
+
+// The changes made to a LetsRevokeState during one MMD
+type LetsRevokeDelta struct {
+	CRVDeltas map[uint64] CRV	// Newly revoked indices of each bucket
+	Releases map[uint64] CRV	// Indices of each bucket released from certificateHold
+	RetiredBuckets []uint64	// Buckets dropped from the state because all of their certificates expired
+	Reasons map[uint64] BucketReasons	// Reasons of the newly revoked indices of each bucket
+	BucketHashes map[uint64] []byte	// SHA-256 hash of the CanonicalCRV of every bucket of the resulting state
+	ReasonHashes map[uint64] []byte	// SHA-256 hash of the serialized reasons of every bucket of the resulting state
+	codec Codec	// Codec used by Encode. Defaults to the DefaultCodecName
+	crvKind string	// Bitmap kind Encode compares against the sparse form of each bucket delta
+}
+
+// Wire format of a single bucket in an encoded state or delta
+type bucketData struct {
+	Bucket 	uint64
+	Data 	[]byte `tls:"minlen:0,maxlen:4294967295"`
+}
+
+// Wire format of a LetsRevokeState
+type letsRevokeStateData struct {
+	CRVs []bucketData `tls:"minlen:0,maxlen:4294967295"`	// Serialized with MarshalCRV, or index lists coded by an IndexCodec
+	Reasons []bucketData `tls:"minlen:0,maxlen:4294967295"`	// Serialized with BucketReasons.Marshal
+}
+
+// Wire format of a LetsRevokeDelta. This is what gets published in RevocationData.CRVDelta
+type letsRevokeDeltaData struct {
+	CRVDeltas 		[]bucketData `tls:"minlen:0,maxlen:4294967295"`	// Serialized with MarshalCRV, or index lists coded by an IndexCodec
+	RetiredBuckets 	[]uint64 `tls:"minlen:0,maxlen:4294967295"`
+	BucketHashes 	[]bucketData `tls:"minlen:0,maxlen:4294967295"`
+	Reasons 		[]bucketData `tls:"minlen:0,maxlen:4294967295"`	// Serialized with BucketReasons.Marshal
+	ReasonHashes 	[]bucketData `tls:"minlen:0,maxlen:4294967295"`
+	Releases 		[]bucketData `tls:"minlen:0,maxlen:4294967295"`	// Serialized with MarshalCRV, or index lists coded by an IndexCodec
+}
+
+// Wire format of the lists of bucket and reason hashes that the CRVHash of a RevocationDigest is computed over
+type bucketManifest struct {
+	BucketHashes []bucketData `tls:"minlen:0,maxlen:4294967295"`
+	ReasonHashes []bucketData `tls:"minlen:0,maxlen:4294967295"`
+}
+
+func newLetsRevoke(config RevocationTypeConfig) (RevocationType, error) {
+	bucketDuration := config.BucketDuration
+	if bucketDuration == 0 {
+		bucketDuration = DefaultBucketDuration
+	}
+	codec, err := GetCodec(config.Codec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := NewCRV(config.CRV); err != nil {
+		return nil, err
+	}
+	maxBits := config.MaxBits
+	if maxBits == 0 {
+		maxBits = MaxBitsInRevocationNumber
+	}
+	if maxBits > MaxBitsInRevocationNumber {
+		return nil, fmt.Errorf("max_bits (%v) exceeds the (%v) index bits of a revocation number", maxBits, MaxBitsInRevocationNumber)
+	}
+	maxLifetime := config.MaxLifetime
+	if maxLifetime == 0 {
+		maxLifetime = DefaultMaxLifetime
+	}
+	return &LetsRevoke{name: config.Name, bucketDuration: bucketDuration, codec: codec, crvKind: config.CRV, maxBits: maxBits, maxLifetime: maxLifetime}, nil
+}
+
+func (l *LetsRevoke) Name() string {
+	return l.name
+}
+
+// Seconds of certificate expiration covered by each bucket
+func (l *LetsRevoke) BucketDuration() uint64 {
+	return l.bucketDuration
+}
+
+// Codec used to encode the states and deltas of the type
+func (l *LetsRevoke) Codec() Codec {
+	return l.codec
+}
+
+// Bits of a revocation number indexing into its bucket
+func (l *LetsRevoke) MaxBits() uint64 {
+	return l.maxBits
+}
+
+// Get the bucket of the revocation numbers of certificates expiring at notAfter (unix seconds)
+func (l *LetsRevoke) ExpirationBucket(notAfter uint64) uint64 {
+	return ExpirationBucket(notAfter, l.bucketDuration)
+}
+
+// Get the first and last bucket at timestamp that still has certificates that have not expired, as far as a certificate
+// issued at timestamp can expire
+func (l *LetsRevoke) LiveBuckets(timestamp uint64) (uint64, uint64) {
+	return ExpirationBucket(timestamp, l.bucketDuration), ExpirationBucket(timestamp + l.maxLifetime, l.bucketDuration)
+}
+
+// Check that the index of every revocation number fits in the maxBits of the type
+func (l *LetsRevoke) ValidateRevocationNums(revocationNums []uint64) error {
+	outOfRange := []uint64{}
+	for _, revocationNum := range revocationNums {
+		if _, index := SplitRevocationNum(revocationNum); index >> l.maxBits != 0 {
+			outOfRange = append(outOfRange, revocationNum)
+		}
+	}
+	if len(outOfRange) > 0 {
+		return &RevocationNumberError{RevocationType: l.name, RevocationNums: outOfRange, MaxBits: l.maxBits}
+	}
+	return nil
+}
+
+// Report the assigned numbers, revoked certificates and highest revoked index of every bucket that has any
+func (l *LetsRevoke) NumberSpaceUsage(state RevocationState, assigned map[uint64] uint64) (*NumberSpaceUsage, error) {
+	letsRevokeState, ok := state.(*LetsRevokeState)
+	if !ok {
+		return nil, fmt.Errorf("cannot report usage of state of type %T with %v", state, l.name)
+	}
+	usage := &NumberSpaceUsage{
+		RevocationType: l.name,
+		MaxBits: l.maxBits,
+		IndicesPerBucket: 1 << l.maxBits,
+		Buckets: []BucketUsage{},
+	}
+	revoked := make(map[uint64] []uint64)
+	buckets := []uint64{}
+	for bucket, crv := range letsRevokeState.CRVs {
+		if indices := crv.ToNums(); len(indices) > 0 {
+			revoked[bucket] = indices
+			buckets = append(buckets, bucket)
+		}
+	}
+	for bucket, count := range assigned {
+		if _, ok := revoked[bucket]; !ok && count > 0 {
+			buckets = append(buckets, bucket)
+		}
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	for _, bucket := range buckets {
+		bucketUsage := BucketUsage{Bucket: bucket, Assigned: assigned[bucket]}
+		consumed := bucketUsage.Assigned
+		if indices := revoked[bucket]; len(indices) > 0 {
+			bucketUsage.Revoked = uint64(len(indices))
+			bucketUsage.HighestIndex = indices[len(indices) - 1]
+			// Numbers revoked without being assigned by the registry still use up the bucket
+			if bucketUsage.HighestIndex + 1 > consumed {
+				consumed = bucketUsage.HighestIndex + 1
+			}
+		}
+		bucketUsage.Consumed = float64(consumed) / float64(usage.IndicesPerBucket)
+		usage.Buckets = append(usage.Buckets, bucketUsage)
+	}
+	return usage, nil
+}
+
+// Create a state without any buckets
+func (l *LetsRevoke) NewState() RevocationState {
+	return &LetsRevokeState{CRVs: make(map[uint64] CRV), Reasons: make(map[uint64] BucketReasons), codec: l.codec, crvKind: l.crvKind}
+}
+
+// Decode a compressed LetsRevokeState
+func (l *LetsRevoke) DecodeState(encodedState []byte) (RevocationState, error) {
+	var stateData letsRevokeStateData
+	codec, err := decodeTLS(encodedState, &stateData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %v state: %w", l.name, err)
+	}
+	crvs, err := unmarshalBuckets(stateData.CRVs, codec, l.crvKind)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %v state: %w", l.name, err)
+	}
+	reasons, err := unmarshalReasons(stateData.Reasons)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %v state: %w", l.name, err)
+	}
+	return &LetsRevokeState{CRVs: crvs, Reasons: reasons, codec: l.codec, crvKind: l.crvKind}, nil
+}
+
+// Add revocations to their bucket CRVs and reasons and retire the buckets that expired by timestamp.
+// Revocations with the RemoveFromCRL reason release certificates on hold by clearing their bits instead.
+// Revocations of already expired buckets are dropped since their certificates can no longer be used
+func (l *LetsRevoke) NextState(state RevocationState, revocations []Revocation, timestamp uint64) (RevocationState, RevocationDelta, error) {
+	currState, ok := state.(*LetsRevokeState)
+	if !ok {
+		return nil, nil, fmt.Errorf("cannot use state of type %T with %v", state, l.name)
+	}
+
+	delta := &LetsRevokeDelta{
+		CRVDeltas: make(map[uint64] CRV),
+		Releases: make(map[uint64] CRV),
+		RetiredBuckets: []uint64{},
+		Reasons: make(map[uint64] BucketReasons),
+		codec: l.codec,
+		crvKind: l.crvKind,
+	}
+	bucketIndices := make(map[uint64][]uint64)
+	releasedIndices := make(map[uint64][]uint64)
+	for _, revocation := range revocations {
+		bucket, index := SplitRevocationNum(revocation.RevocationNum)
+		if IsBucketExpired(bucket, l.bucketDuration, timestamp) {
+			glog.Infof("dropping revocation number (%v) of expired bucket (%v)", revocation.RevocationNum, bucket)
+			continue
+		}
+		if revocation.Reason == RemoveFromCRL {
+			currentReason, revoked := currState.RevocationReason(revocation.RevocationNum)
+			if !revoked {
+				// Held and released within the same MMD, so there is no bit to clear
+				continue
+			}
+			if err := CheckReasonTransition(revocation.RevocationNum, revoked, currentReason, RemoveFromCRL); err != nil {
+				return nil, nil, err
+			}
+			releasedIndices[bucket] = append(releasedIndices[bucket], index)
+			continue
+		}
+		bucketIndices[bucket] = append(bucketIndices[bucket], index)
+		if revocation.Reason != Unspecified {
+			if _, ok := delta.Reasons[bucket]; !ok {
+				delta.Reasons[bucket] = make(BucketReasons)
+			}
+			delta.Reasons[bucket][index] = revocation.Reason
+		}
+	}
+	for bucket, indices := range bucketIndices {
+		delta.CRVDeltas[bucket] = NewSparseCRVFromNums(indices)
+	}
+	for bucket, indices := range releasedIndices {
+		delta.Releases[bucket] = NewSparseCRVFromNums(indices)
+	}
+	for _, bucket := range sortedBuckets(currState.CRVs) {
+		if IsBucketExpired(bucket, l.bucketDuration, timestamp) {
+			delta.RetiredBuckets = append(delta.RetiredBuckets, bucket)
+		}
+	}
+
+	newState, err := currState.Apply(delta)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to apply delta: %w", err)
+	}
+	delta.BucketHashes, err = newState.(*LetsRevokeState).bucketHashes()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to hash buckets: %w", err)
+	}
+	delta.ReasonHashes, err = newState.(*LetsRevokeState).reasonHashes()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to hash reasons: %w", err)
+	}
+	return newState, delta, nil
+}
+
+// Decode a compressed LetsRevokeDelta
+func (l *LetsRevoke) DecodeDelta(encodedDelta []byte) (RevocationDelta, error) {
+	var deltaData letsRevokeDeltaData
+	codec, err := decodeTLS(encodedDelta, &deltaData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %v delta: %w", l.name, err)
+	}
+	crvDeltas, err := unmarshalBuckets(deltaData.CRVDeltas, codec, SparseCRVKind)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %v delta: %w", l.name, err)
+	}
+	releases, err := unmarshalBuckets(deltaData.Releases, codec, SparseCRVKind)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %v delta: %w", l.name, err)
+	}
+	reasons, err := unmarshalReasons(deltaData.Reasons)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %v delta: %w", l.name, err)
+	}
+	delta := &LetsRevokeDelta{
+		CRVDeltas: crvDeltas,
+		Releases: releases,
+		RetiredBuckets: deltaData.RetiredBuckets,
+		Reasons: reasons,
+		BucketHashes: bucketHashesFromData(deltaData.BucketHashes),
+		ReasonHashes: bucketHashesFromData(deltaData.ReasonHashes),
+		codec: l.codec,
+		crvKind: l.crvKind,
+	}
+	return delta, nil
+}
+
+// The CRVHash commits to the hashes of the CRV and the reasons of every bucket and the CRVDeltaHash to the compressed delta,
+// which holds both the set and the cleared bits of the MMD
+func (l *LetsRevoke) Digest(state RevocationState, delta RevocationDelta, timestamp uint64, hashAlgo tls.HashAlgorithm) (*mtr.RevocationDigest, error) {
+	letsRevokeState, ok := state.(*LetsRevokeState)
+	if !ok {
+		return nil, fmt.Errorf("cannot digest state of type %T with %v", state, l.name)
+	}
+	bucketHashes, err := letsRevokeState.bucketHashes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash buckets when creating rev digest: %w", err)
+	}
+	reasonHashes, err := letsRevokeState.reasonHashes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash reasons when creating rev digest: %w", err)
+	}
+	manifest, err := tls.Marshal(bucketManifest{BucketHashes: bucketHashesToData(bucketHashes), ReasonHashes: bucketHashesToData(reasonHashes)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize bucket manifest when creating rev digest: %w", err)
+	}
+	crvHash, _, err := signature.GenerateHash(hashAlgo, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash crv when creating rev digest: %w", err)
+	}
+
+	compDeltaCRV, err := delta.Encode()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress deltaCRV when creating rev digest: %w", err)
+	}
+	crvDeltaHash, _, err := signature.GenerateHash(hashAlgo, compDeltaCRV)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash deltaCRV when creating rev digest: %w", err)
+	}
+
+	revDigest := &mtr.RevocationDigest{
+		Timestamp: timestamp,
+		CRVHash: crvHash,
+		CRVDeltaHash: crvDeltaHash,
+	}
+	return revDigest, nil
+}
+
+// Drop the retired buckets, clear the released bits and OR the bucket deltas into a copy of the state
+func (s *LetsRevokeState) Apply(delta RevocationDelta) (RevocationState, error) {
+	crvDelta, ok := delta.(*LetsRevokeDelta)
+	if !ok {
+		return nil, fmt.Errorf("cannot apply delta of type %T to a Let's-Revoke state", delta)
+	}
+	crvs := make(map[uint64] CRV)
+	for bucket, crv := range s.CRVs {
+		crvs[bucket] = crv
+	}
+	reasons := make(map[uint64] BucketReasons)
+	for bucket, bucketReasons := range s.Reasons {
+		reasons[bucket] = bucketReasons
+	}
+	for _, bucket := range crvDelta.RetiredBuckets {
+		delete(crvs, bucket)
+		delete(reasons, bucket)
+	}
+	for bucket, released := range crvDelta.Releases {
+		crv, ok := crvs[bucket]
+		if !ok {
+			continue
+		}
+		clearedCRV, err := CopyCRV(crv)
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy crv of bucket (%v): %w", bucket, err)
+		}
+		bucketReasons := make(BucketReasons)
+		for index, reason := range reasons[bucket] {
+			bucketReasons[index] = reason
+		}
+		for _, index := range released.ToNums() {
+			if err := clearedCRV.ClearBit(index); err != nil {
+				return nil, fmt.Errorf("failed to release index (%v) of bucket (%v): %w", index, bucket, err)
+			}
+			delete(bucketReasons, index)
+		}
+		crvs[bucket] = clearedCRV
+		reasons[bucket] = bucketReasons
+	}
+	// A later reason replaces the earlier one, e.g. when a superseded certificate turns out to have a compromised key
+	for bucket, deltaReasons := range crvDelta.Reasons {
+		bucketReasons := make(BucketReasons)
+		for index, reason := range reasons[bucket] {
+			bucketReasons[index] = reason
+		}
+		for index, reason := range deltaReasons {
+			bucketReasons[index] = reason
+		}
+		reasons[bucket] = bucketReasons
+	}
+	for bucket, bucketDelta := range crvDelta.CRVDeltas {
+		crv, ok := crvs[bucket]
+		if !ok {
+			newCRV, err := NewCRV(s.crvKind)
+			if err != nil {
+				return nil, err
+			}
+			crv = newCRV
+		}
+		newCRV, err := crv.Or(bucketDelta)
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply delta of bucket (%v): %w", bucket, err)
+		}
+		crvs[bucket] = newCRV
+	}
+	return &LetsRevokeState{CRVs: crvs, Reasons: reasons, codec: s.codec, crvKind: s.crvKind}, nil
+}
+
+func (s *LetsRevokeState) Encode() ([]byte, error) {
+	crvs, err := marshalBuckets(s.CRVs, bucketMarshaler(s.codec, MarshalCRV))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode Let's-Revoke state: %w", err)
+	}
+	return encodeTLS(s.codec, letsRevokeStateData{CRVs: crvs, Reasons: marshalReasons(s.Reasons)})
+}
+
+func (s *LetsRevokeState) Equals(other RevocationState) bool {
+	otherState, ok := other.(*LetsRevokeState)
+	if !ok || len(s.CRVs) != len(otherState.CRVs) {
+		return false
+	}
+	for bucket, crv := range s.CRVs {
+		otherCRV, ok := otherState.CRVs[bucket]
+		if !ok || !crv.Equals(otherCRV) {
+			return false
+		}
+		if !bytes.Equal(s.Reasons[bucket].Marshal(), otherState.Reasons[bucket].Marshal()) {
+			return false
+		}
+	}
+	return true
+}
+
+// Get the reason revocationNum was revoked for and whether it is revoked at all
+func (s *LetsRevokeState) RevocationReason(revocationNum uint64) (ReasonCode, bool) {
+	bucket, index := SplitRevocationNum(revocationNum)
+	crv, ok := s.CRVs[bucket]
+	if !ok || !crv.GetBit(index) {
+		return Unspecified, false
+	}
+	return s.Reasons[bucket][index], true
+}
+
+// Get the revocation numbers of every revoked certificate in bucket order
+func (s *LetsRevokeState) RevocationNums() []uint64 {
+	return bucketsToRevocationNums(s.CRVs)
+}
+
+// Hash the CanonicalCRV of every bucket
+func (s *LetsRevokeState) bucketHashes() (map[uint64] []byte, error) {
+	bucketHashes := make(map[uint64] []byte)
+	for bucket, crv := range s.CRVs {
+		serializedCRV, err := CanonicalCRV(crv)
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialize crv of bucket (%v): %w", bucket, err)
+		}
+		bucketHash, _, err := signature.GenerateHash(tls.SHA256, serializedCRV)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash crv of bucket (%v): %w", bucket, err)
+		}
+		bucketHashes[bucket] = bucketHash
+	}
+	return bucketHashes, nil
+}
+
+// Encode every bucket delta in its sparse or bitmap form, whichever is smaller, or as the index list coded by an IndexCodec
+func (d *LetsRevokeDelta) Encode() ([]byte, error) {
+	marshal := bucketMarshaler(d.codec, func(crv CRV) ([]byte, error) { return MarshalCompactCRV(crv, d.crvKind) })
+	crvDeltas, err := marshalBuckets(d.CRVDeltas, marshal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode Let's-Revoke delta: %w", err)
+	}
+	releases, err := marshalBuckets(d.Releases, marshal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode Let's-Revoke delta: %w", err)
+	}
+	deltaData := letsRevokeDeltaData{
+		CRVDeltas: crvDeltas,
+		Releases: releases,
+		RetiredBuckets: d.RetiredBuckets,
+		BucketHashes: bucketHashesToData(d.BucketHashes),
+		Reasons: marshalReasons(d.Reasons),
+		ReasonHashes: bucketHashesToData(d.ReasonHashes),
+	}
+	return encodeTLS(d.codec, deltaData)
+}
+
+// Get the newly revoked revocation numbers in bucket order
+func (d *LetsRevokeDelta) RevocationNums() []uint64 {
+	return bucketsToRevocationNums(d.CRVDeltas)
+}
+
+// Get the revocation numbers released from certificateHold in bucket order
+func (d *LetsRevokeDelta) ReleasedNums() []uint64 {
+	return bucketsToRevocationNums(d.Releases)
+}
+
+// Check that the bucket and reason hashes published in the delta match the hashes of state
+func (d *LetsRevokeDelta) VerifyBucketHashes(state *LetsRevokeState) error {
+	bucketHashes, err := state.bucketHashes()
+	if err != nil {
+		return fmt.Errorf("failed to hash buckets of state: %w", err)
+	}
+	if err := compareBucketHashes(bucketHashes, d.BucketHashes); err != nil {
+		return fmt.Errorf("bucket hashes do not match: %w", err)
+	}
+	reasonHashes, err := state.reasonHashes()
+	if err != nil {
+		return fmt.Errorf("failed to hash reasons of state: %w", err)
+	}
+	if err := compareBucketHashes(reasonHashes, d.ReasonHashes); err != nil {
+		return fmt.Errorf("reason hashes do not match: %w", err)
+	}
+	return nil
+}
+
+// Check that the hashes computed from a state equal the published ones
+func compareBucketHashes(computed map[uint64] []byte, published map[uint64] []byte) error {
+	if len(computed) != len(published) {
+		return fmt.Errorf("state has (%v) buckets but delta has hashes for (%v)", len(computed), len(published))
+	}
+	for bucket, bucketHash := range computed {
+		if !bytes.Equal(bucketHash, published[bucket]) {
+			return fmt.Errorf("hash of bucket (%v) does not match delta", bucket)
+		}
+	}
+	return nil
+}
+
+// Hash the serialized reasons of every bucket, including buckets without any reasons
+func (s *LetsRevokeState) reasonHashes() (map[uint64] []byte, error) {
+	reasonHashes := make(map[uint64] []byte)
+	for bucket := range s.CRVs {
+		reasonHash, _, err := signature.GenerateHash(tls.SHA256, s.Reasons[bucket].Marshal())
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash reasons of bucket (%v): %w", bucket, err)
+		}
+		reasonHashes[bucket] = reasonHash
+	}
+	return reasonHashes, nil
+}
+
+// Get the buckets of a bucket map in ascending order
+func sortedBuckets(buckets map[uint64] CRV) []uint64 {
+	sorted := []uint64{}
+	for bucket := range buckets {
+		sorted = append(sorted, bucket)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// Join the set bits of every bucket into revocation numbers
+func bucketsToRevocationNums(buckets map[uint64] CRV) []uint64 {
+	revocationNums := []uint64{}
+	for _, bucket := range sortedBuckets(buckets) {
+		for _, index := range buckets[bucket].ToNums() {
+			revocationNums = append(revocationNums, JoinRevocationNum(bucket, index))
+		}
+	}
+	return revocationNums
+}
+
+// Get the function that serializes the bucket CRVs encoded with codec, which codes their index lists if it is an
+// IndexCodec and uses marshal otherwise
+func bucketMarshaler(codec Codec, marshal func(CRV) ([]byte, error)) func(CRV) ([]byte, error) {
+	if indexCodec, ok := codec.(IndexCodec); ok {
+		return func(crv CRV) ([]byte, error) { return indexCodec.EncodeIndices(crv.ToNums()), nil }
+	}
+	return marshal
+}
+
+// Serialize the CRV of every bucket with marshal in ascending bucket order
+func marshalBuckets(buckets map[uint64] CRV, marshal func(CRV) ([]byte, error)) ([]bucketData, error) {
+	bucketDataList := []bucketData{}
+	for _, bucket := range sortedBuckets(buckets) {
+		serialized, err := marshal(buckets[bucket])
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialize crv of bucket (%v): %w", bucket, err)
+		}
+		bucketDataList = append(bucketDataList, bucketData{Bucket: bucket, Data: serialized})
+	}
+	return bucketDataList, nil
+}
+
+// Deserialize the CRV of every bucket encoded with codec. Index lists coded by an IndexCodec are read into CRVs of kind
+func unmarshalBuckets(bucketDataList []bucketData, codec Codec, kind string) (map[uint64] CRV, error) {
+	indexCodec, indexCoded := codec.(IndexCodec)
+	buckets := make(map[uint64] CRV)
+	for _, data := range bucketDataList {
+		if indexCoded {
+			crv, err := unmarshalIndices(indexCodec, data.Data, kind)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode indices of bucket (%v): %w", data.Bucket, err)
+			}
+			buckets[data.Bucket] = crv
+			continue
+		}
+		crv, err := UnmarshalCRV(data.Data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to deserialize crv of bucket (%v): %w", data.Bucket, err)
+		}
+		buckets[data.Bucket] = crv
+	}
+	return buckets, nil
+}
+
+// Decode an index list coded by indexCodec into a CRV of kind
+func unmarshalIndices(indexCodec IndexCodec, data []byte, kind string) (CRV, error) {
+	indices, err := indexCodec.DecodeIndices(data)
+	if err != nil {
+		return nil, err
+	}
+	if kind == SparseCRVKind {
+		return NewSparseCRVFromNums(indices), nil
+	}
+	crv, err := NewCRV(kind)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indices {
+		if err := crv.SetBit(index); err != nil {
+			return nil, err
+		}
+	}
+	return crv, nil
+}
+
+// Serialize the reasons of every bucket that has any in ascending bucket order
+func marshalReasons(reasons map[uint64] BucketReasons) []bucketData {
+	buckets := []uint64{}
+	for bucket, bucketReasons := range reasons {
+		if len(bucketReasons) > 0 {
+			buckets = append(buckets, bucket)
+		}
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	bucketDataList := []bucketData{}
+	for _, bucket := range buckets {
+		bucketDataList = append(bucketDataList, bucketData{Bucket: bucket, Data: reasons[bucket].Marshal()})
+	}
+	return bucketDataList
+}
+
+// Deserialize the reasons of every bucket
+func unmarshalReasons(bucketDataList []bucketData) (map[uint64] BucketReasons, error) {
+	reasons := make(map[uint64] BucketReasons)
+	for _, data := range bucketDataList {
+		bucketReasons, err := UnmarshalBucketReasons(data.Data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to deserialize reasons of bucket (%v): %w", data.Bucket, err)
+		}
+		reasons[data.Bucket] = bucketReasons
+	}
+	return reasons, nil
+}
+
+// Convert bucket hashes from their wire format
+func bucketHashesFromData(bucketDataList []bucketData) map[uint64] []byte {
+	bucketHashes := make(map[uint64] []byte)
+	for _, bucketHash := range bucketDataList {
+		bucketHashes[bucketHash.Bucket] = bucketHash.Data
+	}
+	return bucketHashes
+}
+
+// Convert bucket hashes to their wire format in ascending bucket order
+func bucketHashesToData(bucketHashes map[uint64] []byte) []bucketData {
+	buckets := []uint64{}
+	for bucket := range bucketHashes {
+		buckets = append(buckets, bucket)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	bucketDataList := []bucketData{}
+	for _, bucket := range buckets {
+		bucketDataList = append(bucketDataList, bucketData{Bucket: bucket, Data: bucketHashes[bucket]})
+	}
+	return bucketDataList
+}
+
+// TLS serialize v and compress it with codec, or the DefaultCodecName if codec is nil.
+// An IndexCodec already coded the CRVs in v, so the rest is only prefixed with its ID
+func encodeTLS(codec Codec, v interface{}) ([]byte, error) {
+	serialized, err := tls.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize %T: %w", v, err)
+	}
+	if codec == nil {
+		if codec, err = GetCodec(DefaultCodecName); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := codec.(IndexCodec); ok {
+		return append([]byte{codec.ID()}, serialized...), nil
+	}
+	return EncodeWithCodec(codec, serialized)
+}
+
+// Decompress data with the codec it was encoded with and TLS deserialize it into v. Returns the codec
+func decodeTLS(data []byte, v interface{}) (Codec, error) {
+	codec, err := EncodedCodec(data)
+	if err != nil {
+		return nil, err
+	}
+	serialized := data[1:]
+	if _, ok := codec.(IndexCodec); !ok {
+		if serialized, err = DecodeWithCodec(data); err != nil {
+			return nil, err
+		}
+	}
+	rest, err := tls.Unmarshal(serialized, v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to deserialize %T: %w", v, err)
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("trailing data after %T", v)
+	}
+	return codec, nil
+}
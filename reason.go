@@ -0,0 +1,177 @@
+package ctca
+
+import (
+	"fmt"
+	"sort"
+	"encoding/binary"
+)
+
+// ReasonCode is an RFC 5280 CRLReason
+type ReasonCode uint8
+
+const (
+	Unspecified ReasonCode = 0
+	KeyCompromise ReasonCode = 1
+	CACompromise ReasonCode = 2
+	AffiliationChanged ReasonCode = 3
+	Superseded ReasonCode = 4
+	CessationOfOperation ReasonCode = 5
+	CertificateHold ReasonCode = 6
+	// 7 is not used
+	RemoveFromCRL ReasonCode = 8
+	PrivilegeWithdrawn ReasonCode = 9
+	AACompromise ReasonCode = 10
+)
+
+var reasonCodeNames = map[ReasonCode]string{
+	Unspecified: "unspecified",
+	KeyCompromise: "keyCompromise",
+	CACompromise: "cACompromise",
+	AffiliationChanged: "affiliationChanged",
+	Superseded: "superseded",
+	CessationOfOperation: "cessationOfOperation",
+	CertificateHold: "certificateHold",
+	RemoveFromCRL: "removeFromCRL",
+	PrivilegeWithdrawn: "privilegeWithdrawn",
+	AACompromise: "aACompromise",
+}
+
+// Check that the reason code is defined by RFC 5280
+func (r ReasonCode) IsValid() bool {
+	_, ok := reasonCodeNames[r]
+	return ok
+}
+
+// Get the RFC 5280 name of the reason code
+func (r ReasonCode) String() string {
+	if name, ok := reasonCodeNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(r))
+}
+
+// A revocation number together with the reason it was revoked for
+type Revocation struct {
+	RevocationNum 	uint64
+	Reason 			ReasonCode
+}
+
+// Pair every revocation number with the reason at the same position of reasons.
+// Numbers without a reason are revoked as Unspecified
+func NewRevocations(revocationNums []uint64, reasons []ReasonCode) ([]Revocation, error) {
+	if len(reasons) > len(revocationNums) {
+		return nil, fmt.Errorf("got (%v) reasons for (%v) revocation nums", len(reasons), len(revocationNums))
+	}
+	revocations := make([]Revocation, len(revocationNums))
+	for i, revocationNum := range revocationNums {
+		revocations[i].RevocationNum = revocationNum
+		if i < len(reasons) {
+			if !reasons[i].IsValid() {
+				return nil, fmt.Errorf("invalid reason code (%v) for revocation num (%v)", uint8(reasons[i]), revocationNum)
+			}
+			revocations[i].Reason = reasons[i]
+		}
+	}
+	return revocations, nil
+}
+
+// The reasons of the revoked indices of a bucket. Indices revoked as Unspecified are left out
+type BucketReasons map[uint64]ReasonCode
+
+// Serialize the reasons as their count followed by the gap to each index from the previous one as a uvarint and its reason byte.
+// The serialization is canonical, so it is also what reason hashes are computed over
+func (b BucketReasons) Marshal() []byte {
+	indices := []uint64{}
+	for index, reason := range b {
+		if reason != Unspecified {
+			indices = append(indices, index)
+		}
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+
+	var buf [binary.MaxVarintLen64]byte
+	data := append([]byte{}, buf[:binary.PutUvarint(buf[:], uint64(len(indices)))]...)
+	prev := uint64(0)
+	for _, index := range indices {
+		data = append(data, buf[:binary.PutUvarint(buf[:], index - prev)]...)
+		data = append(data, byte(b[index]))
+		prev = index
+	}
+	return data
+}
+
+// Deserialize reasons serialized by BucketReasons.Marshal
+func UnmarshalBucketReasons(data []byte) (BucketReasons, error) {
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, fmt.Errorf("failed to read reason count")
+	}
+	data = data[n:]
+	// Every reason takes at least two bytes, which bounds the allocation by the size of the input
+	if count > uint64(len(data)) / 2 {
+		return nil, fmt.Errorf("reason count (%v) exceeds reasons size", count)
+	}
+	reasons := make(BucketReasons, count)
+	index := uint64(0)
+	for i := uint64(0); i < count; i++ {
+		gap, n := binary.Uvarint(data)
+		if n <= 0 || len(data) <= n {
+			return nil, fmt.Errorf("failed to read reason (%v)", i)
+		}
+		if (i > 0 && gap == 0) || index + gap < index {
+			return nil, fmt.Errorf("reason (%v) index is not ascending", i)
+		}
+		index += gap
+		reason := ReasonCode(data[n])
+		if !reason.IsValid() || reason == Unspecified || reason == RemoveFromCRL {
+			return nil, fmt.Errorf("invalid reason code (%v) for index (%v)", uint8(reason), index)
+		}
+		reasons[index] = reason
+		data = data[n+1:]
+	}
+	if len(data) > 0 {
+		return nil, fmt.Errorf("trailing data after reasons")
+	}
+	return reasons, nil
+}
+
+// ReasonTransitionError is returned for revocations that would change the status of a certificate in a way RFC 5280 forbids
+type ReasonTransitionError struct {
+	RevocationNum 	uint64
+	Revoked 		bool	// Whether the certificate was revoked before the revocation
+	CurrentReason 	ReasonCode	// Reason the certificate was revoked for if Revoked
+	Reason 			ReasonCode	// Reason of the rejected revocation
+}
+
+func (e *ReasonTransitionError) Error() string {
+	switch {
+	case e.Reason == RemoveFromCRL && !e.Revoked:
+		return fmt.Sprintf("cannot release revocation number (%v) because it is not revoked", e.RevocationNum)
+	case e.Reason == RemoveFromCRL:
+		return fmt.Sprintf("cannot release revocation number (%v) revoked for %v, only certificates on %v can be released", e.RevocationNum, e.CurrentReason, CertificateHold)
+	case e.CurrentReason == KeyCompromise:
+		return fmt.Sprintf("cannot change reason of revocation number (%v) from %v to %v", e.RevocationNum, e.CurrentReason, e.Reason)
+	default:
+		return fmt.Sprintf("cannot put revocation number (%v) on %v because it is already revoked for %v", e.RevocationNum, e.Reason, e.CurrentReason)
+	}
+}
+
+// Check that a certificate whose status is given by revoked and currentReason may be revoked for reason.
+// Only certificates on certificateHold can be released with removeFromCRL, a keyCompromise revocation is final
+// and a certificate that is already revoked cannot be put on hold. Revoking a revoked certificate as Unspecified leaves its reason unchanged
+func CheckReasonTransition(revocationNum uint64, revoked bool, currentReason ReasonCode, reason ReasonCode) error {
+	allowed := true
+	switch {
+	case reason == RemoveFromCRL:
+		allowed = revoked && currentReason == CertificateHold
+	case !revoked || reason == Unspecified:
+	case currentReason == KeyCompromise:
+		allowed = reason == KeyCompromise
+	case reason == CertificateHold:
+		allowed = currentReason == CertificateHold
+	}
+	if !allowed {
+		return &ReasonTransitionError{RevocationNum: revocationNum, Revoked: revoked, CurrentReason: currentReason, Reason: reason}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package ctca
+
+import (
+	"testing"
+	"reflect"
+	"bytes"
+
+	"github.com/google/certificate-transparency-go/tls"
+)
+
+func TestBucketReasonsMarshalRoundTrip(t *testing.T) {
+	reasons := BucketReasons{3: KeyCompromise, 1000: Superseded, 7: Unspecified}
+	deserializedReasons, err := UnmarshalBucketReasons(reasons.Marshal())
+	if err != nil {
+		t.Fatalf("failed to deserialize reasons: %v", err)
+	}
+	if !reflect.DeepEqual(deserializedReasons, BucketReasons{3: KeyCompromise, 1000: Superseded}) {
+		t.Fatalf("deserialized reasons (%v) not equal to reasons without unspecified (%v)", deserializedReasons, reasons)
+	}
+
+	if _, err := UnmarshalBucketReasons([]byte{1, 5, 7}); err == nil {
+		t.Fatalf("failed to reject undefined reason code")
+	}
+	if _, err := NewRevocations([]uint64{1}, []ReasonCode{KeyCompromise, Superseded}); err == nil {
+		t.Fatalf("failed to reject more reasons than revocation nums")
+	}
+}
+
+func TestLetsRevokeCommitsToReasons(t *testing.T) {
+	revType, err := NewRevocationType(RevocationTypeConfig{Name: LetsRevokeMechanism})
+	if err != nil {
+		t.Fatalf("failed to create revocation type: %v", err)
+	}
+	revocations, err := NewRevocations([]uint64{1, 2}, []ReasonCode{Superseded, Unspecified})
+	if err != nil {
+		t.Fatalf("failed to create revocations: %v", err)
+	}
+	state, delta, err := revType.NextState(revType.NewState(), revocations, 0)
+	if err != nil {
+		t.Fatalf("failed to create next state: %v", err)
+	}
+	if reason, revoked := state.RevocationReason(1); !revoked || reason != Superseded {
+		t.Fatalf("reason (%v, revoked %v) of revocation num (1) not equal to (%v)", reason, revoked, Superseded)
+	}
+	if reason, revoked := state.RevocationReason(2); !revoked || reason != Unspecified {
+		t.Fatalf("reason (%v, revoked %v) of revocation num (2) not equal to (%v)", reason, revoked, Unspecified)
+	}
+	if _, revoked := state.RevocationReason(3); revoked {
+		t.Fatalf("revocation num (3) reported as revoked")
+	}
+
+	// The same CRV with a different reason must produce a different digest
+	otherRevocations, _ := NewRevocations([]uint64{1, 2}, []ReasonCode{KeyCompromise, Unspecified})
+	otherState, otherDelta, err := revType.NextState(revType.NewState(), otherRevocations, 0)
+	if err != nil {
+		t.Fatalf("failed to create next state: %v", err)
+	}
+	digest, err := revType.Digest(state, delta, 0, tls.SHA256)
+	if err != nil {
+		t.Fatalf("failed to digest state: %v", err)
+	}
+	otherDigest, err := revType.Digest(otherState, otherDelta, 0, tls.SHA256)
+	if err != nil {
+		t.Fatalf("failed to digest state: %v", err)
+	}
+	if bytes.Equal(digest.CRVHash, otherDigest.CRVHash) {
+		t.Fatalf("CRVHash does not commit to reasons")
+	}
+
+	// A later reason replaces the earlier one and verifiers following the deltas see it
+	nextState, nextDelta, err := revType.NextState(state, otherRevocations[:1], 0)
+	if err != nil {
+		t.Fatalf("failed to create next state: %v", err)
+	}
+	encodedDelta, err := nextDelta.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode delta: %v", err)
+	}
+	decodedDelta, err := revType.DecodeDelta(encodedDelta)
+	if err != nil {
+		t.Fatalf("failed to decode delta: %v", err)
+	}
+	appliedState, err := state.Apply(decodedDelta)
+	if err != nil {
+		t.Fatalf("failed to apply decoded delta: %v", err)
+	}
+	if !appliedState.Equals(nextState) {
+		t.Fatalf("applied state not equal to next state")
+	}
+	if reason, _ := appliedState.RevocationReason(1); reason != KeyCompromise {
+		t.Fatalf("reason (%v) of revocation num (1) not replaced by (%v)", reason, KeyCompromise)
+	}
+	if err := decodedDelta.(*LetsRevokeDelta).VerifyBucketHashes(appliedState.(*LetsRevokeState)); err != nil {
+		t.Fatalf("failed to verify hashes of decoded delta: %v", err)
+	}
+}
+
+func TestCheckReasonTransition(t *testing.T) {
+	tests := []struct {
+		revoked bool
+		currentReason ReasonCode
+		reason ReasonCode
+		allowed bool
+	}{
+		{false, Unspecified, CertificateHold, true},
+		{true, CertificateHold, RemoveFromCRL, true},
+		{true, CertificateHold, KeyCompromise, true},
+		{true, CertificateHold, Unspecified, true},
+		{false, Unspecified, RemoveFromCRL, false},
+		{true, Superseded, RemoveFromCRL, false},
+		{true, KeyCompromise, RemoveFromCRL, false},
+		{true, KeyCompromise, Superseded, false},
+		{true, KeyCompromise, CertificateHold, false},
+		{true, KeyCompromise, Unspecified, true},
+		{true, Superseded, CertificateHold, false},
+		{true, Superseded, KeyCompromise, true},
+	}
+	for _, test := range tests {
+		err := CheckReasonTransition(5, test.revoked, test.currentReason, test.reason)
+		if test.allowed && err != nil {
+			t.Fatalf("failed to allow transition from (%v, %v) to %v: %v", test.revoked, test.currentReason, test.reason, err)
+		}
+		if _, ok := err.(*ReasonTransitionError); !test.allowed && !ok {
+			t.Fatalf("expected ReasonTransitionError for transition from (%v, %v) to %v, got: %v", test.revoked, test.currentReason, test.reason, err)
+		}
+	}
+}
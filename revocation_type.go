@@ -0,0 +1,104 @@
+package ctca
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/google/certificate-transparency-go/tls"
+
+	mtr "github.com/n-ct/ct-monitor"
+)
+
+// RevocationType describes how a revocation mechanism represents its revocation state,
+// encodes the changes made to that state each MMD and commits to both in an SRD
+type RevocationType interface {
+	Name() string	// Name published in RevocationData.RevocationType
+	NewState() RevocationState	// Empty revocation state
+	DecodeState(encodedState []byte) (RevocationState, error)
+	// Produce the state of the MMD at timestamp from the previous state and the revocations made since, along with the delta between them
+	NextState(state RevocationState, revocations []Revocation, timestamp uint64) (RevocationState, RevocationDelta, error)
+	DecodeDelta(encodedDelta []byte) (RevocationDelta, error)
+	ValidateRevocationNums(revocationNums []uint64) error	// Returns a *RevocationNumberError for numbers outside the number space of the type
+	// Report how much of the number space is consumed by the numbers assigned in each bucket and the revocations of state
+	NumberSpaceUsage(state RevocationState, assigned map[uint64] uint64) (*NumberSpaceUsage, error)
+	ExpirationBucket(notAfter uint64) uint64	// Bucket of the revocation numbers of certificates expiring at notAfter
+	LiveBuckets(timestamp uint64) (uint64, uint64)	// First and last partitioned bucket that accept revocations at timestamp
+	Digest(state RevocationState, delta RevocationDelta, timestamp uint64, hashAlgo tls.HashAlgorithm) (*mtr.RevocationDigest, error)
+}
+
+// The revocation state of a RevocationType at a given MMD
+type RevocationState interface {
+	Apply(delta RevocationDelta) (RevocationState, error)	// Returns a new state. The receiver is left unchanged
+	Encode() ([]byte, error)
+	Equals(other RevocationState) bool
+	RevocationNums() []uint64
+	RevocationReason(revocationNum uint64) (ReasonCode, bool)	// The reason revocationNum was revoked for and whether it is revoked
+}
+
+// The changes made to a RevocationState during a single MMD
+type RevocationDelta interface {
+	Encode() ([]byte, error)	// The encoding that is published in RevocationData.CRVDelta
+	RevocationNums() []uint64
+	ReleasedNums() []uint64	// Numbers that were revoked with certificateHold and are no longer revoked
+}
+
+// Configures one revocation type of the CA
+type RevocationTypeConfig struct {
+	Name 		string `json:"name"`	// Name published in RevocationData
+	Mechanism 	string `json:"mechanism"`	// Registered mechanism implementing the type. Defaults to Name
+	BucketDuration	uint64 `json:"bucket_duration"`	// Seconds of certificate expiration covered by one CRV partition
+	Codec		string `json:"codec"`	// Name of the Codec compressing published deltas and stored CRVs. Defaults to xz
+	CRV		string `json:"crv"`	// Kind of CRV representing each bucket, bitarray, roaring or sparse. Defaults to roaring
+	MaxBits		uint64 `json:"max_bits"`	// Bits of a revocation number indexing into its bucket. Defaults to MaxBitsInRevocationNumber
+	MaxLifetime	uint64 `json:"max_lifetime"`	// Longest time in seconds a certificate stays valid, bounding the buckets that accept revocations
+	MMD		uint64 `json:"mmd"`	// Seconds between the SRDs of the type. Defaults to the mmd of the CA list
+}
+
+// Creates a RevocationType from its configuration
+type RevocationTypeFactory func(config RevocationTypeConfig) (RevocationType, error)
+
+var (
+	revocationMechanisms = make(map[string]RevocationTypeFactory)
+	revocationMechanismsLock sync.RWMutex
+)
+
+// Make a revocation mechanism available to NewRevocationType
+func RegisterRevocationMechanism(mechanism string, factory RevocationTypeFactory) {
+	revocationMechanismsLock.Lock()
+	defer revocationMechanismsLock.Unlock()
+	revocationMechanisms[mechanism] = factory
+}
+
+// Get the names of every registered revocation mechanism
+func RevocationMechanisms() []string {
+	revocationMechanismsLock.RLock()
+	defer revocationMechanismsLock.RUnlock()
+	mechanisms := []string{}
+	for mechanism := range revocationMechanisms {
+		mechanisms = append(mechanisms, mechanism)
+	}
+	sort.Strings(mechanisms)
+	return mechanisms
+}
+
+// Create the RevocationType described by config using its registered mechanism
+func NewRevocationType(config RevocationTypeConfig) (RevocationType, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("revocation type config is missing a name")
+	}
+	if config.Mechanism == "" {
+		config.Mechanism = config.Name
+	}
+	revocationMechanismsLock.RLock()
+	factory, ok := revocationMechanisms[config.Mechanism]
+	revocationMechanismsLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown revocation mechanism (%v) for revocation type (%v)", config.Mechanism, config.Name)
+	}
+	revType, err := factory(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create revocation type (%v): %w", config.Name, err)
+	}
+	return revType, nil
+}
@@ -0,0 +1,217 @@
+package ctca
+
+import (
+	"testing"
+	"errors"
+	"reflect"
+)
+
+// Revoke every number for an unspecified reason
+func unspecifiedRevocations(revocationNums []uint64) []Revocation {
+	revocations, _ := NewRevocations(revocationNums, nil)
+	return revocations
+}
+
+func TestNewRevocationType(t *testing.T) {
+	revType, err := NewRevocationType(RevocationTypeConfig{Name: "Emergency", Mechanism: LetsRevokeMechanism})
+	if err != nil {
+		t.Fatalf("failed to create revocation type: %v", err)
+	}
+	if revType.Name() != "Emergency" {
+		t.Fatalf("revocation type name (%v) not equal to configured name (%v)", revType.Name(), "Emergency")
+	}
+
+	if _, err := NewRevocationType(RevocationTypeConfig{Name: "Unknown"}); err == nil {
+		t.Fatalf("failed to reject revocation type with unregistered mechanism")
+	}
+}
+
+func TestLetsRevokeApplyEncodeDecodeRoundTrip(t *testing.T) {
+	revType, err := NewRevocationType(RevocationTypeConfig{Name: LetsRevokeMechanism})
+	if err != nil {
+		t.Fatalf("failed to create revocation type: %v", err)
+	}
+	revocationNums := []uint64{JoinRevocationNum(2, 1), JoinRevocationNum(2, 7), JoinRevocationNum(3, 1)}
+	state, delta, err := revType.NextState(revType.NewState(), unspecifiedRevocations(revocationNums), 0)
+	if err != nil {
+		t.Fatalf("failed to create next state: %v", err)
+	}
+
+	encodedState, err := state.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode state: %v", err)
+	}
+	decodedState, err := revType.DecodeState(encodedState)
+	if err != nil {
+		t.Fatalf("failed to decode state: %v", err)
+	}
+	if !decodedState.Equals(state) {
+		t.Fatalf("decoded state (%v) not equal to state (%v)", decodedState.RevocationNums(), state.RevocationNums())
+	}
+
+	encodedDelta, err := delta.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode delta: %v", err)
+	}
+	decodedDelta, err := revType.DecodeDelta(encodedDelta)
+	if err != nil {
+		t.Fatalf("failed to decode delta: %v", err)
+	}
+	if !reflect.DeepEqual(decodedDelta.RevocationNums(), delta.RevocationNums()) {
+		t.Fatalf("decoded delta (%v) not equal to delta (%v)", decodedDelta.RevocationNums(), delta.RevocationNums())
+	}
+}
+
+func TestLetsRevokeRetiresExpiredBuckets(t *testing.T) {
+	revType, err := NewRevocationType(RevocationTypeConfig{Name: LetsRevokeMechanism, BucketDuration: 100})
+	if err != nil {
+		t.Fatalf("failed to create revocation type: %v", err)
+	}
+	firstBucket := ExpirationBucket(150, 100)
+	secondBucket := ExpirationBucket(250, 100)
+	revocationNums := []uint64{JoinRevocationNum(firstBucket, 1), JoinRevocationNum(secondBucket, 2), JoinRevocationNum(UnpartitionedBucket, 3)}
+	state, _, err := revType.NextState(revType.NewState(), unspecifiedRevocations(revocationNums), 100)
+	if err != nil {
+		t.Fatalf("failed to create next state: %v", err)
+	}
+	if !reflect.DeepEqual(state.RevocationNums(), []uint64{3, revocationNums[0], revocationNums[1]}) {
+		t.Fatalf("state revocation nums (%v) not equal to revoked nums (%v)", state.RevocationNums(), revocationNums)
+	}
+
+	// Every certificate of the first bucket has expired at 200, so it is retired and late revocations of it are dropped
+	nextState, delta, err := revType.NextState(state, unspecifiedRevocations([]uint64{JoinRevocationNum(firstBucket, 4)}), 200)
+	if err != nil {
+		t.Fatalf("failed to create next state: %v", err)
+	}
+	letsRevokeDelta := delta.(*LetsRevokeDelta)
+	if !reflect.DeepEqual(letsRevokeDelta.RetiredBuckets, []uint64{firstBucket}) {
+		t.Fatalf("retired buckets (%v) not equal to expired bucket (%v)", letsRevokeDelta.RetiredBuckets, firstBucket)
+	}
+	if len(delta.RevocationNums()) != 0 {
+		t.Fatalf("revocation of expired bucket was not dropped: %v", delta.RevocationNums())
+	}
+	if !reflect.DeepEqual(nextState.RevocationNums(), []uint64{3, revocationNums[1]}) {
+		t.Fatalf("state revocation nums (%v) still contain retired bucket", nextState.RevocationNums())
+	}
+	if err := letsRevokeDelta.VerifyBucketHashes(nextState.(*LetsRevokeState)); err != nil {
+		t.Fatalf("failed to verify bucket hashes of delta: %v", err)
+	}
+
+	// A verifier holding the previous state reaches the same state from the published delta
+	encodedDelta, err := delta.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode delta: %v", err)
+	}
+	decodedDelta, err := revType.DecodeDelta(encodedDelta)
+	if err != nil {
+		t.Fatalf("failed to decode delta: %v", err)
+	}
+	appliedState, err := state.Apply(decodedDelta)
+	if err != nil {
+		t.Fatalf("failed to apply decoded delta: %v", err)
+	}
+	if !appliedState.Equals(nextState) {
+		t.Fatalf("applied state (%v) not equal to next state (%v)", appliedState.RevocationNums(), nextState.RevocationNums())
+	}
+	if err := decodedDelta.(*LetsRevokeDelta).VerifyBucketHashes(appliedState.(*LetsRevokeState)); err != nil {
+		t.Fatalf("failed to verify bucket hashes of decoded delta: %v", err)
+	}
+}
+
+func TestLetsRevokeValidateRevocationNums(t *testing.T) {
+	revType, err := NewRevocationType(RevocationTypeConfig{Name: LetsRevokeMechanism, MaxBits: 16})
+	if err != nil {
+		t.Fatalf("failed to create revocation type: %v", err)
+	}
+	if err := revType.ValidateRevocationNums([]uint64{0, 1 << 16 - 1, JoinRevocationNum(5, 1 << 16 - 1)}); err != nil {
+		t.Fatalf("failed to accept revocation nums in range: %v", err)
+	}
+	outOfRange := []uint64{1 << 16, JoinRevocationNum(5, 1 << 20)}
+	err = revType.ValidateRevocationNums(append([]uint64{3}, outOfRange...))
+	revNumErr, ok := err.(*RevocationNumberError)
+	if !ok {
+		t.Fatalf("expected RevocationNumberError for out of range revocation nums, got: %v", err)
+	}
+	if !reflect.DeepEqual(revNumErr.RevocationNums, outOfRange) || revNumErr.MaxBits != 16 {
+		t.Fatalf("RevocationNumberError (%+v) does not report out of range revocation nums (%v)", revNumErr, outOfRange)
+	}
+
+	if _, err := NewRevocationType(RevocationTypeConfig{Name: LetsRevokeMechanism, MaxBits: MaxBitsInRevocationNumber + 1}); err == nil {
+		t.Fatalf("failed to reject max_bits above MaxBitsInRevocationNumber")
+	}
+
+	// Only the buckets of certificates that are valid at the timestamp, or may be issued then, accept revocations
+	revType, err = NewRevocationType(RevocationTypeConfig{Name: LetsRevokeMechanism, BucketDuration: 100, MaxLifetime: 1000})
+	if err != nil {
+		t.Fatalf("failed to create revocation type: %v", err)
+	}
+	if first, last := revType.LiveBuckets(550); first != 6 || last != 16 {
+		t.Fatalf("live buckets at (550) are (%v) to (%v)", first, last)
+	}
+	if err := ValidateExpirationBuckets(revType, []uint64{3, JoinRevocationNum(6, 1), JoinRevocationNum(16, 1)}, 550); err != nil {
+		t.Fatalf("failed to accept revocation nums of live buckets: %v", err)
+	}
+	outside := []uint64{JoinRevocationNum(5, 1), JoinRevocationNum(17, 1), JoinRevocationNum(1 << 31, 1 << 32 - 1)}
+	var bucketErr *ExpirationBucketError
+	if err := ValidateExpirationBuckets(revType, append([]uint64{3}, outside...), 550); !errors.As(err, &bucketErr) || !reflect.DeepEqual(bucketErr.RevocationNums, outside) {
+		t.Fatalf("expected ExpirationBucketError for revocation nums (%v), got: %v", outside, err)
+	}
+}
+
+func TestLetsRevokeHoldAndRelease(t *testing.T) {
+	revType, err := NewRevocationType(RevocationTypeConfig{Name: LetsRevokeMechanism, CRV: RoaringCRVKind})
+	if err != nil {
+		t.Fatalf("failed to create revocation type: %v", err)
+	}
+	revocations, err := NewRevocations([]uint64{3, 9, 12}, []ReasonCode{CertificateHold, KeyCompromise, CertificateHold})
+	if err != nil {
+		t.Fatalf("failed to create revocations: %v", err)
+	}
+	heldState, _, err := revType.NextState(revType.NewState(), revocations, 0)
+	if err != nil {
+		t.Fatalf("failed to create next state: %v", err)
+	}
+
+	releases, err := NewRevocations([]uint64{3, 20}, []ReasonCode{RemoveFromCRL, Superseded})
+	if err != nil {
+		t.Fatalf("failed to create releases: %v", err)
+	}
+	releasedState, delta, err := revType.NextState(heldState, releases, 0)
+	if err != nil {
+		t.Fatalf("failed to create next state: %v", err)
+	}
+	if !reflect.DeepEqual(delta.ReleasedNums(), []uint64{3}) || !reflect.DeepEqual(delta.RevocationNums(), []uint64{20}) {
+		t.Fatalf("delta releases (%v) and revocations (%v) not equal to requested ones", delta.ReleasedNums(), delta.RevocationNums())
+	}
+	if !reflect.DeepEqual(releasedState.RevocationNums(), []uint64{9, 12, 20}) {
+		t.Fatalf("state revocation nums (%v) still contain released revocation num", releasedState.RevocationNums())
+	}
+	if _, revoked := releasedState.RevocationReason(3); revoked {
+		t.Fatalf("released revocation num is still revoked")
+	}
+
+	// A verifier holding the previous state clears the same bits from the published delta
+	encodedDelta, err := delta.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode delta: %v", err)
+	}
+	decodedDelta, err := revType.DecodeDelta(encodedDelta)
+	if err != nil {
+		t.Fatalf("failed to decode delta: %v", err)
+	}
+	appliedState, err := heldState.Apply(decodedDelta)
+	if err != nil {
+		t.Fatalf("failed to apply decoded delta: %v", err)
+	}
+	if !appliedState.Equals(releasedState) {
+		t.Fatalf("applied state (%v) not equal to released state (%v)", appliedState.RevocationNums(), releasedState.RevocationNums())
+	}
+	if err := decodedDelta.(*LetsRevokeDelta).VerifyBucketHashes(appliedState.(*LetsRevokeState)); err != nil {
+		t.Fatalf("failed to verify bucket hashes of decoded delta: %v", err)
+	}
+
+	keyCompromiseRelease, _ := NewRevocations([]uint64{9}, []ReasonCode{RemoveFromCRL})
+	if _, _, err := revType.NextState(releasedState, keyCompromiseRelease, 0); err == nil {
+		t.Fatalf("failed to reject release of revocation num revoked for keyCompromise")
+	}
+}
@@ -0,0 +1,416 @@
+package ctca
+
+import (
+	"fmt"
+	"sort"
+	"math/bits"
+	"encoding/binary"
+)
+
+const (
+	roaringArrayMaxCardinality = 4096	// Containers holding more values than this are stored as bitmaps
+	roaringBitmapWords = 1 << 16 / 64
+	roaringArrayContainer uint8 = 0
+	roaringBitmapContainer uint8 = 1
+	roaringMaxIndex = 1 << 32 - 1
+)
+
+// RoaringCRV is a compressed bitmap CRV in the style of Roaring bitmaps.
+// Indices are split into their upper 16 bits, which select a container, and their lower 16 bits, which are stored in it.
+// Containers with few values keep them in a sorted array and dense containers switch to a 2^16 bit bitmap,
+// so memory and serialized size grow with the number of revoked certificates rather than the highest index
+type RoaringCRV struct {
+	keys []uint16	// Sorted upper 16 bits of the indices in each container
+	containers []*roaringContainer
+}
+
+// Holds the lower 16 bits of the indices that share an upper 16 bits
+type roaringContainer struct {
+	array []uint16	// Sorted values while the container is an array container
+	bitmap []uint64	// roaringBitmapWords words once the container is a bitmap container
+	cardinality int
+}
+
+func NewRoaringCRV() *RoaringCRV {
+	return &RoaringCRV{}
+}
+
+func (r *RoaringCRV) Kind() string {
+	return RoaringCRVKind
+}
+
+func (r *RoaringCRV) SetBit(index uint64) error {
+	if index > roaringMaxIndex {
+		return fmt.Errorf("index (%v) exceeds max roaring index (%v)", index, uint64(roaringMaxIndex))
+	}
+	key, value := uint16(index >> 16), uint16(index)
+	i := sort.Search(len(r.keys), func(i int) bool { return r.keys[i] >= key })
+	if i == len(r.keys) || r.keys[i] != key {
+		r.keys = append(r.keys, 0)
+		copy(r.keys[i+1:], r.keys[i:])
+		r.keys[i] = key
+		r.containers = append(r.containers, nil)
+		copy(r.containers[i+1:], r.containers[i:])
+		r.containers[i] = &roaringContainer{}
+	}
+	r.containers[i].add(value)
+	return nil
+}
+
+// Clear the bit at index, dropping its container once it is empty
+func (r *RoaringCRV) ClearBit(index uint64) error {
+	if index > roaringMaxIndex {
+		return nil
+	}
+	key := uint16(index >> 16)
+	i := sort.Search(len(r.keys), func(i int) bool { return r.keys[i] >= key })
+	if i == len(r.keys) || r.keys[i] != key {
+		return nil
+	}
+	r.containers[i].remove(uint16(index))
+	if r.containers[i].cardinality == 0 {
+		r.keys = append(r.keys[:i], r.keys[i+1:]...)
+		r.containers = append(r.containers[:i], r.containers[i+1:]...)
+	}
+	return nil
+}
+
+func (r *RoaringCRV) GetBit(index uint64) bool {
+	if index > roaringMaxIndex {
+		return false
+	}
+	container := r.container(uint16(index >> 16))
+	return container != nil && container.contains(uint16(index))
+}
+
+// OR other into a copy of the CRV
+func (r *RoaringCRV) Or(other CRV) (CRV, error) {
+	otherRoaring, ok := other.(*RoaringCRV)
+	if !ok {
+		result := r.copy()
+		for _, index := range other.ToNums() {
+			if err := result.SetBit(index); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+
+	result := &RoaringCRV{}
+	i, j := 0, 0
+	for i < len(r.keys) || j < len(otherRoaring.keys) {
+		switch {
+		case j == len(otherRoaring.keys) || (i < len(r.keys) && r.keys[i] < otherRoaring.keys[j]):
+			result.keys = append(result.keys, r.keys[i])
+			result.containers = append(result.containers, r.containers[i].copy())
+			i++
+		case i == len(r.keys) || otherRoaring.keys[j] < r.keys[i]:
+			result.keys = append(result.keys, otherRoaring.keys[j])
+			result.containers = append(result.containers, otherRoaring.containers[j].copy())
+			j++
+		default:
+			result.keys = append(result.keys, r.keys[i])
+			result.containers = append(result.containers, r.containers[i].or(otherRoaring.containers[j]))
+			i++
+			j++
+		}
+	}
+	return result, nil
+}
+
+func (r *RoaringCRV) Equals(other CRV) bool {
+	otherRoaring, ok := other.(*RoaringCRV)
+	if !ok {
+		return equalNums(r.ToNums(), other.ToNums())
+	}
+	if len(r.keys) != len(otherRoaring.keys) {
+		return false
+	}
+	for i, key := range r.keys {
+		if key != otherRoaring.keys[i] || !r.containers[i].equals(otherRoaring.containers[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *RoaringCRV) ToNums() []uint64 {
+	nums := make([]uint64, 0, r.Cardinality())
+	for i, key := range r.keys {
+		for _, value := range r.containers[i].values() {
+			nums = append(nums, uint64(key) << 16 | uint64(value))
+		}
+	}
+	return nums
+}
+
+func (r *RoaringCRV) Cardinality() uint64 {
+	cardinality := uint64(0)
+	for _, container := range r.containers {
+		cardinality += uint64(container.cardinality)
+	}
+	return cardinality
+}
+
+// Serialize as the number of containers followed by each container's key, type and values, all big endian
+func (r *RoaringCRV) Marshal() ([]byte, error) {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(len(r.keys)))
+	for i, key := range r.keys {
+		container := r.containers[i]
+		var header [5]byte
+		binary.BigEndian.PutUint16(header[0:], key)
+		binary.BigEndian.PutUint16(header[3:], uint16(container.cardinality - 1))
+		if container.bitmap != nil {
+			header[2] = roaringBitmapContainer
+			data = append(data, header[:]...)
+			for _, word := range container.bitmap {
+				data = append(data, make([]byte, 8)...)
+				binary.BigEndian.PutUint64(data[len(data) - 8:], word)
+			}
+			continue
+		}
+		header[2] = roaringArrayContainer
+		data = append(data, header[:]...)
+		for _, value := range container.array {
+			data = append(data, byte(value >> 8), byte(value))
+		}
+	}
+	return data, nil
+}
+
+// Deserialize a RoaringCRV. Only the canonical form produced by Marshal is accepted so equal CRVs always hash equally
+func UnmarshalRoaringCRV(data []byte) (*RoaringCRV, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("roaring crv is missing container count")
+	}
+	numContainers := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	// Every container takes at least 7 bytes, which bounds the allocation by the size of the input
+	if uint64(numContainers) * 7 > uint64(len(data)) {
+		return nil, fmt.Errorf("container count (%v) exceeds roaring crv size", numContainers)
+	}
+	r := &RoaringCRV{
+		keys: make([]uint16, 0, numContainers),
+		containers: make([]*roaringContainer, 0, numContainers),
+	}
+	for i := uint32(0); i < numContainers; i++ {
+		if len(data) < 5 {
+			return nil, fmt.Errorf("roaring container (%v) is truncated", i)
+		}
+		key := binary.BigEndian.Uint16(data[0:])
+		containerType := data[2]
+		cardinality := int(binary.BigEndian.Uint16(data[3:])) + 1
+		data = data[5:]
+		if len(r.keys) > 0 && key <= r.keys[len(r.keys) - 1] {
+			return nil, fmt.Errorf("roaring container keys are not strictly ascending")
+		}
+
+		container := &roaringContainer{cardinality: cardinality}
+		switch containerType {
+		case roaringArrayContainer:
+			if cardinality > roaringArrayMaxCardinality || len(data) < cardinality * 2 {
+				return nil, fmt.Errorf("invalid array container (%v)", i)
+			}
+			container.array = make([]uint16, cardinality)
+			for j := range container.array {
+				container.array[j] = binary.BigEndian.Uint16(data[j * 2:])
+				if j > 0 && container.array[j] <= container.array[j - 1] {
+					return nil, fmt.Errorf("array container (%v) is not strictly ascending", i)
+				}
+			}
+			data = data[cardinality * 2:]
+		case roaringBitmapContainer:
+			if cardinality <= roaringArrayMaxCardinality || len(data) < roaringBitmapWords * 8 {
+				return nil, fmt.Errorf("invalid bitmap container (%v)", i)
+			}
+			container.bitmap = make([]uint64, roaringBitmapWords)
+			setBits := 0
+			for j := range container.bitmap {
+				container.bitmap[j] = binary.BigEndian.Uint64(data[j * 8:])
+				setBits += bits.OnesCount64(container.bitmap[j])
+			}
+			if setBits != cardinality {
+				return nil, fmt.Errorf("bitmap container (%v) cardinality does not match its bits", i)
+			}
+			data = data[roaringBitmapWords * 8:]
+		default:
+			return nil, fmt.Errorf("unknown roaring container type (%v)", containerType)
+		}
+		r.keys = append(r.keys, key)
+		r.containers = append(r.containers, container)
+	}
+	if len(data) > 0 {
+		return nil, fmt.Errorf("trailing data after roaring crv")
+	}
+	return r, nil
+}
+
+func (r *RoaringCRV) container(key uint16) *roaringContainer {
+	i := sort.Search(len(r.keys), func(i int) bool { return r.keys[i] >= key })
+	if i == len(r.keys) || r.keys[i] != key {
+		return nil
+	}
+	return r.containers[i]
+}
+
+func (r *RoaringCRV) copy() *RoaringCRV {
+	result := &RoaringCRV{keys: append([]uint16{}, r.keys...)}
+	for _, container := range r.containers {
+		result.containers = append(result.containers, container.copy())
+	}
+	return result
+}
+
+func (c *roaringContainer) add(value uint16) {
+	if c.bitmap != nil {
+		word, bit := value / 64, uint64(1) << (value % 64)
+		if c.bitmap[word] & bit == 0 {
+			c.bitmap[word] |= bit
+			c.cardinality++
+		}
+		return
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= value })
+	if i < len(c.array) && c.array[i] == value {
+		return
+	}
+	c.array = append(c.array, 0)
+	copy(c.array[i+1:], c.array[i:])
+	c.array[i] = value
+	c.cardinality++
+	if c.cardinality > roaringArrayMaxCardinality {
+		c.toBitmap()
+	}
+}
+
+// Remove a value, turning a bitmap container back into an array container once it is small enough
+func (c *roaringContainer) remove(value uint16) {
+	if c.bitmap != nil {
+		word, bit := value / 64, uint64(1) << (value % 64)
+		if c.bitmap[word] & bit != 0 {
+			c.bitmap[word] &^= bit
+			c.cardinality--
+			if c.cardinality <= roaringArrayMaxCardinality {
+				c.array = c.values()
+				c.bitmap = nil
+			}
+		}
+		return
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= value })
+	if i < len(c.array) && c.array[i] == value {
+		c.array = append(c.array[:i], c.array[i+1:]...)
+		c.cardinality--
+	}
+}
+
+func (c *roaringContainer) contains(value uint16) bool {
+	if c.bitmap != nil {
+		return c.bitmap[value / 64] & (1 << (value % 64)) != 0
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= value })
+	return i < len(c.array) && c.array[i] == value
+}
+
+func (c *roaringContainer) toBitmap() {
+	c.bitmap = make([]uint64, roaringBitmapWords)
+	for _, value := range c.array {
+		c.bitmap[value / 64] |= 1 << (value % 64)
+	}
+	c.array = nil
+}
+
+// Get the values of the container in ascending order
+func (c *roaringContainer) values() []uint16 {
+	if c.bitmap == nil {
+		return c.array
+	}
+	values := make([]uint16, 0, c.cardinality)
+	for word, bitsOfWord := range c.bitmap {
+		for bitsOfWord != 0 {
+			values = append(values, uint16(word * 64 + bits.TrailingZeros64(bitsOfWord)))
+			bitsOfWord &= bitsOfWord - 1
+		}
+	}
+	return values
+}
+
+func (c *roaringContainer) or(other *roaringContainer) *roaringContainer {
+	if c.bitmap == nil && other.bitmap == nil {
+		result := &roaringContainer{array: make([]uint16, 0, len(c.array) + len(other.array))}
+		i, j := 0, 0
+		for i < len(c.array) || j < len(other.array) {
+			switch {
+			case j == len(other.array) || (i < len(c.array) && c.array[i] < other.array[j]):
+				result.array = append(result.array, c.array[i])
+				i++
+			case i == len(c.array) || other.array[j] < c.array[i]:
+				result.array = append(result.array, other.array[j])
+				j++
+			default:
+				result.array = append(result.array, c.array[i])
+				i++
+				j++
+			}
+		}
+		result.cardinality = len(result.array)
+		if result.cardinality > roaringArrayMaxCardinality {
+			result.toBitmap()
+		}
+		return result
+	}
+
+	result := c.copy()
+	if result.bitmap == nil {
+		result.toBitmap()
+	}
+	if other.bitmap == nil {
+		for _, value := range other.array {
+			result.bitmap[value / 64] |= 1 << (value % 64)
+		}
+	} else {
+		for word := range result.bitmap {
+			result.bitmap[word] |= other.bitmap[word]
+		}
+	}
+	result.cardinality = 0
+	for _, word := range result.bitmap {
+		result.cardinality += bits.OnesCount64(word)
+	}
+	return result
+}
+
+func (c *roaringContainer) equals(other *roaringContainer) bool {
+	if c.cardinality != other.cardinality {
+		return false
+	}
+	// Containers are always converted to bitmaps at the same cardinality, so equal containers have the same type
+	if c.bitmap != nil && other.bitmap != nil {
+		for word := range c.bitmap {
+			if c.bitmap[word] != other.bitmap[word] {
+				return false
+			}
+		}
+		return true
+	}
+	if c.bitmap != nil || other.bitmap != nil {
+		return false
+	}
+	for i := range c.array {
+		if c.array[i] != other.array[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *roaringContainer) copy() *roaringContainer {
+	result := &roaringContainer{cardinality: c.cardinality}
+	if c.bitmap != nil {
+		result.bitmap = append([]uint64{}, c.bitmap...)
+	} else {
+		result.array = append([]uint16{}, c.array...)
+	}
+	return result
+}
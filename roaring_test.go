@@ -0,0 +1,152 @@
+package ctca
+
+import (
+	"testing"
+	"reflect"
+)
+
+func TestRoaringCRVSetBitOrRoundTrip(t *testing.T) {
+	crv := NewRoaringCRV()
+	revNumsList := []uint64{}
+	// Enough indices in the first container to turn it into a bitmap container
+	for i := uint64(0); i < roaringArrayMaxCardinality + 10; i++ {
+		revNumsList = append(revNumsList, i * 3)
+	}
+	revNumsList = append(revNumsList, 1 << 20, 1 << 32 - 1)
+	for _, revNum := range revNumsList {
+		if err := crv.SetBit(revNum); err != nil {
+			t.Fatalf("failed to set bit (%v): %v", revNum, err)
+		}
+	}
+	if crv.containers[0].bitmap == nil {
+		t.Fatalf("dense container was not converted to a bitmap")
+	}
+	if !reflect.DeepEqual(crv.ToNums(), revNumsList) {
+		t.Fatalf("roaring CRV nums not equal to set revNums")
+	}
+	if crv.Cardinality() != uint64(len(revNumsList)) {
+		t.Fatalf("roaring CRV cardinality (%v) not equal to number of set bits (%v)", crv.Cardinality(), len(revNumsList))
+	}
+	if crv.GetBit(1) || !crv.GetBit(3) {
+		t.Fatalf("GetBit does not match set bits")
+	}
+	if err := crv.SetBit(1 << 32); err == nil {
+		t.Fatalf("failed to reject index above max roaring index")
+	}
+
+	serializedCRV, err := MarshalCRV(crv)
+	if err != nil {
+		t.Fatalf("failed to serialize roaring CRV: %v", err)
+	}
+	deserializedCRV, err := UnmarshalCRV(serializedCRV)
+	if err != nil {
+		t.Fatalf("failed to deserialize roaring CRV: %v", err)
+	}
+	if !deserializedCRV.Equals(crv) {
+		t.Fatalf("deserialized roaring CRV not equal to roaring CRV")
+	}
+
+	bitArrayCRV := NewBitArrayCRV()
+	bitArrayCRV.SetBit(1)
+	bitArrayCRV.SetBit(1 << 20)
+	orCRV, err := crv.Or(bitArrayCRV)
+	if err != nil {
+		t.Fatalf("failed to OR bitarray CRV into roaring CRV: %v", err)
+	}
+	if orCRV.Kind() != RoaringCRVKind || orCRV.Cardinality() != crv.Cardinality() + 1 {
+		t.Fatalf("OR of roaring CRV and bitarray CRV has kind (%v) and cardinality (%v)", orCRV.Kind(), orCRV.Cardinality())
+	}
+	if crv.GetBit(1) {
+		t.Fatalf("OR changed the receiver")
+	}
+}
+
+func TestUnmarshalRoaringCRVRejectsNonCanonicalContainers(t *testing.T) {
+	// Array container with values out of order
+	if _, err := UnmarshalRoaringCRV([]byte{0, 0, 0, 1, 0, 0, roaringArrayContainer, 0, 1, 0, 5, 0, 2}); err == nil {
+		t.Fatalf("failed to reject unsorted array container")
+	}
+	// Container count larger than the data
+	if _, err := UnmarshalRoaringCRV([]byte{0xff, 0xff, 0xff, 0xff}); err == nil {
+		t.Fatalf("failed to reject truncated roaring CRV")
+	}
+}
+
+func TestRoaringCRVClearBitKeepsCanonicalForm(t *testing.T) {
+	crv := NewRoaringCRV()
+	for i := uint64(0); i <= roaringArrayMaxCardinality; i++ {
+		if err := crv.SetBit(i * 2); err != nil {
+			t.Fatalf("failed to set bit (%v): %v", i * 2, err)
+		}
+	}
+	if err := crv.SetBit(1 << 20); err != nil {
+		t.Fatalf("failed to set bit (%v): %v", 1 << 20, err)
+	}
+	// Clearing one value turns the bitmap container back into an array container and the last value drops its container
+	if err := crv.ClearBit(0); err != nil {
+		t.Fatalf("failed to clear bit (%v): %v", 0, err)
+	}
+	if err := crv.ClearBit(1 << 20); err != nil {
+		t.Fatalf("failed to clear bit (%v): %v", 1 << 20, err)
+	}
+	if err := crv.ClearBit(1); err != nil {
+		t.Fatalf("failed to clear unset bit (%v): %v", 1, err)
+	}
+	if crv.GetBit(0) || crv.GetBit(1 << 20) || !crv.GetBit(2) {
+		t.Fatalf("ClearBit cleared the wrong bits")
+	}
+
+	expectedCRV := NewRoaringCRV()
+	for i := uint64(1); i <= roaringArrayMaxCardinality; i++ {
+		expectedCRV.SetBit(i * 2)
+	}
+	serialized, err := crv.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal crv: %v", err)
+	}
+	expectedSerialized, err := expectedCRV.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal expected crv: %v", err)
+	}
+	if !reflect.DeepEqual(serialized, expectedSerialized) {
+		t.Fatalf("serialized crv after ClearBit not equal to crv built without the cleared bits")
+	}
+	if _, err := UnmarshalRoaringCRV(serialized); err != nil {
+		t.Fatalf("failed to unmarshal crv after ClearBit: %v", err)
+	}
+}
+
+func TestLetsRevokeRoaringCRVs(t *testing.T) {
+	revType, err := NewRevocationType(RevocationTypeConfig{Name: LetsRevokeMechanism, CRV: RoaringCRVKind})
+	if err != nil {
+		t.Fatalf("failed to create revocation type: %v", err)
+	}
+	revocationNums := []uint64{JoinRevocationNum(2, 5), JoinRevocationNum(2, 1 << 31)}
+	state, delta, err := revType.NextState(revType.NewState(), unspecifiedRevocations(revocationNums), 0)
+	if err != nil {
+		t.Fatalf("failed to create next state: %v", err)
+	}
+	if kind := state.(*LetsRevokeState).CRVs[2].Kind(); kind != RoaringCRVKind {
+		t.Fatalf("bucket CRV kind (%v) not equal to configured kind (%v)", kind, RoaringCRVKind)
+	}
+
+	encodedDelta, err := delta.Encode()
+	if err != nil {
+		t.Fatalf("failed to encode delta: %v", err)
+	}
+	decodedDelta, err := revType.DecodeDelta(encodedDelta)
+	if err != nil {
+		t.Fatalf("failed to decode delta: %v", err)
+	}
+	appliedState, err := revType.NewState().Apply(decodedDelta)
+	if err != nil {
+		t.Fatalf("failed to apply decoded delta: %v", err)
+	}
+	if err := decodedDelta.(*LetsRevokeDelta).VerifyBucketHashes(appliedState.(*LetsRevokeState)); err != nil {
+		t.Fatalf("failed to verify bucket hashes of decoded delta: %v", err)
+	}
+
+	if _, err := NewRevocationType(RevocationTypeConfig{Name: LetsRevokeMechanism, CRV: "unknown"}); err == nil {
+		t.Fatalf("failed to reject unknown crv kind")
+	}
+}
@@ -1,8 +1,7 @@
 package sequencer
 
 import (
-	"fmt"
-	"time"
+	"sync"
 
 	"github.com/golang/glog"
 
@@ -10,39 +9,48 @@ import (
 )
 
 // Run the sequencer that will keep track of time for the MMD
+// Every revocation type runs on its own schedule: it wakes up at every MMD boundary of the revocation type and
+// produces the SRDs that are due, including the ones of boundaries that were missed while the CA was down, so
+// it catches up as soon as it starts. A revocation type with a short MMD is not held up by the schedule of another.
+// The time is taken from the Clock of the CA, so a clock.Fake drives the sequencer through simulated MMDs.
+// Run returns once done is closed or receives a value
 func Run(done chan bool, caInstance *ca.CA) error {
-	mmdStr := fmt.Sprintf("%v", caInstance.MMD) + "s"
-	mmdDur, err := time.ParseDuration(mmdStr)
-	if err != nil {
-		return fmt.Errorf("failed to parse mmd into duration: %v", err)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, revType := range caInstance.RevocationTypeNames() {
+		wg.Add(1)
+		go func(revType string) {
+			defer wg.Done()
+			runSchedule(stop, caInstance, revType)
+		}(revType)
 	}
-	ticker := time.NewTicker(mmdDur)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-done:
-			glog.Infoln("Shutting down sequencer")
-			return nil
-		case <-ticker.C:
-			caInstance.UpdateMMD()
-			glog.Infoln("New MMD")
-			glog.Infof("PrevTimestamp: %v", caInstance.PreviousMMDTimestamp)
-			glog.Infof("DeltaRevocations: %v", caInstance.DeltaRevocations)
+	<-done
+	close(stop)
+	wg.Wait()
+	glog.Infoln("Shutting down sequencer")
+	return nil
+}
 
-			// Add delta revocations to crv
-			// TODO: Currently hardcoded to let's-revoke. Make modular later
-			revType := "Let's-Revoke"
-			glog.Infoln("Doing revocation transparency tasks")
-			caInstance.DoRevocationTransparencyTasks(revType)	
-			glog.Infoln(*caInstance.RevocationObjMap[revType])
-
-			// Clear delta revocations
-			if err = caInstance.ClearDeltaRevocations(); err != nil {
-				glog.Infof("failed to clear revocations in sequencer: %v", err)
-			}
-			glog.Infof("Cleared deltaRevocations")
-			glog.Infoln(caInstance.CASignedDigestMap)
+// Produce the SRDs of revType at its MMD boundaries until stop is closed
+func runSchedule(stop chan struct{}, caInstance *ca.CA, revType string) {
+	clk := caInstance.Clock
+	for {
+		// The CA is shared with the handlers and the other schedules, so it is only used through its methods, which do the locking
+		produced, err := caInstance.CatchUpRevocationType(revType, clk.Now())
+		if err != nil {
+			glog.Errorf("failed to do revocation transparency tasks of revType (%v): %v", revType, err)
+		}
+		if produced > 0 {
+			glog.Infof("New MMD of revType (%v), produced %v SRDs", revType, produced)
+		}
 
+		now := clk.Now()
+		timer := clk.NewTimer(caInstance.NextMMDBoundary(revType, now).Sub(now))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C():
 		}
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,112 @@
+package sequencer
+
+import (
+	"testing"
+	"time"
+
+	ctca "github.com/n-ct/ct-certificate-authority"
+	"github.com/n-ct/ct-certificate-authority/ca"
+	"github.com/n-ct/ct-certificate-authority/clock"
+)
+
+const epochs = 2000
+
+// Drive the sequencer through thousands of MMDs with a fake clock, revoking a number every hundred MMDs.
+// The CA publishes uncompressed deltas, so the run is not dominated by setting up an xz writer per SRD
+func TestRunSimulatedMMDs(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1600000000, 0))
+	caInstance, err := ca.NewCAWithClock("../testdata/ca_config_simulation.json", "../testdata/ca_list.json", "../testdata/log_list.json", ca.NewMemoryStorage(), fake)
+	if err != nil {
+		t.Fatalf("failed to create ca: %v", err)
+	}
+	defer caInstance.Close()
+	revType := caInstance.DefaultRevocationType
+	mmd := time.Duration(caInstance.MMD) * time.Second
+	start := uint64(fake.Now().Unix())
+
+	done := make(chan bool)
+	seqErr := make(chan error, 1)
+	go func() {
+		seqErr <- Run(done, caInstance)
+	}()
+	for i := 0; i < epochs; i++ {
+		// The sequencer waits for the next boundary once it has produced the SRDs of this one
+		fake.BlockUntil(1)
+		if i % 100 == 0 {
+			if err := caInstance.AddRevocations(revType, []ctca.Revocation{{RevocationNum: uint64(i), Reason: ctca.KeyCompromise}}); err != nil {
+				t.Fatalf("failed to add revocations: %v", err)
+			}
+		}
+		fake.Advance(mmd)
+	}
+	fake.BlockUntil(1)
+	close(done)
+	if err := <-seqErr; err != nil {
+		t.Fatalf("sequencer failed: %v", err)
+	}
+
+	// Every boundary has an SRD, and each revocation is published by the SRD of the boundary after it was added
+	if timestamp := caInstance.MMDTimestamp(); timestamp != start + epochs * caInstance.MMD {
+		t.Fatalf("sequencer stopped at (%v) instead of (%v)", timestamp, start + epochs * caInstance.MMD)
+	}
+	for i := uint64(0); i <= epochs; i++ {
+		timestamp := start + i * caInstance.MMD
+		srd, err := caInstance.GetCASRD(revType, timestamp)
+		if err != nil {
+			t.Fatalf("no SRD at MMD (%v): %v", i, err)
+		}
+		delta, err := caInstance.RevocationTypes[revType].DecodeDelta(srd.RevData.CRVDelta)
+		if err != nil {
+			t.Fatalf("failed to decode delta of SRD (%v): %v", timestamp, err)
+		}
+		revNums := delta.RevocationNums()
+		if published := i > 0 && (i - 1) % 100 == 0; published != (len(revNums) == 1) || published && revNums[0] != i - 1 {
+			t.Fatalf("SRD of MMD (%v) publishes revocation nums (%v)", i, revNums)
+		}
+	}
+}
+
+// Run an hourly and a per-minute revocation type side by side for six simulated hours
+func TestRunIndependentSchedules(t *testing.T) {
+	hour := uint64(1600000000) / 3600 * 3600
+	fake := clock.NewFake(time.Unix(int64(hour), 0))
+	caInstance, err := ca.NewCAWithClock("../testdata/ca_config_mmd_schedules.json", "../testdata/ca_list.json", "../testdata/log_list.json", ca.NewMemoryStorage(), fake)
+	if err != nil {
+		t.Fatalf("failed to create ca: %v", err)
+	}
+	defer caInstance.Close()
+	revTypes := caInstance.RevocationTypeNames()
+
+	done := make(chan bool)
+	seqErr := make(chan error, 1)
+	go func() {
+		seqErr <- Run(done, caInstance)
+	}()
+	for i := 0; i < 6 * 60; i++ {
+		// Every schedule waits for its next boundary
+		fake.BlockUntil(len(revTypes))
+		fake.Advance(time.Minute)
+	}
+	fake.BlockUntil(len(revTypes))
+	close(done)
+	if err := <-seqErr; err != nil {
+		t.Fatalf("sequencer failed: %v", err)
+	}
+
+	for _, revType := range revTypes {
+		mmd := caInstance.RevocationTypeMMD(revType)
+		count := 6 * 3600 / mmd + 1
+		for i := uint64(0); i < count; i++ {
+			if _, err := caInstance.GetCASRD(revType, hour + i * mmd); err != nil {
+				t.Fatalf("no SRD of (%v) at MMD (%v): %v", revType, i, err)
+			}
+		}
+		if uint64(len(caInstance.CASignedDigestMap[revType])) != count {
+			t.Fatalf("(%v) produced (%v) SRDs instead of (%v)", revType, len(caInstance.CASignedDigestMap[revType]), count)
+		}
+		status, err := caInstance.GetLatestRevocationStatus(revType)
+		if err != nil || status.Timestamp != hour + 6 * 3600 || status.NextTimestamp != hour + 6 * 3600 + mmd {
+			t.Fatalf("unexpected revocation status (%+v) of (%v): %v", status, revType, err)
+		}
+	}
+}
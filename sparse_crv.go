@@ -0,0 +1,145 @@
+package ctca
+
+import (
+	"fmt"
+	"sort"
+	"encoding/binary"
+)
+
+// SparseCRV is a CRV that only stores the sorted indices of its set bits.
+// It serializes to the number of indices followed by the gap to each index from the previous one, all as uvarints,
+// which is far smaller than a bitmap when few bits are set and costs nothing to build for indices near 2^32
+type SparseCRV struct {
+	indices []uint64	// Strictly ascending
+}
+
+func NewSparseCRV() *SparseCRV {
+	return &SparseCRV{indices: []uint64{}}
+}
+
+// Create a SparseCRV from indices in any order
+func NewSparseCRVFromNums(indices []uint64) *SparseCRV {
+	sorted := append([]uint64{}, indices...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	crv := NewSparseCRV()
+	for i, index := range sorted {
+		if i == 0 || index != sorted[i-1] {
+			crv.indices = append(crv.indices, index)
+		}
+	}
+	return crv
+}
+
+func (s *SparseCRV) Kind() string {
+	return SparseCRVKind
+}
+
+func (s *SparseCRV) SetBit(index uint64) error {
+	i := sort.Search(len(s.indices), func(i int) bool { return s.indices[i] >= index })
+	if i < len(s.indices) && s.indices[i] == index {
+		return nil
+	}
+	s.indices = append(s.indices, 0)
+	copy(s.indices[i+1:], s.indices[i:])
+	s.indices[i] = index
+	return nil
+}
+
+func (s *SparseCRV) ClearBit(index uint64) error {
+	i := sort.Search(len(s.indices), func(i int) bool { return s.indices[i] >= index })
+	if i < len(s.indices) && s.indices[i] == index {
+		s.indices = append(s.indices[:i], s.indices[i+1:]...)
+	}
+	return nil
+}
+
+func (s *SparseCRV) GetBit(index uint64) bool {
+	i := sort.Search(len(s.indices), func(i int) bool { return s.indices[i] >= index })
+	return i < len(s.indices) && s.indices[i] == index
+}
+
+// Merge the set bits of other into a new SparseCRV
+func (s *SparseCRV) Or(other CRV) (CRV, error) {
+	otherIndices := other.ToNums()
+	result := &SparseCRV{indices: make([]uint64, 0, len(s.indices) + len(otherIndices))}
+	i, j := 0, 0
+	for i < len(s.indices) || j < len(otherIndices) {
+		switch {
+		case j == len(otherIndices) || (i < len(s.indices) && s.indices[i] < otherIndices[j]):
+			result.indices = append(result.indices, s.indices[i])
+			i++
+		case i == len(s.indices) || otherIndices[j] < s.indices[i]:
+			result.indices = append(result.indices, otherIndices[j])
+			j++
+		default:
+			result.indices = append(result.indices, s.indices[i])
+			i++
+			j++
+		}
+	}
+	return result, nil
+}
+
+func (s *SparseCRV) Equals(other CRV) bool {
+	return equalNums(s.indices, other.ToNums())
+}
+
+func (s *SparseCRV) ToNums() []uint64 {
+	return append([]uint64{}, s.indices...)
+}
+
+func (s *SparseCRV) Cardinality() uint64 {
+	return uint64(len(s.indices))
+}
+
+func (s *SparseCRV) Marshal() ([]byte, error) {
+	data := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64 * (len(s.indices) + 1))
+	data = data[:binary.PutUvarint(data, uint64(len(s.indices)))]
+	var buf [binary.MaxVarintLen64]byte
+	prev := uint64(0)
+	for i, index := range s.indices {
+		gap := index - prev
+		if i > 0 {
+			// Indices are strictly ascending, so every gap after the first is at least one
+			gap--
+		}
+		data = append(data, buf[:binary.PutUvarint(buf[:], gap)]...)
+		prev = index
+	}
+	return data, nil
+}
+
+// Deserialize a SparseCRV serialized by Marshal
+func UnmarshalSparseCRV(data []byte) (*SparseCRV, error) {
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, fmt.Errorf("failed to read sparse crv index count")
+	}
+	data = data[n:]
+	// Every index takes at least one byte, which bounds the allocation by the size of the input
+	if count > uint64(len(data)) {
+		return nil, fmt.Errorf("index count (%v) exceeds sparse crv size", count)
+	}
+	s := &SparseCRV{indices: make([]uint64, 0, count)}
+	prev := uint64(0)
+	for i := uint64(0); i < count; i++ {
+		gap, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("failed to read gap of index (%v)", i)
+		}
+		data = data[n:]
+		index := prev + gap
+		if i > 0 {
+			index++
+		}
+		if index < prev || (i > 0 && index == prev) {
+			return nil, fmt.Errorf("index (%v) of sparse crv overflows", i)
+		}
+		s.indices = append(s.indices, index)
+		prev = index
+	}
+	if len(data) > 0 {
+		return nil, fmt.Errorf("trailing data after sparse crv")
+	}
+	return s, nil
+}
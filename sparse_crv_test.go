@@ -0,0 +1,96 @@
+package ctca
+
+import (
+	"testing"
+	"reflect"
+)
+
+func TestSparseCRVMarshalRoundTrip(t *testing.T) {
+	revNumsList := []uint64{0, 1, 2, 1000, 1 << 32 - 1}
+	crv := NewSparseCRVFromNums([]uint64{1000, 2, 0, 1 << 32 - 1, 1, 2})
+	if !reflect.DeepEqual(crv.ToNums(), revNumsList) {
+		t.Fatalf("sparse CRV nums (%v) not equal to sorted revNums (%v)", crv.ToNums(), revNumsList)
+	}
+	serializedCRV, err := MarshalCRV(crv)
+	if err != nil {
+		t.Fatalf("failed to serialize sparse CRV: %v", err)
+	}
+	deserializedCRV, err := UnmarshalCRV(serializedCRV)
+	if err != nil {
+		t.Fatalf("failed to deserialize sparse CRV: %v", err)
+	}
+	if !reflect.DeepEqual(deserializedCRV.ToNums(), revNumsList) {
+		t.Fatalf("deserialized sparse CRV nums (%v) not equal to revNums (%v)", deserializedCRV.ToNums(), revNumsList)
+	}
+
+	// A gap that overflows the previous index must be rejected
+	if _, err := UnmarshalSparseCRV([]byte{2, 5, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}); err == nil {
+		t.Fatalf("failed to reject overflowing sparse CRV")
+	}
+}
+
+func TestMarshalCompactCRVPicksSmallerForm(t *testing.T) {
+	farDelta := NewSparseCRVFromNums([]uint64{1 << 32 - 1})
+	serializedDelta, err := MarshalCompactCRV(farDelta, BitArrayCRVKind)
+	if err != nil {
+		t.Fatalf("failed to serialize delta: %v", err)
+	}
+	if serializedDelta[0] != sparseCRVKindID || len(serializedDelta) > 16 {
+		t.Fatalf("delta with a single far index serialized as kind (%v) in (%v) bytes", serializedDelta[0], len(serializedDelta))
+	}
+
+	denseNums := []uint64{}
+	for i := uint64(0); i < 10000; i++ {
+		denseNums = append(denseNums, i)
+	}
+	denseDelta := NewSparseCRVFromNums(denseNums)
+	for _, bitmapKind := range []string{BitArrayCRVKind, RoaringCRVKind} {
+		serializedDelta, err := MarshalCompactCRV(denseDelta, bitmapKind)
+		if err != nil {
+			t.Fatalf("failed to serialize delta: %v", err)
+		}
+		deserializedDelta, err := UnmarshalCRV(serializedDelta)
+		if err != nil {
+			t.Fatalf("failed to deserialize delta: %v", err)
+		}
+		if deserializedDelta.Kind() != bitmapKind {
+			t.Fatalf("dense delta serialized as (%v) instead of smaller (%v)", deserializedDelta.Kind(), bitmapKind)
+		}
+		if !deserializedDelta.Equals(denseDelta) {
+			t.Fatalf("deserialized delta not equal to delta")
+		}
+	}
+}
+
+func TestLetsRevokeAppliesSparseAndBitmapDeltas(t *testing.T) {
+	revType, err := NewRevocationType(RevocationTypeConfig{Name: LetsRevokeMechanism})
+	if err != nil {
+		t.Fatalf("failed to create revocation type: %v", err)
+	}
+	state := revType.NewState()
+	for _, revocationNums := range [][]uint64{{1 << 24}, {1, 2, 3, 4, 5, 6, 7, 8, 9, 10}} {
+		nextState, delta, err := revType.NextState(state, unspecifiedRevocations(revocationNums), 0)
+		if err != nil {
+			t.Fatalf("failed to create next state: %v", err)
+		}
+		encodedDelta, err := delta.Encode()
+		if err != nil {
+			t.Fatalf("failed to encode delta: %v", err)
+		}
+		decodedDelta, err := revType.DecodeDelta(encodedDelta)
+		if err != nil {
+			t.Fatalf("failed to decode delta: %v", err)
+		}
+		appliedState, err := state.Apply(decodedDelta)
+		if err != nil {
+			t.Fatalf("failed to apply decoded delta: %v", err)
+		}
+		if !appliedState.Equals(nextState) {
+			t.Fatalf("applied state (%v) not equal to next state (%v)", appliedState.RevocationNums(), nextState.RevocationNums())
+		}
+		if err := decodedDelta.(*LetsRevokeDelta).VerifyBucketHashes(appliedState.(*LetsRevokeState)); err != nil {
+			t.Fatalf("failed to verify bucket hashes of decoded delta: %v", err)
+		}
+		state = nextState
+	}
+}
@@ -10,22 +10,133 @@ const (
 	PostLogSRDWithRevDataPath	= "/ct/v1/post-log-srd-with-rev-data"	
 	PostNewRevocationNumsPath	= "/ct/v1/post-new-revocation-nums"
 	RevokeAndProduceSRDPath		= "/ct/v1/revoke-and-produce-srd"
+	GetNumberSpaceUsagePath		= "/ct/v1/get-number-space-usage"
+	GetRevocationReasonPath		= "/ct/v1/get-revocation-reason"
+	AssignRevocationNumPath		= "/ct/v1/assign-revocation-num"
+	GetCertificateRecordPath	= "/ct/v1/get-certificate-record"
+	RevokeCertificatePath		= "/ct/v1/revoke-certificate"
+	IssueCertificatePath		= "/ct/v1/issue-certificate"
+	GetCRLPath					= "/ct/v1/get-crl"
+	OCSPPath					= "/ct/v1/ocsp"	// POST, or GET with the base64 request appended as a path segment
+	GetSRDDeliveriesPath		= "/ct/v1/admin/get-srd-deliveries"
+	PostCASRDPath				= "/ct/v1/post-ca-srd"	// Endpoint of the logs the CA delivers its SRDs to
+)
+
+// Query parameter naming the revocation type of a GET request. Requests without it use the default revocation type
+const (
+	RevocationTypeParam = "revocation_type"
+	RevocationNumParam = "revocation_num"
+	FingerprintParam = "fingerprint"
+	SerialParam = "serial"
+	DeltaParam = "delta"	// Set to true to get the delta CRL instead of the full CRL
 )
 
 // TypeID const variables
 const (
 )
 
+// The delivery of the SRDs of the CA to one log
+type LogDeliveryState struct {
+	LogID		string
+	URL			string
+	Pending		int	// SRDs in the outbox of the log
+	Delivered	uint64	// SRDs the log accepted since the CA started
+	LastDeliveredRevocationType	string
+	LastDeliveredTimestamp		uint64
+	Attempts	int	// Failed attempts to deliver the oldest pending SRD
+	NextAttempt	uint64	// Unix time of the next attempt after a failure, 0 when none failed yet
+	LastError	string	// Why the last attempt failed
+}
+
+// The latest SRDs of a revocation type, which publishes an SRD every MMD seconds
 type RevocationStatus struct {
+	RevocationType	string
+	Timestamp		uint64	// Timestamp of the MMD of CASRD
+	MMD				uint64	// Seconds between the SRDs of the revocation type
+	NextTimestamp	uint64	// Timestamp of the next MMD of the revocation type
 	CASRD 	mtr.CTObject
 	LogSRDs	[]mtr.CTObject
 }
 
 type PostNewRevocationNumsRequest struct {
+	RevocationType	string	// Defaults to the default revocation type of the CA
 	RevocationNums []uint64
+	Reasons 		[]ReasonCode	// RFC 5280 reason of the revocation number at the same position. Missing reasons are unspecified
+	Certificates 	[]CertificateRevocation	// Registered certificates revoked by fingerprint or serial
+}
+
+// Revokes a registered certificate identified by exactly one of its SHA-256 fingerprint or its serial
+type CertificateRevocation struct {
+	Fingerprint 	string
+	Serial 			string
+	Reason 			ReasonCode
+}
+
+// Revokes a certificate issued by the CA by submitting the certificate itself
+type RevokeCertificateRequest struct {
+	RevocationType	string	// Defaults to the default revocation type of the CA
+	Certificate 	string	// PEM encoded certificate, or the base64 of its DER encoding
+	Reason 			ReasonCode
+}
+
+// Requests a revocation number for a certificate. Asking again for the same certificate returns the number it already has
+type AssignRevocationNumRequest struct {
+	RevocationType	string	// Defaults to the default revocation type of the CA
+	Fingerprint 	string	// SHA-256 fingerprint of the DER encoded certificate in hex
+	Serial 			string	// Serial of the certificate in hex
+	NotAfter 		uint64	// Expiration of the certificate in unix seconds, which selects the bucket of the number
+}
+
+// Requests a certificate for the subject, names and public key of a CSR
+type IssueCertificateRequest struct {
+	RevocationType	string	// Defaults to the default revocation type of the CA
+	CSR 			string	// PEM encoded CSR, or the base64 of its DER encoding
+}
+
+// A certificate issued by the CA along with the precertificate it was issued from
+type IssuedCertificate struct {
+	Record 			CertificateRecord	// Revocation number carried by the revocation number extension of both certificates
+	Precertificate 	[]byte	// DER precertificate carrying the CT poison extension
+	Certificate 	[]byte	// DER final certificate
+}
+
+// The revocation number assigned to a certificate by the CA
+type CertificateRecord struct {
+	RevocationType 	string
+	RevocationNum 	uint64
+	Fingerprint 	string
+	Serial 			string
+	NotAfter 		uint64
+	PrecertificateFingerprint string `json:",omitempty"`	// Set for certificates issued by the CA from a precertificate
 }
 
 type RevokeAndProduceSRDRequest struct {
+	RevocationType	string	// Defaults to the default revocation type of the CA
 	PercentRevoked 	uint8
 	TotalCerts 		uint64
-}
\ No newline at end of file
+}
+
+// How much of the revocation number space of a revocation type is consumed by its latest revocation state
+type NumberSpaceUsage struct {
+	RevocationType 	string
+	MaxBits 		uint64
+	IndicesPerBucket 	uint64	// Size of the number space of each bucket, 2^MaxBits
+	Buckets 		[]BucketUsage
+}
+
+type BucketUsage struct {
+	Bucket 			uint64
+	Assigned 		uint64	// Number of revocation numbers of the bucket assigned to certificates, in index order
+	Revoked 		uint64	// Number of revoked certificates in the bucket
+	HighestIndex 	uint64	// Highest revoked index of the bucket
+	Consumed 		float64	// Fraction of the bucket's number space assigned, or up to and including HighestIndex if that is higher
+}
+
+// The reason a revocation number was revoked for as of the latest MMD
+type RevocationReasonResponse struct {
+	RevocationType 	string
+	RevocationNum 	uint64
+	Revoked 		bool
+	Reason 			ReasonCode
+	ReasonName 		string
+}